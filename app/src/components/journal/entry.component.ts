@@ -4,6 +4,7 @@ import { toHtml } from '../../util/markdown.js';
 
 const [css, html] = await importCssAndHtml(import.meta.url, 'entry.component');
 
+import * as Responses from '../../models/responses.js';
 import { journalStore } from '../../stores/journal.store.js';
 
 export class EntryComponent extends BaseComponent {
@@ -19,12 +20,12 @@ export class EntryComponent extends BaseComponent {
   index: number | undefined;
 
   connectedCallback(): void {
-    this.entryHtml = toHtml(this.bindings[this.getAttribute('let-entry') || ''] as string);
+    this.entryHtml = toHtml((this.bindings[this.getAttribute('let-entry') || ''] as Responses.JournalItem).text);
     this.index = parseInt(this.getAttribute('data-index') || '0');
     super.connectedCallback();
   }
 
-  get entries(): string[] {
+  get entries(): Responses.JournalItem[] {
     return journalStore.current?.entries || [];
   }
 
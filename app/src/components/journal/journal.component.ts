@@ -1,6 +1,7 @@
 import { importCssAndHtml } from '../../loader.js';
 import { BaseComponent } from '../base.component.js';
 
+import * as Responses from '../../models/responses.js';
 import { journalStore } from '../../stores/journal.store.js';
 import { router } from '../router.js';
 import { toGoDateString } from '../../util/date.js';
@@ -35,7 +36,7 @@ export class JournalComponent extends BaseComponent {
     return journalStore.currentDate < journalStore.today;
   }
 
-  get entries(): string[] {
+  get entries(): Responses.JournalItem[] {
     return journalStore.current?.entries || [];
   }
 
@@ -2,8 +2,16 @@
  * Created by mike on 5/3/15.
  */
 
+export interface JournalItem {
+    id: string;
+    text: string;
+    done: boolean;
+    create_date: Date;
+    position: number;
+}
+
 export interface JournalEntry {
-    entries: string[];
+    entries: JournalItem[];
     user_id: string;
     create_date: Date;
     date: string;
@@ -102,23 +102,27 @@ export class JournalStore extends BaseStore<StoreProps> implements StoreProps {
       return;
     }
 
-    let entries = this.current.entries.slice(0);
-
-    if (!req.entry) {
-      entries.splice(req.index, 1);
-    } else {
-      entries[req.index] = req.entry;
-    }
+    const entries = this.current.entries.slice(0);
+    const items = "/journal/" + this.current.id + "/items";
+    const item = entries[req.index];
 
     try {
-      const response = await fetch("/journal/" + this.current.id, {
-        body: JSON.stringify({ entries }),
-        method: 'PUT'
-      });
+      // Past the last item adds one, otherwise the item is edited or removed
+      const response = item == null
+        ? await fetch(items, { body: JSON.stringify({ text: req.entry }), method: 'POST' })
+        : await fetch(items + "/" + item.id, req.entry
+          ? { body: JSON.stringify({ text: req.entry }), method: 'PATCH' }
+          : { method: 'DELETE' });
 
       if (response.ok) {
-        const json = await response.json() as BaseResponse<Responses.JournalEntry>;
+        const json = await response.json() as BaseResponse<Responses.JournalItem>;
         if (json.success === true) {
+          if (!req.entry) {
+            entries.splice(req.index, 1);
+          } else {
+            entries[req.index] = json.result;
+          }
+
           this.current.entries = entries;
         } else {
           this.error = json.error;
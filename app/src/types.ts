@@ -1,4 +1,6 @@
+import { JournalItem } from './models/responses.js';
+
 export interface SearchResult {
   date: Date;
-  entries: ReadonlyArray<string>;
+  entries: ReadonlyArray<JournalItem>;
 }
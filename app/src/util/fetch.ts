@@ -16,7 +16,7 @@ let csrfToken: string | null = null;
 const BASE_URL = '/api';
 
 export async function fetch(url: string, init?: RequestInit) {
-  if (csrfToken != null && init?.method && ['POST', 'DELETE', 'PUT'].includes(init?.method)) {
+  if (csrfToken != null && init?.method && ['POST', 'DELETE', 'PUT', 'PATCH'].includes(init?.method)) {
     init = {
       ...init,
       headers: {
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mikeyoon/MyDailyStuff/lib"
+)
+
+// Admin commands run against the same storage and mail settings as the web
+// server, for example:
+//
+//	MyDailyStuff user create someone@example.com
+//	ESURL=http://es:9200 MyDailyStuff index status
+
+type command func(mds *lib.MdsService, args []string) error
+
+var commands = map[string]map[string]command{
+	"user": {
+		"create":         userCreate,
+		"verify":         userVerify,
+		"reset-password": userResetPassword,
+		"disable-2fa":    userDisableTwoFactor,
+		"delete":         userDelete,
+		"set-role":       userSetRole,
+		"set-plan":       userSetPlan,
+	},
+	"index": {
+		"create":  indexCreate,
+		"reindex": indexReindex,
+		"status":  indexStatus,
+	},
+	"journal": {
+		"export": journalExport,
+		"import": journalImport,
+		"retag":  journalRetag,
+	},
+	"audit": {
+		"query": auditQuery,
+	},
+}
+
+const commandUsage = `Usage: MyDailyStuff [settings] <command> <subcommand> [flags]
+
+Without a command the web server is started.
+
+  user create <email> [-password p]          create a verified user
+  user verify <email>                        complete a pending registration
+  user reset-password <email> [-password p]  set a password, or email a reset link
+  user disable-2fa <email>                   turn off two-factor authentication
+  user delete <email> [-yes]                 delete a user and their journal
+  user set-role <email> [-role admin]        grant a role, no -role takes it away
+  user set-plan <email> [-plan name]         put a user on a plan, no -plan uses the defaults
+  index create                               create or migrate the indices
+  index reindex                              rebuild the indices from their current data
+  index status                               show the index and schema version of each alias
+  journal export -user <email> [-format f] [-out file]
+                                             export a user's journal as json, csv or zip
+  journal import -user <email> -format f [-conflict c] [-dry-run] <file>
+                                             import json, csv or dayone, skipping, merging
+                                             or overwriting existing days
+  journal retag [-user email]                store the hashtags of entries written before tags,
+                                             for every user without -user
+  audit query [-user email] [-actor email] [-action a] [-result r] [-ip ip] [-since 24h] [-limit n]
+                                             show security events, newest first
+
+Settings are read from STORAGE_BACKEND, ESURL, SQLITE_PATH, SENDGRID_USERNAME,
+SENDGRID_PASSWORD and PLANS, as for the web server.
+`
+
+// isCommand reports whether the first argument after the settings names an
+// admin command, anything else starts the web server
+func isCommand(name string) bool {
+	return name == "help" || commands[name] != nil
+}
+
+// usage prints the commands followed by the settings flags
+func usage() {
+	fmt.Fprint(flag.CommandLine.Output(), commandUsage+"\nSettings flags, overridden by their environment variables:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs an admin command and returns the process exit code
+func runCommand(args []string) int {
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Print(commandUsage)
+		return 0
+	}
+
+	if len(args) < 2 || commands[args[0]] == nil || commands[args[0]][args[1]] == nil {
+		fmt.Fprint(os.Stderr, commandUsage)
+		return 2
+	}
+
+	mds := lib.MdsService{}
+	err := mds.Init(serviceOptions())
+
+	if err == nil {
+		err = commands[args[0]][args[1]](&mds, args[2:])
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// parseArgs parses flags that may come before or after positional arguments
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// emailArg parses a command that takes a single email address
+func emailArg(flags *flag.FlagSet, args []string) (string, error) {
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return "", err
+	}
+
+	if len(positional) != 1 {
+		return "", errors.New(flags.Name() + " takes one email address")
+	}
+
+	return positional[0], nil
+}
+
+func prompt(question string) (string, error) {
+	fmt.Fprint(os.Stderr, question)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+
+	return strings.TrimSpace(line), err
+}
+
+// audit records an admin command in the security audit log
+func audit(mds *lib.MdsService, action string, userId string, email string, err error) {
+	event := lib.AuditEvent{UserId: userId, Email: email, Action: action, UserAgent: "admin command"}
+
+	if err := mds.RecordAuditEvent(event, err); err != nil {
+		fmt.Fprintln(os.Stderr, "Error recording audit event: "+err.Error())
+	}
+}
+
+//User Commands
+
+func userCreate(mds *lib.MdsService, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	password := flags.String("password", "", "Password, read from stdin when empty")
+
+	email, err := emailArg(flags, args)
+	if err == nil && *password == "" {
+		*password, err = prompt("Password: ")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	user, err := mds.CreateVerifiedUser(email, *password)
+	audit(mds, lib.AuditRegister, user.ID, email, err)
+
+	if err == nil {
+		fmt.Println("Created user " + user.ID)
+	}
+
+	return err
+}
+
+func userVerify(mds *lib.MdsService, args []string) error {
+	email, err := emailArg(flag.NewFlagSet("user verify", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	id, err := mds.VerifyUser(email)
+	audit(mds, lib.AuditVerify, id, email, err)
+
+	if err == nil {
+		fmt.Println("Verified user " + id)
+	}
+
+	return err
+}
+
+func userDisableTwoFactor(mds *lib.MdsService, args []string) error {
+	email, err := emailArg(flag.NewFlagSet("user disable-2fa", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	err = mds.ResetTwoFactor(email)
+	audit(mds, lib.AuditTwoFactorDisable, "", email, err)
+
+	if err == nil {
+		fmt.Println("Disabled two-factor authentication for " + email)
+	}
+
+	return err
+}
+
+func userResetPassword(mds *lib.MdsService, args []string) error {
+	flags := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+	password := flags.String("password", "", "New password, a reset link is emailed when empty")
+
+	email, err := emailArg(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if *password != "" {
+		err = mds.SetPassword(email, *password)
+		audit(mds, lib.AuditPasswordReset, "", email, err)
+
+		if err == nil {
+			fmt.Println("Password changed for " + email)
+		}
+
+		return err
+	}
+
+	if mds.MailClient == nil {
+		return errors.New("mail isn't configured, set SENDGRID_USERNAME or pass -password")
+	}
+
+	err = mds.CreateAndSendResetPassword(email)
+	audit(mds, lib.AuditPasswordResetRequest, "", email, err)
+
+	if err == nil {
+		fmt.Println("Sent a reset link to " + email)
+	}
+
+	return err
+}
+
+func userDelete(mds *lib.MdsService, args []string) error {
+	flags := flag.NewFlagSet("user delete", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "Don't ask for confirmation")
+
+	email, err := emailArg(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if !*yes {
+		answer, err := prompt("Delete " + email + " and all of their journal entries? [y/N] ")
+		if err != nil {
+			return err
+		}
+
+		if strings.ToLower(answer) != "y" {
+			return errors.New("cancelled")
+		}
+	}
+
+	// Looked up first, the audit event can't find the account once it is gone
+	user, _ := mds.GetUserByEmail(email, false)
+	err = mds.DeleteUser(email)
+	audit(mds, lib.AuditAccountDelete, user.ID, email, err)
+
+	if err == nil {
+		fmt.Println("Deleted " + email)
+	}
+
+	return err
+}
+
+func userSetRole(mds *lib.MdsService, args []string) error {
+	flags := flag.NewFlagSet("user set-role", flag.ContinueOnError)
+	role := flags.String("role", "", "Role to grant, admin, or empty to remove it")
+
+	email, err := emailArg(flags, args)
+	if err != nil {
+		return err
+	}
+
+	user, err := mds.SetRole(email, *role)
+	audit(mds, lib.AuditRoleChange, user.ID, email, err)
+
+	if err == nil && *role == "" {
+		fmt.Println("Removed the role of " + email)
+	} else if err == nil {
+		fmt.Println("Granted " + *role + " to " + email)
+	}
+
+	return err
+}
+
+func userSetPlan(mds *lib.MdsService, args []string) error {
+	flags := flag.NewFlagSet("user set-plan", flag.ContinueOnError)
+	plan := flags.String("plan", "", "Plan from the PLANS setting, or empty for the default limits")
+
+	email, err := emailArg(flags, args)
+	if err != nil {
+		return err
+	}
+
+	user, err := mds.SetPlan(email, *plan)
+	audit(mds, lib.AuditPlanChange, user.ID, email, err)
+
+	if err == nil && *plan == "" {
+		fmt.Println("Moved " + email + " to the default limits")
+	} else if err == nil {
+		fmt.Println("Moved " + email + " to the " + *plan + " plan")
+	}
+
+	return err
+}
+
+//Index Commands
+
+func printIndexes(indexes []lib.IndexStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ALIAS\tINDEX\tVERSION\tLATEST")
+	for _, status := range indexes {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", status.Alias, status.Index, status.Version, status.Latest)
+	}
+	w.Flush()
+}
+
+func indexCreate(mds *lib.MdsService, args []string) error {
+	indexes, err := mds.MigrateIndexes(false)
+	if err == nil {
+		printIndexes(indexes)
+	}
+
+	return err
+}
+
+func indexReindex(mds *lib.MdsService, args []string) error {
+	indexes, err := mds.MigrateIndexes(true)
+	if err == nil {
+		printIndexes(indexes)
+	}
+
+	return err
+}
+
+func indexStatus(mds *lib.MdsService, args []string) error {
+	indexes, err := mds.IndexStatus()
+	if err == nil {
+		printIndexes(indexes)
+	}
+
+	return err
+}
+
+//Journal Commands
+
+func journalExport(mds *lib.MdsService, args []string) error {
+	flags := flag.NewFlagSet("journal export", flag.ContinueOnError)
+	email := flags.String("user", "", "Email of the user to export")
+	format := flags.String("format", lib.ExportJSON, "Export format, json, csv or zip")
+	out := flags.String("out", "", "Output file, stdout when empty")
+
+	_, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if *email == "" {
+		return errors.New("journal export needs -user")
+	}
+
+	user, err := mds.GetUserByEmail(*email, true)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return mds.ExportJournal(user.ID, *format, w)
+}
+
+func journalImport(mds *lib.MdsService, args []string) error {
+	flags := flag.NewFlagSet("journal import", flag.ContinueOnError)
+	email := flags.String("user", "", "Email of the user to import into")
+	format := flags.String("format", "", "Import format, json, csv or dayone")
+	conflict := flags.String("conflict", lib.ConflictSkip, "Existing days, skip, merge or overwrite")
+	dryRun := flags.Bool("dry-run", false, "Report without writing anything")
+
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if *email == "" || len(positional) != 1 {
+		return errors.New("journal import needs -user and one file")
+	}
+
+	user, err := mds.GetUserByEmail(*email, true)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(positional[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	report, err := mds.ImportJournal(user.ID, file, lib.ImportOptions{Format: *format, OnConflict: *conflict, DryRun: *dryRun})
+	if err != nil {
+		return err
+	}
+
+	if report.DryRun {
+		fmt.Println("Dry run, nothing was written")
+	}
+
+	fmt.Printf("%d days: %d created, %d merged, %d overwritten, %d skipped, %d invalid\n",
+		report.Days, report.Created, report.Merged, report.Overwritten, report.Skipped, len(report.Invalid))
+
+	for _, issue := range report.Invalid {
+		if issue.Line > 0 {
+			fmt.Printf("  line %d: %s\n", issue.Line, issue.Error)
+		} else {
+			fmt.Printf("  %s: %s\n", issue.Date, issue.Error)
+		}
+	}
+
+	return nil
+}
+
+func journalRetag(mds *lib.MdsService, args []string) error {
+	flags := flag.NewFlagSet("journal retag", flag.ContinueOnError)
+	email := flags.String("user", "", "Email of the user to retag, every user when empty")
+
+	_, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	var users []lib.AdminUser
+	if *email != "" {
+		user, err := mds.GetUserByEmail(*email, true)
+		if err != nil {
+			return err
+		}
+
+		users = append(users, lib.AdminUser{ID: user.ID, Email: user.Email})
+	} else {
+		for offset := 0; ; {
+			page, total, err := mds.SearchUsers(lib.UserQuery{Status: lib.UserStatusVerified, Limit: 100, Offset: offset})
+			if err != nil {
+				return err
+			}
+
+			users = append(users, page...)
+			offset += len(page)
+			if len(page) == 0 || int64(offset) >= total {
+				break
+			}
+		}
+	}
+
+	entries := 0
+	for _, user := range users {
+		count, err := mds.RetagJournal(user.ID)
+		if err != nil {
+			return fmt.Errorf("retagging %s: %w", user.Email, err)
+		}
+
+		entries += count
+	}
+
+	fmt.Printf("Retagged %d entries of %d users\n", entries, len(users))
+	return nil
+}
+
+//Audit Commands
+
+func auditQuery(mds *lib.MdsService, args []string) error {
+	flags := flag.NewFlagSet("audit query", flag.ContinueOnError)
+	email := flags.String("user", "", "Email of the account, or the address typed in for unknown accounts")
+	actor := flags.String("actor", "", "Email of the administrator who acted")
+	action := flags.String("action", "", "Only this action, such as login or password_reset")
+	result := flags.String("result", "", "Only success or failure")
+	ip := flags.String("ip", "", "Only events from this IP")
+	since := flags.Duration("since", 0, "Only events this recent, such as 24h")
+	limit := flags.Int("limit", 50, "Most events to show")
+
+	if _, err := parseArgs(flags, args); err != nil {
+		return err
+	}
+
+	query := lib.AuditQuery{Action: *action, Result: *result, IP: *ip, Limit: *limit}
+	if *since > 0 {
+		query.Since = time.Now().Add(-*since)
+	}
+
+	if *email != "" {
+		if user, err := mds.GetUserByEmail(*email, false); err == nil {
+			query.UserId = user.ID
+		} else {
+			query.Email = *email
+		}
+	}
+
+	if *actor != "" {
+		admin, err := mds.GetUserByEmail(*actor, true)
+		if err != nil {
+			return err
+		}
+
+		query.ActorId = admin.ID
+	}
+
+	events, err := mds.QueryAuditEvents(query)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tACTION\tRESULT\tUSER\tACTOR\tIP\tDETAIL")
+	for _, event := range events {
+		user := event.UserId
+		if user == "" {
+			user = event.Email
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", event.Date.UTC().Format(time.RFC3339), event.Action, event.Result, user, event.ActorId, event.IP, event.Detail)
+	}
+
+	return w.Flush()
+}
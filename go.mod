@@ -5,9 +5,11 @@ go 1.18
 require (
 	github.com/gin-contrib/sessions v0.0.5
 	github.com/gin-gonic/gin v1.8.1
+	github.com/go-martini/martini v0.0.0-20170121215854-22fa46961aab
 	github.com/google/uuid v1.3.0
 	github.com/jinzhu/now v1.1.5
 	github.com/kennygrant/sanitize v1.2.4
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/newrelic/go-agent/v3 v3.17.0
 	github.com/newrelic/go-agent/v3/integrations/nrgin v1.1.2
 	github.com/olivere/elastic v6.2.37+incompatible
@@ -21,6 +23,7 @@ require (
 )
 
 require (
+	github.com/codegangsta/inject v0.0.0-20150114235600-33e0aa1cb7c0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dchest/uniuri v0.0.0-20200228104902-7aecb25e1fe5 // indirect
 	github.com/fortytw2/leaktest v1.3.0 // indirect
@@ -58,3 +61,6 @@ require (
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+// gin-contrib/sessions pulls in the retracted v2 tag, which is older than v1.14
+exclude github.com/mattn/go-sqlite3 v2.0.3+incompatible
@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Personal access tokens let scripts call the journal and search API with an
+// Authorization: Bearer header instead of a browser session. Like reset
+// tokens, only a hash of the secret is stored.
+
+const (
+	// ScopeJournalRead allows reading entries, streaks and exports
+	ScopeJournalRead = "journal:read"
+	// ScopeJournalWrite allows creating, changing, deleting and importing entries
+	ScopeJournalWrite = "journal:write"
+	// ScopeSearch allows searching entries
+	ScopeSearch = "search"
+
+	accessTokenPrefix = "mds_"
+	// maxAccessTokens is how many tokens one user can have
+	maxAccessTokens = 50
+	// tokenTouchInterval limits how often last used is written for a busy token
+	tokenTouchInterval = time.Minute
+)
+
+var accessTokenScopes = []string{ScopeJournalRead, ScopeJournalWrite, ScopeSearch}
+
+type AccessToken struct {
+	ID         string     `json:"id"`
+	UserId     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"token_hash,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	CreateDate time.Time  `json:"create_date"`
+	LastUsed   *time.Time `json:"last_used"`
+	Expires    *time.Time `json:"expires"`
+}
+
+func (t *AccessToken) GetID() string   { return t.ID }
+func (t *AccessToken) SetID(id string) { t.ID = id }
+
+// HasScope reports whether the token was granted scope
+func (t AccessToken) HasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+
+	for _, scope := range scopes {
+		known := false
+		for _, valid := range accessTokenScopes {
+			known = known || scope == valid
+		}
+
+		if !known {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CreateAccessToken issues a token for the user. The secret is only returned
+// here, afterwards the token can only be listed and revoked.
+func (s MdsService) CreateAccessToken(userId string, name string, scopes []string, expires *time.Time) (AccessToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return AccessToken{}, "", AccessTokenNameInvalid
+	}
+
+	if !validScopes(scopes) {
+		return AccessToken{}, "", AccessTokenScopeInvalid
+	}
+
+	if expires != nil && !expires.After(time.Now()) {
+		return AccessToken{}, "", AccessTokenExpiryInvalid
+	}
+
+	if _, err := s.GetUserById(userId); err != nil {
+		return AccessToken{}, "", err
+	}
+
+	existing, err := s.store.GetAccessTokens(userId)
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+
+	if len(existing) >= maxAccessTokens {
+		return AccessToken{}, "", TooManyAccessTokens
+	}
+
+	secret, hash, err := newToken()
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+
+	token := AccessToken{
+		ID:         uuid.NewString(),
+		UserId:     userId,
+		Name:       name,
+		Hash:       hash,
+		Scopes:     scopes,
+		CreateDate: time.Now(),
+		Expires:    expires,
+	}
+
+	if err := s.store.SaveAccessToken(token); err != nil {
+		return AccessToken{}, "", err
+	}
+
+	token.Hash = ""
+	return token, accessTokenPrefix + secret, nil
+}
+
+// GetAccessTokens lists a user's tokens, newest first, without their hashes
+func (s MdsService) GetAccessTokens(userId string) ([]AccessToken, error) {
+	tokens, err := s.store.GetAccessTokens(userId)
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+
+	return tokens, err
+}
+
+func (s MdsService) RevokeAccessToken(userId string, id string) error {
+	err := s.store.DeleteAccessToken(userId, id)
+	if err == RecordNotFound {
+		return AccessTokenNotFound
+	}
+
+	return err
+}
+
+// AuthenticateAccessToken finds the token for a bearer secret and records
+// that it was used
+func (s MdsService) AuthenticateAccessToken(secret string) (AccessToken, error) {
+	if !strings.HasPrefix(secret, accessTokenPrefix) {
+		return AccessToken{}, AccessTokenInvalid
+	}
+
+	token, err := s.store.GetAccessToken(hashToken(strings.TrimPrefix(secret, accessTokenPrefix)))
+	if err == RecordNotFound {
+		return AccessToken{}, AccessTokenInvalid
+	}
+
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	if token.Expires != nil && time.Now().After(*token.Expires) {
+		return AccessToken{}, AccessTokenExpired
+	}
+
+	// Tokens outlive their user only until the account is gone
+	if _, err := s.GetUserById(token.UserId); err != nil {
+		return AccessToken{}, AccessTokenInvalid
+	}
+
+	now := time.Now()
+	if token.LastUsed == nil || now.Sub(*token.LastUsed) > tokenTouchInterval {
+		token.LastUsed = &now
+		s.store.TouchAccessToken(token.ID, now)
+	}
+
+	token.Hash = ""
+	return token, nil
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Access tokens", func() {
+	var service MdsService
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		var err error
+		user, err = service.CreateVerifiedUser("tokens@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	It("should only store a hash of the secret", func() {
+		token, secret, err := service.CreateAccessToken(user.ID, "Shortcut", []string{ScopeJournalWrite}, nil)
+		Expect(err).To(BeNil())
+		Expect(secret).To(HavePrefix(accessTokenPrefix))
+		Expect(token.Hash).To(BeEmpty())
+
+		stored, err := service.store.GetAccessTokens(user.ID)
+		Expect(err).To(BeNil())
+		Expect(stored).To(HaveLen(1))
+		Expect(stored[0].Hash).To(Equal(hashToken(secret[len(accessTokenPrefix):])))
+	})
+
+	It("should validate the name, scopes and expiry", func() {
+		_, _, err := service.CreateAccessToken(user.ID, " ", []string{ScopeSearch}, nil)
+		Expect(err).To(Equal(AccessTokenNameInvalid))
+
+		_, _, err = service.CreateAccessToken(user.ID, "Shortcut", []string{"admin"}, nil)
+		Expect(err).To(Equal(AccessTokenScopeInvalid))
+
+		_, _, err = service.CreateAccessToken(user.ID, "Shortcut", nil, nil)
+		Expect(err).To(Equal(AccessTokenScopeInvalid))
+
+		past := time.Now().Add(-time.Hour)
+		_, _, err = service.CreateAccessToken(user.ID, "Shortcut", []string{ScopeSearch}, &past)
+		Expect(err).To(Equal(AccessTokenExpiryInvalid))
+	})
+
+	It("should authenticate and record the last use", func() {
+		created, secret, _ := service.CreateAccessToken(user.ID, "Shortcut", []string{ScopeJournalRead, ScopeSearch}, nil)
+
+		token, err := service.AuthenticateAccessToken(secret)
+		Expect(err).To(BeNil())
+		Expect(token.ID).To(Equal(created.ID))
+		Expect(token.HasScope(ScopeSearch)).To(BeTrue())
+		Expect(token.HasScope(ScopeJournalWrite)).To(BeFalse())
+
+		tokens, _ := service.GetAccessTokens(user.ID)
+		Expect(tokens[0].LastUsed).NotTo(BeNil())
+		Expect(tokens[0].Hash).To(BeEmpty())
+
+		_, err = service.AuthenticateAccessToken("mds_" + secret)
+		Expect(err).To(Equal(AccessTokenInvalid))
+	})
+
+	It("should reject expired tokens", func() {
+		expires := time.Now().Add(time.Hour)
+		created, secret, _ := service.CreateAccessToken(user.ID, "Shortcut", []string{ScopeSearch}, &expires)
+
+		stored, _ := service.store.GetAccessToken(hashToken(secret[len(accessTokenPrefix):]))
+		past := time.Now().Add(-time.Minute)
+		stored.Expires = &past
+		Expect(stored.ID).To(Equal(created.ID))
+		Expect(service.store.SaveAccessToken(stored)).To(BeNil())
+
+		_, err := service.AuthenticateAccessToken(secret)
+		Expect(err).To(Equal(AccessTokenExpired))
+	})
+
+	It("should only revoke the owner's tokens", func() {
+		created, secret, _ := service.CreateAccessToken(user.ID, "Shortcut", []string{ScopeSearch}, nil)
+		other, _ := service.CreateVerifiedUser("other@test.com", "password")
+
+		Expect(service.RevokeAccessToken(other.ID, created.ID)).To(Equal(AccessTokenNotFound))
+		Expect(service.RevokeAccessToken(user.ID, created.ID)).To(BeNil())
+
+		_, err := service.AuthenticateAccessToken(secret)
+		Expect(err).To(Equal(AccessTokenInvalid))
+	})
+
+	Describe("Middleware", func() {
+		var router *gin.Engine
+
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			controller := Controller{}
+			controller.SetOptions(service, false)
+
+			router = gin.New()
+			router.GET("/journal", controller.TokenAuth, RequireScope(ScopeJournalRead), func(c *gin.Context) {
+				c.String(200, c.GetString("userId"))
+			})
+		})
+
+		request := func(secret string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/journal", nil)
+			req.Header.Set("Authorization", "Bearer "+secret)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		It("should sign in a token with the scope", func() {
+			_, secret, _ := service.CreateAccessToken(user.ID, "Reader", []string{ScopeJournalRead}, nil)
+
+			recorder := request(secret)
+			Expect(recorder.Code).To(Equal(200))
+			Expect(recorder.Body.String()).To(Equal(user.ID))
+		})
+
+		It("should refuse a token without the scope", func() {
+			_, secret, _ := service.CreateAccessToken(user.ID, "Writer", []string{ScopeJournalWrite}, nil)
+			Expect(request(secret).Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should refuse an unknown token", func() {
+			Expect(request("mds_unknown").Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+})
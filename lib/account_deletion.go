@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// Deleting an account removes the user, their journal, sessions and access
+// tokens, leaving only a tombstone that records the deletion. With a grace
+// period the account is signed out everywhere and marked, and
+// PurgeDeletedAccounts deletes it once the period ends unless it was
+// cancelled.
+
+const (
+	// purgeBatchSize is how many accounts PurgeDeletedAccounts deletes per run
+	purgeBatchSize = 100
+
+	// recentSignIn is how long after signing in a user without a password
+	// can delete their account
+	recentSignIn = 10 * time.Minute
+
+	// DeletedByUser and DeletedByAdmin are the reasons recorded in tombstones
+	DeletedByUser  = "user"
+	DeletedByAdmin = "admin"
+)
+
+// Tombstone is what remains of a deleted account. The email is only kept as
+// a hash, so support can tell whether an address had an account.
+type Tombstone struct {
+	ID         string    `json:"id"`
+	EmailHash  string    `json:"email_hash"`
+	Reason     string    `json:"reason"`
+	CreateDate time.Time `json:"create_date"`
+	DeleteDate time.Time `json:"delete_date"`
+}
+
+func (t *Tombstone) GetID() string   { return t.ID }
+func (t *Tombstone) SetID(id string) { t.ID = id }
+
+// DeleteAccount deletes the account after checking the password. Users who
+// only sign in with a provider have no password, so they must have signed in
+// within recentSignIn instead, signedIn being when the current session began.
+// With a grace period it returns when the account will be deleted instead.
+func (s MdsService) DeleteAccount(userId string, password string, signedIn time.Time) (*time.Time, error) {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.PasswordHash == "" {
+		if signedIn.IsZero() || time.Since(signedIn) > recentSignIn {
+			return nil, SignInRequired
+		}
+	} else if s.comparePassword(&user, password) != nil {
+		return nil, PasswordIncorrect
+	}
+
+	if user.DeleteAfter != nil {
+		return user.DeleteAfter, nil
+	}
+
+	if s.deleteGrace <= 0 {
+		err = s.purgeAccount(user, DeletedByUser)
+		if err == nil {
+			err = s.sendDeletedNotice(user.Email)
+		}
+
+		return nil, err
+	}
+
+	if err := s.revokeAccess(userId); err != nil {
+		return nil, err
+	}
+
+	deleteAfter := time.Now().Add(s.deleteGrace)
+	user.DeleteAfter = &deleteAfter
+	if err := s.store.SaveUser(user); err != nil {
+		return nil, err
+	}
+
+	err = s.sendEmail(user.Email, "Your MyDailyStuff account will be deleted",
+		"Your MyDailyStuff account and journal will be deleted on "+deleteAfter.UTC().Format("Jan 2, 2006 15:04 MST")+".\n\n"+
+			"To keep your account, sign in and cancel the deletion from your profile before then.")
+
+	return &deleteAfter, err
+}
+
+// CancelAccountDeletion keeps an account that is waiting to be deleted
+func (s MdsService) CancelAccountDeletion(userId string) error {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	if user.DeleteAfter == nil {
+		return AccountDeletionNotPending
+	}
+
+	user.DeleteAfter = nil
+	return s.store.SaveUser(user)
+}
+
+// PurgeDeletedAccounts deletes the accounts whose grace period has ended,
+// returning how many were deleted
+func (s MdsService) PurgeDeletedAccounts() (int, error) {
+	users, err := s.store.GetUsersToDelete(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, user := range users {
+		if err := s.purgeAccount(user, DeletedByUser); err != nil {
+			return count, err
+		}
+
+		count++
+		if err := s.sendDeletedNotice(user.Email); err != nil {
+			log.Println("Error sending deletion notice:", err)
+		}
+	}
+
+	return count, nil
+}
+
+// revokeAccess signs the user out everywhere and revokes their access tokens
+func (s MdsService) revokeAccess(userId string) error {
+	tokens, err := s.store.GetAccessTokens(userId)
+	for i := 0; err == nil && i < len(tokens); i++ {
+		err = s.store.DeleteAccessToken(userId, tokens[i].ID)
+	}
+
+	if err == nil {
+		err = s.store.DeleteSessions(userId, "")
+	}
+
+	return err
+}
+
+// purgeAccount deletes everything stored for a user. The tombstone is
+// written first, so a purge that fails part way can simply be run again.
+func (s MdsService) purgeAccount(user User, reason string) error {
+	err := s.store.SaveTombstone(Tombstone{
+		ID:         user.ID,
+		EmailHash:  hashToken(strings.ToLower(user.Email)),
+		Reason:     reason,
+		CreateDate: user.CreateDate,
+		DeleteDate: time.Now(),
+	})
+
+	if err == nil {
+		err = s.revokeAccess(user.ID)
+	}
+
+	if err == nil {
+		err = s.store.DeleteJournalEntries(user.ID)
+	}
+
+	if err == nil {
+		err = s.store.DeleteRevisions(user.ID)
+	}
+
+	if err == nil {
+		err = s.store.DeleteUser(user.ID)
+	}
+
+	return err
+}
+
+func (s MdsService) sendDeletedNotice(email string) error {
+	return s.sendEmail(email, "Your MyDailyStuff account has been deleted",
+		"Your MyDailyStuff account and all of your journal entries have been deleted. Thanks for writing with us.")
+}
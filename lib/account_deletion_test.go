@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sendgrid/rest"
+	"github.com/stretchr/testify/mock"
+)
+
+var _ = Describe("Account deletion", func() {
+	var service MdsService
+	var client *MockSendGridClient
+	var user User
+	var sessionSecret, tokenSecret string
+
+	setup := func(grace time.Duration) {
+		service = newTestService(ServiceOptions{DeletionGracePeriod: grace})
+
+		client = new(MockSendGridClient)
+		client.On("Send", mock.AnythingOfType("*mail.SGMailV3")).Return(&rest.Response{}, nil)
+		service.MailClient = client
+
+		var err error
+		user, err = service.CreateVerifiedUser("delete@test.com", "password")
+		Expect(err).To(BeNil())
+
+		_, err = service.CreateJournalEntry(user.ID, []string{"Something"}, time.Now())
+		Expect(err).To(BeNil())
+
+		_, sessionSecret, err = service.CreateSession(user.ID, "10.0.0.1", "Firefox", true)
+		Expect(err).To(BeNil())
+		_, tokenSecret, err = service.CreateAccessToken(user.ID, "Shortcut", []string{ScopeJournalRead}, nil)
+		Expect(err).To(BeNil())
+	}
+
+	expectPurged := func() {
+		_, err := service.GetUserById(user.ID)
+		Expect(err).To(Equal(UserNotFound))
+
+		count := 0
+		Expect(service.store.EachJournalEntry(user.ID, func(JournalEntry) error {
+			count++
+			return nil
+		})).To(BeNil())
+		Expect(count).To(Equal(0))
+
+		if memory, ok := service.store.(*memoryStore); ok {
+			Expect(memory.tombstones).To(HaveKey(user.ID))
+			Expect(memory.tombstones[user.ID].EmailHash).To(Equal(hashToken("delete@test.com")))
+		}
+	}
+
+	expectSignedOut := func() {
+		_, err := service.AuthenticateSession(sessionSecret)
+		Expect(err).To(Equal(SessionInvalid))
+		_, err = service.AuthenticateAccessToken(tokenSecret)
+		Expect(err).To(Equal(AccessTokenInvalid))
+	}
+
+	Context("Without a grace period", func() {
+		BeforeEach(func() {
+			setup(0)
+		})
+
+		It("should require the password", func() {
+			_, err := service.DeleteAccount(user.ID, "wrong", time.Time{})
+			Expect(err).To(Equal(PasswordIncorrect))
+
+			_, err = service.GetUserById(user.ID)
+			Expect(err).To(BeNil())
+		})
+
+		It("should require a recent sign-in from users without a password", func() {
+			// Accounts created by single sign-on have no password
+			user.PasswordHash = ""
+			Expect(service.store.SaveUser(user)).To(BeNil())
+
+			_, err := service.DeleteAccount(user.ID, "", time.Time{})
+			Expect(err).To(Equal(SignInRequired))
+			_, err = service.DeleteAccount(user.ID, "", time.Now().Add(-time.Hour))
+			Expect(err).To(Equal(SignInRequired))
+
+			_, err = service.GetUserById(user.ID)
+			Expect(err).To(BeNil())
+
+			deleteAfter, err := service.DeleteAccount(user.ID, "", time.Now().Add(-time.Minute))
+			Expect(err).To(BeNil())
+			Expect(deleteAfter).To(BeNil())
+			expectPurged()
+		})
+
+		It("should delete everything and confirm by email", func() {
+			deleteAfter, err := service.DeleteAccount(user.ID, "password", time.Time{})
+			Expect(err).To(BeNil())
+			Expect(deleteAfter).To(BeNil())
+
+			expectPurged()
+			expectSignedOut()
+			client.AssertNumberOfCalls(GinkgoT(), "Send", 1)
+		})
+	})
+
+	Context("With a grace period", func() {
+		BeforeEach(func() {
+			setup(7 * 24 * time.Hour)
+		})
+
+		It("should schedule the deletion and sign out everywhere", func() {
+			deleteAfter, err := service.DeleteAccount(user.ID, "password", time.Time{})
+			Expect(err).To(BeNil())
+			Expect(*deleteAfter).To(BeTemporally("~", time.Now().Add(7*24*time.Hour), time.Minute))
+
+			stored, err := service.GetUserById(user.ID)
+			Expect(err).To(BeNil())
+			Expect(stored.DeleteAfter).NotTo(BeNil())
+			expectSignedOut()
+
+			count, err := service.PurgeDeletedAccounts()
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(0))
+		})
+
+		It("should let the user cancel", func() {
+			Expect(service.CancelAccountDeletion(user.ID)).To(Equal(AccountDeletionNotPending))
+
+			_, err := service.DeleteAccount(user.ID, "password", time.Time{})
+			Expect(err).To(BeNil())
+			Expect(service.CancelAccountDeletion(user.ID)).To(BeNil())
+
+			stored, _ := service.GetUserById(user.ID)
+			Expect(stored.DeleteAfter).To(BeNil())
+		})
+
+		It("should purge once the grace period ends", func() {
+			_, err := service.DeleteAccount(user.ID, "password", time.Time{})
+			Expect(err).To(BeNil())
+
+			stored, _ := service.GetUserById(user.ID)
+			past := time.Now().Add(-time.Minute)
+			stored.DeleteAfter = &past
+			Expect(service.store.SaveUser(stored)).To(BeNil())
+
+			count, err := service.PurgeDeletedAccounts()
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(1))
+			expectPurged()
+		})
+	})
+})
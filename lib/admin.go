@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"strings"
+	"time"
+)
+
+// Administrators support users through the admin API instead of editing the
+// stores by hand. The role is granted with the `user set-role` command, and
+// every admin action is recorded in the audit log with the admin as actor.
+
+const (
+	// RoleAdmin can use the admin API, users without a role can't
+	RoleAdmin = "admin"
+
+	// Statuses a user search can filter by
+	UserStatusVerified  = "verified"
+	UserStatusPending   = "pending"
+	UserStatusSuspended = "suspended"
+
+	// maxUserSearchLimit is the most users a search returns
+	maxUserSearchLimit = 100
+)
+
+// UserQuery selects users matching every field that is set
+type UserQuery struct {
+	// Email matches addresses containing it
+	Email  string
+	Status string
+	Role   string
+	Limit  int
+	Offset int
+}
+
+// matches reports whether the user is selected by the query, for stores
+// that filter in process
+func (q UserQuery) matches(user User) bool {
+	switch q.Status {
+	case UserStatusVerified:
+		if user.VerifyToken != nil {
+			return false
+		}
+	case UserStatusPending:
+		if user.VerifyToken == nil {
+			return false
+		}
+	case UserStatusSuspended:
+		if user.SuspendedAt == nil {
+			return false
+		}
+	}
+
+	return strings.Contains(user.Email, q.Email) && (q.Role == "" || user.Role == q.Role)
+}
+
+// AdminUser is what administrators see of an account
+type AdminUser struct {
+	ID            string     `json:"id"`
+	Email         string     `json:"email"`
+	Role          string     `json:"role,omitempty"`
+	Plan          string     `json:"plan,omitempty"`
+	CreateDate    time.Time  `json:"create_date"`
+	LastLoginDate time.Time  `json:"last_login_date"`
+	Verified      bool       `json:"verified"`
+	VerifyExpires *time.Time `json:"verify_expires,omitempty"`
+	TwoFactor     bool       `json:"two_factor"`
+	SingleSignOn  bool       `json:"single_sign_on"`
+	PendingEmail  *string    `json:"pending_email,omitempty"`
+	SuspendedAt   *time.Time `json:"suspended_at,omitempty"`
+	DeleteAfter   *time.Time `json:"delete_after,omitempty"`
+}
+
+func adminUser(user User) AdminUser {
+	return AdminUser{
+		ID:            user.ID,
+		Email:         user.Email,
+		Role:          user.Role,
+		Plan:          user.Plan,
+		CreateDate:    user.CreateDate,
+		LastLoginDate: user.LastLoginDate,
+		Verified:      user.VerifyToken == nil,
+		VerifyExpires: user.VerifyExpires,
+		TwoFactor:     user.TOTPEnabled,
+		SingleSignOn:  user.ExternalID != nil,
+		PendingEmail:  user.PendingEmail,
+		SuspendedAt:   user.SuspendedAt,
+		DeleteAfter:   user.DeleteAfter,
+	}
+}
+
+// UserStats are the aggregate counts shown to administrators
+type UserStats struct {
+	// Users counts every account, including pending registrations
+	Users           int64 `json:"users"`
+	Verified        int64 `json:"verified"`
+	Pending         int64 `json:"pending"`
+	Suspended       int64 `json:"suspended"`
+	Admins          int64 `json:"admins"`
+	TwoFactor       int64 `json:"two_factor"`
+	PendingDeletion int64 `json:"pending_deletion"`
+	JournalEntries  int64 `json:"journal_entries"`
+}
+
+// IsAdmin reports whether the user can use the admin API
+func (s MdsService) IsAdmin(userId string) (bool, error) {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return false, err
+	}
+
+	return user.Role == RoleAdmin && user.SuspendedAt == nil, nil
+}
+
+// SearchUsers returns a page of users, newest first, with the total matching
+func (s MdsService) SearchUsers(query UserQuery) ([]AdminUser, int64, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultSearchLimit
+	} else if query.Limit > maxUserSearchLimit {
+		query.Limit = maxUserSearchLimit
+	}
+
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+
+	query.Email = strings.ToLower(strings.TrimSpace(query.Email))
+
+	users, total, err := s.store.SearchUsers(query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	retval := make([]AdminUser, 0, len(users))
+	for _, user := range users {
+		retval = append(retval, adminUser(user))
+	}
+
+	return retval, total, nil
+}
+
+// anyUser finds a user or pending registration, GetUserById only finds users
+func (s MdsService) anyUser(userId string) (User, error) {
+	user, err := s.store.GetUserById(userId)
+	if err == RecordNotFound {
+		return User{}, UserNotFound
+	}
+
+	return user, err
+}
+
+// GetAdminUser returns what administrators see of one account
+func (s MdsService) GetAdminUser(userId string) (AdminUser, error) {
+	user, err := s.anyUser(userId)
+	if err != nil {
+		return AdminUser{}, err
+	}
+
+	return adminUser(user), nil
+}
+
+// ResendVerification emails a pending registration a new verification link
+func (s MdsService) ResendVerification(userId string) error {
+	user, err := s.anyUser(userId)
+	if err != nil {
+		return err
+	}
+
+	if user.VerifyToken == nil {
+		return UserAlreadyVerified
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	// The registration may have been verified since it was read
+	err = s.store.RenewVerifyToken(user.ID, hash, time.Now().Add(s.verifyTokenTTL()))
+	if err == RecordNotFound {
+		return UserAlreadyVerified
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.sendVerification(user.Email, token)
+}
+
+// ForcePasswordReset removes the password, signs the user out everywhere and
+// emails them a reset link
+func (s MdsService) ForcePasswordReset(userId string) error {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.SetPasswordHash(userId, ""); err != nil {
+		return err
+	}
+
+	if err := s.revokeAccess(userId); err != nil {
+		return err
+	}
+
+	return s.CreateAndSendResetPassword(user.Email)
+}
+
+// SuspendUser stops the user from signing in and signs them out everywhere
+func (s MdsService) SuspendUser(userId string) error {
+	user, err := s.anyUser(userId)
+	if err != nil {
+		return err
+	}
+
+	if user.SuspendedAt == nil {
+		now := time.Now()
+		if err := s.store.SetSuspendedAt(userId, &now); err != nil {
+			return err
+		}
+	}
+
+	return s.revokeAccess(userId)
+}
+
+// UnsuspendUser lets a suspended user sign in again
+func (s MdsService) UnsuspendUser(userId string) error {
+	user, err := s.anyUser(userId)
+	if err != nil {
+		return err
+	}
+
+	if user.SuspendedAt == nil {
+		return nil
+	}
+
+	return s.store.SetSuspendedAt(userId, nil)
+}
+
+// GetUserStats counts users by status and journal entries
+func (s MdsService) GetUserStats() (UserStats, error) {
+	return s.store.GetUserStats()
+}
@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sendgrid/rest"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	"github.com/stretchr/testify/mock"
+)
+
+var _ = Describe("Admin", func() {
+	var service MdsService
+	var client *MockSendGridClient
+	var admin User
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		client = new(MockSendGridClient)
+		client.On("Send", mock.AnythingOfType("*mail.SGMailV3")).Return(&rest.Response{}, nil)
+		service.MailClient = client
+
+		var err error
+		admin, err = service.CreateVerifiedUser("admin@test.com", "password")
+		Expect(err).To(BeNil())
+		admin, err = service.SetRole("admin@test.com", RoleAdmin)
+		Expect(err).To(BeNil())
+
+		time.Sleep(5 * time.Millisecond)
+		user, err = service.CreateVerifiedUser("user@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	It("should grant and take away the role", func() {
+		isAdmin, err := service.IsAdmin(admin.ID)
+		Expect(err).To(BeNil())
+		Expect(isAdmin).To(BeTrue())
+
+		isAdmin, _ = service.IsAdmin(user.ID)
+		Expect(isAdmin).To(BeFalse())
+
+		_, err = service.SetRole("user@test.com", "owner")
+		Expect(err).To(Equal(RoleInvalid))
+
+		_, err = service.SetRole("admin@test.com", "")
+		Expect(err).To(BeNil())
+		isAdmin, _ = service.IsAdmin(admin.ID)
+		Expect(isAdmin).To(BeFalse())
+	})
+
+	It("should search users", func() {
+		Expect(service.CreateUserVerification("pending@test.com", "password")).To(BeNil())
+
+		users, total, err := service.SearchUsers(UserQuery{})
+		Expect(err).To(BeNil())
+		Expect(total).To(BeEquivalentTo(3))
+		Expect(users[0].Email).To(Equal("pending@test.com"))
+		Expect(users[0].Verified).To(BeFalse())
+
+		users, total, _ = service.SearchUsers(UserQuery{Email: "USER@"})
+		Expect(total).To(BeEquivalentTo(1))
+		Expect(users[0].ID).To(Equal(user.ID))
+
+		users, _, _ = service.SearchUsers(UserQuery{Status: UserStatusPending})
+		Expect(users).To(HaveLen(1))
+
+		users, _, _ = service.SearchUsers(UserQuery{Role: RoleAdmin})
+		Expect(users).To(HaveLen(1))
+		Expect(users[0].ID).To(Equal(admin.ID))
+
+		users, total, _ = service.SearchUsers(UserQuery{Status: UserStatusVerified, Limit: 1, Offset: 1})
+		Expect(total).To(BeEquivalentTo(2))
+		Expect(users).To(HaveLen(1))
+		Expect(users[0].ID).To(Equal(admin.ID))
+
+		users, _, _ = service.SearchUsers(UserQuery{Email: "%"})
+		Expect(users).To(BeEmpty())
+	})
+
+	It("should resend verification to pending registrations", func() {
+		Expect(service.CreateUserVerification("pending@test.com", "password")).To(BeNil())
+		pending, _ := service.GetUserByEmail("pending@test.com", false)
+
+		Expect(service.ResendVerification(pending.ID)).To(BeNil())
+		client.AssertNumberOfCalls(GinkgoT(), "Send", 2)
+
+		stored, _ := service.store.GetUserById(pending.ID)
+		Expect(*stored.VerifyToken).NotTo(Equal(*pending.VerifyToken))
+
+		Expect(service.ResendVerification(user.ID)).To(Equal(UserAlreadyVerified))
+		Expect(service.ResendVerification("nobody")).To(Equal(UserNotFound))
+	})
+
+	It("should force a password reset", func() {
+		_, secret, err := service.CreateSession(user.ID, "10.0.0.1", "test", false)
+		Expect(err).To(BeNil())
+
+		Expect(service.ForcePasswordReset(user.ID)).To(BeNil())
+		client.AssertNumberOfCalls(GinkgoT(), "Send", 1)
+
+		_, err = service.GetUserByLogin("user@test.com", "password", "")
+		Expect(err).To(Equal(UserNotFound))
+
+		_, err = service.AuthenticateSession(secret)
+		Expect(err).To(Equal(SessionInvalid))
+
+		stored, _ := service.GetUserById(user.ID)
+		Expect(stored.ResetToken).NotTo(BeNil())
+	})
+
+	It("should suspend and unsuspend", func() {
+		_, secret, err := service.CreateSession(user.ID, "10.0.0.1", "test", false)
+		Expect(err).To(BeNil())
+
+		Expect(service.SuspendUser(user.ID)).To(BeNil())
+
+		_, err = service.AuthenticateSession(secret)
+		Expect(err).To(Equal(SessionInvalid))
+
+		_, err = service.GetUserByLogin("user@test.com", "password", "")
+		Expect(err).To(Equal(AccountSuspended))
+
+		_, err = service.GetUserByLogin("user@test.com", "wrong", "")
+		Expect(err).To(Equal(UserNotFound))
+
+		Expect(service.UnsuspendUser(user.ID)).To(BeNil())
+		_, err = service.GetUserByLogin("user@test.com", "password", "")
+		Expect(err).To(BeNil())
+	})
+
+	It("should keep changes made to the user while it runs", func() {
+		Expect(service.CreateUserVerification("pending@test.com", "password")).To(BeNil())
+		pending, _ := service.GetUserByEmail("pending@test.com", false)
+
+		store := service.store
+		service.store = changedAfterGet{Store: store, change: func(store Store, userId string) {
+			changed, _ := store.GetUserById(userId)
+			changed.TimeZone = "Asia/Tokyo"
+			store.SaveUser(changed)
+		}}
+
+		Expect(service.SuspendUser(user.ID)).To(BeNil())
+		Expect(service.UnsuspendUser(user.ID)).To(BeNil())
+		Expect(service.ForcePasswordReset(user.ID)).To(BeNil())
+		Expect(service.ResendVerification(pending.ID)).To(BeNil())
+
+		stored, _ := store.GetUserById(user.ID)
+		Expect(stored.TimeZone).To(Equal("Asia/Tokyo"))
+		Expect(stored.SuspendedAt).To(BeNil())
+		Expect(stored.PasswordHash).To(BeEmpty())
+		Expect(stored.ResetToken).NotTo(BeNil())
+
+		stored, _ = store.GetUserById(pending.ID)
+		Expect(stored.TimeZone).To(Equal("Asia/Tokyo"))
+		Expect(*stored.VerifyToken).NotTo(Equal(*pending.VerifyToken))
+	})
+
+	It("should not resend verification once the registration is verified", func() {
+		Expect(service.CreateUserVerification("pending@test.com", "password")).To(BeNil())
+		pending, _ := service.GetUserByEmail("pending@test.com", false)
+
+		store := service.store
+		service.store = changedAfterGet{Store: store, change: func(store Store, userId string) {
+			store.ConsumeVerifyToken(userId, *pending.VerifyToken)
+		}}
+
+		Expect(service.ResendVerification(pending.ID)).To(Equal(UserAlreadyVerified))
+		stored, _ := store.GetUserById(pending.ID)
+		Expect(stored.VerifyToken).To(BeNil())
+		client.AssertNumberOfCalls(GinkgoT(), "Send", 1)
+	})
+
+	It("should not verify a suspended registration", func() {
+		Expect(service.CreateUserVerification("pending@test.com", "password")).To(BeNil())
+		pending, _ := service.GetUserByEmail("pending@test.com", false)
+		Expect(service.SuspendUser(pending.ID)).To(BeNil())
+
+		message := client.Calls[0].Arguments[0].(*mail.SGMailV3)
+		token := message.Personalizations[0].DynamicTemplateData["token"].(string)
+
+		_, err := service.CreateUser(token)
+		Expect(err).To(Equal(AccountSuspended))
+	})
+
+	It("should count users", func() {
+		Expect(service.CreateUserVerification("pending@test.com", "password")).To(BeNil())
+		Expect(service.SuspendUser(user.ID)).To(BeNil())
+		_, err := service.CreateJournalEntry(user.ID, []string{"entry"}, time.Now())
+		Expect(err).To(BeNil())
+		trashed, err := service.CreateJournalEntry(user.ID, []string{"trashed"}, time.Now().AddDate(0, 0, -1))
+		Expect(err).To(BeNil())
+		Expect(service.DeleteJournalEntry(trashed.ID, user.ID)).To(BeNil())
+
+		stats, err := service.GetUserStats()
+		Expect(err).To(BeNil())
+		Expect(stats).To(Equal(UserStats{Users: 3, Verified: 2, Pending: 1, Suspended: 1, Admins: 1, JournalEntries: 1}))
+	})
+
+	Describe("Controller", func() {
+		var router *gin.Engine
+		var signedIn string
+
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			controller := Controller{}
+			controller.SetOptions(service, false)
+
+			router = gin.New()
+			router.Use(sessions.Sessions("my_session", cookie.NewStore([]byte("secret"))))
+			router.Use(func(c *gin.Context) {
+				c.Set("userId", signedIn)
+			})
+			router.GET("/api/admin/users/:id", controller.RequireAdmin, controller.AdminGetUser)
+			router.POST("/api/admin/users/:id/suspend", controller.RequireAdmin, controller.AdminSuspendUser)
+		})
+
+		request := func(method string, path string) int {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, nil)
+			router.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+
+		It("should only let admins in", func() {
+			signedIn = user.ID
+			Expect(request("GET", "/api/admin/users/"+admin.ID)).To(Equal(http.StatusForbidden))
+
+			signedIn = admin.ID
+			Expect(request("GET", "/api/admin/users/"+user.ID)).To(Equal(200))
+			Expect(request("GET", "/api/admin/users/nobody")).To(Equal(http.StatusNotFound))
+		})
+
+		It("should audit admin actions", func() {
+			signedIn = admin.ID
+			Expect(request("POST", "/api/admin/users/"+user.ID+"/suspend")).To(Equal(200))
+			time.Sleep(5 * time.Millisecond)
+			Expect(request("POST", "/api/admin/users/"+admin.ID+"/suspend")).To(Equal(200))
+
+			events, err := service.QueryAuditEvents(AuditQuery{ActorId: admin.ID, Action: AuditAdminSuspend})
+			Expect(err).To(BeNil())
+			Expect(events).To(HaveLen(2))
+			Expect(events[0].UserId).To(Equal(admin.ID))
+			Expect(events[0].Detail).To(Equal(AdminSelfSuspend.Error()))
+			Expect(events[1].UserId).To(Equal(user.ID))
+			Expect(events[1].Result).To(Equal(AuditSuccess))
+
+			isAdmin, _ := service.IsAdmin(admin.ID)
+			Expect(isAdmin).To(BeTrue())
+		})
+	})
+})
+
+// changedAfterGet changes a user right after it is read, like another
+// request would
+type changedAfterGet struct {
+	Store
+	change func(store Store, userId string)
+}
+
+func (s changedAfterGet) GetUserById(userId string) (User, error) {
+	user, err := s.Store.GetUserById(userId)
+	if err == nil {
+		s.change(s.Store, userId)
+	}
+
+	return user, err
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Security events, such as sign-ins, password resets and account changes,
+// are appended to an audit log with the client's IP and user agent. Records
+// are never changed or removed, so they outlive the account they describe.
+// The controller records web requests and the admin commands record
+// themselves.
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+
+	// defaultAuditLimit is how many events a query returns unless it asks for more
+	defaultAuditLimit = 50
+	// maxAuditLimit is the most events a query returns
+	maxAuditLimit = 500
+)
+
+// Actions recorded in the audit log
+const (
+	AuditLogin                = "login"
+	AuditLoginTwoFactor       = "login_two_factor"
+	AuditLoginOIDC            = "login_oidc"
+	AuditLogout               = "logout"
+	AuditRegister             = "register"
+	AuditVerify               = "verify"
+	AuditPasswordResetRequest = "password_reset_request"
+	AuditPasswordReset        = "password_reset"
+	AuditPasswordChange       = "password_change"
+	AuditEmailChangeRequest   = "email_change_request"
+	AuditEmailChange          = "email_change"
+	AuditTwoFactorEnable      = "two_factor_enable"
+	AuditTwoFactorDisable     = "two_factor_disable"
+	AuditTokenCreate          = "token_create"
+	AuditTokenRevoke          = "token_revoke"
+	AuditSessionRevoke        = "session_revoke"
+	AuditAccountDelete        = "account_delete"
+	AuditAccountRestore       = "account_restore"
+	AuditRoleChange           = "role_change"
+	AuditPlanChange           = "plan_change"
+
+	// Actions of administrators
+	AuditAdminSearch             = "admin_search"
+	AuditAdminView               = "admin_view"
+	AuditAdminStats              = "admin_stats"
+	AuditAdminResendVerification = "admin_resend_verification"
+	AuditAdminForceReset         = "admin_force_reset"
+	AuditAdminSuspend            = "admin_suspend"
+	AuditAdminUnsuspend          = "admin_unsuspend"
+)
+
+type AuditEvent struct {
+	ID     string `json:"id"`
+	UserId string `json:"user_id,omitempty"`
+	// ActorId is the administrator who acted on the user, empty when the
+	// user acted themselves
+	ActorId string `json:"actor_id,omitempty"`
+	// Email is the address typed in, for events before the user is known
+	Email     string    `json:"email,omitempty"`
+	Action    string    `json:"action"`
+	Result    string    `json:"result"`
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Date      time.Time `json:"date"`
+}
+
+func (e *AuditEvent) GetID() string   { return e.ID }
+func (e *AuditEvent) SetID(id string) { e.ID = id }
+
+// AuditQuery selects events matching every field that is set
+type AuditQuery struct {
+	UserId  string
+	ActorId string
+	Email   string
+	Action  string
+	Result  string
+	IP      string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// RecordAuditEvent appends an event to the audit log, err is the outcome of
+// the action. An event with only an email is filed under the account that
+// has it, if any.
+func (s MdsService) RecordAuditEvent(event AuditEvent, err error) error {
+	event.ID = uuid.NewString()
+	event.Date = time.Now()
+	event.Email = strings.ToLower(strings.TrimSpace(event.Email))
+	event.Result = AuditSuccess
+
+	if err != nil {
+		event.Result = AuditFailure
+		event.Detail = err.Error()
+	}
+
+	if event.UserId == "" && event.Email != "" {
+		if user, err := s.GetUserByEmail(event.Email, false); err == nil {
+			event.UserId = user.ID
+		}
+	}
+
+	if len(event.UserAgent) > 500 {
+		event.UserAgent = event.UserAgent[:500]
+	}
+
+	return s.store.SaveAuditEvent(event)
+}
+
+// GetAuditEvents returns a user's recent security activity, newest first
+func (s MdsService) GetAuditEvents(userId string, limit int) ([]AuditEvent, error) {
+	if userId == "" {
+		return nil, UserUnauthorized
+	}
+
+	return s.QueryAuditEvents(AuditQuery{UserId: userId, Limit: limit})
+}
+
+// QueryAuditEvents searches the audit log, newest first
+func (s MdsService) QueryAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultAuditLimit
+	} else if query.Limit > maxAuditLimit {
+		query.Limit = maxAuditLimit
+	}
+
+	query.Email = strings.ToLower(strings.TrimSpace(query.Email))
+	return s.store.GetAuditEvents(query)
+}
+
+// matches reports whether the event is selected by the query, for stores
+// that filter in process
+func (q AuditQuery) matches(event AuditEvent) bool {
+	return (q.UserId == "" || event.UserId == q.UserId) &&
+		(q.ActorId == "" || event.ActorId == q.ActorId) &&
+		(q.Email == "" || event.Email == q.Email) &&
+		(q.Action == "" || event.Action == q.Action) &&
+		(q.Result == "" || event.Result == q.Result) &&
+		(q.IP == "" || event.IP == q.IP) &&
+		(q.Since.IsZero() || !event.Date.Before(q.Since)) &&
+		(q.Until.IsZero() || !event.Date.After(q.Until))
+}
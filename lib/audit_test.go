@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Audit", func() {
+	var service MdsService
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		var err error
+		user, err = service.CreateVerifiedUser("audit@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	It("should list a user's events newest first", func() {
+		Expect(service.RecordAuditEvent(AuditEvent{UserId: user.ID, Action: AuditLogin, IP: "10.0.0.1"}, nil)).To(BeNil())
+		time.Sleep(5 * time.Millisecond)
+		Expect(service.RecordAuditEvent(AuditEvent{UserId: user.ID, Action: AuditPasswordChange}, PasswordInvalid)).To(BeNil())
+		Expect(service.RecordAuditEvent(AuditEvent{UserId: "someone", Action: AuditLogin}, nil)).To(BeNil())
+
+		events, err := service.GetAuditEvents(user.ID, 0)
+		Expect(err).To(BeNil())
+		Expect(events).To(HaveLen(2))
+
+		Expect(events[0].Action).To(Equal(AuditPasswordChange))
+		Expect(events[0].Result).To(Equal(AuditFailure))
+		Expect(events[0].Detail).To(Equal(PasswordInvalid.Error()))
+		Expect(events[1].Result).To(Equal(AuditSuccess))
+		Expect(events[1].IP).To(Equal("10.0.0.1"))
+		Expect(events[1].ID).NotTo(BeEmpty())
+
+		events, err = service.GetAuditEvents(user.ID, 1)
+		Expect(err).To(BeNil())
+		Expect(events).To(HaveLen(1))
+	})
+
+	It("should file events by email under the account", func() {
+		Expect(service.RecordAuditEvent(AuditEvent{Email: " Audit@Test.com", Action: AuditLogin}, UserNotFound)).To(BeNil())
+		Expect(service.RecordAuditEvent(AuditEvent{Email: "nobody@test.com", Action: AuditLogin}, UserNotFound)).To(BeNil())
+
+		events, err := service.GetAuditEvents(user.ID, 0)
+		Expect(err).To(BeNil())
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Email).To(Equal("audit@test.com"))
+
+		events, err = service.QueryAuditEvents(AuditQuery{Email: "Nobody@test.com"})
+		Expect(err).To(BeNil())
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].UserId).To(BeEmpty())
+	})
+
+	It("should filter queries", func() {
+		service.RecordAuditEvent(AuditEvent{UserId: user.ID, Action: AuditLogin, IP: "10.0.0.1"}, nil)
+		service.RecordAuditEvent(AuditEvent{UserId: user.ID, Action: AuditLogin, IP: "10.0.0.2"}, errors.New("bad"))
+		service.RecordAuditEvent(AuditEvent{UserId: user.ID, Action: AuditLogout, IP: "10.0.0.1"}, nil)
+
+		events, _ := service.QueryAuditEvents(AuditQuery{Action: AuditLogin})
+		Expect(events).To(HaveLen(2))
+
+		events, _ = service.QueryAuditEvents(AuditQuery{Result: AuditFailure})
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].IP).To(Equal("10.0.0.2"))
+
+		events, _ = service.QueryAuditEvents(AuditQuery{IP: "10.0.0.1", Action: AuditLogout})
+		Expect(events).To(HaveLen(1))
+
+		events, _ = service.QueryAuditEvents(AuditQuery{Since: time.Now().Add(time.Hour)})
+		Expect(events).To(BeEmpty())
+
+		events, _ = service.QueryAuditEvents(AuditQuery{Until: time.Now().Add(-time.Hour)})
+		Expect(events).To(BeEmpty())
+	})
+
+	It("should require a user", func() {
+		_, err := service.GetAuditEvents("", 0)
+		Expect(err).To(Equal(UserUnauthorized))
+	})
+
+	Describe("Controller", func() {
+		var router *gin.Engine
+
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			controller := Controller{}
+			controller.SetOptions(service, false)
+
+			router = gin.New()
+			router.TrustedPlatform = gin.PlatformCloudflare
+			router.Use(sessions.Sessions("my_session", cookie.NewStore([]byte("secret"))))
+			router.POST("/api/account/login", controller.Login)
+		})
+
+		login := func(password string) {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/account/login",
+				strings.NewReader(`{"email":"audit@test.com","password":"`+password+`"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("CF-Connecting-IP", "203.0.113.7")
+			req.Header.Set("User-Agent", "test-agent")
+
+			router.ServeHTTP(recorder, req)
+			Expect(recorder.Code).To(Equal(200))
+		}
+
+		It("should record logins with the client", func() {
+			login("wrong")
+
+			events, err := service.GetAuditEvents(user.ID, 0)
+			Expect(err).To(BeNil())
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Action).To(Equal(AuditLogin))
+			Expect(events[0].Result).To(Equal(AuditFailure))
+			Expect(events[0].IP).To(Equal("203.0.113.7"))
+			Expect(events[0].UserAgent).To(Equal("test-agent"))
+		})
+	})
+})
@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Carrying over copies, or moves, the items of the most recent earlier entry
+// that aren't done into a day's entry, for those who keep the day's list as a
+// to-do list. Users can have it done every night at midnight in their time
+// zone, see RunNightlyCarryOver.
+
+const (
+	// CarryOverCopy leaves the items in the earlier entry as well
+	CarryOverCopy = "copy"
+	// CarryOverMove removes the carried items from the earlier entry
+	CarryOverMove = "move"
+)
+
+// ItemOrigin is the item a carried over item came from
+type ItemOrigin struct {
+	EntryID string    `json:"entry_id"`
+	ItemID  string    `json:"item_id"`
+	Date    time.Time `json:"date"`
+}
+
+// CarryOverResult is the entry on the day, nil when there still is none, how
+// many items were carried into it and how many unfinished items didn't fit
+// under the item limit
+type CarryOverResult struct {
+	Entry   *JournalEntry `json:"entry"`
+	Carried int           `json:"carried"`
+	Left    int           `json:"left"`
+}
+
+func validCarryOver(mode string) bool {
+	return mode == CarryOverCopy || mode == CarryOverMove
+}
+
+// nextMidnight returns the start of the day after now in loc
+func nextMidnight(now time.Time, loc *time.Location) time.Time {
+	year, month, day := now.In(loc).Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+}
+
+// CarryOver brings the unfinished items of the user's latest entry before
+// date into the entry on date, creating it when needed. Items already
+// carried from that entry aren't carried again.
+func (s MdsService) CarryOver(userId string, date time.Time, mode string, editor Editor) (CarryOverResult, error) {
+	var result CarryOverResult
+	if !validCarryOver(mode) {
+		return result, CarryOverModeInvalid
+	}
+
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return result, err
+	}
+
+	day := calendarDay(date, locationOf(user))
+	limits := s.limitsFor(user)
+
+	previous, _, err := s.store.SearchJournal(userId, JournalQuery{End: day.AddDate(0, 0, -1), Limit: 1})
+	if err != nil {
+		return result, err
+	}
+
+	entry, err := s.store.GetJournalEntryByDate(userId, day)
+	if err == nil {
+		result.Entry = &entry
+	} else if err == RecordNotFound {
+		entry = JournalEntry{ID: uuid.NewString(), UserId: userId, Date: day, CreateDate: time.Now().UTC(), Entries: JournalItems{}}
+	} else {
+		return result, err
+	}
+
+	if len(previous) == 0 {
+		return result, nil
+	}
+
+	from := previous[0]
+	before := entry.Entries
+	entry.Entries = append(JournalItems{}, before...)
+	carried := map[string]bool{}
+	for _, item := range entry.Entries {
+		if item.CarriedFrom != nil && item.CarriedFrom.EntryID == from.ID {
+			carried[item.CarriedFrom.ItemID] = true
+		}
+	}
+
+	kept := JournalItems{}
+	for _, item := range from.Entries {
+		if item.Done || carried[item.ID] {
+			kept = append(kept, item)
+			continue
+		}
+
+		if len(entry.Entries) >= limits.MaxItems {
+			kept = append(kept, item)
+			result.Left++
+			continue
+		}
+
+		copied := item
+		copied.ID = uuid.NewString()
+		copied.CarriedFrom = &ItemOrigin{EntryID: from.ID, ItemID: item.ID, Date: from.Date}
+		entry.Entries = append(entry.Entries, copied)
+		result.Carried++
+
+		if mode == CarryOverCopy {
+			kept = append(kept, item)
+		}
+	}
+
+	if result.Carried == 0 {
+		return result, nil
+	}
+
+	// The new entry is saved first so a failure in between leaves the items
+	// in both rather than neither
+	if result.Entry == nil {
+		err = s.saveItems(entry)
+	} else {
+		err = s.saveRevised(entry, before, editor)
+	}
+
+	if err != nil {
+		return result, err
+	}
+
+	if mode == CarryOverMove {
+		moved := from.Entries
+		from.Entries = kept
+		if err := s.saveRevised(from, moved, editor); err != nil {
+			return result, err
+		}
+	}
+
+	entry.Entries.renumber()
+	entry.Tags = extractTags(entry.Entries.Texts())
+	result.Entry = &entry
+	return result, nil
+}
+
+// SetCarryOver turns the nightly carry over on with copy or move, or off
+// with an empty mode
+func (s MdsService) SetCarryOver(userId string, mode string) error {
+	if mode != "" && !validCarryOver(mode) {
+		return CarryOverModeInvalid
+	}
+
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	user.CarryOver = mode
+	user.CarryOverAfter = nil
+	if mode != "" {
+		next := nextMidnight(time.Now(), locationOf(user))
+		user.CarryOverAfter = &next
+	}
+
+	return s.store.SaveUser(user)
+}
+
+// RunNightlyCarryOver carries over items for every user whose midnight has
+// passed since their last run and returns how many users it ran for
+func (s MdsService) RunNightlyCarryOver(now time.Time) (int, error) {
+	count := 0
+	for {
+		users, err := s.store.GetUsersToCarryOver(now)
+		if err != nil || len(users) == 0 {
+			return count, err
+		}
+
+		for _, user := range users {
+			if user.SuspendedAt == nil && user.DeleteAfter == nil {
+				if _, err := s.CarryOver(user.ID, now, user.CarryOver, nightlyEditor); err != nil {
+					log.Println("Error carrying over items for "+user.ID+":", err)
+				} else {
+					count++
+				}
+			}
+
+			// Carrying over takes a while, the rest of the user may have
+			// changed since it was read
+			next := nextMidnight(now, locationOf(user))
+			if err := s.store.SetCarryOverAfter(user.ID, &next); err != nil {
+				return count, err
+			}
+		}
+	}
+}
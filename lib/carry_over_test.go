@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Carry over", func() {
+	var service MdsService
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{JournalLimits: JournalLimits{MaxItems: 3}})
+
+		var err error
+		user, err = service.CreateVerifiedUser("carry@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	day := func(date string) time.Time {
+		parsed, _ := time.Parse("2006-01-02", date)
+		return parsed
+	}
+
+	write := func(date string, items ...string) JournalEntry {
+		entry, err := service.CreateJournalEntry(user.ID, items, day(date))
+		Expect(err).To(BeNil())
+		return entry
+	}
+
+	entryOn := func(date string) JournalEntry {
+		entry, err := service.GetJournalEntryByDate(user.ID, day(date))
+		Expect(err).To(BeNil())
+		return entry
+	}
+
+	It("should copy unfinished items of the latest entry", func() {
+		write("2021-02-27", "old")
+		from := write("2021-03-01", "done", "open", "also open")
+		service.ToggleJournalItem(from.ID, user.ID, from.Entries[0].ID, Editor{})
+
+		result, err := service.CarryOver(user.ID, day("2021-03-03"), CarryOverCopy, Editor{})
+		Expect(err).To(BeNil())
+		Expect(result.Carried).To(Equal(2))
+		Expect(result.Entry.Entries.Texts()).To(Equal([]string{"open", "also open"}))
+
+		item := entryOn("2021-03-03").Entries[1]
+		Expect(item.Position).To(Equal(1))
+		Expect(item.ID).NotTo(Equal(from.Entries[2].ID))
+		Expect(item.CarriedFrom).To(Equal(&ItemOrigin{EntryID: from.ID, ItemID: from.Entries[2].ID, Date: day("2021-03-01")}))
+		Expect(entryOn("2021-03-01").Entries).To(HaveLen(3))
+
+		result, _ = service.CarryOver(user.ID, day("2021-03-03"), CarryOverCopy, Editor{})
+		Expect(result.Carried).To(Equal(0))
+		Expect(entryOn("2021-03-03").Entries).To(HaveLen(2))
+	})
+
+	It("should move items", func() {
+		write("2021-03-01", "#work open")
+		write("2021-03-02", "today")
+
+		result, err := service.CarryOver(user.ID, day("2021-03-02"), CarryOverMove, Editor{})
+		Expect(err).To(BeNil())
+		Expect(result.Carried).To(Equal(1))
+		Expect(entryOn("2021-03-02").Entries.Texts()).To(Equal([]string{"today", "#work open"}))
+		Expect(entryOn("2021-03-02").Tags).To(Equal([]string{"work"}))
+		Expect(entryOn("2021-03-01").Entries).To(BeEmpty())
+		Expect(entryOn("2021-03-01").Tags).To(BeEmpty())
+	})
+
+	It("should stop at the item limit", func() {
+		write("2021-03-01", "one", "two", "three")
+		write("2021-03-02", "today", "busy")
+
+		result, err := service.CarryOver(user.ID, day("2021-03-02"), CarryOverMove, Editor{})
+		Expect(err).To(BeNil())
+		Expect(result.Carried).To(Equal(1))
+		Expect(result.Left).To(Equal(2))
+		Expect(entryOn("2021-03-02").Entries.Texts()).To(Equal([]string{"today", "busy", "one"}))
+		Expect(entryOn("2021-03-01").Entries.Texts()).To(Equal([]string{"two", "three"}))
+	})
+
+	It("should not create an entry with nothing to carry", func() {
+		result, err := service.CarryOver(user.ID, day("2021-03-02"), CarryOverCopy, Editor{})
+		Expect(err).To(BeNil())
+		Expect(result.Carried).To(Equal(0))
+		Expect(result.Entry).To(BeNil())
+
+		_, err = service.GetJournalEntryByDate(user.ID, day("2021-03-02"))
+		Expect(err).To(Equal(NoJournalWithDate))
+
+		_, err = service.CarryOver(user.ID, day("2021-03-02"), "keep", Editor{})
+		Expect(err).To(Equal(CarryOverModeInvalid))
+	})
+
+	Describe("Nightly", func() {
+		It("should run after midnight in the user's zone", func() {
+			tokyo, _ := time.LoadLocation("Asia/Tokyo")
+			Expect(service.SetTimeZone(user.ID, "Asia/Tokyo")).To(BeNil())
+			Expect(service.SetCarryOver(user.ID, "sometimes")).To(Equal(CarryOverModeInvalid))
+			Expect(service.SetCarryOver(user.ID, CarryOverMove)).To(BeNil())
+
+			stored, _ := service.GetUserById(user.ID)
+			Expect(stored.CarryOverAfter.In(tokyo).Hour()).To(Equal(0))
+			Expect(stored.CarryOverAfter.After(time.Now())).To(BeTrue())
+
+			yesterday := time.Now().In(tokyo).AddDate(0, 0, -1)
+			service.CreateJournalEntry(user.ID, []string{"open"}, yesterday)
+
+			count, err := service.RunNightlyCarryOver(stored.CarryOverAfter.Add(-time.Minute))
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(0))
+
+			count, err = service.RunNightlyCarryOver(*stored.CarryOverAfter)
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(1))
+
+			entry, err := service.GetJournalEntryByDate(user.ID, *stored.CarryOverAfter)
+			Expect(err).To(BeNil())
+			Expect(entry.Entries.Texts()).To(Equal([]string{"open"}))
+
+			ran, _ := service.GetUserById(user.ID)
+			Expect(*ran.CarryOverAfter).To(BeTemporally("==", stored.CarryOverAfter.AddDate(0, 0, 1)))
+		})
+
+		It("should keep changes made to the user while it runs", func() {
+			Expect(service.SetCarryOver(user.ID, CarryOverCopy)).To(BeNil())
+			stored, _ := service.GetUserById(user.ID)
+
+			service.store = changedWhileRead{Store: service.store, change: func(store Store) {
+				changed, _ := store.GetUserById(user.ID)
+				changed.PasswordHash = "changed"
+				Expect(store.SaveUser(changed)).To(BeNil())
+			}}
+
+			count, err := service.RunNightlyCarryOver(*stored.CarryOverAfter)
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(1))
+
+			ran, _ := service.GetUserById(user.ID)
+			Expect(ran.PasswordHash).To(Equal("changed"))
+			Expect(ran.CarryOverAfter.After(*stored.CarryOverAfter)).To(BeTrue())
+		})
+
+		It("should follow a new time zone and turn off", func() {
+			service.SetCarryOver(user.ID, CarryOverCopy)
+			Expect(service.SetTimeZone(user.ID, "America/New_York")).To(BeNil())
+
+			stored, _ := service.GetUserById(user.ID)
+			newYork, _ := time.LoadLocation("America/New_York")
+			Expect(stored.CarryOverAfter.In(newYork).Hour()).To(Equal(0))
+
+			Expect(service.SetCarryOver(user.ID, "")).To(BeNil())
+			stored, _ = service.GetUserById(user.ID)
+			Expect(stored.CarryOverAfter).To(BeNil())
+
+			count, _ := service.RunNightlyCarryOver(time.Now().AddDate(0, 0, 2))
+			Expect(count).To(Equal(0))
+		})
+	})
+})
+
+// changedWhileRead changes the users due for the nightly carry over right
+// after they are read, like another request would
+type changedWhileRead struct {
+	Store
+	change func(store Store)
+}
+
+func (s changedWhileRead) GetUsersToCarryOver(date time.Time) ([]User, error) {
+	users, err := s.Store.GetUsersToCarryOver(date)
+	if len(users) > 0 {
+		s.change(s.Store)
+	}
+
+	return users, err
+}
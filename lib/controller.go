@@ -1,8 +1,15 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -16,6 +23,30 @@ type LoginRequest struct {
 	Persist  bool   `json:"persist"`
 }
 
+// LoginResult tells the client a code is needed to finish signing in
+type LoginResult struct {
+	TwoFactorRequired bool `json:"two_factor_required"`
+}
+
+type TwoFactorRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type PasswordRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// DeleteAccountRequest has no password for users who only sign in with a provider
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type CreateTokenRequest struct {
+	Name    string     `json:"name" binding:"required"`
+	Scopes  []string   `json:"scopes" binding:"required"`
+	Expires *time.Time `json:"expires"`
+}
+
 type RegisterRequest struct {
 	Email    string `json:"email" binding:"required"`
 	Password string `json:"password" binding:"required"`
@@ -26,6 +57,19 @@ type ModifyAccountRequest struct {
 	Email    string `json:"email"`
 }
 
+type ChangeEmailRequest struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type TimeZoneRequest struct {
+	TimeZone string `json:"time_zone"`
+}
+
+type CarryOverSettingRequest struct {
+	Mode string `json:"mode"`
+}
+
 type CreateEntryRequest struct {
 	Date    string   `json:"date" binding:"required"`
 	Entries []string `json:"entries" binding:"required"`
@@ -35,12 +79,40 @@ type ModifyEntryRequest struct {
 	Entries []string `json:"entries" binding:"required"`
 }
 
+type CarryOverRequest struct {
+	Date string `json:"date" binding:"required"`
+	Mode string `json:"mode"`
+}
+
+type ItemRequest struct {
+	Text string `json:"text" binding:"required"`
+}
+
+type ReorderItemsRequest struct {
+	Order []string `json:"order" binding:"required"`
+}
+
+type DiffRevisionsRequest struct {
+	From string `form:"from" binding:"required"`
+	To   string `form:"to"`
+}
+
 type SearchJournalRequest struct {
-	Query  string `form:"query"`
-	Start  string `form:"start"`
-	End    string `form:"end"`
-	Limit  int    `form:"limit"`
-	Offset int    `form:"offset"`
+	Query  string   `form:"query"`
+	Tags   []string `form:"tags"`
+	Start  string   `form:"start"`
+	End    string   `form:"end"`
+	Limit  int      `form:"limit"`
+	Offset int      `form:"offset"`
+}
+
+type RenameTagRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type MergeTagsRequest struct {
+	Tags []string `json:"tags" binding:"required"`
+	Into string   `json:"into" binding:"required"`
 }
 
 type FindDaysRequest struct {
@@ -48,6 +120,20 @@ type FindDaysRequest struct {
 	End   string `form:"end"`
 }
 
+type ImportJournalRequest struct {
+	Format     string `form:"format" binding:"required"`
+	OnConflict string `form:"conflict"`
+	DryRun     bool   `form:"dry_run"`
+}
+
+type AdminSearchRequest struct {
+	Email  string `form:"email"`
+	Status string `form:"status"`
+	Role   string `form:"role"`
+	Limit  int    `form:"limit"`
+	Offset int    `form:"offset"`
+}
+
 type ResetPasswordRequest struct {
 	Token    string `json:"token" binding:"required"`
 	Password string `json:"password" binding:"required"`
@@ -84,22 +170,203 @@ func (c *Controller) SetOptions(service Service, useSecureCookie bool) {
 }
 
 func (r *Controller) Login(c *gin.Context) {
-	session := sessions.Default(c)
 	var req LoginRequest
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameters provided"})
 		return
 	}
-	user, err := r.service.GetUserByLogin(req.Email, req.Password)
+	user, err := r.service.GetUserByLogin(req.Email, req.Password, c.ClientIP())
+	r.audit(c, AuditLogin, user.ID, req.Email, err)
+
+	if respondThrottled(c, err) {
+		return
+	}
+
+	if err == AccountSuspended {
+		c.JSON(200, ErrorResponse(err.Error()))
+		return
+	}
 
 	if err != nil {
 		c.JSON(200, ErrorResponse("Incorrect email or password"))
 		return
 	}
 
+	if user.TOTPEnabled {
+		pendTwoFactor(sessions.Default(c), user.ID, req.Persist)
+		c.JSON(200, SuccessResponse(LoginResult{TwoFactorRequired: true}))
+		return
+	}
+
+	if err := r.startSession(c, user.ID, req.Persist); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, SuccessResponse(nil))
+}
+
+// respondThrottled answers 429 with a Retry-After header when err is a ThrottleError
+func respondThrottled(c *gin.Context, err error) bool {
+	var throttled ThrottleError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+
+	c.Header("Retry-After", strconv.Itoa(int(throttled.RetryAfter().Seconds())))
+	c.JSON(http.StatusTooManyRequests, ErrorResponse(TooManyAttempts.Error()))
+	return true
+}
+
+// VerifyLogin completes a login with a two-factor or recovery code
+func (r *Controller) VerifyLogin(c *gin.Context) {
+	session := sessions.Default(c)
+	var req TwoFactorRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameters provided"})
+		return
+	}
+
+	userId, _ := session.Get("pendingUserId").(string)
+	expires, _ := session.Get("pendingExpires").(int64)
+	if userId == "" || time.Now().Unix() > expires {
+		c.JSON(http.StatusUnauthorized, ErrorResponse("Login expired, sign in again"))
+		return
+	}
+
+	err := r.service.VerifyTwoFactor(userId, req.Code)
+	r.audit(c, AuditLoginTwoFactor, userId, "", err)
+
+	if respondThrottled(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(TwoFactorCodeInvalid.Error()))
+		return
+	}
+
+	persist, _ := session.Get("pendingPersist").(bool)
+	session.Delete("pendingUserId")
+	session.Delete("pendingPersist")
+	session.Delete("pendingExpires")
+
+	if err := r.startSession(c, userId, persist); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, SuccessResponse(nil))
+}
+
+// pendTwoFactor remembers who passed the password, or the sign-in provider,
+// until VerifyLogin gets a code
+func pendTwoFactor(session sessions.Session, userId string, persist bool) {
+	session.Set("pendingUserId", userId)
+	session.Set("pendingPersist", persist)
+	session.Set("pendingExpires", time.Now().Add(twoFactorTimeout).Unix())
+	session.Save()
+}
+
+// OIDCLogin sends the browser to the sign-in provider
+func (r *Controller) OIDCLogin(c *gin.Context) {
+	session := sessions.Default(c)
+
+	request, err := r.service.OIDCAuthURL()
+	if err == OIDCNotConfigured {
+		c.JSON(http.StatusNotFound, ErrorResponse(err.Error()))
+		return
+	}
+
+	if err != nil {
+		log.Println("OpenID sign-in failed:", err)
+		c.JSON(http.StatusBadGateway, ErrorResponse("Sign-in provider is unavailable"))
+		return
+	}
+
+	session.Set("oidcState", request.State)
+	session.Set("oidcNonce", request.Nonce)
+	session.Set("oidcVerifier", request.Verifier)
+	session.Set("oidcPersist", c.Query("persist") == "true")
+	session.Set("oidcExpires", time.Now().Add(10*time.Minute).Unix())
+	session.Save()
+
+	c.Redirect(http.StatusFound, request.URL)
+}
+
+// OIDCCallback finishes a provider sign-in and redirects to the journal, or
+// back to the login page with the error
+func (r *Controller) OIDCCallback(c *gin.Context) {
+	session := sessions.Default(c)
+
+	state, _ := session.Get("oidcState").(string)
+	nonce, _ := session.Get("oidcNonce").(string)
+	verifier, _ := session.Get("oidcVerifier").(string)
+	persist, _ := session.Get("oidcPersist").(bool)
+	expires, _ := session.Get("oidcExpires").(int64)
+
+	for _, key := range []string{"oidcState", "oidcNonce", "oidcVerifier", "oidcPersist", "oidcExpires"} {
+		session.Delete(key)
+	}
+	session.Save()
+
+	fail := func(err error) {
+		c.Redirect(http.StatusFound, "/login?error="+url.QueryEscape(err.Error()))
+	}
+
+	if state == "" || c.Query("state") != state || time.Now().Unix() > expires {
+		fail(OIDCStateInvalid)
+		return
+	}
+
+	if c.Query("error") != "" || c.Query("code") == "" {
+		fail(errors.New("Sign-in was cancelled"))
+		return
+	}
+
+	user, err := r.service.OIDCLogin(c.Query("code"), verifier, nonce)
+	r.audit(c, AuditLoginOIDC, user.ID, "", err)
+
+	switch err {
+	case nil:
+	case OIDCEmailUnverified, OIDCAccountLinked, OIDCTokenInvalid, UserNotFound, AccountSuspended:
+		fail(err)
+		return
+	default:
+		log.Println("OpenID sign-in failed:", err)
+		fail(errors.New("Sign-in provider is unavailable"))
+		return
+	}
+
+	if user.TOTPEnabled {
+		pendTwoFactor(session, user.ID, persist)
+		c.Redirect(http.StatusFound, "/login?two_factor=true")
+		return
+	}
+
+	if err := r.startSession(c, user.ID, persist); err != nil {
+		log.Println("OpenID sign-in failed:", err)
+		fail(errors.New("Sign-in failed, please try again"))
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/journal")
+}
+
+// startSession signs the user in, for 30 days when persist is set. The
+// cookie keeps the secret of a session recorded by the service.
+func (r *Controller) startSession(c *gin.Context, userId string, persist bool) error {
+	session := sessions.Default(c)
+
+	_, secret, err := r.service.CreateSession(userId, c.ClientIP(), c.Request.UserAgent(), persist)
+	if err != nil {
+		return err
+	}
+
 	maxAge := 0
-	if req.Persist {
+	if persist {
 		maxAge = 2592000 //30 days
 	}
 
@@ -110,48 +377,166 @@ func (r *Controller) Login(c *gin.Context) {
 		MaxAge:   maxAge,
 	})
 
-	session.Set("userId", user.ID)
+	session.Set("userId", userId)
+	session.Set("sessionId", secret)
 	session.Save()
 	c.Header("X-Csrf-Token", csrf.GetToken(c))
-
-	c.JSON(200, SuccessResponse(nil))
+	return nil
 }
 
-func (r *Controller) RequireLogin(c *gin.Context) {
+// sessionUser returns the signed in user after checking the session hasn't
+// been revoked or expired, clearing the cookie's login when it has
+func (r *Controller) sessionUser(c *gin.Context) string {
 	session := sessions.Default(c)
 
-	if session.Get("userId") == nil {
-		c.Redirect(302, "/login")
-	} else {
-		_, err := r.service.GetUserById(session.Get("userId").(string))
-		if err == nil {
-			c.Next()
-		} else {
-			session.Delete(("userId"))
-			c.Redirect(302, "/login")
+	userId, _ := session.Get("userId").(string)
+	if userId == "" {
+		return ""
+	}
+
+	if value, ok := c.Get("session"); ok {
+		return value.(Session).UserId
+	}
+
+	secret, _ := session.Get("sessionId").(string)
+	current, err := r.service.AuthenticateSession(secret)
+	if err != nil || current.UserId != userId {
+		if err != nil && err != SessionInvalid {
+			log.Println("Session check failed:", err)
 		}
+
+		session.Delete("userId")
+		session.Delete("sessionId")
+		session.Save()
+		return ""
 	}
+
+	c.Set("session", current)
+	return userId
 }
 
-func (r *Controller) BypassIfLoggedIn(c *gin.Context) {
-	session := sessions.Default(c)
+// currentSessionId is the ID of the session making the request, if any
+func currentSessionId(c *gin.Context) string {
+	if value, ok := c.Get("session"); ok {
+		return value.(Session).ID
+	}
+
+	return ""
+}
+
+// sessionSignedIn is when the session making the request began, zero for
+// access tokens
+func sessionSignedIn(c *gin.Context) time.Time {
+	if value, ok := c.Get("session"); ok {
+		return value.(Session).CreateDate
+	}
+
+	return time.Time{}
+}
+
+// SessionAuth checks the session of requests that aren't signed in with an
+// access token, so LoginRequired only sees sessions that are still active
+func (r *Controller) SessionAuth(c *gin.Context) {
+	if c.GetString("userId") == "" {
+		r.sessionUser(c)
+	}
+
+	c.Next()
+}
+
+// BearerToken returns the personal access token in the Authorization header, if any
+func BearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	return ""
+}
+
+// currentUserId is the user of an access token, or else of the session
+func currentUserId(c *gin.Context) string {
+	if userId := c.GetString("userId"); userId != "" {
+		return userId
+	}
+
+	return sessions.Default(c).Get("userId").(string)
+}
+
+// editorOf describes where a request that changes an entry came from
+func editorOf(c *gin.Context) Editor {
+	editor := Editor{SessionID: currentSessionId(c), Device: c.Request.UserAgent()}
+	if value, ok := c.Get("accessToken"); ok {
+		editor.TokenID = value.(AccessToken).ID
+	}
+
+	return editor
+}
+
+// TokenAuth signs in a request with a personal access token. Requests
+// without one are left for the session check that follows.
+func (r *Controller) TokenAuth(c *gin.Context) {
+	secret := BearerToken(c)
+	if secret == "" {
+		c.Next()
+		return
+	}
 
-	if session.Get("userId") != nil {
-		_, err := r.service.GetUserById(session.Get("userId").(string))
-		if err == nil {
-			c.Redirect(301, "/journal")
+	token, err := r.service.AuthenticateAccessToken(secret)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse(err.Error()))
+		return
+	}
+
+	c.Set("userId", token.UserId)
+	c.Set("accessToken", token)
+	c.Next()
+}
+
+// RequireScope rejects access tokens without the scope, sessions can do anything
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if value, ok := c.Get("accessToken"); ok && !value.(AccessToken).HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse(AccessTokenScopeMissing.Error()))
 			return
-		} else {
-			session.Delete(("userId"))
 		}
+
+		c.Next()
+	}
+}
+
+func (r *Controller) RequireLogin(c *gin.Context) {
+	if r.sessionUser(c) == "" {
+		c.Redirect(302, "/login")
+	} else {
+		c.Next()
+	}
+}
+
+func (r *Controller) BypassIfLoggedIn(c *gin.Context) {
+	if r.sessionUser(c) != "" {
+		c.Redirect(301, "/journal")
+		return
 	}
 
 	c.Next()
 }
 
 func (r *Controller) Logout(c *gin.Context) {
+	if id := currentSessionId(c); id != "" {
+		r.audit(c, AuditLogout, currentUserId(c), "", r.service.RevokeSession(currentUserId(c), id))
+	}
+
+	r.clearSession(c)
+	c.JSON(200, SuccessResponse(nil))
+}
+
+// clearSession signs the browser out by expiring the cookie
+func (r *Controller) clearSession(c *gin.Context) {
 	session := sessions.Default(c)
 	session.Delete("userId")
+	session.Delete("sessionId")
 	session.Options(sessions.Options{
 		MaxAge:   -1,
 		HttpOnly: true,
@@ -160,6 +545,92 @@ func (r *Controller) Logout(c *gin.Context) {
 	})
 
 	session.Save()
+}
+
+// audit records a security event with the client's IP and user agent, err
+// is the outcome of the action
+func (r *Controller) audit(c *gin.Context, action string, userId string, email string, err error) {
+	r.recordAudit(c, AuditEvent{UserId: userId, Email: email, Action: action}, err)
+}
+
+// adminAudit records an administrator's action on the user with userId
+func (r *Controller) adminAudit(c *gin.Context, action string, userId string, err error) {
+	r.recordAudit(c, AuditEvent{UserId: userId, ActorId: currentUserId(c), Action: action}, err)
+}
+
+func (r *Controller) recordAudit(c *gin.Context, event AuditEvent, err error) {
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+
+	if err := r.service.RecordAuditEvent(event, err); err != nil {
+		log.Println("Error recording audit event:", err)
+	}
+}
+
+// GetActivity lists the user's recent security events, ?limit= sets how many
+func (r *Controller) GetActivity(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	events, err := r.service.GetAuditEvents(currentUserId(c), limit)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(events))
+	}
+}
+
+// GetSessions lists where the user is signed in
+func (r *Controller) GetSessions(c *gin.Context) {
+	list, err := r.service.GetSessions(currentUserId(c), currentSessionId(c))
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(list))
+	}
+}
+
+// RevokeSession signs out one session, which may be the current one
+func (r *Controller) RevokeSession(c *gin.Context) {
+	err := r.service.RevokeSession(currentUserId(c), c.Param("id"))
+	r.audit(c, AuditSessionRevoke, currentUserId(c), "", err)
+
+	if err == SessionNotFound {
+		c.JSON(http.StatusNotFound, ErrorResponse(err.Error()))
+		return
+	}
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+		return
+	}
+
+	if c.Param("id") == currentSessionId(c) {
+		r.clearSession(c)
+	}
+
+	c.JSON(200, SuccessResponse(nil))
+}
+
+// RevokeSessions signs out everywhere, or only the other sessions with ?others=true
+func (r *Controller) RevokeSessions(c *gin.Context) {
+	except := ""
+	if c.Query("others") == "true" {
+		except = currentSessionId(c)
+	}
+
+	err := r.service.RevokeSessions(currentUserId(c), except)
+	r.audit(c, AuditSessionRevoke, currentUserId(c), "", err)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+		return
+	}
+
+	if except == "" {
+		r.clearSession(c)
+	}
+
 	c.JSON(200, SuccessResponse(nil))
 }
 
@@ -169,12 +640,25 @@ func (r *Controller) Profile(c *gin.Context) {
 
 	c.Header("X-Csrf-Token", csrf.GetToken(c))
 
+	var limits JournalLimits
+	if err == nil {
+		limits, err = r.service.GetJournalLimits(user.ID)
+	}
+
 	if err == nil {
 		c.JSON(200, SuccessResponse(map[string]interface{}{
 			"user_id":         user.ID,
 			"create_date":     user.CreateDate,
 			"last_login_date": user.LastLoginDate,
 			"email":           user.Email,
+			"two_factor":      user.TOTPEnabled,
+			"pending_email":   user.PendingEmail,
+			"delete_after":    user.DeleteAfter,
+			"role":            user.Role,
+			"plan":            user.Plan,
+			"time_zone":       user.TimeZone,
+			"carry_over":      user.CarryOver,
+			"limits":          limits,
 		}))
 	} else {
 		c.JSON(404, ErrorResponse(err.Error()))
@@ -189,6 +673,8 @@ func (r *Controller) Register(c *gin.Context) {
 	}
 
 	err := r.service.CreateUserVerification(req.Email, req.Password)
+	r.audit(c, AuditRegister, "", req.Email, err)
+
 	if err != nil {
 		c.JSON(200, ErrorResponse(err.Error()))
 	} else {
@@ -204,7 +690,10 @@ func (r *Controller) UpdateProfile(c *gin.Context) {
 		return
 	}
 
-	err := r.service.UpdateUser(session.Get("userId").(string), "", req.Password)
+	err := r.service.UpdateUser(session.Get("userId").(string), "", req.Password, currentSessionId(c))
+	if req.Password != "" {
+		r.audit(c, AuditPasswordChange, currentUserId(c), "", err)
+	}
 
 	if err != nil {
 		c.JSON(200, ErrorResponse(err.Error()))
@@ -213,8 +702,106 @@ func (r *Controller) UpdateProfile(c *gin.Context) {
 	}
 }
 
-func (r *Controller) CreateForgotPasswordRequest(c *gin.Context) {
-	err := r.service.CreateAndSendResetPassword(c.Param("email"))
+// DeleteAccount deletes the account, or schedules it with a grace period,
+// and signs the browser out
+func (r *Controller) DeleteAccount(c *gin.Context) {
+	var req DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deleteAfter, err := r.service.DeleteAccount(currentUserId(c), req.Password, sessionSignedIn(c))
+	r.audit(c, AuditAccountDelete, currentUserId(c), "", err)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+		return
+	}
+
+	r.clearSession(c)
+	c.JSON(200, SuccessResponse(map[string]interface{}{"delete_after": deleteAfter}))
+}
+
+// CancelAccountDeletion keeps an account scheduled for deletion
+func (r *Controller) CancelAccountDeletion(c *gin.Context) {
+	err := r.service.CancelAccountDeletion(currentUserId(c))
+	r.audit(c, AuditAccountRestore, currentUserId(c), "", err)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(nil))
+	}
+}
+
+// SetTimeZone changes the zone the user's dates are resolved in
+func (r *Controller) SetTimeZone(c *gin.Context) {
+	var req TimeZoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := r.service.SetTimeZone(currentUserId(c), req.TimeZone)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(nil))
+	}
+}
+
+// SetCarryOver turns the nightly carry over of unfinished items on or off
+func (r *Controller) SetCarryOver(c *gin.Context) {
+	var req CarryOverSettingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := r.service.SetCarryOver(currentUserId(c), req.Mode)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(nil))
+	}
+}
+
+// ChangeEmail sends a confirmation link to the new address
+func (r *Controller) ChangeEmail(c *gin.Context) {
+	var req ChangeEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := r.service.RequestEmailChange(currentUserId(c), req.Password, req.Email)
+	r.audit(c, AuditEmailChangeRequest, currentUserId(c), "", err)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(nil))
+	}
+}
+
+// ConfirmEmail is opened from the link in the email, then shows the profile
+func (r *Controller) ConfirmEmail(c *gin.Context) {
+	userId, err := r.service.ConfirmEmailChange(c.Param("token"))
+	r.audit(c, AuditEmailChange, userId, "", err)
+
+	if err != nil {
+		c.Redirect(http.StatusFound, "/profile?error="+url.QueryEscape(err.Error()))
+	} else {
+		c.Redirect(http.StatusFound, "/profile?email=confirmed")
+	}
+}
+
+func (r *Controller) CreateForgotPasswordRequest(c *gin.Context) {
+	err := r.service.CreateAndSendResetPassword(c.Param("email"))
+	r.audit(c, AuditPasswordResetRequest, "", c.Param("email"), err)
 
 	if err != nil {
 		fmt.Println(err.Error() + " " + c.Query("email"))
@@ -226,7 +813,6 @@ func (r *Controller) CreateForgotPasswordRequest(c *gin.Context) {
 func (r *Controller) GetResetPasswordRequest(c *gin.Context) {
 	_, err := r.service.GetResetPassword(c.Param("token"))
 
-	//TODO: Check if token has expired
 	if err != nil {
 		c.JSON(200, ErrorResponse(err.Error()))
 	} else {
@@ -241,7 +827,10 @@ func (r *Controller) ResetPassword(c *gin.Context) {
 		return
 	}
 
+	// Looked up first, as the token no longer finds the user once it is used
+	reset, _ := r.service.GetResetPassword(req.Token)
 	err := r.service.ResetPassword(req.Token, req.Password)
+	r.audit(c, AuditPasswordReset, reset.ID, "", err)
 
 	if err != nil {
 		c.JSON(200, ErrorResponse(err.Error()))
@@ -251,22 +840,64 @@ func (r *Controller) ResetPassword(c *gin.Context) {
 }
 
 func (r *Controller) VerifyAccount(c *gin.Context) {
-	session := sessions.Default(c)
 	id, err := r.service.CreateUser(c.Param("token"))
+	r.audit(c, AuditVerify, id, "", err)
+
+	if err == nil {
+		err = r.startSession(c, id, false)
+	}
 
 	if err == nil {
-		session.Set("userId", id)
-		session.Save()
-		c.Header("X-Csrf-Token", csrf.GetToken(c))
 		c.JSON(200, SuccessResponse(nil))
 	} else {
 		c.JSON(200, ErrorResponse(err.Error()))
 	}
 }
 
+// parseDate reads a date from the client in the user's time zone, "today"
+// is the current day there
+func (r *Controller) parseDate(c *gin.Context, value string) (time.Time, error) {
+	if value == "today" {
+		return time.Now(), nil
+	}
+
+	loc, err := r.service.GetLocation(currentUserId(c))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	date, err := now.ParseInLocation(loc, value)
+	if err != nil {
+		return time.Time{}, DateInvalid
+	}
+
+	return date, nil
+}
+
+// parseRange reads the optional start and end of a search
+func (r *Controller) parseRange(c *gin.Context, req SearchJournalRequest) (JournalQuery, error) {
+	var query JournalQuery
+	var err error
+
+	if req.Start != "" {
+		query.Start, err = r.parseDate(c, req.Start)
+	}
+
+	if err == nil && req.End != "" {
+		query.End, err = r.parseDate(c, req.End)
+	}
+
+	return query, err
+}
+
 func (r *Controller) GetEntryByDate(c *gin.Context) {
-	session := sessions.Default(c)
-	entry, err := r.service.GetJournalEntryByDate(session.Get("userId").(string), now.MustParse(c.Param("date")))
+	date, err := r.parseDate(c, c.Param("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse(err.Error()))
+		return
+	}
+
+	entry, err := r.service.GetJournalEntryByDate(currentUserId(c), date)
 
 	if err != nil {
 		if err == NoJournalWithDate {
@@ -279,9 +910,9 @@ func (r *Controller) GetEntryByDate(c *gin.Context) {
 	}
 }
 
+// DeleteEntry moves an entry to the trash
 func (r *Controller) DeleteEntry(c *gin.Context) {
-	session := sessions.Default(c)
-	err := r.service.DeleteJournalEntry(c.Param("id"), session.Get("userId").(string))
+	err := r.service.DeleteJournalEntry(c.Param("id"), currentUserId(c))
 
 	if err != nil {
 		c.JSON(200, ErrorResponse(err.Error()))
@@ -290,15 +921,46 @@ func (r *Controller) DeleteEntry(c *gin.Context) {
 	}
 }
 
+// GetTrash lists the deleted entries that can still be restored
+func (r *Controller) GetTrash(c *gin.Context) {
+	entries, err := r.service.GetTrash(currentUserId(c))
+
+	if err != nil {
+		c.JSON(500, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(entries))
+	}
+}
+
+// RestoreEntry takes an entry out of the trash
+func (r *Controller) RestoreEntry(c *gin.Context) {
+	entry, err := r.service.RestoreJournalEntry(currentUserId(c), c.Param("id"))
+
+	if err == EntryNotFound {
+		c.JSON(http.StatusNotFound, ErrorResponse(err.Error()))
+	} else if err == EntryRestoreConflict {
+		c.JSON(http.StatusConflict, ErrorResponse(err.Error()))
+	} else if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(entry))
+	}
+}
+
 func (r *Controller) CreateEntry(c *gin.Context) {
-	session := sessions.Default(c)
 	var entry CreateEntryRequest
 	if err := c.ShouldBindJSON(&entry); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	result, err := r.service.CreateJournalEntry(session.Get("userId").(string), entry.Entries, now.MustParse(entry.Date))
+	date, err := r.parseDate(c, entry.Date)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse(err.Error()))
+		return
+	}
+
+	result, err := r.service.CreateJournalEntry(currentUserId(c), entry.Entries, date)
 
 	if err != nil {
 		c.JSON(200, ErrorResponse(err.Error()))
@@ -309,13 +971,12 @@ func (r *Controller) CreateEntry(c *gin.Context) {
 }
 
 func (r *Controller) UpdateEntry(c *gin.Context) {
-	session := sessions.Default(c)
 	var entry ModifyEntryRequest
 	if err := c.ShouldBindJSON(&entry); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	err := r.service.UpdateJournalEntry(c.Param("id"), session.Get("userId").(string), entry.Entries)
+	err := r.service.UpdateJournalEntry(c.Param("id"), currentUserId(c), entry.Entries, editorOf(c))
 
 	if err != nil {
 		c.JSON(200, ErrorResponse(err.Error()))
@@ -324,30 +985,141 @@ func (r *Controller) UpdateEntry(c *gin.Context) {
 	}
 }
 
-func (r *Controller) SearchJournal(c *gin.Context) {
-	session := sessions.Default(c)
-	var req SearchJournalRequest
+// itemResponse writes a changed item, or the error changing it
+func itemResponse(c *gin.Context, item interface{}, err error) {
+	if err == ItemNotFound || err == EntryNotFound || err == RevisionNotFound {
+		c.JSON(http.StatusNotFound, ErrorResponse(err.Error()))
+	} else if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(item))
+	}
+}
+
+// AddItem adds an item to the end of an entry
+func (r *Controller) AddItem(c *gin.Context) {
+	var req ItemRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var query JournalQuery
-	query.Query = req.Query
-	query.Limit = req.Limit
-	query.Offset = req.Offset
+	item, err := r.service.AddJournalItem(c.Param("id"), currentUserId(c), req.Text, editorOf(c))
+	itemResponse(c, item, err)
+}
 
-	if req.Start != "" {
-		query.Start = now.MustParse(req.Start)
+// EditItem changes the text of one item
+func (r *Controller) EditItem(c *gin.Context) {
+	var req ItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	if req.End != "" {
-		query.End = now.MustParse(req.End)
+	item, err := r.service.EditJournalItem(c.Param("id"), currentUserId(c), c.Param("item"), req.Text, editorOf(c))
+	itemResponse(c, item, err)
+}
+
+// ToggleItem marks an item done or not done
+func (r *Controller) ToggleItem(c *gin.Context) {
+	item, err := r.service.ToggleJournalItem(c.Param("id"), currentUserId(c), c.Param("item"), editorOf(c))
+	itemResponse(c, item, err)
+}
+
+// ReorderItems moves an entry's items into the order of their IDs
+func (r *Controller) ReorderItems(c *gin.Context) {
+	var req ReorderItemsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	results, total, err := r.service.SearchJournal(session.Get("userId").(string), query)
+	items, err := r.service.ReorderJournalItems(c.Param("id"), currentUserId(c), req.Order, editorOf(c))
+	itemResponse(c, items, err)
+}
+
+// RemoveItem removes one item from an entry
+func (r *Controller) RemoveItem(c *gin.Context) {
+	err := r.service.RemoveJournalItem(c.Param("id"), currentUserId(c), c.Param("item"), editorOf(c))
+	itemResponse(c, nil, err)
+}
+
+// CarryOver copies or moves the unfinished items of the latest earlier entry
+// into the entry on the date, copying when no mode is given
+func (r *Controller) CarryOver(c *gin.Context) {
+	var req CarryOverRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
+	date, err := r.parseDate(c, req.Date)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse(err.Error()))
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = CarryOverCopy
+	}
+
+	result, err := r.service.CarryOver(currentUserId(c), date, req.Mode, editorOf(c))
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(result))
+	}
+}
+
+// GetRevisions lists the earlier versions of an entry, newest first
+func (r *Controller) GetRevisions(c *gin.Context) {
+	revisions, err := r.service.GetRevisions(currentUserId(c), c.Param("entry"))
+	itemResponse(c, revisions, err)
+}
+
+// DiffRevisions compares two versions of an entry item by item, ?from= is a
+// revision and ?to= another one or, when left out, the entry as it is now
+func (r *Controller) DiffRevisions(c *gin.Context) {
+	var req DiffRevisionsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	diff, err := r.service.DiffRevisions(currentUserId(c), c.Param("entry"), req.From, req.To)
+	itemResponse(c, diff, err)
+}
+
+// RestoreRevision puts an entry back the way a revision has it
+func (r *Controller) RestoreRevision(c *gin.Context) {
+	entry, err := r.service.RestoreRevision(currentUserId(c), c.Param("entry"), c.Param("revision"), editorOf(c))
+	itemResponse(c, entry, err)
+}
+
+func (r *Controller) SearchJournal(c *gin.Context) {
+	var req SearchJournalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query, err := r.parseRange(c, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse(err.Error()))
+		return
+	}
+
+	query.Query = req.Query
+	query.Tags = req.Tags
+	query.Limit = req.Limit
+	query.Offset = req.Offset
+
+	results, total, err := r.service.SearchJournal(currentUserId(c), query)
+
+	if err == TagInvalid {
+		c.JSON(http.StatusBadRequest, ErrorResponse(err.Error()))
+	} else if err != nil {
 		c.JSON(500, ErrorResponse(err.Error()))
 	} else {
 		c.JSON(200, PagedSuccessResponse(results, total))
@@ -355,39 +1127,89 @@ func (r *Controller) SearchJournal(c *gin.Context) {
 }
 
 func (r *Controller) SearchJournalDates(c *gin.Context) {
-	session := sessions.Default(c)
 	var req SearchJournalRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var query JournalQuery
-	query.Query = req.Query
-
-	if req.Start != "" {
-		query.Start = now.MustParse(req.Start)
+	query, err := r.parseRange(c, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse(err.Error()))
+		return
 	}
 
-	if req.End != "" {
-		query.End = now.MustParse(req.End)
-	} else if req.Start != "" { // bit hacky, probably should have a flag in the request to do a default range
+	query.Query = req.Query
+	query.Tags = req.Tags
+
+	if req.End == "" && req.Start != "" { // bit hacky, probably should have a flag in the request to do a default range
 		query.End = query.Start.AddDate(0, 3, 0)
 		query.Start = query.Start.AddDate(0, -3, 0)
 	}
 
-	results, err := r.service.SearchJournalDates(session.Get("userId").(string), query)
-	if err != nil {
+	results, err := r.service.SearchJournalDates(currentUserId(c), query)
+	if err == TagInvalid {
+		c.JSON(http.StatusBadRequest, ErrorResponse(err.Error()))
+	} else if err != nil {
 		c.JSON(500, ErrorResponse(err.Error()))
 	} else {
 		c.JSON(200, SuccessResponse(results))
 	}
 }
 
+// GetTags lists the user's tags with how many entries have each
+func (r *Controller) GetTags(c *gin.Context) {
+	tags, err := r.service.GetTags(currentUserId(c))
+
+	if err != nil {
+		c.JSON(500, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(tags))
+	}
+}
+
+// RenameTag rewrites a tag in every entry and returns how many changed
+func (r *Controller) RenameTag(c *gin.Context) {
+	var req RenameTagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	count, err := r.service.RenameTag(currentUserId(c), c.Param("tag"), req.Name, editorOf(c))
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(gin.H{"entries": count}))
+	}
+}
+
+// MergeTags replaces several tags with one in every entry and returns how many changed
+func (r *Controller) MergeTags(c *gin.Context) {
+	var req MergeTagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	count, err := r.service.MergeTags(currentUserId(c), req.Tags, req.Into, editorOf(c))
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(gin.H{"entries": count}))
+	}
+}
+
 func (r *Controller) GetStreak(c *gin.Context) {
-	session := sessions.Default(c)
+	date, err := r.parseDate(c, c.Param("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse(err.Error()))
+		return
+	}
 
-	streak, err := r.service.GetStreak(session.Get("userId").(string), now.MustParse(c.Param("date")), 10)
+	streak, err := r.service.GetStreak(currentUserId(c), date, 10)
 
 	if err != nil {
 		c.JSON(500, ErrorResponse(err.Error()))
@@ -395,3 +1217,244 @@ func (r *Controller) GetStreak(c *gin.Context) {
 		c.JSON(200, SuccessResponse(streak))
 	}
 }
+
+func (r *Controller) ExportJournal(c *gin.Context) {
+	format := c.DefaultQuery("format", ExportJSON)
+
+	contentType, ok := ExportContentTypes[format]
+	if !ok {
+		c.JSON(400, ErrorResponse(ExportFormatInvalid.Error()))
+		return
+	}
+
+	filename := "mydailystuff-" + time.Now().UTC().Format("2006-01-02") + "." + format
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(200)
+
+	err := r.service.ExportJournal(currentUserId(c), format, c.Writer)
+
+	if err != nil && !c.Writer.Written() {
+		c.Header("Content-Type", "")
+		c.Header("Content-Disposition", "")
+		c.JSON(500, ErrorResponse(err.Error()))
+	} else if err != nil {
+		//Headers are already sent, so the download is left truncated
+		log.Println("Error exporting journal: " + err.Error())
+	}
+}
+
+// maxImportSize limits the upload accepted by ImportJournal
+const maxImportSize = 32 << 20
+
+func (r *Controller) ImportJournal(c *gin.Context) {
+	var req ImportJournalRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	//Accept a multipart upload from a form or the raw file as the body
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	var body io.Reader = c.Request.Body
+
+	if c.ContentType() == "multipart/form-data" {
+		file, _, err := c.Request.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		defer file.Close()
+		body = file
+	}
+
+	report, err := r.service.ImportJournal(currentUserId(c), body, ImportOptions{
+		Format:     req.Format,
+		OnConflict: req.OnConflict,
+		DryRun:     req.DryRun,
+		Editor:     editorOf(c),
+	})
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(report))
+	}
+}
+
+// EnrollTwoFactor returns a new secret and provisioning URI to show as a QR code
+func (r *Controller) EnrollTwoFactor(c *gin.Context) {
+	session := sessions.Default(c)
+	enrollment, err := r.service.EnrollTwoFactor(session.Get("userId").(string))
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(enrollment))
+	}
+}
+
+// ConfirmTwoFactor turns two-factor authentication on and returns the recovery codes
+func (r *Controller) ConfirmTwoFactor(c *gin.Context) {
+	session := sessions.Default(c)
+	var req TwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := r.service.ConfirmTwoFactor(session.Get("userId").(string), req.Code)
+	r.audit(c, AuditTwoFactorEnable, currentUserId(c), "", err)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(gin.H{"recovery_codes": codes}))
+	}
+}
+
+func (r *Controller) DisableTwoFactor(c *gin.Context) {
+	session := sessions.Default(c)
+	var req PasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := r.service.DisableTwoFactor(session.Get("userId").(string), req.Password)
+	r.audit(c, AuditTwoFactorDisable, currentUserId(c), "", err)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(nil))
+	}
+}
+
+func (r *Controller) GetAccessTokens(c *gin.Context) {
+	session := sessions.Default(c)
+	tokens, err := r.service.GetAccessTokens(session.Get("userId").(string))
+
+	if err != nil {
+		c.JSON(500, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(tokens))
+	}
+}
+
+// CreateAccessToken returns the new token with its secret, which is never shown again
+func (r *Controller) CreateAccessToken(c *gin.Context) {
+	session := sessions.Default(c)
+	var req CreateTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, secret, err := r.service.CreateAccessToken(session.Get("userId").(string), req.Name, req.Scopes, req.Expires)
+	r.audit(c, AuditTokenCreate, currentUserId(c), "", err)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(gin.H{"token": secret, "access_token": token}))
+	}
+}
+
+func (r *Controller) RevokeAccessToken(c *gin.Context) {
+	session := sessions.Default(c)
+	err := r.service.RevokeAccessToken(session.Get("userId").(string), c.Param("id"))
+	r.audit(c, AuditTokenRevoke, currentUserId(c), "", err)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, SuccessResponse(nil))
+	}
+}
+
+// RequireAdmin rejects users without the admin role
+func (r *Controller) RequireAdmin(c *gin.Context) {
+	admin, err := r.service.IsAdmin(currentUserId(c))
+	if err != nil || !admin {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse(AdminRequired.Error()))
+		return
+	}
+
+	c.Next()
+}
+
+// respondAdmin answers an admin action, 404 when the user doesn't exist
+func respondAdmin(c *gin.Context, result interface{}, err error) {
+	switch err {
+	case nil:
+		c.JSON(200, SuccessResponse(result))
+	case UserNotFound:
+		c.JSON(http.StatusNotFound, ErrorResponse(err.Error()))
+	default:
+		c.JSON(200, ErrorResponse(err.Error()))
+	}
+}
+
+// AdminSearchUsers finds users by part of their email, status and role
+func (r *Controller) AdminSearchUsers(c *gin.Context) {
+	var req AdminSearchRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	users, total, err := r.service.SearchUsers(UserQuery{Email: req.Email, Status: req.Status, Role: req.Role, Limit: req.Limit, Offset: req.Offset})
+	r.adminAudit(c, AuditAdminSearch, "", err)
+
+	if err != nil {
+		c.JSON(200, ErrorResponse(err.Error()))
+	} else {
+		c.JSON(200, PagedSuccessResponse(users, total))
+	}
+}
+
+func (r *Controller) AdminGetUser(c *gin.Context) {
+	user, err := r.service.GetAdminUser(c.Param("id"))
+	r.adminAudit(c, AuditAdminView, c.Param("id"), err)
+	respondAdmin(c, user, err)
+}
+
+func (r *Controller) AdminResendVerification(c *gin.Context) {
+	err := r.service.ResendVerification(c.Param("id"))
+	r.adminAudit(c, AuditAdminResendVerification, c.Param("id"), err)
+	respondAdmin(c, nil, err)
+}
+
+// AdminForcePasswordReset removes the password and emails the user a reset link
+func (r *Controller) AdminForcePasswordReset(c *gin.Context) {
+	err := r.service.ForcePasswordReset(c.Param("id"))
+	r.adminAudit(c, AuditAdminForceReset, c.Param("id"), err)
+	respondAdmin(c, nil, err)
+}
+
+func (r *Controller) AdminSuspendUser(c *gin.Context) {
+	var err error
+	if c.Param("id") == currentUserId(c) {
+		err = AdminSelfSuspend
+	} else {
+		err = r.service.SuspendUser(c.Param("id"))
+	}
+
+	r.adminAudit(c, AuditAdminSuspend, c.Param("id"), err)
+	respondAdmin(c, nil, err)
+}
+
+func (r *Controller) AdminUnsuspendUser(c *gin.Context) {
+	err := r.service.UnsuspendUser(c.Param("id"))
+	r.adminAudit(c, AuditAdminUnsuspend, c.Param("id"), err)
+	respondAdmin(c, nil, err)
+}
+
+// AdminStats returns aggregate counts of users and journal entries
+func (r *Controller) AdminStats(c *gin.Context) {
+	stats, err := r.service.GetUserStats()
+	r.adminAudit(c, AuditAdminStats, "", err)
+	respondAdmin(c, stats, err)
+}
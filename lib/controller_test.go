@@ -2,6 +2,7 @@ package lib
 
 import (
 	"html/template"
+	"io"
 	"net/http"
 	"time"
 
@@ -29,13 +30,188 @@ func (s MockService) GetUserByEmail(email string, verified bool) (User, error) {
 	return args.Get(0).(User), args.Error(1)
 }
 
-func (s MockService) GetUserByLogin(email string, password string) (User, error) {
+func (s MockService) GetUserByLogin(email string, password string, ip string) (User, error) {
 	args := s.Called(email, password)
 	return args.Get(0).(User), args.Error(1)
 }
 
-func (s MockService) UpdateUser(id string, email string, password string) error {
-	args := s.Called(id, email, password)
+func (s MockService) EnrollTwoFactor(userId string) (TwoFactorEnrollment, error) {
+	args := s.Called(userId)
+	return args.Get(0).(TwoFactorEnrollment), args.Error(1)
+}
+
+func (s MockService) ConfirmTwoFactor(userId string, code string) ([]string, error) {
+	args := s.Called(userId, code)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (s MockService) VerifyTwoFactor(userId string, code string) error {
+	args := s.Called(userId, code)
+	return args.Error(0)
+}
+
+func (s MockService) DisableTwoFactor(userId string, password string) error {
+	args := s.Called(userId, password)
+	return args.Error(0)
+}
+
+func (s MockService) CreateAccessToken(userId string, name string, scopes []string, expires *time.Time) (AccessToken, string, error) {
+	args := s.Called(userId, name, scopes, expires)
+	return args.Get(0).(AccessToken), args.String(1), args.Error(2)
+}
+
+func (s MockService) GetAccessTokens(userId string) ([]AccessToken, error) {
+	args := s.Called(userId)
+	return args.Get(0).([]AccessToken), args.Error(1)
+}
+
+func (s MockService) RevokeAccessToken(userId string, id string) error {
+	args := s.Called(userId, id)
+	return args.Error(0)
+}
+
+func (s MockService) AuthenticateAccessToken(secret string) (AccessToken, error) {
+	args := s.Called(secret)
+	return args.Get(0).(AccessToken), args.Error(1)
+}
+
+func (s MockService) OIDCAuthURL() (OIDCRequest, error) {
+	args := s.Called()
+	return args.Get(0).(OIDCRequest), args.Error(1)
+}
+
+func (s MockService) OIDCLogin(code string, verifier string, nonce string) (User, error) {
+	args := s.Called(code, verifier, nonce)
+	return args.Get(0).(User), args.Error(1)
+}
+
+func (s MockService) CreateSession(userId string, ip string, userAgent string, persist bool) (Session, string, error) {
+	args := s.Called(userId, ip, userAgent, persist)
+	return args.Get(0).(Session), args.String(1), args.Error(2)
+}
+
+func (s MockService) AuthenticateSession(secret string) (Session, error) {
+	args := s.Called(secret)
+	return args.Get(0).(Session), args.Error(1)
+}
+
+func (s MockService) GetSessions(userId string, currentId string) ([]Session, error) {
+	args := s.Called(userId, currentId)
+	return args.Get(0).([]Session), args.Error(1)
+}
+
+func (s MockService) RevokeSession(userId string, id string) error {
+	args := s.Called(userId, id)
+	return args.Error(0)
+}
+
+func (s MockService) RevokeSessions(userId string, except string) error {
+	args := s.Called(userId, except)
+	return args.Error(0)
+}
+
+func (s MockService) RequestEmailChange(userId string, password string, email string) error {
+	args := s.Called(userId, password, email)
+	return args.Error(0)
+}
+
+func (s MockService) ConfirmEmailChange(token string) (string, error) {
+	args := s.Called(token)
+	return args.String(0), args.Error(1)
+}
+
+func (s MockService) DeleteAccount(userId string, password string, signedIn time.Time) (*time.Time, error) {
+	args := s.Called(userId, password, signedIn)
+	return args.Get(0).(*time.Time), args.Error(1)
+}
+
+func (s MockService) CancelAccountDeletion(userId string) error {
+	args := s.Called(userId)
+	return args.Error(0)
+}
+
+func (s MockService) RecordAuditEvent(event AuditEvent, err error) error {
+	args := s.Called(event, err)
+	return args.Error(0)
+}
+
+func (s MockService) GetAuditEvents(userId string, limit int) ([]AuditEvent, error) {
+	args := s.Called(userId, limit)
+	return args.Get(0).([]AuditEvent), args.Error(1)
+}
+
+func (s MockService) IsAdmin(userId string) (bool, error) {
+	args := s.Called(userId)
+	return args.Bool(0), args.Error(1)
+}
+
+func (s MockService) SearchUsers(query UserQuery) ([]AdminUser, int64, error) {
+	args := s.Called(query)
+	return args.Get(0).([]AdminUser), args.Get(1).(int64), args.Error(2)
+}
+
+func (s MockService) GetAdminUser(userId string) (AdminUser, error) {
+	args := s.Called(userId)
+	return args.Get(0).(AdminUser), args.Error(1)
+}
+
+func (s MockService) ResendVerification(userId string) error {
+	args := s.Called(userId)
+	return args.Error(0)
+}
+
+func (s MockService) ForcePasswordReset(userId string) error {
+	args := s.Called(userId)
+	return args.Error(0)
+}
+
+func (s MockService) SuspendUser(userId string) error {
+	args := s.Called(userId)
+	return args.Error(0)
+}
+
+func (s MockService) UnsuspendUser(userId string) error {
+	args := s.Called(userId)
+	return args.Error(0)
+}
+
+func (s MockService) GetUserStats() (UserStats, error) {
+	args := s.Called()
+	return args.Get(0).(UserStats), args.Error(1)
+}
+
+func (s MockService) GetJournalLimits(userId string) (JournalLimits, error) {
+	args := s.Called(userId)
+	return args.Get(0).(JournalLimits), args.Error(1)
+}
+
+func (s MockService) GetTags(userId string) ([]TagCount, error) {
+	args := s.Called(userId)
+	return args.Get(0).([]TagCount), args.Error(1)
+}
+
+func (s MockService) RenameTag(userId string, tag string, name string, editor Editor) (int, error) {
+	args := s.Called(userId, tag, name, editor)
+	return args.Int(0), args.Error(1)
+}
+
+func (s MockService) MergeTags(userId string, tags []string, into string, editor Editor) (int, error) {
+	args := s.Called(userId, tags, into, editor)
+	return args.Int(0), args.Error(1)
+}
+
+func (s MockService) GetLocation(userId string) (*time.Location, error) {
+	args := s.Called(userId)
+	return args.Get(0).(*time.Location), args.Error(1)
+}
+
+func (s MockService) SetTimeZone(userId string, zone string) error {
+	args := s.Called(userId, zone)
+	return args.Error(0)
+}
+
+func (s MockService) UpdateUser(id string, email string, password string, keepSession string) error {
+	args := s.Called(id, email, password, keepSession)
 	return args.Error(0)
 }
 
@@ -74,11 +250,71 @@ func (s MockService) CreateJournalEntry(userId string, entries []string, date ti
 	return args.Get(0).(JournalEntry), args.Error(1)
 }
 
-func (s MockService) UpdateJournalEntry(id string, userId string, entries []string) error {
-	args := s.Called(id, userId, entries)
+func (s MockService) UpdateJournalEntry(id string, userId string, entries []string, editor Editor) error {
+	args := s.Called(id, userId, entries, editor)
+	return args.Error(0)
+}
+
+func (s MockService) AddJournalItem(entryId string, userId string, text string, editor Editor) (JournalItem, error) {
+	args := s.Called(entryId, userId, text, editor)
+	return args.Get(0).(JournalItem), args.Error(1)
+}
+
+func (s MockService) EditJournalItem(entryId string, userId string, itemId string, text string, editor Editor) (JournalItem, error) {
+	args := s.Called(entryId, userId, itemId, text, editor)
+	return args.Get(0).(JournalItem), args.Error(1)
+}
+
+func (s MockService) ToggleJournalItem(entryId string, userId string, itemId string, editor Editor) (JournalItem, error) {
+	args := s.Called(entryId, userId, itemId, editor)
+	return args.Get(0).(JournalItem), args.Error(1)
+}
+
+func (s MockService) ReorderJournalItems(entryId string, userId string, order []string, editor Editor) (JournalItems, error) {
+	args := s.Called(entryId, userId, order, editor)
+	return args.Get(0).(JournalItems), args.Error(1)
+}
+
+func (s MockService) CarryOver(userId string, date time.Time, mode string, editor Editor) (CarryOverResult, error) {
+	args := s.Called(userId, date, mode, editor)
+	return args.Get(0).(CarryOverResult), args.Error(1)
+}
+
+func (s MockService) SetCarryOver(userId string, mode string) error {
+	args := s.Called(userId, mode)
 	return args.Error(0)
 }
 
+func (s MockService) RemoveJournalItem(entryId string, userId string, itemId string, editor Editor) error {
+	args := s.Called(entryId, userId, itemId, editor)
+	return args.Error(0)
+}
+
+func (s MockService) GetTrash(userId string) ([]JournalEntry, error) {
+	args := s.Called(userId)
+	return args.Get(0).([]JournalEntry), args.Error(1)
+}
+
+func (s MockService) RestoreJournalEntry(userId string, id string) (JournalEntry, error) {
+	args := s.Called(userId, id)
+	return args.Get(0).(JournalEntry), args.Error(1)
+}
+
+func (s MockService) GetRevisions(userId string, entryId string) ([]Revision, error) {
+	args := s.Called(userId, entryId)
+	return args.Get(0).([]Revision), args.Error(1)
+}
+
+func (s MockService) DiffRevisions(userId string, entryId string, from string, to string) (RevisionDiff, error) {
+	args := s.Called(userId, entryId, from, to)
+	return args.Get(0).(RevisionDiff), args.Error(1)
+}
+
+func (s MockService) RestoreRevision(userId string, entryId string, revisionId string, editor Editor) (JournalEntry, error) {
+	args := s.Called(userId, entryId, revisionId, editor)
+	return args.Get(0).(JournalEntry), args.Error(1)
+}
+
 func (s MockService) DeleteJournalEntry(id string, userId string) error {
 	args := s.Called(id, userId)
 	return args.Error(0)
@@ -104,6 +340,16 @@ func (s MockService) GetStreak(userId string, date time.Time, limit int) (int, e
 	return args.Get(0).(int), args.Error(1)
 }
 
+func (s MockService) ExportJournal(userId string, format string, w io.Writer) error {
+	args := s.Called(userId, format, w)
+	return args.Error(0)
+}
+
+func (s MockService) ImportJournal(userId string, r io.Reader, options ImportOptions) (ImportReport, error) {
+	args := s.Called(userId, r, options)
+	return args.Get(0).(ImportReport), args.Error(1)
+}
+
 type MockSession struct {
 	mock.Mock
 }
@@ -635,7 +881,7 @@ var _ = Describe("Controller", func() {
 	Describe("Update Entry", func() {
 		Context("Where entry successfully created", func() {
 			It("should return success response", func() {
-				service.On("UpdateJournalEntry", "id", mockUser1.ID, mockEntry1.Entries).Return(nil)
+				service.On("UpdateJournalEntry", "id", mockUser1.ID, mockEntry1.Entries, Editor{}).Return(nil)
 				session.On("Get", "userId").Return(mockUser1.ID)
 				render.On("JSON", 200, SuccessResponse(nil)).Return()
 
@@ -646,7 +892,7 @@ var _ = Describe("Controller", func() {
 
 		Context("Where entry failed to create", func() {
 			It("should return failure response", func() {
-				service.On("UpdateJournalEntry", "id", mockUser1.ID, mockEntry1.Entries).
+				service.On("UpdateJournalEntry", "id", mockUser1.ID, mockEntry1.Entries, Editor{}).
 					Return(EntryNotFound)
 				session.On("Get", "userId").Return(mockUser1.ID)
 				render.On("JSON", 200, ErrorResponse(EntryNotFound.Error())).Return()
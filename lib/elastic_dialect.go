@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic"
+)
+
+// esDialect covers the request differences between Elasticsearch 6.x, which
+// still has mapping types, and the typeless APIs of 7.x and 8.x.
+type esDialect struct {
+	Version  string
+	Typeless bool
+}
+
+// newEsDialect picks the dialect for a cluster version such as "7.17.3"
+func newEsDialect(version string) esDialect {
+	major, _ := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	return esDialect{Version: version, Typeless: major >= 7}
+}
+
+// docType is the type used in document paths, typeless clusters use _doc
+func (d esDialect) docType(typ string) string {
+	if d.Typeless {
+		return "_doc"
+	}
+
+	return typ
+}
+
+// updatePath is the partial update endpoint for a document. IDs such as the
+// login keys come from what a client typed, so they are escaped.
+func (d esDialect) updatePath(index string, typ string, id string) string {
+	if d.Typeless {
+		return "/" + index + "/_update/" + url.PathEscape(id)
+	}
+
+	return "/" + index + "/" + typ + "/" + url.PathEscape(id) + "/_update"
+}
+
+// noop is the ctx.op an update script sets to skip the write, 7.x deprecates "none"
+func (d esDialect) noop() string {
+	if d.Typeless {
+		return "noop"
+	}
+
+	return "none"
+}
+
+// indexBody converts a typeless index body for the cluster, nesting the
+// mapping under its type name for 6.x
+func (d esDialect) indexBody(body string, typ string) (string, error) {
+	if d.Typeless {
+		return body, nil
+	}
+
+	var index map[string]interface{}
+	err := json.Unmarshal([]byte(body), &index)
+	if err != nil {
+		return "", err
+	}
+
+	if mappings, ok := index["mappings"]; ok {
+		index["mappings"] = map[string]interface{}{typ: mappings}
+	}
+
+	typed, err := json.Marshal(index)
+	return string(typed), err
+}
+
+// esTotalHits reads hits.total, a number before 7.0 and an object after
+type esTotalHits struct {
+	Value    int64  `json:"value"`
+	Relation string `json:"relation"`
+}
+
+func (t *esTotalHits) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] != '{' {
+		t.Relation = "eq"
+		return json.Unmarshal(data, &t.Value)
+	}
+
+	type totalHits esTotalHits
+	return json.Unmarshal(data, (*totalHits)(t))
+}
+
+type esSearchHits struct {
+	Total esTotalHits          `json:"total"`
+	Hits  []*elastic.SearchHit `json:"hits"`
+}
+
+// esSearchResult is the part of a search response the store reads, parsed
+// for either dialect
+type esSearchResult struct {
+	Hits         esSearchHits               `json:"hits"`
+	Aggregations map[string]json.RawMessage `json:"aggregations"`
+}
+
+func (r *esSearchResult) TotalHits() int64 {
+	return r.Hits.Total.Value
+}
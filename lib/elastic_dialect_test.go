@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeCluster answers just enough of the Elasticsearch API to check which
+// requests the store sends for a cluster version
+type fakeCluster struct {
+	mu       sync.Mutex
+	version  string
+	total    string
+	requests []string
+	bodies   []string
+	// responses overrides the answer for a "METHOD /path" request
+	responses map[string]string
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	request := r.Method + " " + r.URL.Path
+	f.requests = append(f.requests, request)
+	f.bodies = append(f.bodies, string(body))
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if response, ok := f.responses[request]; ok {
+		w.Write([]byte(response))
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/":
+		w.Write([]byte(`{"version":{"number":"` + f.version + `"}}`))
+	case r.Method == "HEAD", strings.HasPrefix(r.URL.Path, "/_alias/"):
+		w.WriteHeader(404)
+		w.Write([]byte(`{}`))
+	case r.Method == "PUT":
+		w.Write([]byte(`{"acknowledged":true}`))
+	case strings.HasSuffix(r.URL.Path, "/_search"):
+		w.Write([]byte(`{"hits":{"total":` + f.total + `,"hits":[{"_id":"u1","_source":{"email":"test@test.com"}}]}}`))
+	default:
+		w.Write([]byte(`{"result":"updated"}`))
+	}
+}
+
+// bodyOf returns the body of the first request starting with prefix
+func (f *fakeCluster) bodyOf(prefix string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, r := range f.requests {
+		if strings.HasPrefix(r, prefix) {
+			return f.bodies[i]
+		}
+	}
+
+	return ""
+}
+
+func (f *fakeCluster) has(request string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, r := range f.requests {
+		if r == request {
+			return true
+		}
+	}
+
+	return false
+}
+
+var _ = Describe("Elasticsearch dialect", func() {
+	Describe("Version detection", func() {
+		It("should use mapping types before 7.0", func() {
+			Expect(newEsDialect("6.8.23").Typeless).To(BeFalse())
+			Expect(newEsDialect("7.17.3").Typeless).To(BeTrue())
+			Expect(newEsDialect("8.11.1").Typeless).To(BeTrue())
+		})
+	})
+
+	Describe("Index body", func() {
+		It("should nest the mapping under the type for 6.x", func() {
+			body, err := newEsDialect("6.8.23").indexBody(IndexUserJSON, userType)
+			Expect(err).To(BeNil())
+
+			var index map[string]map[string]interface{}
+			json.Unmarshal([]byte(body), &index)
+			Expect(index["mappings"]).To(HaveKey(userType))
+		})
+
+		It("should leave the mapping typeless for 7.x", func() {
+			body, err := newEsDialect("7.17.3").indexBody(IndexUserJSON, userType)
+			Expect(err).To(BeNil())
+			Expect(body).To(Equal(IndexUserJSON))
+		})
+	})
+
+	Describe("Total hits", func() {
+		It("should parse a number", func() {
+			var result esSearchResult
+			err := json.Unmarshal([]byte(`{"hits":{"total":3,"hits":[]}}`), &result)
+			Expect(err).To(BeNil())
+			Expect(result.TotalHits()).To(Equal(int64(3)))
+		})
+
+		It("should parse an object", func() {
+			var result esSearchResult
+			err := json.Unmarshal([]byte(`{"hits":{"total":{"value":4,"relation":"eq"},"hits":[]}}`), &result)
+			Expect(err).To(BeNil())
+			Expect(result.TotalHits()).To(Equal(int64(4)))
+		})
+	})
+
+	Describe("Requests", func() {
+		var cluster *fakeCluster
+		var server *httptest.Server
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		Context("Against a 7.x cluster", func() {
+			It("should use typeless requests", func() {
+				cluster = &fakeCluster{version: "7.17.3", total: `{"value":1,"relation":"eq"}`}
+				server = httptest.NewServer(cluster)
+
+				store, err := newElasticStore(server.URL)
+				Expect(err).To(BeNil())
+				Expect(cluster.bodyOf("PUT /" + userIndex() + "_v")).NotTo(ContainSubstring(`"user"`))
+
+				user, err := store.GetUserByEmail("test@test.com", true)
+				Expect(err).To(BeNil())
+				Expect(user.ID).To(Equal("u1"))
+
+				token := "token"
+				Expect(store.SetResetToken("u1", &token, nil)).To(BeNil())
+				Expect(cluster.has("POST /" + userIndex() + "/_update/u1")).To(BeTrue())
+
+				Expect(store.ConsumeResetToken("u1", token)).To(BeNil())
+				Expect(cluster.bodies[len(cluster.bodies)-1]).To(ContainSubstring(`'noop'`))
+
+				_, err = store.AddLoginFailure("ip:10.0.0.1", time.Now(), time.Now())
+				Expect(err).To(BeNil())
+				Expect(cluster.has("POST /" + loginIndex() + "/_update/ip:10.0.0.1")).To(BeTrue())
+
+				_, err = store.AddLoginFailure("account:a/../b?c#d%e@test.com", time.Now(), time.Now())
+				Expect(err).To(BeNil())
+				Expect(cluster.has("POST /" + loginIndex() + "/_update/account:a/../b?c#d%e@test.com")).To(BeTrue())
+
+				Expect(store.ForgiveLoginFailures("ip:10.0.0.1", loginForgiven)).To(BeNil())
+				Expect(cluster.bodies[len(cluster.bodies)-1]).To(ContainSubstring(`"count":5`))
+
+				Expect(store.SaveUser(user)).To(BeNil())
+				Expect(cluster.has("PUT /" + userIndex() + "/_doc/u1")).To(BeTrue())
+
+				Expect(store.SaveJournalEntries([]JournalEntry{{ID: "j1"}})).To(BeNil())
+				Expect(cluster.bodyOf("POST /_bulk")).NotTo(ContainSubstring(`"_type"`))
+			})
+		})
+
+		Context("Against a 6.x cluster", func() {
+			It("should use typed requests", func() {
+				cluster = &fakeCluster{version: "6.8.23", total: "1"}
+				server = httptest.NewServer(cluster)
+
+				store, err := newElasticStore(server.URL)
+				Expect(err).To(BeNil())
+				Expect(cluster.bodyOf("PUT /" + userIndex() + "_v")).To(ContainSubstring(`"user"`))
+
+				user, err := store.GetUserByEmail("test@test.com", true)
+				Expect(err).To(BeNil())
+				Expect(user.ID).To(Equal("u1"))
+
+				token := "token"
+				Expect(store.SetResetToken("u1", &token, nil)).To(BeNil())
+				Expect(cluster.has("POST /" + userIndex() + "/user/u1/_update")).To(BeTrue())
+
+				Expect(store.ConsumeResetToken("u1", token)).To(BeNil())
+				Expect(cluster.bodies[len(cluster.bodies)-1]).To(ContainSubstring(`'none'`))
+
+				_, err = store.AddLoginFailure("ip:10.0.0.1", time.Now(), time.Now())
+				Expect(err).To(BeNil())
+				Expect(cluster.has("POST /" + loginIndex() + "/login/ip:10.0.0.1/_update")).To(BeTrue())
+
+				Expect(store.SaveUser(user)).To(BeNil())
+				Expect(cluster.has("PUT /" + userIndex() + "/user/u1")).To(BeTrue())
+
+				Expect(store.SaveJournalEntries([]JournalEntry{{ID: "j1"}})).To(BeNil())
+				Expect(cluster.bodyOf("POST /_bulk")).To(ContainSubstring(`"_type":"journal"`))
+			})
+		})
+	})
+})
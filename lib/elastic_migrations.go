@@ -0,0 +1,366 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// Each logical index (mds_user, mds_journal, ...) is an alias over a
+// versioned physical index such as mds_user_v1_20221010120000. The schema
+// version is stored in the mapping's _meta. When a schema version is bumped,
+// migrate creates a new physical index, reindexes the old one into it and
+// swaps the alias in a single atomic request.
+
+const (
+	// UserSchemaVersion must be bumped whenever IndexUserJSON changes
+	UserSchemaVersion = 10
+	// JournalSchemaVersion must be bumped whenever IndexJournalJSON changes
+	JournalSchemaVersion = 4
+	// LoginSchemaVersion must be bumped whenever IndexLoginJSON changes
+	LoginSchemaVersion = 1
+	// TokenSchemaVersion must be bumped whenever IndexTokenJSON changes
+	TokenSchemaVersion = 1
+	// SessionSchemaVersion must be bumped whenever IndexSessionJSON changes
+	SessionSchemaVersion = 1
+	// TombstoneSchemaVersion must be bumped whenever IndexTombstoneJSON changes
+	TombstoneSchemaVersion = 1
+	// AuditSchemaVersion must be bumped whenever IndexAuditJSON changes
+	AuditSchemaVersion = 2
+	// RevisionSchemaVersion must be bumped whenever IndexRevisionJSON changes
+	RevisionSchemaVersion = 1
+)
+
+type esSchema struct {
+	alias   string
+	typ     string
+	version int
+	body    string
+	script  string // painless run on each document when reindexing into this schema
+}
+
+// journalItemsScript turns items stored as strings into the objects of
+// journal schema 3, with the IDs and created date JournalItems reads them with
+const journalItemsScript = `
+if (ctx._source.entries != null) {
+	def items = [];
+	for (int i = 0; i < ctx._source.entries.size(); i++) {
+		def item = ctx._source.entries[i];
+		if (item instanceof String) {
+			item = ['id': String.valueOf(i + 1), 'text': item, 'done': false, 'create_date': ctx._source.create_date, 'position': i];
+		}
+		items.add(item);
+	}
+	ctx._source.entries = items;
+}`
+
+func esSchemas() []esSchema {
+	return []esSchema{
+		{alias: userIndex(), typ: userType, version: UserSchemaVersion, body: IndexUserJSON},
+		{alias: journalIndex(), typ: journalType, version: JournalSchemaVersion, body: IndexJournalJSON, script: journalItemsScript},
+		{alias: loginIndex(), typ: loginType, version: LoginSchemaVersion, body: IndexLoginJSON},
+		{alias: tokenIndex(), typ: tokenType, version: TokenSchemaVersion, body: IndexTokenJSON},
+		{alias: sessionIndex(), typ: sessionType, version: SessionSchemaVersion, body: IndexSessionJSON},
+		{alias: tombstoneIndex(), typ: tombstoneType, version: TombstoneSchemaVersion, body: IndexTombstoneJSON},
+		{alias: auditIndex(), typ: auditType, version: AuditSchemaVersion, body: IndexAuditJSON},
+		{alias: revisionIndex(), typ: revisionType, version: RevisionSchemaVersion, body: IndexRevisionJSON},
+	}
+}
+
+// IndexStatus describes where an alias points and which schema it holds
+type IndexStatus struct {
+	Alias   string `json:"alias"`
+	Index   string `json:"index"`
+	Version int    `json:"version"`
+	Latest  int    `json:"latest"`
+}
+
+var SchemaDowngrade = errors.New("Index schema is newer than this server")
+
+func (s *elasticStore) request(method string, path string, params url.Values, body interface{}) (*elastic.Response, error) {
+	return s.es.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method:       method,
+		Path:         path,
+		Params:       params,
+		Body:         body,
+		IgnoreErrors: []int{404},
+	})
+}
+
+// aliasTarget returns the physical index behind an alias, or "" when the alias doesn't exist
+func (s *elasticStore) aliasTarget(alias string) (string, error) {
+	resp, err := s.request("GET", "/_alias/"+alias, nil, nil)
+	if err != nil || resp.StatusCode == 404 {
+		return "", err
+	}
+
+	var indices map[string]interface{}
+	err = json.Unmarshal(resp.Body, &indices)
+	if err != nil {
+		return "", err
+	}
+
+	if len(indices) != 1 {
+		return "", fmt.Errorf("alias %s points to %d indices", alias, len(indices))
+	}
+
+	for index := range indices {
+		return index, nil
+	}
+
+	return "", nil
+}
+
+// schemaVersion reads the version from an index's mapping _meta, 0 when it has none
+func (s *elasticStore) schemaVersion(index string, typ string) (int, error) {
+	resp, err := s.request("GET", "/"+index+"/_mapping", nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	type meta struct {
+		Meta struct {
+			SchemaVersion int `json:"schema_version"`
+		} `json:"_meta"`
+	}
+
+	var mappings map[string]struct {
+		Mappings json.RawMessage `json:"mappings"`
+	}
+
+	err = json.Unmarshal(resp.Body, &mappings)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, mapping := range mappings {
+		if !s.dialect.Typeless {
+			var typed map[string]meta
+			err = json.Unmarshal(mapping.Mappings, &typed)
+			return typed[typ].Meta.SchemaVersion, err
+		}
+
+		var typeless meta
+		err = json.Unmarshal(mapping.Mappings, &typeless)
+		return typeless.Meta.SchemaVersion, err
+	}
+
+	return 0, nil
+}
+
+// versionedBody adds the schema version to the mapping _meta of an index body
+func versionedBody(body string, version int) (string, error) {
+	var index map[string]interface{}
+	err := json.Unmarshal([]byte(body), &index)
+	if err != nil {
+		return "", err
+	}
+
+	mappings, _ := index["mappings"].(map[string]interface{})
+	if mappings == nil {
+		mappings = map[string]interface{}{}
+		index["mappings"] = mappings
+	}
+
+	mappings["_meta"] = map[string]interface{}{"schema_version": version}
+
+	versioned, err := json.Marshal(index)
+	return string(versioned), err
+}
+
+func (s *elasticStore) createVersionedIndex(schema esSchema) (string, error) {
+	index := fmt.Sprintf("%s_v%d_%s", schema.alias, schema.version, time.Now().UTC().Format("20060102150405"))
+
+	body, err := versionedBody(schema.body, schema.version)
+	if err == nil {
+		body, err = s.dialect.indexBody(body, schema.typ)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	log.Println("Creating index " + index)
+	_, err = s.es.CreateIndex(index).BodyString(body).Do(context.Background())
+	return index, err
+}
+
+func (s *elasticStore) reindex(from string, to string, script string) error {
+	log.Println("Reindexing " + from + " into " + to)
+	body := map[string]interface{}{
+		"source": map[string]interface{}{"index": from},
+		"dest":   map[string]interface{}{"index": to},
+	}
+
+	if script != "" {
+		body["script"] = map[string]interface{}{"lang": "painless", "source": script}
+	}
+
+	resp, err := s.request("POST", "/_reindex", url.Values{"refresh": []string{"true"}, "wait_for_completion": []string{"true"}}, body)
+
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Failures []interface{} `json:"failures"`
+	}
+
+	err = json.Unmarshal(resp.Body, &result)
+	if err == nil && len(result.Failures) > 0 {
+		err = fmt.Errorf("reindex from %s to %s had %d failures", from, to, len(result.Failures))
+	}
+
+	return err
+}
+
+// blockWrites makes an index read-only, or writable again. The old index is
+// read-only while it is copied, so a write can't land in it after the copy
+// and be lost with it; such writes fail instead until the alias has moved.
+func (s *elasticStore) blockWrites(index string, blocked bool) error {
+	_, err := s.request("PUT", "/"+index+"/_settings", nil, map[string]interface{}{"index.blocks.write": blocked})
+	return err
+}
+
+// abandonMigration deletes the index a failed migration was building and
+// lets the old index take writes again
+func (s *elasticStore) abandonMigration(old string, index string) {
+	if _, err := s.es.DeleteIndex(index).Do(context.Background()); err != nil {
+		log.Println("Error deleting " + index + ": " + err.Error())
+	}
+
+	if old != "" {
+		if err := s.blockWrites(old, false); err != nil {
+			log.Println("Error allowing writes to " + old + " again: " + err.Error())
+		}
+	}
+}
+
+// pointAlias moves the alias from the old index, or replaces a legacy index
+// named like the alias, in one atomic request
+func (s *elasticStore) pointAlias(alias string, old string, index string, legacy bool) error {
+	actions := []map[string]interface{}{
+		{"add": map[string]interface{}{"index": index, "alias": alias}},
+	}
+
+	if legacy {
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": old}})
+	} else if old != "" {
+		actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": old, "alias": alias}})
+	}
+
+	_, err := s.es.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/_aliases",
+		Body:   map[string]interface{}{"actions": actions},
+	})
+
+	return err
+}
+
+func (s *elasticStore) status(schema esSchema) (IndexStatus, bool, error) {
+	status := IndexStatus{Alias: schema.alias, Latest: schema.version}
+
+	index, err := s.aliasTarget(schema.alias)
+	if err != nil {
+		return status, false, err
+	}
+
+	legacy := false
+	if index == "" {
+		exists, err := s.es.IndexExists(schema.alias).Do(context.Background())
+		if err != nil || !exists {
+			return status, false, err
+		}
+
+		// Indices created before migrations carry the alias name and no version
+		index = schema.alias
+		legacy = true
+	}
+
+	status.Index = index
+	status.Version, err = s.schemaVersion(index, schema.typ)
+	return status, legacy, err
+}
+
+// migrate brings one alias up to its schema version, rebuilding the
+// physical index even when current if force is set
+func (s *elasticStore) migrate(schema esSchema, force bool) (IndexStatus, error) {
+	status, legacy, err := s.status(schema)
+	if err != nil {
+		return status, err
+	}
+
+	if status.Version > schema.version {
+		return status, SchemaDowngrade
+	}
+
+	if status.Index != "" && status.Version == schema.version && !force {
+		return status, nil
+	}
+
+	index, err := s.createVersionedIndex(schema)
+	if err != nil {
+		return status, err
+	}
+
+	if status.Index != "" {
+		err = s.blockWrites(status.Index, true)
+		if err == nil {
+			err = s.reindex(status.Index, index, schema.script)
+		}
+	}
+
+	if err == nil {
+		err = s.pointAlias(schema.alias, status.Index, index, legacy)
+	}
+
+	if err != nil {
+		s.abandonMigration(status.Index, index)
+		return status, err
+	}
+
+	log.Printf("Alias %s now points to %s (schema v%d)\n", schema.alias, index, schema.version)
+	return IndexStatus{Alias: schema.alias, Index: index, Version: schema.version, Latest: schema.version}, nil
+}
+
+func (s *elasticStore) indexStatus() ([]IndexStatus, error) {
+	var retval []IndexStatus
+	for _, schema := range esSchemas() {
+		status, _, err := s.status(schema)
+		if err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, status)
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) migrateIndexes(force bool) ([]IndexStatus, error) {
+	var retval []IndexStatus
+	for _, schema := range esSchemas() {
+		status, err := s.migrate(schema, force)
+		if err != nil {
+			log.Println("Error migrating " + schema.alias + " index: " + err.Error())
+			return nil, err
+		}
+
+		retval = append(retval, status)
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) createIndexes() error {
+	log.Println("Preparing Indexes")
+	_, err := s.migrateIndexes(false)
+	return err
+}
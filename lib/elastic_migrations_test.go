@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Elasticsearch migrations", func() {
+	var cluster *fakeCluster
+	var server *httptest.Server
+	var store *elasticStore
+
+	connect := func(version string) {
+		cluster = &fakeCluster{version: version, total: "0", responses: map[string]string{}}
+		server = httptest.NewServer(cluster)
+
+		var err error
+		store, err = newElasticStore(server.URL)
+		Expect(err).To(BeNil())
+
+		cluster.requests = nil
+		cluster.bodies = nil
+	}
+
+	userSchema := func() esSchema {
+		return esSchemas()[0]
+	}
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("On an empty cluster", func() {
+		It("should create versioned indices behind the aliases", func() {
+			cluster = &fakeCluster{version: "7.17.3", total: "0"}
+			server = httptest.NewServer(cluster)
+
+			_, err := newElasticStore(server.URL)
+			Expect(err).To(BeNil())
+
+			Expect(cluster.bodyOf("PUT /" + userIndex() + "_v" + strconv.Itoa(UserSchemaVersion) + "_")).To(ContainSubstring(`"_meta":{"schema_version":` + strconv.Itoa(UserSchemaVersion) + `}`))
+			Expect(cluster.bodyOf("PUT /" + journalIndex() + "_v" + strconv.Itoa(JournalSchemaVersion) + "_")).To(ContainSubstring(`"_meta":{"schema_version":` + strconv.Itoa(JournalSchemaVersion) + `}`))
+			Expect(cluster.has("POST /_reindex")).To(BeFalse())
+			Expect(cluster.bodyOf("POST /_aliases")).To(ContainSubstring(`"alias":"` + userIndex() + `"`))
+		})
+	})
+
+	Context("With an alias at the current version", func() {
+		It("should leave the index alone", func() {
+			connect("7.17.3")
+			cluster.responses["GET /_alias/"+userIndex()] = `{"mds_user_v1_1":{"aliases":{}}}`
+			cluster.responses["GET /mds_user_v1_1/_mapping"] = `{"mds_user_v1_1":{"mappings":{"_meta":{"schema_version":` + strconv.Itoa(UserSchemaVersion) + `}}}}`
+
+			status, err := store.migrate(userSchema(), false)
+			Expect(err).To(BeNil())
+			Expect(status.Index).To(Equal("mds_user_v1_1"))
+			Expect(status.Version).To(Equal(UserSchemaVersion))
+			Expect(cluster.bodyOf("PUT /")).To(BeEmpty())
+		})
+
+		It("should read the version under the type on 6.x", func() {
+			connect("6.8.23")
+			cluster.responses["GET /_alias/"+userIndex()] = `{"mds_user_v1_1":{"aliases":{}}}`
+			cluster.responses["GET /mds_user_v1_1/_mapping"] = `{"mds_user_v1_1":{"mappings":{"user":{"_meta":{"schema_version":` + strconv.Itoa(UserSchemaVersion) + `}}}}}`
+
+			status, err := store.migrate(userSchema(), false)
+			Expect(err).To(BeNil())
+			Expect(status.Version).To(Equal(UserSchemaVersion))
+			Expect(cluster.bodyOf("PUT /")).To(BeEmpty())
+		})
+
+		It("should rebuild when forced", func() {
+			connect("7.17.3")
+			cluster.responses["GET /_alias/"+userIndex()] = `{"mds_user_v1_1":{"aliases":{}}}`
+			cluster.responses["GET /mds_user_v1_1/_mapping"] = `{"mds_user_v1_1":{"mappings":{"_meta":{"schema_version":` + strconv.Itoa(UserSchemaVersion) + `}}}}`
+
+			status, err := store.migrate(userSchema(), true)
+			Expect(err).To(BeNil())
+			Expect(status.Index).NotTo(Equal("mds_user_v1_1"))
+			Expect(cluster.bodyOf("POST /_reindex")).To(ContainSubstring(`"index":"mds_user_v1_1"`))
+		})
+	})
+
+	Context("With an alias at an older version", func() {
+		It("should reindex and swap the alias atomically", func() {
+			connect("7.17.3")
+			cluster.responses["GET /_alias/"+userIndex()] = `{"mds_user_v0":{"aliases":{}}}`
+			cluster.responses["GET /mds_user_v0/_mapping"] = `{"mds_user_v0":{"mappings":{}}}`
+
+			status, err := store.migrate(userSchema(), false)
+			Expect(err).To(BeNil())
+			Expect(status.Version).To(Equal(UserSchemaVersion))
+
+			Expect(cluster.bodyOf("POST /_reindex")).To(ContainSubstring(`"source":{"index":"mds_user_v0"}`))
+			Expect(cluster.bodyOf("POST /_reindex")).To(ContainSubstring(`"dest":{"index":"` + status.Index + `"}`))
+
+			aliases := cluster.bodyOf("POST /_aliases")
+			Expect(aliases).To(ContainSubstring(`"add":{"alias":"` + userIndex() + `","index":"` + status.Index + `"}`))
+			Expect(aliases).To(ContainSubstring(`"remove":{"alias":"` + userIndex() + `","index":"mds_user_v0"}`))
+		})
+
+		It("should block writes to the old index while copying it", func() {
+			connect("7.17.3")
+			cluster.responses["GET /_alias/"+userIndex()] = `{"mds_user_v0":{"aliases":{}}}`
+			cluster.responses["GET /mds_user_v0/_mapping"] = `{"mds_user_v0":{"mappings":{}}}`
+
+			_, err := store.migrate(userSchema(), false)
+			Expect(err).To(BeNil())
+			Expect(cluster.bodyOf("PUT /mds_user_v0/_settings")).To(Equal(`{"index.blocks.write":true}`))
+
+			blocked, reindexed := -1, -1
+			for i, request := range cluster.requests {
+				if request == "PUT /mds_user_v0/_settings" {
+					blocked = i
+				} else if request == "POST /_reindex" {
+					reindexed = i
+				}
+			}
+
+			Expect(blocked).To(BeNumerically(">=", 0))
+			Expect(blocked).To(BeNumerically("<", reindexed))
+		})
+
+		It("should convert journal items while reindexing", func() {
+			connect("7.17.3")
+			cluster.responses["GET /_alias/"+journalIndex()] = `{"mds_journal_v2_1":{"aliases":{}}}`
+			cluster.responses["GET /mds_journal_v2_1/_mapping"] = `{"mds_journal_v2_1":{"mappings":{"_meta":{"schema_version":2}}}}`
+
+			_, err := store.migrate(esSchemas()[1], false)
+			Expect(err).To(BeNil())
+			Expect(cluster.bodyOf("POST /_reindex")).To(ContainSubstring(`"script":{"lang":"painless"`))
+			Expect(cluster.bodyOf("POST /_reindex")).To(ContainSubstring(`item instanceof String`))
+		})
+
+		It("should fail when reindexing fails", func() {
+			connect("7.17.3")
+			cluster.responses["GET /_alias/"+userIndex()] = `{"mds_user_v0":{"aliases":{}}}`
+			cluster.responses["GET /mds_user_v0/_mapping"] = `{"mds_user_v0":{"mappings":{}}}`
+			cluster.responses["POST /_reindex"] = `{"failures":[{"id":"u1"}]}`
+
+			_, err := store.migrate(userSchema(), false)
+			Expect(err).NotTo(BeNil())
+			Expect(cluster.has("POST /_aliases")).To(BeFalse())
+
+			var created string
+			for _, request := range cluster.requests {
+				if strings.HasPrefix(request, "PUT /"+userIndex()+"_v") {
+					created = strings.TrimPrefix(request, "PUT ")
+				}
+			}
+
+			Expect(cluster.has("DELETE " + created)).To(BeTrue())
+			Expect(cluster.bodies[len(cluster.bodies)-1]).To(Equal(`{"index.blocks.write":false}`))
+		})
+	})
+
+	Context("With an index created before migrations", func() {
+		It("should replace the index with an alias", func() {
+			connect("7.17.3")
+			cluster.responses["HEAD /"+userIndex()] = ``
+			cluster.responses["GET /"+userIndex()+"/_mapping"] = `{"mds_user":{"mappings":{}}}`
+
+			status, err := store.migrate(userSchema(), false)
+			Expect(err).To(BeNil())
+
+			Expect(cluster.bodyOf("POST /_reindex")).To(ContainSubstring(`"source":{"index":"` + userIndex() + `"}`))
+
+			aliases := cluster.bodyOf("POST /_aliases")
+			Expect(aliases).To(ContainSubstring(`"add":{"alias":"` + userIndex() + `","index":"` + status.Index + `"}`))
+			Expect(aliases).To(ContainSubstring(`"remove_index":{"index":"` + userIndex() + `"}`))
+		})
+	})
+
+	Context("With an alias at a newer version", func() {
+		It("should refuse to downgrade", func() {
+			connect("7.17.3")
+			newer := strconv.Itoa(UserSchemaVersion + 1)
+			cluster.responses["GET /_alias/"+userIndex()] = `{"mds_user_v` + newer + `":{"aliases":{}}}`
+			cluster.responses["GET /mds_user_v"+newer+"/_mapping"] = `{"mds_user_v` + newer + `":{"mappings":{"_meta":{"schema_version":` + newer + `}}}}`
+
+			_, err := store.migrate(userSchema(), false)
+			Expect(err).To(Equal(SchemaDowngrade))
+		})
+	})
+})
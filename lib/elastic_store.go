@@ -0,0 +1,1276 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// esIndex the main ES index, default to mds
+var esIndex = "mds"
+
+const (
+	// userType ES index for user data
+	userType = "user"
+	// journalType ES index for journal entries
+	journalType = "journal"
+	// loginType ES index for failed login counters
+	loginType = "login"
+	// tokenType ES index for personal access tokens
+	tokenType = "token"
+	// sessionType ES index for sign-in sessions
+	sessionType = "session"
+	// tombstoneType ES index for records of deleted accounts
+	tombstoneType = "tombstone"
+	// auditType ES index for the security audit log
+	auditType = "audit"
+	// revisionType ES index for earlier versions of journal entries
+	revisionType = "revision"
+)
+
+func userIndex() string {
+	return esIndex + "_" + userType
+}
+
+func journalIndex() string {
+	return esIndex + "_" + journalType
+}
+
+func loginIndex() string {
+	return esIndex + "_" + loginType
+}
+
+func tokenIndex() string {
+	return esIndex + "_" + tokenType
+}
+
+func sessionIndex() string {
+	return esIndex + "_" + sessionType
+}
+
+func tombstoneIndex() string {
+	return esIndex + "_" + tombstoneType
+}
+
+func auditIndex() string {
+	return esIndex + "_" + auditType
+}
+
+func revisionIndex() string {
+	return esIndex + "_" + revisionType
+}
+
+type IdDocument interface {
+	GetID() string
+	SetID(id string)
+}
+
+type IndexSettings struct {
+	Mapper   map[string]interface{} `json:"mapper"`
+	Mappings map[string]interface{} `json:"mappings"`
+}
+
+type elasticStore struct {
+	es      *elastic.Client
+	dialect esDialect
+}
+
+func newElasticStore(elasticUrl string) (*elasticStore, error) {
+	conn, err := elastic.NewClient(
+		elastic.SetURL(elasticUrl),
+		elastic.SetSniff(false),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := conn.ElasticsearchVersion(elasticUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Connected to Elasticsearch " + version)
+	s := &elasticStore{es: conn, dialect: newEsDialect(version)}
+	err = s.createIndexes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Document requests go through these helpers so the paths match the dialect
+
+func (s *elasticStore) indexDoc(index string, typ string, id string, doc interface{}) error {
+	ctx := context.Background()
+	_, err := s.es.Index().Index(index).Type(s.dialect.docType(typ)).Id(id).BodyJson(doc).Refresh("true").Do(ctx)
+	return err
+}
+
+func (s *elasticStore) getDoc(index string, typ string, id string, output interface{}) error {
+	ctx := context.Background()
+	result, err := s.es.Get().Index(index).Type(s.dialect.docType(typ)).Id(id).Do(ctx)
+
+	if elastic.IsNotFound(err) || (err == nil && !result.Found) {
+		return RecordNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(*result.Source, output)
+}
+
+func (s *elasticStore) updateDoc(index string, typ string, id string, doc interface{}) error {
+	ctx := context.Background()
+	_, err := s.es.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   s.dialect.updatePath(index, typ, id),
+		Params: url.Values{"refresh": []string{"true"}},
+		Body:   map[string]interface{}{"doc": doc},
+	})
+
+	if elastic.IsNotFound(err) {
+		return RecordNotFound
+	}
+
+	return err
+}
+
+func (s *elasticStore) deleteDoc(index string, typ string, id string) error {
+	ctx := context.Background()
+	_, err := s.es.Delete().Index(index).Type(s.dialect.docType(typ)).Id(id).Refresh("true").Do(ctx)
+
+	if elastic.IsNotFound(err) {
+		return RecordNotFound
+	}
+
+	return err
+}
+
+// search runs a query without a type in the path, so it works on every dialect
+func (s *elasticStore) search(index string, source *elastic.SearchSource) (*esSearchResult, error) {
+	ctx := context.Background()
+	body, err := source.Source()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.es.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + index + "/_search",
+		Body:   body,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(esSearchResult)
+	err = json.Unmarshal(resp.Body, result)
+	return result, err
+}
+
+func getSingleResult(result *esSearchResult, output interface{}) (string, error) {
+	if len(result.Hits.Hits) > 0 {
+		err := json.Unmarshal(*result.Hits.Hits[0].Source, output)
+		return result.Hits.Hits[0].Id, err
+	}
+
+	return "", RecordNotFound
+}
+
+func initID(doc IdDocument, id string, err error) {
+	if err == nil {
+		doc.SetID(id)
+	}
+}
+
+func getUserFromResult(result *esSearchResult) (User, error) {
+	var user User
+	id, err := getSingleResult(result, &user)
+	initID(&user, id, err)
+	return user, err
+}
+
+func getVerificationFromResult(result *esSearchResult) (UserVerification, error) {
+	var verification UserVerification
+	id, err := getSingleResult(result, &verification)
+	initID(&verification, id, err)
+	return verification, err
+}
+
+func getResetFromResult(result *esSearchResult) (PasswordReset, error) {
+	var reset PasswordReset
+	id, err := getSingleResult(result, &reset)
+	initID(&reset, id, err)
+	return reset, err
+}
+
+func getEntryFromResult(result *esSearchResult) (JournalEntry, error) {
+	var entry JournalEntry
+	id, err := getSingleResult(result, &entry)
+	initID(&entry, id, err)
+	return entry, err
+}
+
+func getEntryFromHit(hit *elastic.SearchHit) (JournalEntry, error) {
+	var entry JournalEntry
+	err := json.Unmarshal(*hit.Source, &entry)
+	initID(&entry, hit.Id, err)
+	return entry, err
+}
+
+// highlightedItems returns the items a highlight matched, with the text
+// highlighted. The whole text of each matching item is highlighted so it can
+// be found again without the tags.
+func highlightedItems(items JournalItems, highlights []string) JournalItems {
+	strip := strings.NewReplacer("<strong>", "", "</strong>", "")
+	used := make([]bool, len(items))
+	var retval JournalItems
+
+	for _, highlighted := range highlights {
+		text := strip.Replace(highlighted)
+		for index, item := range items {
+			if !used[index] && item.Text == text {
+				used[index] = true
+				item.Text = highlighted
+				retval = append(retval, item)
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(retval, func(i, j int) bool { return retval[i].Position < retval[j].Position })
+	return retval
+}
+
+// dateRangeFilter adds the start and end of a journal query to the bool query
+func dateRangeFilter(query *elastic.BoolQuery, jq JournalQuery) *elastic.BoolQuery {
+	start := dayOf(jq.Start)
+	end := dayOf(jq.End)
+
+	if !jq.Start.IsZero() && !jq.End.IsZero() {
+		query = query.Filter(elastic.NewRangeQuery("date").Gte(start).Lte(end))
+	} else if !jq.Start.IsZero() {
+		query = query.Filter(elastic.NewRangeQuery("date").Gte(start))
+	} else if !jq.End.IsZero() {
+		query = query.Filter(elastic.NewRangeQuery("date").Lte(end))
+	}
+
+	return query
+}
+
+// tagFilter requires every tag of the query
+func tagFilter(query *elastic.BoolQuery, jq JournalQuery) *elastic.BoolQuery {
+	for _, tag := range jq.Tags {
+		query = query.Filter(elastic.NewTermQuery("tags", tag))
+	}
+
+	return query
+}
+
+//User Functions
+
+func (s *elasticStore) GetUserById(id string) (User, error) {
+	var user User
+	err := s.getDoc(userIndex(), userType, id, &user)
+	initID(&user, id, err)
+	return user, err
+}
+
+func (s *elasticStore) GetUserByEmail(email string, verified bool) (User, error) {
+	query := elastic.NewBoolQuery().
+		Must(elastic.NewTermQuery("email", strings.ToLower(email)))
+
+	if verified {
+		query = query.MustNot(elastic.NewExistsQuery("verify_token"))
+	}
+
+	result, err := s.search(userIndex(), elastic.NewSearchSource().Query(query))
+
+	if err != nil {
+		return User{}, err
+	}
+
+	return getUserFromResult(result)
+}
+
+func (s *elasticStore) GetUserByExternalID(externalId string) (User, error) {
+	query := elastic.NewTermQuery("external_id", externalId)
+	result, err := s.search(userIndex(), elastic.NewSearchSource().Query(query))
+
+	if err != nil {
+		return User{}, err
+	}
+
+	return getUserFromResult(result)
+}
+
+func (s *elasticStore) SaveUser(user User) error {
+	return s.indexDoc(userIndex(), userType, user.ID, user)
+}
+
+func (s *elasticStore) DeleteUser(id string) error {
+	return s.deleteDoc(userIndex(), userType, id)
+}
+
+func (s *elasticStore) GetUsersToDelete(date time.Time) ([]User, error) {
+	query := elastic.NewRangeQuery("delete_after").Lte(date)
+	result, err := s.search(userIndex(), elastic.NewSearchSource().Query(query).Size(purgeBatchSize))
+
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]User, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		var user User
+		err := json.Unmarshal(*hit.Source, &user)
+		initID(&user, hit.Id, err)
+		if err == nil {
+			retval = append(retval, user)
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) GetUsersToCarryOver(date time.Time) ([]User, error) {
+	query := elastic.NewRangeQuery("carry_over_after").Lte(date)
+	result, err := s.search(userIndex(), elastic.NewSearchSource().Query(query).Size(purgeBatchSize))
+
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]User, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		var user User
+		err := json.Unmarshal(*hit.Source, &user)
+		initID(&user, hit.Id, err)
+		if err == nil {
+			retval = append(retval, user)
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) SetCarryOverAfter(userId string, after *time.Time) error {
+	return s.updateDoc(userIndex(), userType, userId, map[string]interface{}{"carry_over_after": after})
+}
+
+func (s *elasticStore) SetSuspendedAt(userId string, at *time.Time) error {
+	return s.updateDoc(userIndex(), userType, userId, map[string]interface{}{"suspended_at": at})
+}
+
+func (s *elasticStore) SetPasswordHash(userId string, hash string) error {
+	return s.updateDoc(userIndex(), userType, userId, map[string]interface{}{"password_hash": hash})
+}
+
+func (s *elasticStore) SaveTombstone(tombstone Tombstone) error {
+	return s.indexDoc(tombstoneIndex(), tombstoneType, tombstone.ID, tombstone)
+}
+
+func (s *elasticStore) GetUserVerification(token string) (UserVerification, error) {
+	search := elastic.NewTermQuery("verify_token", token)
+	result, err := s.search(userIndex(), elastic.NewSearchSource().Query(search))
+
+	if err != nil {
+		return UserVerification{}, err
+	}
+
+	return getVerificationFromResult(result)
+}
+
+func (s *elasticStore) SaveUserVerification(verify UserVerification) error {
+	return s.indexDoc(userIndex(), userType, verify.ID, verify)
+}
+
+func (s *elasticStore) ConsumeVerifyToken(userId string, token string) error {
+	return s.consumeToken(userId, "verify_token", "verify_expires", token)
+}
+
+func (s *elasticStore) RenewVerifyToken(userId string, token string, expires time.Time) error {
+	return s.updateUserIf(userId,
+		"if (ctx._source.verify_token != null) { ctx._source.verify_token = params.token; ctx._source.verify_expires = params.expires } "+
+			"else { ctx.op = '"+s.dialect.noop()+"' }",
+		map[string]interface{}{"token": token, "expires": expires})
+}
+
+// consumeToken clears a token field in a script, so the check and the write
+// happen atomically on the document and only one caller sees "updated"
+func (s *elasticStore) consumeToken(userId string, field string, expires string, token string) error {
+	return s.updateUserIf(userId,
+		"if (ctx._source[params.field] == params.token) { ctx._source[params.field] = null; ctx._source[params.expires] = null } "+
+			"else { ctx.op = '"+s.dialect.noop()+"' }",
+		map[string]interface{}{"field": field, "expires": expires, "token": token})
+}
+
+func (s *elasticStore) AdvanceTOTPStep(userId string, step int64) error {
+	return s.updateUserIf(userId,
+		"if (ctx._source.totp_last_step == null || ctx._source.totp_last_step < params.step) { ctx._source.totp_last_step = params.step } "+
+			"else { ctx.op = '"+s.dialect.noop()+"' }",
+		map[string]interface{}{"step": step})
+}
+
+func (s *elasticStore) UseRecoveryCode(userId string, hash string) error {
+	return s.updateUserIf(userId,
+		"int index = ctx._source.recovery_codes == null ? -1 : ctx._source.recovery_codes.indexOf(params.hash); "+
+			"if (index >= 0) { ctx._source.recovery_codes.remove(index) } else { ctx.op = '"+s.dialect.noop()+"' }",
+		map[string]interface{}{"hash": hash})
+}
+
+// updateUserIf runs a script that checks and changes a user in one atomic
+// update, returning RecordNotFound when the script skips the write
+func (s *elasticStore) updateUserIf(userId string, script string, params map[string]interface{}) error {
+	ctx := context.Background()
+	resp, err := s.es.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   s.dialect.updatePath(userIndex(), userType, userId),
+		Params: url.Values{"refresh": []string{"true"}},
+		Body: map[string]interface{}{
+			"script": map[string]interface{}{
+				"lang":   "painless",
+				"source": script,
+				"params": params,
+			},
+		},
+	})
+
+	if elastic.IsNotFound(err) {
+		return RecordNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Result string `json:"result"`
+	}
+
+	err = json.Unmarshal(resp.Body, &result)
+	if err == nil && result.Result != "updated" {
+		err = RecordNotFound
+	}
+
+	return err
+}
+
+func (s *elasticStore) GetResetPassword(token string) (PasswordReset, error) {
+	search := elastic.NewTermQuery("reset_token", token)
+	result, err := s.search(userIndex(), elastic.NewSearchSource().Query(search))
+
+	if err != nil {
+		return PasswordReset{}, err
+	}
+
+	return getResetFromResult(result)
+}
+
+func (s *elasticStore) SetResetToken(userId string, token *string, expires *time.Time) error {
+	return s.updateDoc(userIndex(), userType, userId, map[string]interface{}{"reset_token": token, "reset_expires": expires})
+}
+
+func (s *elasticStore) ConsumeResetToken(userId string, token string) error {
+	return s.consumeToken(userId, "reset_token", "reset_expires", token)
+}
+
+func (s *elasticStore) GetEmailChange(token string) (EmailChange, error) {
+	search := elastic.NewTermQuery("email_token", token)
+	result, err := s.search(userIndex(), elastic.NewSearchSource().Query(search))
+
+	if err != nil {
+		return EmailChange{}, err
+	}
+
+	var change EmailChange
+	id, err := getSingleResult(result, &change)
+	initID(&change, id, err)
+	return change, err
+}
+
+func (s *elasticStore) GetPendingEmailChange(email string, now time.Time) (EmailChange, error) {
+	query := elastic.NewBoolQuery().
+		Must(elastic.NewTermQuery("pending_email", email)).
+		Must(elastic.NewExistsQuery("email_token")).
+		Must(elastic.NewRangeQuery("email_expires").Gt(now))
+	result, err := s.search(userIndex(), elastic.NewSearchSource().Query(query).Size(1))
+
+	if err != nil {
+		return EmailChange{}, err
+	}
+
+	var change EmailChange
+	id, err := getSingleResult(result, &change)
+	initID(&change, id, err)
+	return change, err
+}
+
+func (s *elasticStore) SetEmailChange(userId string, email *string, token *string, expires *time.Time) error {
+	return s.updateDoc(userIndex(), userType, userId, map[string]interface{}{"pending_email": email, "email_token": token, "email_expires": expires})
+}
+
+func (s *elasticStore) ConsumeEmailToken(userId string, token string) error {
+	return s.consumeToken(userId, "email_token", "email_expires", token)
+}
+
+//Journal Functions
+
+// inTrash matches deleted entries, which journal queries leave out
+func inTrash() elastic.Query {
+	return elastic.NewExistsQuery("deleted_at")
+}
+
+func (s *elasticStore) GetJournalEntry(id string) (JournalEntry, error) {
+	var entry JournalEntry
+	err := s.getDoc(journalIndex(), journalType, id, &entry)
+	initID(&entry, id, err)
+	return entry, err
+}
+
+func (s *elasticStore) GetJournalEntryByDate(userId string, date time.Time) (JournalEntry, error) {
+	query := elastic.NewBoolQuery().
+		Must(elastic.NewTermQuery("user_id", userId)).
+		Filter(elastic.NewTermQuery("date", dayOf(date))).
+		MustNot(inTrash())
+
+	result, err := s.search(journalIndex(), elastic.NewSearchSource().Query(query))
+
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	return getEntryFromResult(result)
+}
+
+func (s *elasticStore) SaveJournalEntry(entry JournalEntry) error {
+	return s.indexDoc(journalIndex(), journalType, entry.ID, entry)
+}
+
+func (s *elasticStore) SaveJournalEntries(entries []JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	bulk := s.es.Bulk().Refresh("true")
+	for _, entry := range entries {
+		request := elastic.NewBulkIndexRequest().Index(journalIndex()).Id(entry.ID).Doc(entry)
+		if !s.dialect.Typeless {
+			request = request.Type(journalType)
+		}
+
+		bulk = bulk.Add(request)
+	}
+
+	result, err := bulk.Do(context.Background())
+	if err == nil && result.Errors {
+		failed := result.Failed()
+		err = errors.New("bulk index failed for " + strconv.Itoa(len(failed)) + " entries")
+
+		if len(failed) > 0 && failed[0].Error != nil {
+			err = errors.New(err.Error() + ": " + failed[0].Error.Reason)
+		}
+	}
+
+	return err
+}
+
+func (s *elasticStore) DeleteJournalEntry(id string) error {
+	return s.deleteDoc(journalIndex(), journalType, id)
+}
+
+func (s *elasticStore) GetJournalEntries(userId string, start time.Time, end time.Time) ([]JournalEntry, error) {
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("user_id", userId),
+		elastic.NewRangeQuery("date").Gte(start).Lte(end),
+	).MustNot(inTrash())
+
+	days := int(end.Sub(start).Hours()/24) + 1
+	result, err := s.search(journalIndex(), elastic.NewSearchSource().Query(query).Sort("date", false).Size(days))
+
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]JournalEntry, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		entry, err := getEntryFromHit(hit)
+		if err == nil {
+			retval = append(retval, entry)
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) SearchJournal(userId string, jq JournalQuery) ([]JournalEntry, int64, error) {
+	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("user_id", userId)).MustNot(inTrash())
+	if jq.Query != "" {
+		query = query.Filter(elastic.NewQueryStringQuery(jq.Query).Field("entries.text").Field("date").Lenient(true))
+	}
+
+	query = tagFilter(dateRangeFilter(query, jq), jq)
+
+	highlight := elastic.NewHighlight().Fields(elastic.NewHighlighterField("entries.text").NumOfFragments(0)).
+		PreTags("<strong>").PostTags("</strong>")
+
+	search := elastic.NewSearchSource().Query(query).Highlight(highlight).Sort("date", false)
+
+	if jq.Limit > 0 {
+		search.Size(jq.Limit)
+	}
+
+	if jq.Offset > 0 {
+		search.From(jq.Offset)
+	}
+
+	result, err := s.search(journalIndex(), search)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	retval := make([]JournalEntry, len(result.Hits.Hits))
+
+	//TODO: Maybe only take the fields we need
+	for index, hit := range result.Hits.Hits {
+		entry, err := getEntryFromHit(hit)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if highlighted := highlightedItems(entry.Entries, hit.Highlight["entries.text"]); len(highlighted) > 0 {
+			entry.Entries = highlighted
+		}
+
+		retval[index] = entry
+	}
+
+	return retval, result.TotalHits(), nil
+}
+
+func (s *elasticStore) SearchJournalDates(userId string, jq JournalQuery) ([]time.Time, error) {
+	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("user_id", userId)).MustNot(inTrash())
+
+	if jq.Query != "" {
+		query = query.Must(elastic.NewMultiMatchQuery(jq.Query, "entries.text", "date").Lenient(true))
+	}
+
+	query = tagFilter(dateRangeFilter(query, jq), jq)
+
+	result, err := s.search(journalIndex(), elastic.NewSearchSource().Query(query).Size(185))
+
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]time.Time, len(result.Hits.Hits))
+
+	for index, hit := range result.Hits.Hits {
+		entry, err := getEntryFromHit(hit)
+		if err != nil {
+			return nil, err
+		}
+
+		retval[index] = entry.Date
+	}
+
+	return retval, nil
+}
+
+// EachJournalEntry pages with search_after on the date, which is unique per
+// user, so it isn't limited by max_result_window
+func (s *elasticStore) EachJournalEntry(userId string, fn func(JournalEntry) error) error {
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user_id", userId)).MustNot(inTrash())
+	var after []interface{}
+
+	for {
+		search := elastic.NewSearchSource().Query(query).Sort("date", true).Size(journalPageSize)
+		if after != nil {
+			search = search.SearchAfter(after...)
+		}
+
+		result, err := s.search(journalIndex(), search)
+		if err != nil {
+			return err
+		}
+
+		for _, hit := range result.Hits.Hits {
+			entry, err := getEntryFromHit(hit)
+			if err == nil {
+				err = fn(entry)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			after = hit.Sort
+		}
+
+		if len(result.Hits.Hits) < journalPageSize {
+			return nil
+		}
+	}
+}
+
+// maxTags is the most tags GetJournalTags counts, the terms aggregation
+// needs a size
+const maxTags = 1000
+
+func (s *elasticStore) GetJournalTags(userId string) ([]TagCount, error) {
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user_id", userId)).MustNot(inTrash())
+	search := elastic.NewSearchSource().Query(query).Size(0).
+		Aggregation("tags", elastic.NewTermsAggregation().Field("tags").Size(maxTags))
+
+	result, err := s.search(journalIndex(), search)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags struct {
+		Buckets []struct {
+			Key      string `json:"key"`
+			DocCount int64  `json:"doc_count"`
+		} `json:"buckets"`
+	}
+
+	if err := json.Unmarshal(result.Aggregations["tags"], &tags); err != nil {
+		return nil, err
+	}
+
+	retval := make([]TagCount, 0, len(tags.Buckets))
+	for _, bucket := range tags.Buckets {
+		retval = append(retval, TagCount{Tag: bucket.Key, Count: bucket.DocCount})
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) GetTrash(userId string, since time.Time) ([]JournalEntry, error) {
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("user_id", userId),
+		elastic.NewRangeQuery("deleted_at").Gt(since),
+	)
+
+	return s.searchEntries(elastic.NewSearchSource().Query(query).Sort("deleted_at", false).Size(maxTrash))
+}
+
+func (s *elasticStore) GetEntriesToPurge(date time.Time) ([]JournalEntry, error) {
+	query := elastic.NewRangeQuery("deleted_at").Lt(date)
+	return s.searchEntries(elastic.NewSearchSource().Query(query).Size(purgeBatchSize))
+}
+
+func (s *elasticStore) searchEntries(search *elastic.SearchSource) ([]JournalEntry, error) {
+	result, err := s.search(journalIndex(), search)
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]JournalEntry, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		entry, err := getEntryFromHit(hit)
+		if err == nil {
+			retval = append(retval, entry)
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) DeleteJournalEntries(userId string) error {
+	ctx := context.Background()
+	query, err := elastic.NewTermQuery("user_id", userId).Source()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.es.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + journalIndex() + "/_delete_by_query",
+		Params: url.Values{"refresh": []string{"true"}, "conflicts": []string{"proceed"}},
+		Body:   map[string]interface{}{"query": query},
+	})
+
+	return err
+}
+
+//Revision Functions
+
+func (s *elasticStore) SaveRevision(revision Revision) error {
+	return s.indexDoc(revisionIndex(), revisionType, revision.ID, revision)
+}
+
+func (s *elasticStore) GetRevision(id string) (Revision, error) {
+	var revision Revision
+	err := s.getDoc(revisionIndex(), revisionType, id, &revision)
+	initID(&revision, id, err)
+	return revision, err
+}
+
+func (s *elasticStore) GetRevisions(entryId string, limit int) ([]Revision, error) {
+	query := elastic.NewTermQuery("entry_id", entryId)
+	result, err := s.search(revisionIndex(), elastic.NewSearchSource().Query(query).Sort("date", false).Size(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]Revision, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		var revision Revision
+		err := json.Unmarshal(*hit.Source, &revision)
+		initID(&revision, hit.Id, err)
+		if err == nil {
+			retval = append(retval, revision)
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) PruneRevisions(entryId string, keep int) error {
+	query := elastic.NewTermQuery("entry_id", entryId)
+	result, err := s.search(revisionIndex(), elastic.NewSearchSource().Query(query).Sort("date", false).
+		From(keep).Size(purgeBatchSize).FetchSource(false))
+	if err != nil || len(result.Hits.Hits) == 0 {
+		return err
+	}
+
+	ids := make([]string, len(result.Hits.Hits))
+	for index, hit := range result.Hits.Hits {
+		ids[index] = hit.Id
+	}
+
+	return s.deleteRevisions(elastic.NewIdsQuery().Ids(ids...))
+}
+
+func (s *elasticStore) DeleteRevisions(userId string) error {
+	return s.deleteRevisions(elastic.NewTermQuery("user_id", userId))
+}
+
+func (s *elasticStore) deleteRevisions(query elastic.Query) error {
+	source, err := query.Source()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.es.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + revisionIndex() + "/_delete_by_query",
+		Params: url.Values{"refresh": []string{"true"}, "conflicts": []string{"proceed"}},
+		Body:   map[string]interface{}{"query": source},
+	})
+
+	return err
+}
+
+//Access Token Functions
+
+func getTokenFromHit(hit *elastic.SearchHit) (AccessToken, error) {
+	var token AccessToken
+	err := json.Unmarshal(*hit.Source, &token)
+	initID(&token, hit.Id, err)
+	return token, err
+}
+
+func (s *elasticStore) GetAccessToken(hash string) (AccessToken, error) {
+	search := elastic.NewTermQuery("token_hash", hash)
+	result, err := s.search(tokenIndex(), elastic.NewSearchSource().Query(search).Size(1))
+
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	if len(result.Hits.Hits) == 0 {
+		return AccessToken{}, RecordNotFound
+	}
+
+	return getTokenFromHit(result.Hits.Hits[0])
+}
+
+func (s *elasticStore) GetAccessTokens(userId string) ([]AccessToken, error) {
+	search := elastic.NewTermQuery("user_id", userId)
+	result, err := s.search(tokenIndex(), elastic.NewSearchSource().Query(search).Sort("create_date", false).Size(maxAccessTokens))
+
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]AccessToken, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		token, err := getTokenFromHit(hit)
+		if err == nil {
+			retval = append(retval, token)
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) SaveAccessToken(token AccessToken) error {
+	return s.indexDoc(tokenIndex(), tokenType, token.ID, token)
+}
+
+func (s *elasticStore) DeleteAccessToken(userId string, id string) error {
+	var token AccessToken
+	err := s.getDoc(tokenIndex(), tokenType, id, &token)
+
+	if err == nil && token.UserId != userId {
+		err = RecordNotFound
+	}
+
+	if err == nil {
+		err = s.deleteDoc(tokenIndex(), tokenType, id)
+	}
+
+	return err
+}
+
+func (s *elasticStore) TouchAccessToken(id string, used time.Time) error {
+	return s.updateDoc(tokenIndex(), tokenType, id, map[string]interface{}{"last_used": used})
+}
+
+//Session Functions
+
+func getSessionFromHit(hit *elastic.SearchHit) (Session, error) {
+	var session Session
+	err := json.Unmarshal(*hit.Source, &session)
+	initID(&session, hit.Id, err)
+	return session, err
+}
+
+func (s *elasticStore) GetSession(hash string) (Session, error) {
+	search := elastic.NewTermQuery("session_hash", hash)
+	result, err := s.search(sessionIndex(), elastic.NewSearchSource().Query(search).Size(1))
+
+	if err != nil {
+		return Session{}, err
+	}
+
+	if len(result.Hits.Hits) == 0 {
+		return Session{}, RecordNotFound
+	}
+
+	return getSessionFromHit(result.Hits.Hits[0])
+}
+
+func (s *elasticStore) GetSessions(userId string) ([]Session, error) {
+	search := elastic.NewTermQuery("user_id", userId)
+	result, err := s.search(sessionIndex(), elastic.NewSearchSource().Query(search).Sort("last_seen", false).Size(maxSessions))
+
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]Session, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		session, err := getSessionFromHit(hit)
+		if err == nil {
+			retval = append(retval, session)
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *elasticStore) SaveSession(session Session) error {
+	return s.indexDoc(sessionIndex(), sessionType, session.ID, session)
+}
+
+func (s *elasticStore) DeleteSession(userId string, id string) error {
+	var session Session
+	err := s.getDoc(sessionIndex(), sessionType, id, &session)
+
+	if err == nil && session.UserId != userId {
+		err = RecordNotFound
+	}
+
+	if err == nil {
+		err = s.deleteDoc(sessionIndex(), sessionType, id)
+	}
+
+	return err
+}
+
+func (s *elasticStore) DeleteSessions(userId string, except string) error {
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user_id", userId))
+	if except != "" {
+		query = query.MustNot(elastic.NewIdsQuery().Ids(except))
+	}
+
+	source, err := query.Source()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.es.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + sessionIndex() + "/_delete_by_query",
+		Params: url.Values{"refresh": []string{"true"}, "conflicts": []string{"proceed"}},
+		Body:   map[string]interface{}{"query": source},
+	})
+
+	return err
+}
+
+func (s *elasticStore) TouchSession(id string, seen time.Time, expires time.Time) error {
+	return s.updateDoc(sessionIndex(), sessionType, id, map[string]interface{}{"last_seen": seen, "expires": expires})
+}
+
+//Admin Functions
+
+func (s *elasticStore) SearchUsers(query UserQuery) ([]User, int64, error) {
+	search := elastic.NewBoolQuery()
+	if query.Email != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`).Replace(query.Email)
+		search = search.Filter(elastic.NewWildcardQuery("email", "*"+escaped+"*"))
+	}
+
+	if query.Role != "" {
+		search = search.Filter(elastic.NewTermQuery("role", query.Role))
+	}
+
+	switch query.Status {
+	case UserStatusVerified:
+		search = search.MustNot(elastic.NewExistsQuery("verify_token"))
+	case UserStatusPending:
+		search = search.Filter(elastic.NewExistsQuery("verify_token"))
+	case UserStatusSuspended:
+		search = search.Filter(elastic.NewExistsQuery("suspended_at"))
+	}
+
+	source := elastic.NewSearchSource().Query(search).Sort("create_date", false).From(query.Offset).Size(query.Limit).TrackTotalHits(true)
+	result, err := s.search(userIndex(), source)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	retval := make([]User, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		var user User
+		err := json.Unmarshal(*hit.Source, &user)
+		initID(&user, hit.Id, err)
+		if err == nil {
+			retval = append(retval, user)
+		}
+	}
+
+	return retval, result.TotalHits(), nil
+}
+
+// count returns how many documents in the index match the query
+func (s *elasticStore) count(index string, query elastic.Query) (int64, error) {
+	source, err := query.Source()
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.es.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + index + "/_count",
+		Body:   map[string]interface{}{"query": source},
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Count int64 `json:"count"`
+	}
+
+	err = json.Unmarshal(resp.Body, &result)
+	return result.Count, err
+}
+
+func (s *elasticStore) GetUserStats() (UserStats, error) {
+	var stats UserStats
+	counts := []struct {
+		index string
+		query elastic.Query
+		value *int64
+	}{
+		{userIndex(), elastic.NewMatchAllQuery(), &stats.Users},
+		{userIndex(), elastic.NewExistsQuery("verify_token"), &stats.Pending},
+		{userIndex(), elastic.NewExistsQuery("suspended_at"), &stats.Suspended},
+		{userIndex(), elastic.NewTermQuery("role", RoleAdmin), &stats.Admins},
+		{userIndex(), elastic.NewTermQuery("totp_enabled", true), &stats.TwoFactor},
+		{userIndex(), elastic.NewExistsQuery("delete_after"), &stats.PendingDeletion},
+		{journalIndex(), elastic.NewBoolQuery().MustNot(inTrash()), &stats.JournalEntries},
+	}
+
+	for _, count := range counts {
+		value, err := s.count(count.index, count.query)
+		if err != nil {
+			return UserStats{}, err
+		}
+
+		*count.value = value
+	}
+
+	stats.Verified = stats.Users - stats.Pending
+	return stats, nil
+}
+
+//Audit Functions
+
+func (s *elasticStore) SaveAuditEvent(event AuditEvent) error {
+	return s.indexDoc(auditIndex(), auditType, event.ID, event)
+}
+
+func (s *elasticStore) GetAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	search := elastic.NewBoolQuery()
+	terms := map[string]string{"user_id": query.UserId, "actor_id": query.ActorId, "email": query.Email, "action": query.Action, "result": query.Result, "ip": query.IP}
+	for field, value := range terms {
+		if value != "" {
+			search = search.Filter(elastic.NewTermQuery(field, value))
+		}
+	}
+
+	if !query.Since.IsZero() || !query.Until.IsZero() {
+		dates := elastic.NewRangeQuery("date")
+		if !query.Since.IsZero() {
+			dates = dates.Gte(query.Since)
+		}
+
+		if !query.Until.IsZero() {
+			dates = dates.Lte(query.Until)
+		}
+
+		search = search.Filter(dates)
+	}
+
+	result, err := s.search(auditIndex(), elastic.NewSearchSource().Query(search).Sort("date", false).Size(query.Limit))
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]AuditEvent, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		var event AuditEvent
+		err := json.Unmarshal(*hit.Source, &event)
+		initID(&event, hit.Id, err)
+		if err == nil {
+			retval = append(retval, event)
+		}
+	}
+
+	return retval, nil
+}
+
+//Login Attempt Functions
+
+// esLoginAttempts stores times as epoch milliseconds so scripts can compare them
+type esLoginAttempts struct {
+	Failures    int   `json:"failures"`
+	LastFailure int64 `json:"last_failure"`
+	LockedUntil int64 `json:"locked_until"`
+}
+
+func (a esLoginAttempts) attempts(key string) LoginAttempts {
+	attempts := LoginAttempts{Key: key, Failures: a.Failures}
+	if a.LastFailure > 0 {
+		attempts.LastFailure = time.UnixMilli(a.LastFailure)
+	}
+
+	if a.LockedUntil > 0 {
+		attempts.LockedUntil = time.UnixMilli(a.LockedUntil)
+	}
+
+	return attempts
+}
+
+func (s *elasticStore) GetLoginAttempts(key string) (LoginAttempts, error) {
+	var doc esLoginAttempts
+	err := s.getDoc(loginIndex(), loginType, key, &doc)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+
+	return doc.attempts(key), nil
+}
+
+// AddLoginFailure increments the counter in a scripted upsert, so concurrent
+// failures are all counted
+func (s *elasticStore) AddLoginFailure(key string, now time.Time, since time.Time) (LoginAttempts, error) {
+	ctx := context.Background()
+	resp, err := s.es.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   s.dialect.updatePath(loginIndex(), loginType, key),
+		Params: url.Values{"retry_on_conflict": []string{"5"}, "_source": []string{"true"}},
+		Body: map[string]interface{}{
+			"scripted_upsert": true,
+			"upsert":          map[string]interface{}{},
+			"script": map[string]interface{}{
+				"lang": "painless",
+				"source": "if (ctx._source.last_failure == null || ctx._source.last_failure < params.since) { ctx._source.failures = 1 } " +
+					"else { ctx._source.failures += 1 } ctx._source.last_failure = params.now",
+				"params": map[string]interface{}{"now": now.UnixMilli(), "since": since.UnixMilli()},
+			},
+		},
+	})
+
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+
+	var result struct {
+		Get struct {
+			Source esLoginAttempts `json:"_source"`
+		} `json:"get"`
+	}
+
+	err = json.Unmarshal(resp.Body, &result)
+	return result.Get.Source.attempts(key), err
+}
+
+func (s *elasticStore) LockLogin(key string, until time.Time) error {
+	return s.updateDoc(loginIndex(), loginType, key, map[string]interface{}{"locked_until": until.UnixMilli()})
+}
+
+// ForgiveLoginFailures lowers the counter in a script, so it doesn't lose
+// failures counted at the same time
+func (s *elasticStore) ForgiveLoginFailures(key string, count int) error {
+	ctx := context.Background()
+	_, err := s.es.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   s.dialect.updatePath(loginIndex(), loginType, key),
+		Params: url.Values{"retry_on_conflict": []string{"5"}},
+		Body: map[string]interface{}{
+			"script": map[string]interface{}{
+				"lang":   "painless",
+				"source": "ctx._source.failures = Math.max(0, ctx._source.failures - params.count)",
+				"params": map[string]interface{}{"count": count},
+			},
+		},
+	})
+
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *elasticStore) ClearLoginAttempts(key string) error {
+	err := s.deleteDoc(loginIndex(), loginType, key)
+	if err == RecordNotFound {
+		return nil
+	}
+
+	return err
+}
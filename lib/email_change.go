@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// Changing the email address takes the current password and a link sent to
+// the new address. The old address is told about the request, and the
+// account keeps it until the link is opened.
+
+// maxEmailLength is the longest address SMTP allows
+const maxEmailLength = 254
+
+// DefaultSiteURL is where links in emails point when ServiceOptions.SiteURL is empty
+const DefaultSiteURL = "https://mydailystuff.com"
+
+func (s MdsService) siteLink(path string) string {
+	if s.siteURL != "" {
+		return strings.TrimRight(s.siteURL, "/") + path
+	}
+
+	return DefaultSiteURL + path
+}
+
+// validEmail checks that an address typed in looks like one, so it can't
+// carry whitespace or control characters into the lookups and keys built on it
+func validEmail(email string) bool {
+	at := strings.Index(email, "@")
+	if at <= 0 || at == len(email)-1 || len(email) > maxEmailLength {
+		return false
+	}
+
+	for _, r := range email {
+		if r <= ' ' || r == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RequestEmailChange sends a confirmation link to email after checking the password
+func (s MdsService) RequestEmailChange(userId string, password string, email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !validEmail(email) {
+		return EmailInvalid
+	}
+
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	if s.comparePassword(&user, password) != nil {
+		return PasswordIncorrect
+	}
+
+	if email == strings.ToLower(user.Email) {
+		return EmailUnchanged
+	}
+
+	if err := s.emailAvailable(email, userId); err != nil {
+		return err
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(s.verifyTokenTTL())
+	if err := s.store.SetEmailChange(userId, &email, &hash, &expires); err != nil {
+		return err
+	}
+
+	err = s.sendEmail(email, "Confirm your new MyDailyStuff email address",
+		"Open this link to use this address for your MyDailyStuff account:\n\n"+
+			s.siteLink("/api/account/email/"+token)+"\n\n"+
+			"The link works until "+expires.UTC().Format("Jan 2, 2006 15:04 MST")+". If you didn't ask for this, ignore this email.")
+
+	if err == nil {
+		err = s.sendEmail(user.Email, "Your MyDailyStuff email address is changing",
+			"Someone asked to change the email address of your MyDailyStuff account to "+email+". "+
+				"It changes once the link sent there is opened.\n\n"+
+				"If this wasn't you, reset your password to keep your account.")
+	}
+
+	return err
+}
+
+// ConfirmEmailChange switches the account to the address the token was sent
+// to, returning the user's id
+func (s MdsService) ConfirmEmailChange(token string) (string, error) {
+	change, err := s.store.GetEmailChange(hashToken(token))
+	if err == RecordNotFound {
+		return "", EmailChangeNotFound
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if tokenExpired(change.Expires) {
+		return change.ID, EmailChangeExpired
+	}
+
+	err = s.store.ConsumeEmailToken(change.ID, change.Token)
+	if err == RecordNotFound {
+		return change.ID, EmailChangeNotFound
+	}
+
+	if err != nil {
+		return change.ID, err
+	}
+
+	user, err := s.GetUserById(change.ID)
+	if err != nil {
+		return change.ID, err
+	}
+
+	// The address may have been taken since the link was sent, so check right
+	// before switching to it
+	if existing, err := s.GetUserByEmail(change.Email, false); err == nil && existing.ID != change.ID {
+		s.store.SetEmailChange(change.ID, nil, nil, nil)
+		return change.ID, EmailInUse
+	} else if err != nil && err != UserNotFound {
+		return change.ID, err
+	}
+
+	user.Email = change.Email
+	user.PendingEmail = nil
+	return change.ID, s.store.SaveUser(user)
+}
+
+// emailAvailable returns EmailInUse when email belongs to an account other
+// than userId, including unverified registrations and changes waiting to be
+// confirmed
+func (s MdsService) emailAvailable(email string, userId string) error {
+	if existing, err := s.GetUserByEmail(email, false); err == nil && existing.ID != userId {
+		return EmailInUse
+	} else if err != nil && err != UserNotFound {
+		return err
+	}
+
+	return s.emailPending(email, userId)
+}
+
+// emailPending returns EmailInUse when an account other than userId is
+// waiting to confirm a change to email
+func (s MdsService) emailPending(email string, userId string) error {
+	change, err := s.store.GetPendingEmailChange(strings.ToLower(email), time.Now())
+	if err == nil && change.ID != userId {
+		return EmailInUse
+	} else if err != nil && err != RecordNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// sendEmail sends a plain text message
+func (s MdsService) sendEmail(to string, subject string, body string) error {
+	message := mail.NewV3Mail()
+	message.SetFrom(mail.NewEmail("MyDailyStuff", "no-reply@mydailystuff.com"))
+	message.Subject = subject
+	message.AddContent(mail.NewContent("text/plain", body))
+	personalizations := mail.NewPersonalization()
+	personalizations.AddTos(mail.NewEmail(to, to))
+	message.AddPersonalizations(personalizations)
+
+	if s.MailClient != nil {
+		_, err := s.MailClient.Send(message)
+		return err
+	}
+
+	return nil
+}
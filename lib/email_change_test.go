@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sendgrid/rest"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	"github.com/stretchr/testify/mock"
+)
+
+var _ = Describe("Email change", func() {
+	var service MdsService
+	var client *MockSendGridClient
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{SiteURL: "https://example.com/"})
+
+		client = new(MockSendGridClient)
+		client.On("Send", mock.AnythingOfType("*mail.SGMailV3")).Return(&rest.Response{}, nil)
+		service.MailClient = client
+
+		var err error
+		user, err = service.CreateVerifiedUser("old@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	// sentToken reads the token from the link in the confirmation email
+	sentToken := func() string {
+		message := client.Calls[0].Arguments[0].(*mail.SGMailV3)
+		Expect(message.Personalizations[0].To[0].Address).To(Equal("new@test.com"))
+
+		body := message.Content[0].Value
+		start := strings.Index(body, "https://example.com/api/account/email/")
+		Expect(start).To(BeNumerically(">=", 0))
+		return strings.Fields(body[start+len("https://example.com/api/account/email/"):])[0]
+	}
+
+	It("should confirm the new address and tell the old one", func() {
+		Expect(service.RequestEmailChange(user.ID, "password", "New@Test.com")).To(BeNil())
+
+		client.AssertNumberOfCalls(GinkgoT(), "Send", 2)
+		notice := client.Calls[1].Arguments[0].(*mail.SGMailV3)
+		Expect(notice.Personalizations[0].To[0].Address).To(Equal("old@test.com"))
+
+		stored, _ := service.GetUserById(user.ID)
+		Expect(stored.Email).To(Equal("old@test.com"))
+		Expect(*stored.PendingEmail).To(Equal("new@test.com"))
+
+		token := sentToken()
+		id, err := service.ConfirmEmailChange(token)
+		Expect(err).To(BeNil())
+		Expect(id).To(Equal(user.ID))
+
+		stored, _ = service.GetUserById(user.ID)
+		Expect(stored.Email).To(Equal("new@test.com"))
+		Expect(stored.PendingEmail).To(BeNil())
+		Expect(stored.EmailToken).To(BeNil())
+
+		_, err = service.GetUserByLogin("new@test.com", "password", "10.0.0.1")
+		Expect(err).To(BeNil())
+		_, err = service.ConfirmEmailChange(token)
+		Expect(err).To(Equal(EmailChangeNotFound))
+	})
+
+	It("should require the current password", func() {
+		Expect(service.RequestEmailChange(user.ID, "wrong", "new@test.com")).To(Equal(PasswordIncorrect))
+		client.AssertNotCalled(GinkgoT(), "Send", mock.Anything)
+	})
+
+	It("should refuse addresses in use", func() {
+		_, err := service.CreateVerifiedUser("taken@test.com", "password")
+		Expect(err).To(BeNil())
+		Expect(service.CreateUserVerification("pending@test.com", "password")).To(BeNil())
+
+		Expect(service.RequestEmailChange(user.ID, "password", "taken@test.com")).To(Equal(EmailInUse))
+		Expect(service.RequestEmailChange(user.ID, "password", "pending@test.com")).To(Equal(EmailInUse))
+		Expect(service.RequestEmailChange(user.ID, "password", "OLD@test.com")).To(Equal(EmailUnchanged))
+		Expect(service.RequestEmailChange(user.ID, "password", "nope")).To(Equal(EmailInvalid))
+	})
+
+	It("should refuse addresses waiting to be confirmed by another account", func() {
+		other, _ := service.CreateVerifiedUser("other@test.com", "password")
+		Expect(service.RequestEmailChange(other.ID, "password", "new@test.com")).To(BeNil())
+
+		Expect(service.RequestEmailChange(user.ID, "password", "New@test.com")).To(Equal(EmailInUse))
+		Expect(service.CreateUserVerification("new@test.com", "password")).To(Equal(EmailInUse))
+		_, err := service.CreateVerifiedUser("new@test.com", "password")
+		Expect(err).To(Equal(EmailInUse))
+
+		// Asking again for the same address is fine
+		Expect(service.RequestEmailChange(other.ID, "password", "new@test.com")).To(BeNil())
+
+		stored, _ := service.GetUserById(other.ID)
+		past := time.Now().Add(-time.Minute)
+		Expect(service.store.SetEmailChange(other.ID, stored.PendingEmail, stored.EmailToken, &past)).To(BeNil())
+		Expect(service.RequestEmailChange(user.ID, "password", "new@test.com")).To(BeNil())
+	})
+
+	It("should refuse an address taken before confirming", func() {
+		Expect(service.RequestEmailChange(user.ID, "password", "new@test.com")).To(BeNil())
+
+		// Like a registration that checked the address before the change was requested
+		Expect(service.store.SaveUser(User{ID: "racer", Email: "new@test.com", CreateDate: time.Now()})).To(BeNil())
+
+		_, err := service.ConfirmEmailChange(sentToken())
+		Expect(err).To(Equal(EmailInUse))
+
+		stored, _ := service.GetUserById(user.ID)
+		Expect(stored.Email).To(Equal("old@test.com"))
+		Expect(stored.PendingEmail).To(BeNil())
+	})
+
+	It("should expire the link", func() {
+		Expect(service.RequestEmailChange(user.ID, "password", "new@test.com")).To(BeNil())
+
+		stored, _ := service.GetUserById(user.ID)
+		past := time.Now().Add(-time.Minute)
+		Expect(service.store.SetEmailChange(user.ID, stored.PendingEmail, stored.EmailToken, &past)).To(BeNil())
+
+		_, err := service.ConfirmEmailChange(sentToken())
+		Expect(err).To(Equal(EmailChangeExpired))
+	})
+})
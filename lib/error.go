@@ -14,9 +14,58 @@ var EntryNotFound = errors.New("Journal entry not found")
 var EntryAlreadyExists = errors.New("Journal entry already exists")
 var VerificationNotFound = errors.New("Verification token not found")
 var ResetNotFound = errors.New("Password reset token not found")
-var JournalEntryInvalid = errors.New("Journal entries must be 500 characters or less")
+var VerificationExpired = errors.New("Verification token has expired")
+var ResetExpired = errors.New("Password reset token has expired")
+var JournalEntryInvalid = errors.New("Journal entry is too long")
 var JournalEntryEmpty = errors.New("Journal entry can't be empty")
-var TooManyEntries = errors.New("Only a maximum of seven entries per day")
+var TooManyEntries = errors.New("Too many entries for one day")
 
-var PasswordInvalid = errors.New("Password must be 6 characters or more")
+var PasswordInvalid = errors.New("Password must be 6 to 50 characters")
+var PasswordIsEmail = errors.New("Password can't be your email address")
+var PasswordMismatch = errors.New("Password doesn't match")
 var EmailInvalid = errors.New("Email is invalid")
+var UserAlreadyVerified = errors.New("User is already verified")
+var IndexesUnsupported = errors.New("Index commands require the elasticsearch backend")
+var ExportFormatInvalid = errors.New("Export format must be json, csv or zip")
+var ImportFormatInvalid = errors.New("Import format must be json, csv or dayone")
+var ImportConflictInvalid = errors.New("Conflict option must be skip, merge or overwrite")
+var ImportVersionUnsupported = errors.New("Unsupported export version")
+var TooManyAttempts = errors.New("Too many failed attempts, try again later")
+var PasswordIncorrect = errors.New("Password is incorrect")
+var TwoFactorEnabled = errors.New("Two-factor authentication is already enabled")
+var TwoFactorNotEnrolled = errors.New("Two-factor authentication isn't set up")
+var TwoFactorCodeInvalid = errors.New("Invalid authentication code")
+var AccessTokenInvalid = errors.New("Access token is invalid")
+var AccessTokenExpired = errors.New("Access token has expired")
+var AccessTokenNotFound = errors.New("Access token not found")
+var AccessTokenNameInvalid = errors.New("Access token name must be 1 to 100 characters")
+var AccessTokenScopeInvalid = errors.New("Access token scopes must be journal:read, journal:write or search")
+var AccessTokenExpiryInvalid = errors.New("Access token expiry must be in the future")
+var TooManyAccessTokens = errors.New("Only a maximum of 50 access tokens")
+var AccessTokenScopeMissing = errors.New("Access token doesn't have the scope for this request")
+var OIDCNotConfigured = errors.New("Single sign-on isn't configured")
+var OIDCTokenInvalid = errors.New("Sign-in provider returned an invalid ID token")
+var OIDCEmailUnverified = errors.New("Sign-in provider didn't confirm the email address")
+var OIDCAccountLinked = errors.New("Account is already linked to another sign-in")
+var OIDCStateInvalid = errors.New("Sign-in request expired, please try again")
+var SessionInvalid = errors.New("Session has expired or was signed out")
+var SessionNotFound = errors.New("Session not found")
+var EmailUnchanged = errors.New("New email is the same as the current one")
+var EmailChangeNotFound = errors.New("Email change token not found")
+var EmailChangeExpired = errors.New("Email change token has expired")
+var AccountDeletionNotPending = errors.New("Account isn't scheduled for deletion")
+var AccountSuspended = errors.New("Account is suspended")
+var AdminRequired = errors.New("Only administrators can do this")
+var AdminSelfSuspend = errors.New("Administrators can't suspend themselves")
+var RoleInvalid = errors.New("Role must be admin or none")
+var PlanInvalid = errors.New("Plan isn't configured")
+var TagInvalid = errors.New("Tags must start with a letter or number and have a letter")
+var TagExists = errors.New("Tag already exists, merge the tags instead")
+var TimeZoneInvalid = errors.New("Time zone must be an IANA name such as America/New_York")
+var DateInvalid = errors.New("Date must look like 2006-01-02")
+var ItemNotFound = errors.New("Journal item not found")
+var CarryOverModeInvalid = errors.New("Carry over must be copy or move")
+var ItemOrderInvalid = errors.New("Order must list every item of the entry once")
+var RevisionNotFound = errors.New("Revision not found")
+var EntryRestoreConflict = errors.New("Another journal entry already exists for this date")
+var SignInRequired = errors.New("Sign in again to confirm")
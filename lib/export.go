@@ -0,0 +1,183 @@
+package lib
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// ExportJSON is a versioned JSON document with every entry
+	ExportJSON = "json"
+	// ExportCSV has a date,item row for each journal item
+	ExportCSV = "csv"
+	// ExportMarkdown is a ZIP of one Markdown file per day with front matter
+	ExportMarkdown = "zip"
+)
+
+// ExportVersion is bumped whenever the layout of the JSON export changes
+const ExportVersion = 1
+
+// ExportContentTypes maps each export format to its content type
+var ExportContentTypes = map[string]string{
+	ExportJSON:     "application/json",
+	ExportCSV:      "text/csv",
+	ExportMarkdown: "application/zip",
+}
+
+type ExportUser struct {
+	Email      string    `json:"email"`
+	CreateDate time.Time `json:"create_date"`
+}
+
+type ExportEntry struct {
+	Date       string    `json:"date"`
+	CreateDate time.Time `json:"create_date"`
+	Items      []string  `json:"items"`
+}
+
+// JournalExport is the JSON export, written a page of entries at a time
+type JournalExport struct {
+	Version    int           `json:"version"`
+	ExportDate time.Time     `json:"export_date"`
+	User       ExportUser    `json:"user"`
+	Entries    []ExportEntry `json:"entries"`
+}
+
+func exportEntry(entry JournalEntry) ExportEntry {
+	return ExportEntry{
+		Date:       entry.Date.Format("2006-01-02"),
+		CreateDate: entry.CreateDate,
+		Items:      entry.Entries.Texts(),
+	}
+}
+
+// ExportJournal writes every journal entry of a user to w, oldest first
+func (s MdsService) ExportJournal(userId string, format string, w io.Writer) error {
+	if _, ok := ExportContentTypes[format]; !ok {
+		return ExportFormatInvalid
+	}
+
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case ExportCSV:
+		return s.exportCSV(user, w)
+	case ExportMarkdown:
+		return s.exportMarkdown(user, w)
+	default:
+		return s.exportJSON(user, w)
+	}
+}
+
+func (s MdsService) exportJSON(user User, w io.Writer) error {
+	header, err := json.Marshal(JournalExport{
+		Version:    ExportVersion,
+		ExportDate: time.Now().UTC(),
+		User:       ExportUser{Email: user.Email, CreateDate: user.CreateDate},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Stream the entries array so the whole journal is never held in memory
+	prefix := strings.TrimSuffix(string(header), `null}`)
+	_, err = io.WriteString(w, prefix+"[")
+	if err != nil {
+		return err
+	}
+
+	first := true
+	err = s.store.EachJournalEntry(user.ID, func(entry JournalEntry) error {
+		item, err := json.Marshal(exportEntry(entry))
+		if err == nil && !first {
+			_, err = io.WriteString(w, ",")
+		}
+
+		if err == nil {
+			_, err = w.Write(item)
+		}
+
+		first = false
+		return err
+	})
+
+	if err == nil {
+		_, err = io.WriteString(w, "]}\n")
+	}
+
+	return err
+}
+
+func (s MdsService) exportCSV(user User, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"date", "item"})
+
+	if err == nil {
+		err = s.store.EachJournalEntry(user.ID, func(entry JournalEntry) error {
+			date := entry.Date.Format("2006-01-02")
+			for _, item := range entry.Entries {
+				if err := writer.Write([]string{date, item.Text}); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+
+	return err
+}
+
+func (s MdsService) exportMarkdown(user User, w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	err := s.store.EachJournalEntry(user.ID, func(entry JournalEntry) error {
+		date := entry.Date.Format("2006-01-02")
+		file, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     entry.Date.Format("2006") + "/" + date + ".md",
+			Method:   zip.Deflate,
+			Modified: entry.CreateDate,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(file, markdownEntry(entry))
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// markdownEntry renders a journal entry as a Markdown list with YAML front matter
+func markdownEntry(entry JournalEntry) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "---\ndate: %s\ncreated: %s\nitems: %d\n---\n\n",
+		entry.Date.Format("2006-01-02"), entry.CreateDate.UTC().Format(time.RFC3339), len(entry.Entries))
+
+	for _, item := range entry.Entries {
+		b.WriteString("- " + strings.ReplaceAll(item.Text, "\n", "\n  ") + "\n")
+	}
+
+	return b.String()
+}
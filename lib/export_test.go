@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Export", func() {
+	var service MdsService
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		var err error
+		user, err = service.CreateVerifiedUser("export@test.com", "password")
+		Expect(err).To(BeNil())
+
+		for _, day := range []int{3, 1, 2} {
+			service.store.SaveJournalEntry(JournalEntry{
+				ID:         uuid.NewString(),
+				UserId:     user.ID,
+				Entries:    newItems([]string{"first on the day", "second, with \"quotes\""}, time.Now()),
+				Date:       time.Date(2021, 3, day, 0, 0, 0, 0, time.UTC),
+				CreateDate: time.Date(2021, 3, day, 20, 0, 0, 0, time.UTC),
+			})
+		}
+	})
+
+	It("should write versioned JSON oldest first", func() {
+		var buf bytes.Buffer
+		Expect(service.ExportJournal(user.ID, ExportJSON, &buf)).To(BeNil())
+
+		var export JournalExport
+		Expect(json.Unmarshal(buf.Bytes(), &export)).To(BeNil())
+		Expect(export.Version).To(Equal(ExportVersion))
+		Expect(export.User.Email).To(Equal("export@test.com"))
+		Expect(export.Entries).To(HaveLen(3))
+		Expect(export.Entries[0].Date).To(Equal("2021-03-01"))
+		Expect(export.Entries[2].Items).To(HaveLen(2))
+	})
+
+	It("should write valid JSON without entries", func() {
+		other, _ := service.CreateVerifiedUser("empty@test.com", "password")
+
+		var buf bytes.Buffer
+		Expect(service.ExportJournal(other.ID, ExportJSON, &buf)).To(BeNil())
+
+		var export JournalExport
+		Expect(json.Unmarshal(buf.Bytes(), &export)).To(BeNil())
+		Expect(export.Entries).To(BeEmpty())
+	})
+
+	It("should write a CSV row per item", func() {
+		var buf bytes.Buffer
+		Expect(service.ExportJournal(user.ID, ExportCSV, &buf)).To(BeNil())
+
+		rows, err := csv.NewReader(&buf).ReadAll()
+		Expect(err).To(BeNil())
+		Expect(rows).To(HaveLen(7))
+		Expect(rows[0]).To(Equal([]string{"date", "item"}))
+		Expect(rows[2]).To(Equal([]string{"2021-03-01", "second, with \"quotes\""}))
+	})
+
+	It("should write a Markdown file per day", func() {
+		var buf bytes.Buffer
+		Expect(service.ExportJournal(user.ID, ExportMarkdown, &buf)).To(BeNil())
+
+		archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		Expect(err).To(BeNil())
+		Expect(archive.File).To(HaveLen(3))
+		Expect(archive.File[0].Name).To(Equal("2021/2021-03-01.md"))
+
+		file, _ := archive.File[0].Open()
+		content, _ := io.ReadAll(file)
+		Expect(string(content)).To(HavePrefix("---\ndate: 2021-03-01\ncreated: 2021-03-01T20:00:00Z\n"))
+		Expect(string(content)).To(ContainSubstring("\n- first on the day\n"))
+	})
+
+	It("should reject unknown formats", func() {
+		var buf bytes.Buffer
+		Expect(service.ExportJournal(user.ID, "pdf", &buf)).To(Equal(ExportFormatInvalid))
+		Expect(buf.Len()).To(Equal(0))
+	})
+})
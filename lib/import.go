@@ -0,0 +1,399 @@
+package lib
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// ImportJSON reads our own JSON export
+	ImportJSON = "json"
+	// ImportCSV reads date,item rows, several rows may share a date
+	ImportCSV = "csv"
+	// ImportDayOne reads a Day One JSON export, or the ZIP holding it
+	ImportDayOne = "dayone"
+)
+
+const (
+	// ConflictSkip leaves days that already have an entry untouched
+	ConflictSkip = "skip"
+	// ConflictMerge appends new items to the existing entry
+	ConflictMerge = "merge"
+	// ConflictOverwrite replaces the existing items
+	ConflictOverwrite = "overwrite"
+)
+
+type ImportOptions struct {
+	Format string
+	// OnConflict is what to do with a date that already has an entry, ConflictSkip when empty
+	OnConflict string
+	// DryRun reports what would change without writing anything
+	DryRun bool
+	// Editor is kept with the revisions of merged and overwritten entries
+	Editor Editor
+}
+
+// ImportIssue is a record that couldn't be imported
+type ImportIssue struct {
+	Date  string `json:"date,omitempty"`
+	Line  int    `json:"line,omitempty"`
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	DryRun      bool          `json:"dry_run"`
+	Days        int           `json:"days"`
+	Created     int           `json:"created"`
+	Merged      int           `json:"merged"`
+	Overwritten int           `json:"overwritten"`
+	Skipped     int           `json:"skipped"`
+	Invalid     []ImportIssue `json:"invalid,omitempty"`
+}
+
+// importDay collects the items of every record for one date
+type importDay struct {
+	Date       time.Time
+	CreateDate time.Time
+	Items      []string
+}
+
+type importDays map[time.Time]*importDay
+
+func (d importDays) add(date time.Time, createDate time.Time, items ...string) {
+	date = dayOf(date)
+	day, ok := d[date]
+	if !ok {
+		day = &importDay{Date: date, CreateDate: createDate}
+		d[date] = day
+	}
+
+	day.Items = append(day.Items, items...)
+}
+
+// sorted returns the days oldest first
+func (d importDays) sorted() []*importDay {
+	retval := make([]*importDay, 0, len(d))
+	for _, day := range d {
+		retval = append(retval, day)
+	}
+
+	sort.Slice(retval, func(i, j int) bool {
+		return retval[i].Date.Before(retval[j].Date)
+	})
+
+	return retval
+}
+
+var importDateLayouts = []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "1/2/2006"}
+
+// parseImportDate reads the calendar date of a timestamp in the offset it was written with
+func parseImportDate(value string) (time.Time, error) {
+	var err error
+	for _, layout := range importDateLayouts {
+		var date time.Time
+		date, err = time.Parse(layout, strings.TrimSpace(value))
+		if err == nil {
+			return date, nil
+		}
+	}
+
+	return time.Time{}, err
+}
+
+// ImportJournal adds entries from another export to a user's journal. Each
+// day is validated like CreateJournalEntry, and days that fail are listed in
+// the report instead of stopping the import.
+func (s MdsService) ImportJournal(userId string, r io.Reader, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{DryRun: options.DryRun}
+
+	if options.OnConflict == "" {
+		options.OnConflict = ConflictSkip
+	}
+
+	if options.OnConflict != ConflictSkip && options.OnConflict != ConflictMerge && options.OnConflict != ConflictOverwrite {
+		return report, ImportConflictInvalid
+	}
+
+	var days importDays
+	var err error
+
+	switch options.Format {
+	case ImportJSON:
+		days, err = parseJSONImport(r)
+	case ImportCSV:
+		days, report.Invalid, err = parseCSVImport(r)
+	case ImportDayOne:
+		days, err = parseDayOneImport(r)
+	default:
+		err = ImportFormatInvalid
+	}
+
+	if err != nil {
+		return report, err
+	}
+
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return report, err
+	}
+
+	limits := s.limitsFor(user)
+
+	existing := map[time.Time]JournalEntry{}
+	err = s.store.EachJournalEntry(userId, func(entry JournalEntry) error {
+		existing[dayOf(entry.Date)] = entry
+		return nil
+	})
+
+	if err != nil {
+		return report, err
+	}
+
+	var batch []JournalEntry
+	replaced := map[string]JournalItems{}
+	for _, day := range days.sorted() {
+		report.Days++
+		date := day.Date.Format("2006-01-02")
+
+		if err := cleanEntries(day.Items, limits); err != nil {
+			report.Invalid = append(report.Invalid, ImportIssue{Date: date, Error: err.Error()})
+			continue
+		}
+
+		entry, exists := existing[day.Date]
+		if !exists {
+			createDate := day.CreateDate
+			if createDate.IsZero() {
+				createDate = time.Now().UTC()
+			}
+
+			entry = JournalEntry{ID: uuid.NewString(), UserId: userId, Date: day.Date, CreateDate: createDate, Entries: newItems(day.Items, createDate)}
+			report.Created++
+		} else if options.OnConflict == ConflictSkip {
+			report.Skipped++
+			continue
+		} else if options.OnConflict == ConflictMerge {
+			replaced[entry.ID] = entry.Entries
+			entry.Entries = mergeItems(entry.Entries, day.Items)
+			if err := limits.checkCount(len(entry.Entries)); err != nil {
+				report.Invalid = append(report.Invalid, ImportIssue{Date: date, Error: err.Error()})
+				continue
+			}
+
+			report.Merged++
+		} else {
+			replaced[entry.ID] = entry.Entries
+			entry.Entries = reconcileItems(entry.Entries, day.Items, time.Now().UTC())
+			report.Overwritten++
+		}
+
+		entry.Tags = extractTags(entry.Entries.Texts())
+		batch = append(batch, entry)
+	}
+
+	if options.DryRun {
+		return report, nil
+	}
+
+	for _, entry := range batch {
+		previous, ok := replaced[entry.ID]
+		if ok && !sameItems(previous, entry.Entries) {
+			if err := s.keepRevision(entry, previous, options.Editor); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	return report, s.saveEntries(batch)
+}
+
+// saveEntries writes entries journalPageSize at a time
+func (s MdsService) saveEntries(entries []JournalEntry) error {
+	for start := 0; start < len(entries); start += journalPageSize {
+		end := start + journalPageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		if err := s.store.SaveJournalEntries(entries[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeItems appends the items that aren't already in the entry
+func mergeItems(items JournalItems, added []string) JournalItems {
+	merged := append(JournalItems(nil), items...)
+	created := time.Now().UTC()
+
+	for _, item := range added {
+		duplicate := false
+		for _, current := range merged {
+			if strings.EqualFold(current.Text, item) {
+				duplicate = true
+				break
+			}
+		}
+
+		if !duplicate {
+			merged = append(merged, JournalItem{ID: uuid.NewString(), Text: item, CreateDate: created, Position: len(merged)})
+		}
+	}
+
+	return merged
+}
+
+func parseJSONImport(r io.Reader) (importDays, error) {
+	var export JournalExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, err
+	}
+
+	if export.Version < 1 || export.Version > ExportVersion {
+		return nil, ImportVersionUnsupported
+	}
+
+	days := importDays{}
+	for _, entry := range export.Entries {
+		date, err := parseImportDate(entry.Date)
+		if err != nil {
+			return nil, err
+		}
+
+		days.add(date, entry.CreateDate, entry.Items...)
+	}
+
+	return days, nil
+}
+
+func parseCSVImport(r io.Reader) (importDays, []ImportIssue, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	days := importDays{}
+	var issues []ImportIssue
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if line == 1 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "date") {
+			continue
+		}
+
+		if len(record) < 2 {
+			issues = append(issues, ImportIssue{Line: line, Error: "Expected a date and an item"})
+			continue
+		}
+
+		date, err := parseImportDate(record[0])
+		if err != nil {
+			issues = append(issues, ImportIssue{Line: line, Error: "Invalid date " + strconv.Quote(record[0])})
+			continue
+		}
+
+		days.add(date, time.Time{}, record[1])
+	}
+
+	return days, issues, nil
+}
+
+type dayOneExport struct {
+	Entries []struct {
+		CreationDate time.Time `json:"creationDate"`
+		TimeZone     string    `json:"timeZone"`
+		Text         string    `json:"text"`
+	} `json:"entries"`
+}
+
+func parseDayOneImport(r io.Reader) (importDays, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Day One exports a ZIP with the journal JSON beside any photos
+	if bytes.HasPrefix(data, []byte("PK")) {
+		data, err = dayOneJournal(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var export dayOneExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, err
+	}
+
+	days := importDays{}
+	for _, entry := range export.Entries {
+		created := entry.CreationDate
+		if location, err := time.LoadLocation(entry.TimeZone); entry.TimeZone != "" && err == nil {
+			created = created.In(location)
+		}
+
+		days.add(created, entry.CreationDate.UTC(), dayOneItems(entry.Text)...)
+	}
+
+	return days, nil
+}
+
+func dayOneJournal(data []byte) ([]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range archive.File {
+		if strings.HasSuffix(strings.ToLower(file.Name), ".json") {
+			reader, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+
+			return io.ReadAll(reader)
+		}
+	}
+
+	return nil, ImportFormatInvalid
+}
+
+var (
+	dayOneMarker = regexp.MustCompile(`^(#+|[-*+]|\d+[.)])\s+(\[[ xX]\]\s+)?`)
+	dayOneEscape = regexp.MustCompile(`\\([\\\x60*_{}\[\]()#+\-.!])`)
+)
+
+// dayOneItems turns each non-empty line of Day One's Markdown into an item,
+// dropping list markers and headings
+func dayOneItems(text string) []string {
+	var items []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(dayOneMarker.ReplaceAllString(strings.TrimSpace(line), ""))
+		line = dayOneEscape.ReplaceAllString(line, "$1")
+
+		if line != "" && !strings.HasPrefix(line, "![](dayone-moment") {
+			items = append(items, line)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Import", func() {
+	var service MdsService
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		var err error
+		user, err = service.CreateVerifiedUser("import@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	entryOn := func(date string) JournalEntry {
+		day, _ := time.Parse("2006-01-02", date)
+		entry, _ := service.GetJournalEntryByDate(user.ID, day)
+		return entry
+	}
+
+	importCSV := func(csv string, options ImportOptions) ImportReport {
+		options.Format = ImportCSV
+		report, err := service.ImportJournal(user.ID, strings.NewReader(csv), options)
+		Expect(err).To(BeNil())
+		return report
+	}
+
+	Describe("CSV", func() {
+		It("should group rows by date", func() {
+			report := importCSV("date,item\n2021-03-01,one\n2021-03-01,<b>two</b>\n2021-03-02,three\n", ImportOptions{})
+			Expect(report.Days).To(Equal(2))
+			Expect(report.Created).To(Equal(2))
+			Expect(entryOn("2021-03-01").Entries.Texts()).To(Equal([]string{"one", "two"}))
+		})
+
+		It("should report rows it can't read", func() {
+			report := importCSV("2021-03-01,one\nyesterday,two\n2021-03-03\n", ImportOptions{})
+			Expect(report.Created).To(Equal(1))
+			Expect(report.Invalid).To(HaveLen(2))
+			Expect(report.Invalid[0].Line).To(Equal(2))
+		})
+
+		It("should apply the entry limits", func() {
+			report := importCSV("2021-03-01,"+strings.Repeat("a", 501)+"\n"+strings.Repeat("2021-03-02,item\n", 8), ImportOptions{})
+			Expect(report.Created).To(Equal(0))
+			Expect(report.Invalid).To(ConsistOf(
+				ImportIssue{Date: "2021-03-01", Error: "Journal entries must be 500 characters or less"},
+				ImportIssue{Date: "2021-03-02", Error: "Only a maximum of 7 entries per day"},
+			))
+		})
+	})
+
+	Describe("Conflicts", func() {
+		BeforeEach(func() {
+			importCSV("2021-03-01,one\n2021-03-01,two\n", ImportOptions{})
+		})
+
+		It("should skip existing days by default", func() {
+			report := importCSV("2021-03-01,three\n", ImportOptions{})
+			Expect(report.Skipped).To(Equal(1))
+			Expect(entryOn("2021-03-01").Entries.Texts()).To(Equal([]string{"one", "two"}))
+		})
+
+		It("should merge new items", func() {
+			report := importCSV("2021-03-01,Two\n2021-03-01,three\n", ImportOptions{OnConflict: ConflictMerge})
+			Expect(report.Merged).To(Equal(1))
+			Expect(entryOn("2021-03-01").Entries.Texts()).To(Equal([]string{"one", "two", "three"}))
+		})
+
+		It("should not merge past the item limit", func() {
+			report := importCSV("2021-03-01,a\n2021-03-01,b\n2021-03-01,c\n2021-03-01,d\n2021-03-01,e\n2021-03-01,f\n",
+				ImportOptions{OnConflict: ConflictMerge})
+			Expect(report.Invalid).To(HaveLen(1))
+			Expect(entryOn("2021-03-01").Entries).To(HaveLen(2))
+		})
+
+		It("should overwrite existing items", func() {
+			id := entryOn("2021-03-01").ID
+			report := importCSV("2021-03-01,three\n", ImportOptions{OnConflict: ConflictOverwrite})
+			Expect(report.Overwritten).To(Equal(1))
+			Expect(entryOn("2021-03-01").Entries.Texts()).To(Equal([]string{"three"}))
+			Expect(entryOn("2021-03-01").ID).To(Equal(id))
+		})
+
+		It("should write nothing on a dry run", func() {
+			report := importCSV("2021-03-01,three\n2021-03-05,four\n", ImportOptions{OnConflict: ConflictOverwrite, DryRun: true})
+			Expect(report.DryRun).To(BeTrue())
+			Expect(report.Overwritten).To(Equal(1))
+			Expect(report.Created).To(Equal(1))
+			Expect(entryOn("2021-03-01").Entries.Texts()).To(Equal([]string{"one", "two"}))
+			Expect(entryOn("2021-03-05").ID).To(BeEmpty())
+		})
+
+		It("should reject unknown options", func() {
+			_, err := service.ImportJournal(user.ID, strings.NewReader(""), ImportOptions{Format: ImportCSV, OnConflict: "replace"})
+			Expect(err).To(Equal(ImportConflictInvalid))
+
+			_, err = service.ImportJournal(user.ID, strings.NewReader(""), ImportOptions{Format: "xml"})
+			Expect(err).To(Equal(ImportFormatInvalid))
+		})
+	})
+
+	Describe("JSON", func() {
+		It("should read our own export", func() {
+			importCSV("2021-03-01,one\n2021-03-02,two\n", ImportOptions{})
+
+			var buf bytes.Buffer
+			Expect(service.ExportJournal(user.ID, ExportJSON, &buf)).To(BeNil())
+
+			other, _ := service.CreateVerifiedUser("other@test.com", "password")
+			report, err := service.ImportJournal(other.ID, &buf, ImportOptions{Format: ImportJSON})
+			Expect(err).To(BeNil())
+			Expect(report.Created).To(Equal(2))
+
+			day, _ := time.Parse("2006-01-02", "2021-03-02")
+			entry, err := service.GetJournalEntryByDate(other.ID, day)
+			Expect(err).To(BeNil())
+			Expect(entry.Entries.Texts()).To(Equal([]string{"two"}))
+		})
+
+		It("should reject newer export versions", func() {
+			_, err := service.ImportJournal(user.ID, strings.NewReader(`{"version":99,"entries":[]}`), ImportOptions{Format: ImportJSON})
+			Expect(err).To(Equal(ImportVersionUnsupported))
+		})
+	})
+
+	Describe("Day One", func() {
+		dayOne := `{"metadata":{"version":"1.0"},"entries":[
+			{"creationDate":"2021-03-02T03:00:00Z","timeZone":"America/New_York","text":"# Today\n\n- Went for a run\n- [x] Paid rent\n\nCalled mom\\."},
+			{"creationDate":"2021-03-05T12:00:00Z","text":"1. First\n2. Second\n![](dayone-moment://ABC)"}
+		]}`
+
+		It("should read entries in their time zone", func() {
+			report, err := service.ImportJournal(user.ID, strings.NewReader(dayOne), ImportOptions{Format: ImportDayOne})
+			Expect(err).To(BeNil())
+			Expect(report.Created).To(Equal(2))
+
+			Expect(entryOn("2021-03-01").Entries.Texts()).To(Equal([]string{"Today", "Went for a run", "Paid rent", "Called mom."}))
+			Expect(entryOn("2021-03-05").Entries.Texts()).To(Equal([]string{"First", "Second"}))
+		})
+
+		It("should read the JSON from the export ZIP", func() {
+			var buf bytes.Buffer
+			archive := zip.NewWriter(&buf)
+			file, _ := archive.Create("Journal.json")
+			file.Write([]byte(dayOne))
+			archive.Close()
+
+			report, err := service.ImportJournal(user.ID, &buf, ImportOptions{Format: ImportDayOne})
+			Expect(err).To(BeNil())
+			Expect(report.Created).To(Equal(2))
+		})
+	})
+})
@@ -0,0 +1,278 @@
+package lib
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A day's items used to be stored as plain strings, so every change rewrote
+// the whole day. They are now objects with an ID that a single item can be
+// edited, checked off, moved or removed by. Documents written before then
+// still hold strings, which read as items that aren't done with IDs from
+// their position, see legacyItemID.
+
+// JournalItem is one item of a day's journal entry
+type JournalItem struct {
+	ID         string    `json:"id"`
+	Text       string    `json:"text"`
+	Done       bool      `json:"done"`
+	CreateDate time.Time `json:"create_date"`
+	Position   int       `json:"position"`
+	// CarriedFrom is set on items carried over from an earlier entry
+	CarriedFrom *ItemOrigin `json:"carried_from,omitempty"`
+}
+
+// JournalItems are the items of an entry in order
+type JournalItems []JournalItem
+
+// legacyItemID is the ID of an item stored as a string, its position counting
+// from 1. It is kept once the entry is saved again, new items get a UUID.
+func legacyItemID(position int) string {
+	return strconv.Itoa(position + 1)
+}
+
+// UnmarshalJSON reads items stored as objects or as strings
+func (items *JournalItems) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil || raw == nil {
+		*items = nil
+		return err
+	}
+
+	retval := make(JournalItems, len(raw))
+	for position, value := range raw {
+		var err error
+		if len(value) > 0 && value[0] == '"' {
+			retval[position].ID = legacyItemID(position)
+			err = json.Unmarshal(value, &retval[position].Text)
+		} else {
+			err = json.Unmarshal(value, &retval[position])
+		}
+
+		if err != nil {
+			return err
+		}
+
+		retval[position].Position = position
+	}
+
+	*items = retval
+	return nil
+}
+
+// newItems makes items that aren't done from texts
+func newItems(texts []string, created time.Time) JournalItems {
+	retval := make(JournalItems, len(texts))
+	for position, text := range texts {
+		retval[position] = JournalItem{ID: uuid.NewString(), Text: text, CreateDate: created, Position: position}
+	}
+
+	return retval
+}
+
+// Texts returns the text of each item
+func (items JournalItems) Texts() []string {
+	retval := make([]string, len(items))
+	for index, item := range items {
+		retval[index] = item.Text
+	}
+
+	return retval
+}
+
+// index returns the position of the item with an ID, -1 when there is none
+func (items JournalItems) index(id string) int {
+	for index, item := range items {
+		if item.ID == id {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// renumber sets each item's position to its place in the slice
+func (items JournalItems) renumber() {
+	for index := range items {
+		items[index].Position = index
+	}
+}
+
+// fillCreated gives items stored as strings, which have no created date, the
+// date of their entry
+func (items JournalItems) fillCreated(created time.Time) {
+	for index := range items {
+		if items[index].CreateDate.IsZero() {
+			items[index].CreateDate = created
+		}
+	}
+}
+
+// reconcileItems replaces a day's items with texts, keeping the ID, state and
+// created date of each item whose text didn't change
+func reconcileItems(items JournalItems, texts []string, created time.Time) JournalItems {
+	used := make([]bool, len(items))
+	retval := newItems(texts, created)
+
+	for position, text := range texts {
+		for index, item := range items {
+			if !used[index] && item.Text == text {
+				used[index] = true
+				item.Position = position
+				retval[position] = item
+				break
+			}
+		}
+	}
+
+	return retval
+}
+
+// userEntry loads one of the user's entries, EntryNotFound when it belongs to
+// someone else or is in the trash
+func (s MdsService) userEntry(id string, userId string) (JournalEntry, error) {
+	if userId == "" {
+		return JournalEntry{}, UserUnauthorized
+	}
+
+	entry, err := s.store.GetJournalEntry(id)
+	if err == RecordNotFound || (err == nil && (entry.UserId != userId || entry.DeletedAt != nil)) {
+		return JournalEntry{}, EntryNotFound
+	}
+
+	return entry, err
+}
+
+// saveItems renumbers the items and stores the entry with their tags
+func (s MdsService) saveItems(entry JournalEntry) error {
+	entry.Entries.renumber()
+	entry.Tags = extractTags(entry.Entries.Texts())
+	return s.store.SaveJournalEntry(entry)
+}
+
+// changeItem applies fn to one item of an entry, saves it and returns the item
+func (s MdsService) changeItem(entryId string, userId string, itemId string, editor Editor, fn func(*JournalItem)) (JournalItem, error) {
+	entry, err := s.userEntry(entryId, userId)
+	if err != nil {
+		return JournalItem{}, err
+	}
+
+	index := entry.Entries.index(itemId)
+	if index < 0 {
+		return JournalItem{}, ItemNotFound
+	}
+
+	previous := entry.Entries
+	entry.Entries = append(JournalItems{}, previous...)
+	fn(&entry.Entries[index])
+	if err := s.saveRevised(entry, previous, editor); err != nil {
+		return JournalItem{}, err
+	}
+
+	return entry.Entries[index], nil
+}
+
+// AddJournalItem adds an item to the end of an entry
+func (s MdsService) AddJournalItem(entryId string, userId string, text string, editor Editor) (JournalItem, error) {
+	limits, err := s.GetJournalLimits(userId)
+	if err == nil {
+		text, err = cleanItem(text, limits)
+	}
+
+	if err != nil {
+		return JournalItem{}, err
+	}
+
+	entry, err := s.userEntry(entryId, userId)
+	if err == nil {
+		err = limits.checkCount(len(entry.Entries) + 1)
+	}
+
+	if err != nil {
+		return JournalItem{}, err
+	}
+
+	item := newItems([]string{text}, time.Now().UTC())[0]
+	previous := entry.Entries
+	entry.Entries = append(append(JournalItems{}, previous...), item)
+	if err := s.saveRevised(entry, previous, editor); err != nil {
+		return JournalItem{}, err
+	}
+
+	return entry.Entries[len(entry.Entries)-1], nil
+}
+
+// EditJournalItem changes the text of an item
+func (s MdsService) EditJournalItem(entryId string, userId string, itemId string, text string, editor Editor) (JournalItem, error) {
+	limits, err := s.GetJournalLimits(userId)
+	if err == nil {
+		text, err = cleanItem(text, limits)
+	}
+
+	if err != nil {
+		return JournalItem{}, err
+	}
+
+	return s.changeItem(entryId, userId, itemId, editor, func(item *JournalItem) {
+		item.Text = text
+	})
+}
+
+// ToggleJournalItem marks an item done, or not done when it already was
+func (s MdsService) ToggleJournalItem(entryId string, userId string, itemId string, editor Editor) (JournalItem, error) {
+	return s.changeItem(entryId, userId, itemId, editor, func(item *JournalItem) {
+		item.Done = !item.Done
+	})
+}
+
+// ReorderJournalItems puts an entry's items in the order of their IDs, which
+// must name every item once
+func (s MdsService) ReorderJournalItems(entryId string, userId string, order []string, editor Editor) (JournalItems, error) {
+	entry, err := s.userEntry(entryId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(order) != len(entry.Entries) {
+		return nil, ItemOrderInvalid
+	}
+
+	reordered := make(JournalItems, len(order))
+	for position, id := range order {
+		index := entry.Entries.index(id)
+		if index < 0 || reordered.index(id) >= 0 {
+			return nil, ItemOrderInvalid
+		}
+
+		reordered[position] = entry.Entries[index]
+	}
+
+	previous := entry.Entries
+	entry.Entries = reordered
+	if err := s.saveRevised(entry, previous, editor); err != nil {
+		return nil, err
+	}
+
+	return entry.Entries, nil
+}
+
+// RemoveJournalItem removes an item from an entry. The entry stays even
+// without items, DeleteJournalEntry removes the day.
+func (s MdsService) RemoveJournalItem(entryId string, userId string, itemId string, editor Editor) error {
+	entry, err := s.userEntry(entryId, userId)
+	if err != nil {
+		return err
+	}
+
+	index := entry.Entries.index(itemId)
+	if index < 0 {
+		return ItemNotFound
+	}
+
+	previous := entry.Entries
+	entry.Entries = append(append(JournalItems{}, previous[:index]...), previous[index+1:]...)
+	return s.saveRevised(entry, previous, editor)
+}
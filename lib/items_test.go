@@ -0,0 +1,223 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Items", func() {
+	var service MdsService
+	var user User
+	var entry JournalEntry
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{JournalLimits: JournalLimits{MaxItems: 3}})
+
+		var err error
+		user, err = service.CreateVerifiedUser("items@test.com", "password")
+		Expect(err).To(BeNil())
+
+		entry, err = service.CreateJournalEntry(user.ID, []string{"first", "second"}, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC))
+		Expect(err).To(BeNil())
+	})
+
+	stored := func() JournalEntry {
+		found, err := service.store.GetJournalEntry(entry.ID)
+		Expect(err).To(BeNil())
+		return found
+	}
+
+	Describe("Reading", func() {
+		It("should read items stored as strings", func() {
+			var legacy JournalEntry
+			err := json.Unmarshal([]byte(`{"entries":["one","two"]}`), &legacy)
+			Expect(err).To(BeNil())
+			Expect(legacy.Entries).To(Equal(JournalItems{{ID: "1", Text: "one"}, {ID: "2", Text: "two", Position: 1}}))
+		})
+
+		It("should read items stored as objects", func() {
+			var current JournalEntry
+			err := json.Unmarshal([]byte(`{"entries":[{"id":"a","text":"one","done":true,"position":4}]}`), &current)
+			Expect(err).To(BeNil())
+			Expect(current.Entries).To(Equal(JournalItems{{ID: "a", Text: "one", Done: true}}))
+		})
+
+		It("should match highlights back to their items", func() {
+			items := newItems([]string{"ran a mile", "ran again", "slept"}, time.Now())
+			highlighted := highlightedItems(items, []string{"<strong>ran</strong> again", "<strong>ran</strong> a mile"})
+			Expect(highlighted.Texts()).To(Equal([]string{"<strong>ran</strong> a mile", "<strong>ran</strong> again"}))
+			Expect(highlighted[1].ID).To(Equal(items[1].ID))
+		})
+	})
+
+	It("should give new items IDs and positions", func() {
+		Expect(entry.Entries).To(HaveLen(2))
+		Expect(entry.Entries[0].ID).NotTo(BeEmpty())
+		Expect(entry.Entries[0].ID).NotTo(Equal(entry.Entries[1].ID))
+		Expect(entry.Entries[1].Position).To(Equal(1))
+		Expect(entry.Entries[1].CreateDate).To(Equal(entry.CreateDate))
+		Expect(stored().Entries[1].ID).To(Equal(entry.Entries[1].ID))
+	})
+
+	It("should add an item", func() {
+		item, err := service.AddJournalItem(entry.ID, user.ID, " #gym ", Editor{})
+		Expect(err).To(BeNil())
+		Expect(item.Text).To(Equal("#gym"))
+		Expect(item.Position).To(Equal(2))
+
+		Expect(stored().Entries.Texts()).To(Equal([]string{"first", "second", "#gym"}))
+		Expect(stored().Tags).To(Equal([]string{"gym"}))
+
+		_, err = service.AddJournalItem(entry.ID, user.ID, "fourth", Editor{})
+		Expect(err).To(MatchError("Only a maximum of 3 entries per day"))
+
+		_, err = service.AddJournalItem(entry.ID, user.ID, "  ", Editor{})
+		Expect(err).To(Equal(JournalEntryEmpty))
+	})
+
+	It("should edit and toggle an item", func() {
+		id := entry.Entries[1].ID
+
+		item, err := service.EditJournalItem(entry.ID, user.ID, id, "changed", Editor{})
+		Expect(err).To(BeNil())
+		Expect(item.Text).To(Equal("changed"))
+
+		item, err = service.ToggleJournalItem(entry.ID, user.ID, id, Editor{})
+		Expect(err).To(BeNil())
+		Expect(item.Done).To(BeTrue())
+		Expect(stored().Entries[1]).To(Equal(item))
+
+		item, _ = service.ToggleJournalItem(entry.ID, user.ID, id, Editor{})
+		Expect(item.Done).To(BeFalse())
+
+		_, err = service.EditJournalItem(entry.ID, user.ID, "missing", "text", Editor{})
+		Expect(err).To(Equal(ItemNotFound))
+	})
+
+	It("should reorder items", func() {
+		third, _ := service.AddJournalItem(entry.ID, user.ID, "third", Editor{})
+		order := []string{third.ID, entry.Entries[0].ID, entry.Entries[1].ID}
+
+		items, err := service.ReorderJournalItems(entry.ID, user.ID, order, Editor{})
+		Expect(err).To(BeNil())
+		Expect(items.Texts()).To(Equal([]string{"third", "first", "second"}))
+		Expect(items[2].Position).To(Equal(2))
+		Expect(stored().Entries).To(Equal(items))
+
+		for _, bad := range [][]string{order[:2], {order[0], order[0], order[1]}, {order[0], order[1], "missing"}} {
+			_, err = service.ReorderJournalItems(entry.ID, user.ID, bad, Editor{})
+			Expect(err).To(Equal(ItemOrderInvalid))
+		}
+	})
+
+	It("should remove an item", func() {
+		Expect(service.RemoveJournalItem(entry.ID, user.ID, entry.Entries[0].ID, Editor{})).To(BeNil())
+
+		items := stored().Entries
+		Expect(items.Texts()).To(Equal([]string{"second"}))
+		Expect(items[0].Position).To(Equal(0))
+
+		Expect(service.RemoveJournalItem(entry.ID, user.ID, entry.Entries[0].ID, Editor{})).To(Equal(ItemNotFound))
+	})
+
+	It("should keep items unchanged by an update", func() {
+		done, _ := service.ToggleJournalItem(entry.ID, user.ID, entry.Entries[1].ID, Editor{})
+
+		Expect(service.UpdateJournalEntry(entry.ID, user.ID, []string{"second", "new"}, Editor{})).To(BeNil())
+
+		items := stored().Entries
+		Expect(items[0].ID).To(Equal(done.ID))
+		Expect(items[0].Done).To(BeTrue())
+		Expect(items[0].Position).To(Equal(0))
+		Expect(items[1].ID).NotTo(Equal(entry.Entries[0].ID))
+	})
+
+	It("should only change the user's own entries", func() {
+		other, _ := service.CreateVerifiedUser("other@test.com", "password")
+
+		_, err := service.AddJournalItem(entry.ID, other.ID, "mine", Editor{})
+		Expect(err).To(Equal(EntryNotFound))
+		_, err = service.ToggleJournalItem(entry.ID, other.ID, entry.Entries[0].ID, Editor{})
+		Expect(err).To(Equal(EntryNotFound))
+		Expect(service.RemoveJournalItem(entry.ID, "", entry.Entries[0].ID, Editor{})).To(Equal(UserUnauthorized))
+	})
+
+	It("should search items", func() {
+		service.ToggleJournalItem(entry.ID, user.ID, entry.Entries[1].ID, Editor{})
+
+		entries, _, err := service.SearchJournal(user.ID, JournalQuery{Query: "second"})
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Entries).To(HaveLen(1))
+		Expect(entries[0].Entries[0].Text).To(Equal("<strong>second</strong>"))
+		Expect(entries[0].Entries[0].ID).To(Equal(entry.Entries[1].ID))
+		Expect(entries[0].Entries[0].Done).To(BeTrue())
+	})
+
+	Describe("Controller", func() {
+		var router *gin.Engine
+
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			controller := Controller{}
+			controller.SetOptions(service, false)
+
+			router = gin.New()
+			router.Use(sessions.Sessions("my_session", cookie.NewStore([]byte("secret"))))
+			router.Use(func(c *gin.Context) {
+				c.Set("userId", user.ID)
+			})
+			router.POST("/api/journal/:id/items", controller.AddItem)
+			router.PATCH("/api/journal/:id/items", controller.ReorderItems)
+			router.PATCH("/api/journal/:id/items/:item/toggle", controller.ToggleItem)
+			router.DELETE("/api/journal/:id/items/:item", controller.RemoveItem)
+		})
+
+		request := func(method string, path string, body string) (int, Response) {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(recorder, req)
+
+			var response Response
+			json.Unmarshal(recorder.Body.Bytes(), &response)
+			return recorder.Code, response
+		}
+
+		It("should change single items", func() {
+			code, response := request("POST", "/api/journal/"+entry.ID+"/items", `{"text":"third"}`)
+			Expect(code).To(Equal(200))
+			Expect(response.Result).To(HaveKeyWithValue("text", "third"))
+
+			code, response = request("PATCH", "/api/journal/"+entry.ID+"/items/"+entry.Entries[0].ID+"/toggle", "")
+			Expect(code).To(Equal(200))
+			Expect(response.Result).To(HaveKeyWithValue("done", true))
+
+			code, _ = request("DELETE", "/api/journal/"+entry.ID+"/items/"+entry.Entries[0].ID, "")
+			Expect(code).To(Equal(200))
+			Expect(stored().Entries.Texts()).To(Equal([]string{"second", "third"}))
+		})
+
+		It("should report missing items and bad requests", func() {
+			code, response := request("PATCH", "/api/journal/"+entry.ID+"/items/missing/toggle", "")
+			Expect(code).To(Equal(http.StatusNotFound))
+			Expect(response.Error).To(Equal(ItemNotFound.Error()))
+
+			code, _ = request("PATCH", "/api/journal/"+entry.ID+"/items", `{}`)
+			Expect(code).To(Equal(http.StatusBadRequest))
+
+			code, response = request("PATCH", "/api/journal/"+entry.ID+"/items", `{"order":["x"]}`)
+			Expect(code).To(Equal(200))
+			Expect(response.Error).To(Equal(ItemOrderInvalid.Error()))
+		})
+	})
+})
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Journal entries are limited in how many items a day can have and how long
+// each item can be. The defaults come from the server's settings, and a user
+// on a plan gets that plan's limits instead. Plans are only named in the
+// settings, so a plan that is removed falls back to the defaults.
+
+// DefaultJournalLimits are used when the settings don't give any
+var DefaultJournalLimits = JournalLimits{MaxItems: 7, MaxItemLength: 500}
+
+type JournalLimits struct {
+	// MaxItems is how many items one day can have
+	MaxItems int `json:"max_items"`
+	// MaxItemLength is how many characters one item can have
+	MaxItemLength int `json:"max_item_length"`
+}
+
+// withDefaults fills in the limits that aren't set from fallback
+func (l JournalLimits) withDefaults(fallback JournalLimits) JournalLimits {
+	if l.MaxItems <= 0 {
+		l.MaxItems = fallback.MaxItems
+	}
+
+	if l.MaxItemLength <= 0 {
+		l.MaxItemLength = fallback.MaxItemLength
+	}
+
+	return l
+}
+
+// LimitError is returned when a journal entry goes over one of the user's
+// limits, it unwraps to TooManyEntries or JournalEntryInvalid
+type LimitError struct {
+	Err   error
+	Limit int
+}
+
+func (e LimitError) Error() string {
+	if e.Err == TooManyEntries {
+		return fmt.Sprintf("Only a maximum of %d entries per day", e.Limit)
+	}
+
+	return fmt.Sprintf("Journal entries must be %d characters or less", e.Limit)
+}
+
+func (e LimitError) Unwrap() error { return e.Err }
+
+// checkCount returns a LimitError when a day has too many items
+func (l JournalLimits) checkCount(count int) error {
+	if count > l.MaxItems {
+		return LimitError{Err: TooManyEntries, Limit: l.MaxItems}
+	}
+
+	return nil
+}
+
+// ParsePlans reads plans written as name=items/length separated by commas,
+// such as "plus=20/1000,pro=50/2000". A limit left empty uses the default.
+func ParsePlans(spec string) (map[string]JournalLimits, error) {
+	plans := map[string]JournalLimits{}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, limits, found := strings.Cut(part, "=")
+		items, length, _ := strings.Cut(limits, "/")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("plan %q must look like name=items/length", part)
+		}
+
+		var plan JournalLimits
+		var err error
+		if items = strings.TrimSpace(items); items != "" {
+			if plan.MaxItems, err = strconv.Atoi(items); err != nil || plan.MaxItems <= 0 {
+				return nil, fmt.Errorf("plan %q must allow a positive number of items", name)
+			}
+		}
+
+		if length = strings.TrimSpace(length); length != "" {
+			if plan.MaxItemLength, err = strconv.Atoi(length); err != nil || plan.MaxItemLength <= 0 {
+				return nil, fmt.Errorf("plan %q must allow a positive item length", name)
+			}
+		}
+
+		plans[name] = plan
+	}
+
+	return plans, nil
+}
+
+// limitsFor returns the journal limits of the user's plan, or the defaults
+func (s MdsService) limitsFor(user User) JournalLimits {
+	defaults := s.limits.withDefaults(DefaultJournalLimits)
+	if plan, ok := s.plans[user.Plan]; ok && user.Plan != "" {
+		return plan.withDefaults(defaults)
+	}
+
+	return defaults
+}
+
+// GetJournalLimits returns the limits that apply to the user's entries
+func (s MdsService) GetJournalLimits(userId string) (JournalLimits, error) {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return JournalLimits{}, err
+	}
+
+	return s.limitsFor(user), nil
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limits", func() {
+	var service MdsService
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{
+			JournalLimits: JournalLimits{MaxItems: 3},
+			Plans:         map[string]JournalLimits{"pro": {MaxItems: 10, MaxItemLength: 1000}, "short": {MaxItemLength: 20}},
+		})
+
+		var err error
+		user, err = service.CreateVerifiedUser("limits@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	items := func(count int, length int) []string {
+		retval := make([]string, count)
+		for index := range retval {
+			retval[index] = strings.Repeat("a", length)
+		}
+		return retval
+	}
+
+	It("should use the configured defaults", func() {
+		limits, err := service.GetJournalLimits(user.ID)
+		Expect(err).To(BeNil())
+		Expect(limits).To(Equal(JournalLimits{MaxItems: 3, MaxItemLength: 500}))
+
+		_, err = service.CreateJournalEntry(user.ID, items(4, 10), time.Now())
+		Expect(errors.Is(err, TooManyEntries)).To(BeTrue())
+		Expect(err).To(MatchError("Only a maximum of 3 entries per day"))
+	})
+
+	It("should give users on a plan its limits", func() {
+		_, err := service.SetPlan("limits@test.com", "pro")
+		Expect(err).To(BeNil())
+
+		entry, err := service.CreateJournalEntry(user.ID, items(10, 1000), time.Now())
+		Expect(err).To(BeNil())
+
+		err = service.UpdateJournalEntry(entry.ID, user.ID, items(1, 1001), Editor{})
+		Expect(errors.Is(err, JournalEntryInvalid)).To(BeTrue())
+		Expect(err).To(MatchError("Journal entries must be 1000 characters or less"))
+	})
+
+	It("should fill in what a plan leaves out", func() {
+		service.SetPlan("limits@test.com", "short")
+
+		limits, _ := service.GetJournalLimits(user.ID)
+		Expect(limits).To(Equal(JournalLimits{MaxItems: 3, MaxItemLength: 20}))
+	})
+
+	It("should fall back when the plan is removed", func() {
+		service.SetPlan("limits@test.com", "pro")
+		delete(service.plans, "pro")
+
+		limits, _ := service.GetJournalLimits(user.ID)
+		Expect(limits).To(Equal(JournalLimits{MaxItems: 3, MaxItemLength: 500}))
+	})
+
+	It("should only set configured plans", func() {
+		_, err := service.SetPlan("limits@test.com", "gold")
+		Expect(err).To(Equal(PlanInvalid))
+
+		stored, _ := service.GetUserById(user.ID)
+		Expect(stored.Plan).To(BeEmpty())
+	})
+
+	It("should apply the plan to imports", func() {
+		service.SetPlan("limits@test.com", "pro")
+
+		csv := strings.Repeat("2021-03-01,item\n", 8)
+		report, err := service.ImportJournal(user.ID, strings.NewReader(csv), ImportOptions{Format: ImportCSV})
+		Expect(err).To(BeNil())
+		Expect(report.Created).To(Equal(1))
+	})
+
+	Describe("Plans setting", func() {
+		It("should parse plans", func() {
+			plans, err := ParsePlans(" plus=20/1000, pro=50/ ,free=")
+			Expect(err).To(BeNil())
+			Expect(plans).To(Equal(map[string]JournalLimits{
+				"plus": {MaxItems: 20, MaxItemLength: 1000},
+				"pro":  {MaxItems: 50},
+				"free": {},
+			}))
+
+			plans, err = ParsePlans("")
+			Expect(err).To(BeNil())
+			Expect(plans).To(BeEmpty())
+		})
+
+		It("should reject bad plans", func() {
+			for _, spec := range []string{"pro", "=5/10", "pro=x/10", "pro=5/-1", "pro=0/10"} {
+				_, err := ParsePlans(spec)
+				Expect(err).NotTo(BeNil(), spec)
+			}
+		})
+	})
+})
@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Maintenance operations used by the admin commands. They act on an email
+// address and skip the mail round trips the web flows depend on.
+
+// indexManager is implemented by stores with versioned indices
+type indexManager interface {
+	indexStatus() ([]IndexStatus, error)
+	migrateIndexes(force bool) ([]IndexStatus, error)
+}
+
+// CreateVerifiedUser creates an account that can sign in right away
+func (s MdsService) CreateVerifiedUser(email string, password string) (User, error) {
+	if !validEmail(email) {
+		return User{}, EmailInvalid
+	}
+
+	if err := validatePassword(password, email); err != nil {
+		return User{}, err
+	}
+
+	if err := s.emailAvailable(email, ""); err != nil {
+		return User{}, err
+	}
+
+	pass, err := s.passwordHasher().Hash(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{
+		ID:           uuid.NewString(),
+		Email:        strings.ToLower(email),
+		CreateDate:   time.Now(),
+		PasswordHash: pass,
+	}
+
+	return user, s.store.SaveUser(user)
+}
+
+// VerifyUser completes a pending registration without the emailed token
+func (s MdsService) VerifyUser(email string) (string, error) {
+	user, err := s.GetUserByEmail(email, false)
+	if err != nil {
+		return "", err
+	}
+
+	if user.VerifyToken == nil {
+		return user.ID, UserAlreadyVerified
+	}
+
+	// The stored token is a hash, so consume it directly. An operator can verify an expired registration.
+	if err := s.store.ConsumeVerifyToken(user.ID, *user.VerifyToken); err != nil {
+		if err == RecordNotFound {
+			return user.ID, UserAlreadyVerified
+		}
+
+		return "", err
+	}
+
+	user.VerifyToken = nil
+	user.VerifyExpires = nil
+	user.CreateDate = time.Now()
+
+	return user.ID, s.store.SaveUser(user)
+}
+
+// SetPassword replaces the password of a verified user
+func (s MdsService) SetPassword(email string, password string) error {
+	user, err := s.GetUserByEmail(email, true)
+	if err != nil {
+		return err
+	}
+
+	return s.UpdateUser(user.ID, "", password, "")
+}
+
+// SetRole grants a verified user a role, RoleAdmin, or takes it away with ""
+func (s MdsService) SetRole(email string, role string) (User, error) {
+	if role != "" && role != RoleAdmin {
+		return User{}, RoleInvalid
+	}
+
+	user, err := s.GetUserByEmail(email, true)
+	if err != nil {
+		return User{}, err
+	}
+
+	user.Role = role
+	return user, s.store.SaveUser(user)
+}
+
+// SetPlan puts a verified user on one of the configured plans, or back on
+// the default limits with ""
+func (s MdsService) SetPlan(email string, plan string) (User, error) {
+	if _, ok := s.plans[plan]; plan != "" && !ok {
+		return User{}, PlanInvalid
+	}
+
+	user, err := s.GetUserByEmail(email, true)
+	if err != nil {
+		return User{}, err
+	}
+
+	user.Plan = plan
+	return user, s.store.SaveUser(user)
+}
+
+// ResetTwoFactor turns off two-factor authentication without the password,
+// for a user who lost their authenticator and recovery codes
+func (s MdsService) ResetTwoFactor(email string) error {
+	user, err := s.GetUserByEmail(email, true)
+	if err != nil {
+		return err
+	}
+
+	return s.clearTwoFactor(user)
+}
+
+// DeleteUser removes a user, or pending registration, with all of their
+// journal entries, sessions and access tokens
+func (s MdsService) DeleteUser(email string) error {
+	user, err := s.GetUserByEmail(email, false)
+	if err != nil {
+		return err
+	}
+
+	return s.purgeAccount(user, DeletedByAdmin)
+}
+
+// EachJournalEntry calls fn with every journal entry of a user, oldest first
+func (s MdsService) EachJournalEntry(userId string, fn func(JournalEntry) error) error {
+	if userId == "" {
+		return UserUnauthorized
+	}
+
+	return s.store.EachJournalEntry(userId, fn)
+}
+
+// IndexStatus reports the index and schema version behind each alias
+func (s MdsService) IndexStatus() ([]IndexStatus, error) {
+	indexes, ok := s.store.(indexManager)
+	if !ok {
+		return nil, IndexesUnsupported
+	}
+
+	return indexes.indexStatus()
+}
+
+// MigrateIndexes brings every index up to its schema version, force
+// reindexes into new indices even when they are current
+func (s MdsService) MigrateIndexes(force bool) ([]IndexStatus, error) {
+	indexes, ok := s.store.(indexManager)
+	if !ok {
+		return nil, IndexesUnsupported
+	}
+
+	return indexes.migrateIndexes(force)
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Maintenance", func() {
+	var service MdsService
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+	})
+
+	addEntries := func(userId string, count int) {
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		for day := 0; day < count; day++ {
+			service.store.SaveJournalEntry(JournalEntry{
+				ID:         uuid.NewString(),
+				UserId:     userId,
+				Entries:    newItems([]string{"entry"}, time.Now()),
+				Date:       start.AddDate(0, 0, day),
+				CreateDate: time.Now(),
+			})
+		}
+	}
+
+	Describe("Create verified user", func() {
+		It("should be able to log in", func() {
+			user, err := service.CreateVerifiedUser("Admin@Test.com", "password")
+			Expect(err).To(BeNil())
+			Expect(user.Email).To(Equal("admin@test.com"))
+
+			login, err := service.GetUserByLogin("admin@test.com", "password", "")
+			Expect(err).To(BeNil())
+			Expect(login.ID).To(Equal(user.ID))
+		})
+
+		It("should fail if the email is taken", func() {
+			service.CreateVerifiedUser("admin@test.com", "password")
+			_, err := service.CreateVerifiedUser("admin@test.com", "password")
+			Expect(err).To(Equal(EmailInUse))
+		})
+
+		It("should fail with a short password", func() {
+			_, err := service.CreateVerifiedUser("admin@test.com", "pass")
+			Expect(err).To(Equal(PasswordInvalid))
+		})
+	})
+
+	Describe("Verify user", func() {
+		It("should complete a pending registration", func() {
+			Expect(service.CreateUserVerification("pending@test.com", "password")).To(BeNil())
+
+			id, err := service.VerifyUser("pending@test.com")
+			Expect(err).To(BeNil())
+
+			user, err := service.GetUserById(id)
+			Expect(err).To(BeNil())
+			Expect(user.VerifyToken).To(BeNil())
+
+			_, err = service.VerifyUser("pending@test.com")
+			Expect(err).To(Equal(UserAlreadyVerified))
+		})
+
+		It("should fail for an unknown email", func() {
+			_, err := service.VerifyUser("nobody@test.com")
+			Expect(err).To(Equal(UserNotFound))
+		})
+	})
+
+	Describe("Set password", func() {
+		It("should replace the password", func() {
+			service.CreateVerifiedUser("admin@test.com", "password")
+			Expect(service.SetPassword("admin@test.com", "changed")).To(BeNil())
+
+			_, err := service.GetUserByLogin("admin@test.com", "changed", "")
+			Expect(err).To(BeNil())
+		})
+	})
+
+	Describe("Delete user", func() {
+		It("should remove the user and their journal", func() {
+			user, _ := service.CreateVerifiedUser("admin@test.com", "password")
+			addEntries(user.ID, 3)
+
+			Expect(service.DeleteUser("admin@test.com")).To(BeNil())
+
+			_, err := service.GetUserById(user.ID)
+			Expect(err).To(Equal(UserNotFound))
+
+			count := 0
+			service.EachJournalEntry(user.ID, func(entry JournalEntry) error {
+				count++
+				return nil
+			})
+			Expect(count).To(Equal(0))
+		})
+	})
+
+	Describe("Store errors", func() {
+		lookupFailed := errors.New("lookup failed")
+
+		It("should stop before writing anything", func() {
+			user, _ := service.CreateVerifiedUser("admin@test.com", "password")
+			addEntries(user.ID, 1)
+			store := service.store
+			service.store = failingLookup{Store: store, err: lookupFailed}
+
+			Expect(service.DeleteUser("admin@test.com")).To(Equal(lookupFailed))
+			_, err := service.SetRole("admin@test.com", RoleAdmin)
+			Expect(err).To(Equal(lookupFailed))
+			_, err = service.CreateVerifiedUser("admin@test.com", "password")
+			Expect(err).To(Equal(lookupFailed))
+
+			stored, err := store.GetUserById(user.ID)
+			Expect(err).To(BeNil())
+			Expect(stored.Role).To(BeEmpty())
+
+			count := 0
+			service.EachJournalEntry(user.ID, func(entry JournalEntry) error {
+				count++
+				return nil
+			})
+			Expect(count).To(Equal(1))
+		})
+	})
+
+	Describe("Each journal entry", func() {
+		It("should read every page oldest first", func() {
+			user, _ := service.CreateVerifiedUser("admin@test.com", "password")
+			addEntries(user.ID, journalPageSize+20)
+
+			var dates []time.Time
+			err := service.EachJournalEntry(user.ID, func(entry JournalEntry) error {
+				dates = append(dates, entry.Date)
+				return nil
+			})
+
+			Expect(err).To(BeNil())
+			Expect(dates).To(HaveLen(journalPageSize + 20))
+			for index := 1; index < len(dates); index++ {
+				Expect(dates[index].After(dates[index-1])).To(BeTrue())
+			}
+		})
+	})
+
+	Describe("Index status", func() {
+		It("should only be supported by elasticsearch", func() {
+			if testBackend() == BackendElastic {
+				Skip("runs against the other backends")
+			}
+
+			_, err := service.IndexStatus()
+			Expect(err).To(Equal(IndexesUnsupported))
+		})
+	})
+})
+
+// failingLookup fails every lookup by email, like an unavailable store
+type failingLookup struct {
+	Store
+	err error
+}
+
+func (s failingLookup) GetUserByEmail(email string, verified bool) (User, error) {
+	return User{}, s.err
+}
@@ -1,9 +1,9 @@
 package lib
 
+// Index bodies are typeless, as required by Elasticsearch 7 and 8. The 6.x
+// dialect nests each mapping under its type name before creating the index.
+
 const IndexUserJSON = `{
-	"mapper":{
-		 "dynamic":false
-	},
 	"settings":{
 		 "index":{
 				"analysis":{
@@ -17,38 +17,87 @@ const IndexUserJSON = `{
 		 }
 	},
 	"mappings":{
-		 "user":{
-				"properties":{
-					"user_id":{
-							"type":"keyword"
-					},
-					"email":{
-							"type":"keyword"
-					},
-					"password_hash":{
-							"type":"binary"
-					},
-					"verify_token":{
-						"type":"keyword"
-					},
-					"reset_token":{
-						"type":"keyword"
-					},
-					"create_date":{
-							"type":"date"
-					},
-					"last_login_date":{
-							"type":"date"
-					}
-				}
-		 }
+		"dynamic":false,
+		"properties":{
+			"user_id":{
+					"type":"keyword"
+			},
+			"email":{
+					"type":"keyword"
+			},
+			"password_hash":{
+					"type":"binary"
+			},
+			"verify_token":{
+				"type":"keyword"
+			},
+			"verify_expires":{
+				"type":"date"
+			},
+			"reset_token":{
+				"type":"keyword"
+			},
+			"reset_expires":{
+				"type":"date"
+			},
+			"totp_secret":{
+				"type":"keyword",
+				"index":false
+			},
+			"totp_enabled":{
+				"type":"boolean"
+			},
+			"totp_last_step":{
+				"type":"long"
+			},
+			"recovery_codes":{
+				"type":"keyword",
+				"index":false
+			},
+			"external_id":{
+				"type":"keyword"
+			},
+			"pending_email":{
+				"type":"keyword"
+			},
+			"email_token":{
+				"type":"keyword"
+			},
+			"email_expires":{
+				"type":"date"
+			},
+			"delete_after":{
+				"type":"date"
+			},
+			"role":{
+				"type":"keyword"
+			},
+			"suspended_at":{
+				"type":"date"
+			},
+			"plan":{
+				"type":"keyword"
+			},
+			"time_zone":{
+				"type":"keyword"
+			},
+			"carry_over":{
+				"type":"keyword"
+			},
+			"carry_over_after":{
+				"type":"date"
+			},
+			"create_date":{
+					"type":"date"
+			},
+			"last_login_date":{
+					"type":"date"
+			}
+		}
 	}
 }`
 
 const IndexJournalJSON = `{
-	"mapper":{
-		 "dynamic":false
-	},
 	"settings":{
 		 "index":{
 				"analysis":{
@@ -62,30 +111,221 @@ const IndexJournalJSON = `{
 		 }
 	},
 	"mappings":{
-		"journal":{  
-			"properties":{  
-				"user_id":{  
-					"type":"keyword"
-				},
-				"entries":{  
-					"type":"text",
-					"analyzer":"english"
-				},
-				"create_date":{  
-					"type":"date"
-				},
-				"date":{  
-					"type":"date"
+		"dynamic":false,
+		"properties":{
+			"user_id":{
+				"type":"keyword"
+			},
+			"entries":{
+				"properties":{
+					"id":{
+						"type":"keyword"
+					},
+					"text":{
+						"type":"text",
+						"analyzer":"english"
+					},
+					"done":{
+						"type":"boolean"
+					},
+					"create_date":{
+						"type":"date"
+					},
+					"position":{
+						"type":"integer"
+					}
 				}
+			},
+			"tags":{
+				"type":"keyword"
+			},
+			"create_date":{
+				"type":"date"
+			},
+			"date":{
+				"type":"date"
+			},
+			"deleted_at":{
+				"type":"date"
+			}
+		}
+	}
+}`
+
+const IndexLoginJSON = `{
+	"mappings":{
+		"dynamic":false,
+		"properties":{
+			"failures":{
+				"type":"integer"
+			},
+			"last_failure":{
+				"type":"date",
+				"format":"epoch_millis"
+			},
+			"locked_until":{
+				"type":"date",
+				"format":"epoch_millis"
 			}
-	  }
+		}
+	}
+}`
+
+const IndexTokenJSON = `{
+	"mappings":{
+		"dynamic":false,
+		"properties":{
+			"user_id":{
+				"type":"keyword"
+			},
+			"name":{
+				"type":"keyword"
+			},
+			"token_hash":{
+				"type":"keyword"
+			},
+			"scopes":{
+				"type":"keyword"
+			},
+			"create_date":{
+				"type":"date"
+			},
+			"last_used":{
+				"type":"date"
+			},
+			"expires":{
+				"type":"date"
+			}
+		}
+	}
+}`
+
+const IndexSessionJSON = `{
+	"mappings":{
+		"dynamic":false,
+		"properties":{
+			"user_id":{
+				"type":"keyword"
+			},
+			"session_hash":{
+				"type":"keyword"
+			},
+			"create_date":{
+				"type":"date"
+			},
+			"last_seen":{
+				"type":"date"
+			},
+			"expires":{
+				"type":"date"
+			},
+			"persist":{
+				"type":"boolean"
+			},
+			"ip":{
+				"type":"keyword"
+			},
+			"user_agent":{
+				"type":"keyword",
+				"index":false
+			}
+		}
+	}
+}`
+
+const IndexTombstoneJSON = `{
+	"mappings":{
+		"dynamic":false,
+		"properties":{
+			"email_hash":{
+				"type":"keyword"
+			},
+			"reason":{
+				"type":"keyword"
+			},
+			"create_date":{
+				"type":"date"
+			},
+			"delete_date":{
+				"type":"date"
+			}
+		}
+	}
+}`
+
+const IndexAuditJSON = `{
+	"mappings":{
+		"dynamic":false,
+		"properties":{
+			"user_id":{
+				"type":"keyword"
+			},
+			"actor_id":{
+				"type":"keyword"
+			},
+			"email":{
+				"type":"keyword"
+			},
+			"action":{
+				"type":"keyword"
+			},
+			"result":{
+				"type":"keyword"
+			},
+			"detail":{
+				"type":"keyword",
+				"index":false
+			},
+			"ip":{
+				"type":"keyword"
+			},
+			"user_agent":{
+				"type":"keyword",
+				"index":false
+			},
+			"date":{
+				"type":"date"
+			}
+		}
+	}
+}`
+
+const IndexRevisionJSON = `{
+	"mappings":{
+		"dynamic":false,
+		"properties":{
+			"entry_id":{
+				"type":"keyword"
+			},
+			"user_id":{
+				"type":"keyword"
+			},
+			"entries":{
+				"type":"object",
+				"enabled":false
+			},
+			"editor":{
+				"properties":{
+					"session_id":{
+						"type":"keyword"
+					},
+					"token_id":{
+						"type":"keyword"
+					},
+					"device":{
+						"type":"keyword",
+						"index":false
+					}
+				}
+			},
+			"date":{
+				"type":"date"
+			}
+		}
 	}
 }`
 
 const IndexVerifyJSON = `{
-	"mapper":{
-		 "dynamic":false
-	},
 	"settings":{
 		 "index":{
 				"analysis":{
@@ -99,29 +339,25 @@ const IndexVerifyJSON = `{
 		 }
 	},
 	"mappings":{
-		"verify":{
-			"properties":{
-				"email":{
-					"type":"keyword"
-				},
-				"token":{
-					"type":"keyword"
-				},
-				"password_hash":{
-					"type":"binary"
-				},
-				"create_date":{
-					"type":"date"
-				}
+		"dynamic":false,
+		"properties":{
+			"email":{
+				"type":"keyword"
+			},
+			"token":{
+				"type":"keyword"
+			},
+			"password_hash":{
+				"type":"binary"
+			},
+			"create_date":{
+				"type":"date"
 			}
-	  }
+		}
 	}
 }`
 
 const IndexPwResetJSON = `{
-	"mapper":{
-		 "dynamic":false
-	},
 	"settings":{
 		 "index":{
 				"analysis":{
@@ -135,18 +371,17 @@ const IndexPwResetJSON = `{
 		 }
 	},
 	"mappings":{
-		"pwreset":{
-			"properties":{
-			  "user_id":{
-					"type":"keyword"
-			  },
-			  "token":{
-					"type":"keyword"
-			  },
-			  "create_date":{
-					"type":"date"
-			  }
-			}
-	  }
+		"dynamic":false,
+		"properties":{
+		  "user_id":{
+				"type":"keyword"
+		  },
+		  "token":{
+				"type":"keyword"
+		  },
+		  "create_date":{
+				"type":"date"
+		  }
+		}
 	}
 }`
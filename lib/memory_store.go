@@ -0,0 +1,1053 @@
+package lib
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps every record in process. Nothing survives a restart, so
+// it is meant for local development and running the test suite without
+// Elasticsearch.
+type memoryStore struct {
+	mu       sync.RWMutex
+	users    map[string]User
+	journal  map[string]JournalEntry
+	attempts map[string]LoginAttempts
+	tokens   map[string]AccessToken
+	sessions map[string]Session
+	// revisions are earlier versions of journal entries
+	revisions map[string]Revision
+	// tombstones are only written, they are kept for auditing
+	tombstones map[string]Tombstone
+	// audit is appended to in the order events happen
+	audit []AuditEvent
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:      make(map[string]User),
+		journal:    make(map[string]JournalEntry),
+		revisions:  make(map[string]Revision),
+		attempts:   make(map[string]LoginAttempts),
+		tokens:     make(map[string]AccessToken),
+		sessions:   make(map[string]Session),
+		tombstones: make(map[string]Tombstone),
+	}
+}
+
+func copyEntry(entry JournalEntry) JournalEntry {
+	entry.Entries = append(JournalItems(nil), entry.Entries...)
+	if entry.Tags != nil {
+		entry.Tags = append([]string{}, entry.Tags...)
+	}
+
+	if entry.DeletedAt != nil {
+		deleted := *entry.DeletedAt
+		entry.DeletedAt = &deleted
+	}
+
+	return entry
+}
+
+//User Functions
+
+func (s *memoryStore) GetUserById(id string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, RecordNotFound
+	}
+
+	return user, nil
+}
+
+func (s *memoryStore) GetUserByEmail(email string, verified bool) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	email = strings.ToLower(email)
+	for _, user := range s.users {
+		if user.Email == email && (!verified || user.VerifyToken == nil) {
+			return user, nil
+		}
+	}
+
+	return User{}, RecordNotFound
+}
+
+func (s *memoryStore) GetUserByExternalID(externalId string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.ExternalID != nil && *user.ExternalID == externalId {
+			return user, nil
+		}
+	}
+
+	return User{}, RecordNotFound
+}
+
+func (s *memoryStore) SaveUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	s.users[user.ID] = user
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return RecordNotFound
+	}
+
+	delete(s.users, id)
+	return nil
+}
+
+func (s *memoryStore) GetUsersToDelete(date time.Time) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	retval := []User{}
+	for _, user := range s.users {
+		if user.DeleteAfter != nil && !user.DeleteAfter.After(date) && len(retval) < purgeBatchSize {
+			retval = append(retval, user)
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *memoryStore) GetUsersToCarryOver(date time.Time) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	retval := []User{}
+	for _, user := range s.users {
+		if user.CarryOverAfter != nil && !user.CarryOverAfter.After(date) && len(retval) < purgeBatchSize {
+			retval = append(retval, user)
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *memoryStore) SetCarryOverAfter(userId string, after *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return RecordNotFound
+	}
+
+	user.CarryOverAfter = after
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) SetSuspendedAt(userId string, at *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return RecordNotFound
+	}
+
+	user.SuspendedAt = at
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) SetPasswordHash(userId string, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return RecordNotFound
+	}
+
+	user.PasswordHash = hash
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) SaveTombstone(tombstone Tombstone) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tombstones[tombstone.ID] = tombstone
+	return nil
+}
+
+func (s *memoryStore) GetUserVerification(token string) (UserVerification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.VerifyToken != nil && *user.VerifyToken == token {
+			return UserVerification{
+				ID:           user.ID,
+				Email:        user.Email,
+				Token:        *user.VerifyToken,
+				PasswordHash: user.PasswordHash,
+				CreateDate:   user.CreateDate,
+				Expires:      timeOf(user.VerifyExpires),
+			}, nil
+		}
+	}
+
+	return UserVerification{}, RecordNotFound
+}
+
+func (s *memoryStore) SaveUserVerification(verify UserVerification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := verify.Token
+	expires := verify.Expires
+	s.users[verify.ID] = User{
+		ID:            verify.ID,
+		Email:         verify.Email,
+		PasswordHash:  verify.PasswordHash,
+		CreateDate:    verify.CreateDate,
+		VerifyToken:   &token,
+		VerifyExpires: &expires,
+	}
+
+	return nil
+}
+
+func (s *memoryStore) ConsumeVerifyToken(userId string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok || user.VerifyToken == nil || *user.VerifyToken != token {
+		return RecordNotFound
+	}
+
+	user.VerifyToken = nil
+	user.VerifyExpires = nil
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) RenewVerifyToken(userId string, token string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok || user.VerifyToken == nil {
+		return RecordNotFound
+	}
+
+	user.VerifyToken = &token
+	user.VerifyExpires = &expires
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) GetResetPassword(token string) (PasswordReset, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.ResetToken != nil && *user.ResetToken == token {
+			return PasswordReset{ID: user.ID, Token: token, Expires: timeOf(user.ResetExpires)}, nil
+		}
+	}
+
+	return PasswordReset{}, RecordNotFound
+}
+
+func (s *memoryStore) SetResetToken(userId string, token *string, expires *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return RecordNotFound
+	}
+
+	user.ResetToken = token
+	user.ResetExpires = expires
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) ConsumeResetToken(userId string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok || user.ResetToken == nil || *user.ResetToken != token {
+		return RecordNotFound
+	}
+
+	user.ResetToken = nil
+	user.ResetExpires = nil
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) GetEmailChange(token string) (EmailChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.EmailToken != nil && *user.EmailToken == token {
+			return EmailChange{ID: user.ID, Email: stringOf(user.PendingEmail), Token: token, Expires: timeOf(user.EmailExpires)}, nil
+		}
+	}
+
+	return EmailChange{}, RecordNotFound
+}
+
+func (s *memoryStore) GetPendingEmailChange(email string, now time.Time) (EmailChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.EmailToken != nil && stringOf(user.PendingEmail) == email && now.Before(timeOf(user.EmailExpires)) {
+			return EmailChange{ID: user.ID, Email: email, Token: *user.EmailToken, Expires: timeOf(user.EmailExpires)}, nil
+		}
+	}
+
+	return EmailChange{}, RecordNotFound
+}
+
+func (s *memoryStore) SetEmailChange(userId string, email *string, token *string, expires *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return RecordNotFound
+	}
+
+	user.PendingEmail = email
+	user.EmailToken = token
+	user.EmailExpires = expires
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) ConsumeEmailToken(userId string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok || user.EmailToken == nil || *user.EmailToken != token {
+		return RecordNotFound
+	}
+
+	user.EmailToken = nil
+	user.EmailExpires = nil
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) AdvanceTOTPStep(userId string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok || user.TOTPLastStep >= step {
+		return RecordNotFound
+	}
+
+	user.TOTPLastStep = step
+	s.users[userId] = user
+	return nil
+}
+
+func (s *memoryStore) UseRecoveryCode(userId string, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return RecordNotFound
+	}
+
+	codes := []string{}
+	for _, code := range user.RecoveryCodes {
+		if code != hash {
+			codes = append(codes, code)
+		}
+	}
+
+	if len(codes) == len(user.RecoveryCodes) {
+		return RecordNotFound
+	}
+
+	user.RecoveryCodes = codes
+	s.users[userId] = user
+	return nil
+}
+
+//Journal Functions
+
+func (s *memoryStore) GetJournalEntry(id string) (JournalEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.journal[id]
+	if !ok {
+		return JournalEntry{}, RecordNotFound
+	}
+
+	return copyEntry(entry), nil
+}
+
+func (s *memoryStore) GetJournalEntryByDate(userId string, date time.Time) (JournalEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	date = dayOf(date)
+	for _, entry := range s.journal {
+		if entry.UserId == userId && entry.Date.Equal(date) && entry.DeletedAt == nil {
+			return copyEntry(entry), nil
+		}
+	}
+
+	return JournalEntry{}, RecordNotFound
+}
+
+func (s *memoryStore) SaveJournalEntry(entry JournalEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.journal[entry.ID] = copyEntry(entry)
+	return nil
+}
+
+func (s *memoryStore) SaveJournalEntries(entries []JournalEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range entries {
+		s.journal[entry.ID] = copyEntry(entry)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) DeleteJournalEntry(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.journal[id]; !ok {
+		return RecordNotFound
+	}
+
+	delete(s.journal, id)
+	return nil
+}
+
+// userEntries returns a user's entries within the query's date range that
+// aren't in the trash, newest first
+func (s *memoryStore) userEntries(userId string, jq JournalQuery) []JournalEntry {
+	start := dayOf(jq.Start)
+	end := dayOf(jq.End)
+
+	var retval []JournalEntry
+	for _, entry := range s.journal {
+		if entry.UserId != userId || entry.DeletedAt != nil {
+			continue
+		}
+
+		if !jq.Start.IsZero() && entry.Date.Before(start) {
+			continue
+		}
+
+		if !jq.End.IsZero() && entry.Date.After(end) {
+			continue
+		}
+
+		if !hasTags(entry.Tags, jq.Tags) {
+			continue
+		}
+
+		retval = append(retval, copyEntry(entry))
+	}
+
+	sort.Slice(retval, func(i, j int) bool {
+		return retval[i].Date.After(retval[j].Date)
+	})
+
+	return retval
+}
+
+func (s *memoryStore) GetJournalEntries(userId string, start time.Time, end time.Time) ([]JournalEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.userEntries(userId, JournalQuery{Start: start, End: end}), nil
+}
+
+func (s *memoryStore) SearchJournal(userId string, jq JournalQuery) ([]JournalEntry, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	terms := queryTerms(jq.Query)
+	var matches []JournalEntry
+
+	for _, entry := range s.userEntries(userId, jq) {
+		if jq.Query == "" {
+			matches = append(matches, entry)
+			continue
+		}
+
+		highlighted, ok := highlightItems(entry.Entries, terms)
+		if len(highlighted) > 0 {
+			entry.Entries = highlighted
+		}
+
+		if ok || matchDate(entry.Date, terms) {
+			matches = append(matches, entry)
+		}
+	}
+
+	total := int64(len(matches))
+	limit := jq.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	if jq.Offset >= len(matches) {
+		return []JournalEntry{}, total, nil
+	}
+
+	matches = matches[jq.Offset:]
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	return matches, total, nil
+}
+
+func (s *memoryStore) SearchJournalDates(userId string, jq JournalQuery) ([]time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	terms := queryTerms(jq.Query)
+	retval := []time.Time{}
+
+	for _, entry := range s.userEntries(userId, jq) {
+		if jq.Query != "" {
+			_, ok := highlightItems(entry.Entries, terms)
+			if !ok && !matchDate(entry.Date, terms) {
+				continue
+			}
+		}
+
+		retval = append(retval, entry.Date)
+	}
+
+	return retval, nil
+}
+
+func (s *memoryStore) EachJournalEntry(userId string, fn func(JournalEntry) error) error {
+	// Copy first so fn can write to the store
+	s.mu.RLock()
+	entries := s.userEntries(userId, JournalQuery{})
+	s.mu.RUnlock()
+
+	for index := len(entries) - 1; index >= 0; index-- {
+		if err := fn(entries[index]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasTags reports whether tags includes every one that is wanted
+func hasTags(tags []string, wanted []string) bool {
+	for _, tag := range wanted {
+		found := false
+		for _, have := range tags {
+			found = found || have == tag
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *memoryStore) GetJournalTags(userId string) ([]TagCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := map[string]int64{}
+	for _, entry := range s.journal {
+		if entry.UserId != userId || entry.DeletedAt != nil {
+			continue
+		}
+
+		for _, tag := range entry.Tags {
+			counts[tag]++
+		}
+	}
+
+	retval := []TagCount{}
+	for tag, count := range counts {
+		retval = append(retval, TagCount{Tag: tag, Count: count})
+	}
+
+	return retval, nil
+}
+
+func (s *memoryStore) GetTrash(userId string, since time.Time) ([]JournalEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	retval := []JournalEntry{}
+	for _, entry := range s.journal {
+		if entry.UserId == userId && entry.DeletedAt != nil && entry.DeletedAt.After(since) {
+			retval = append(retval, copyEntry(entry))
+		}
+	}
+
+	sort.Slice(retval, func(i, j int) bool {
+		return retval[i].DeletedAt.After(*retval[j].DeletedAt)
+	})
+
+	if len(retval) > maxTrash {
+		retval = retval[:maxTrash]
+	}
+
+	return retval, nil
+}
+
+func (s *memoryStore) GetEntriesToPurge(date time.Time) ([]JournalEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	retval := []JournalEntry{}
+	for _, entry := range s.journal {
+		if entry.DeletedAt != nil && entry.DeletedAt.Before(date) && len(retval) < purgeBatchSize {
+			retval = append(retval, copyEntry(entry))
+		}
+	}
+
+	return retval, nil
+}
+
+func (s *memoryStore) DeleteJournalEntries(userId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, entry := range s.journal {
+		if entry.UserId == userId {
+			delete(s.journal, id)
+		}
+	}
+
+	return nil
+}
+
+//Revision Functions
+
+func (s *memoryStore) SaveRevision(revision Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revision.Entries = append(JournalItems(nil), revision.Entries...)
+	s.revisions[revision.ID] = revision
+	return nil
+}
+
+func (s *memoryStore) GetRevision(id string) (Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	revision, ok := s.revisions[id]
+	if !ok {
+		return Revision{}, RecordNotFound
+	}
+
+	revision.Entries = append(JournalItems(nil), revision.Entries...)
+	return revision, nil
+}
+
+// entryRevisions returns the revisions of an entry, newest first
+func (s *memoryStore) entryRevisions(entryId string) []Revision {
+	retval := []Revision{}
+	for _, revision := range s.revisions {
+		if revision.EntryID == entryId {
+			revision.Entries = append(JournalItems(nil), revision.Entries...)
+			retval = append(retval, revision)
+		}
+	}
+
+	sort.Slice(retval, func(i, j int) bool {
+		return retval[i].Date.After(retval[j].Date)
+	})
+
+	return retval
+}
+
+func (s *memoryStore) GetRevisions(entryId string, limit int) ([]Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	retval := s.entryRevisions(entryId)
+	if len(retval) > limit {
+		retval = retval[:limit]
+	}
+
+	return retval, nil
+}
+
+func (s *memoryStore) PruneRevisions(entryId string, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revisions := s.entryRevisions(entryId)
+	for index := keep; index < len(revisions); index++ {
+		delete(s.revisions, revisions[index].ID)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) DeleteRevisions(userId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, revision := range s.revisions {
+		if revision.UserId == userId {
+			delete(s.revisions, id)
+		}
+	}
+
+	return nil
+}
+
+//Access Token Functions
+
+func (s *memoryStore) GetAccessToken(hash string) (AccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, token := range s.tokens {
+		if token.Hash == hash {
+			return token, nil
+		}
+	}
+
+	return AccessToken{}, RecordNotFound
+}
+
+func (s *memoryStore) GetAccessTokens(userId string) ([]AccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	retval := []AccessToken{}
+	for _, token := range s.tokens {
+		if token.UserId == userId {
+			retval = append(retval, token)
+		}
+	}
+
+	sort.Slice(retval, func(i, j int) bool {
+		return retval[i].CreateDate.After(retval[j].CreateDate)
+	})
+
+	return retval, nil
+}
+
+func (s *memoryStore) SaveAccessToken(token AccessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token.Scopes = append([]string(nil), token.Scopes...)
+	s.tokens[token.ID] = token
+	return nil
+}
+
+func (s *memoryStore) DeleteAccessToken(userId string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok || token.UserId != userId {
+		return RecordNotFound
+	}
+
+	delete(s.tokens, id)
+	return nil
+}
+
+func (s *memoryStore) TouchAccessToken(id string, used time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return RecordNotFound
+	}
+
+	token.LastUsed = &used
+	s.tokens[id] = token
+	return nil
+}
+
+//Session Functions
+
+func (s *memoryStore) GetSession(hash string) (Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, session := range s.sessions {
+		if session.Hash == hash {
+			return session, nil
+		}
+	}
+
+	return Session{}, RecordNotFound
+}
+
+func (s *memoryStore) GetSessions(userId string) ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	retval := []Session{}
+	for _, session := range s.sessions {
+		if session.UserId == userId {
+			retval = append(retval, session)
+		}
+	}
+
+	sort.Slice(retval, func(i, j int) bool {
+		return retval[i].LastSeen.After(retval[j].LastSeen)
+	})
+
+	return retval, nil
+}
+
+func (s *memoryStore) SaveSession(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memoryStore) DeleteSession(userId string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserId != userId {
+		return RecordNotFound
+	}
+
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memoryStore) DeleteSessions(userId string, except string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if session.UserId == userId && id != except {
+			delete(s.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) TouchSession(id string, seen time.Time, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return RecordNotFound
+	}
+
+	session.LastSeen = seen
+	session.Expires = expires
+	s.sessions[id] = session
+	return nil
+}
+
+//Admin Functions
+
+func (s *memoryStore) SearchUsers(query UserQuery) ([]User, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := []User{}
+	for _, user := range s.users {
+		if query.matches(user) {
+			matched = append(matched, user)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].CreateDate.After(matched[j].CreateDate)
+	})
+
+	total := int64(len(matched))
+	if query.Offset >= len(matched) {
+		return []User{}, total, nil
+	}
+
+	matched = matched[query.Offset:]
+	if len(matched) > query.Limit {
+		matched = matched[:query.Limit]
+	}
+
+	return matched, total, nil
+}
+
+func (s *memoryStore) GetUserStats() (UserStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := UserStats{Users: int64(len(s.users))}
+	for _, entry := range s.journal {
+		if entry.DeletedAt == nil {
+			stats.JournalEntries++
+		}
+	}
+
+	for _, user := range s.users {
+		if user.VerifyToken != nil {
+			stats.Pending++
+		}
+
+		if user.SuspendedAt != nil {
+			stats.Suspended++
+		}
+
+		if user.Role == RoleAdmin {
+			stats.Admins++
+		}
+
+		if user.TOTPEnabled {
+			stats.TwoFactor++
+		}
+
+		if user.DeleteAfter != nil {
+			stats.PendingDeletion++
+		}
+	}
+
+	stats.Verified = stats.Users - stats.Pending
+	return stats, nil
+}
+
+//Audit Functions
+
+func (s *memoryStore) SaveAuditEvent(event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.audit = append(s.audit, event)
+	return nil
+}
+
+func (s *memoryStore) GetAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	retval := []AuditEvent{}
+	for i := len(s.audit) - 1; i >= 0 && len(retval) < query.Limit; i-- {
+		if query.matches(s.audit[i]) {
+			retval = append(retval, s.audit[i])
+		}
+	}
+
+	return retval, nil
+}
+
+//Login Attempt Functions
+
+func (s *memoryStore) GetLoginAttempts(key string) (LoginAttempts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok {
+		return LoginAttempts{}, RecordNotFound
+	}
+
+	return attempts, nil
+}
+
+func (s *memoryStore) AddLoginFailure(key string, now time.Time, since time.Time) (LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := s.attempts[key]
+	if attempts.LastFailure.Before(since) {
+		attempts.Failures = 0
+	}
+
+	attempts.Key = key
+	attempts.Failures++
+	attempts.LastFailure = now
+	s.attempts[key] = attempts
+
+	return attempts, nil
+}
+
+func (s *memoryStore) LockLogin(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := s.attempts[key]
+	attempts.Key = key
+	attempts.LockedUntil = until
+	s.attempts[key] = attempts
+
+	return nil
+}
+
+func (s *memoryStore) ForgiveLoginFailures(key string, count int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok {
+		return nil
+	}
+
+	attempts.Failures -= count
+	if attempts.Failures < 0 {
+		attempts.Failures = 0
+	}
+
+	s.attempts[key] = attempts
+	return nil
+}
+
+func (s *memoryStore) ClearLoginAttempts(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
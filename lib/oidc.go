@@ -0,0 +1,484 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Single sign-on uses the OpenID Connect authorization code flow with PKCE.
+// The provider is found through discovery, and the ID token returned by the
+// token endpoint is checked against the provider's published keys. A
+// provider subject is linked to a user the first time it signs in with a
+// verified email, creating the account when there isn't one.
+
+// OIDCOptions configure the sign-in provider, it is disabled without an issuer
+type OIDCOptions struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the absolute URL of the callback route
+	RedirectURL string
+}
+
+// OIDCRequest is one sign-in attempt. URL is where to send the browser, the
+// rest must be kept in the session until the callback.
+type OIDCRequest struct {
+	URL      string
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// oidcLeeway allows for clock drift when checking token times
+const oidcLeeway = time.Minute
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type oidcClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      oidcAudience `json:"aud"`
+	AuthorizedFor string       `json:"azp"`
+	Expires       int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified oidcBool     `json:"email_verified"`
+}
+
+// oidcAudience is a single client or a list of them
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// oidcBool accepts "true" as well, which some providers send
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	*b = oidcBool(strings.Trim(string(data), `"`) == "true")
+	return nil
+}
+
+type oidcKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// oidcProvider caches the discovery document and signing keys. It is shared
+// by copies of MdsService, so it is only used through a pointer.
+type oidcProvider struct {
+	options OIDCOptions
+	client  *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+func newOIDCProvider(options OIDCOptions) *oidcProvider {
+	if options.Issuer == "" {
+		return nil
+	}
+
+	options.Issuer = strings.TrimRight(options.Issuer, "/")
+	return &oidcProvider{options: options, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *oidcProvider) getJSON(target string, output interface{}) error {
+	resp, err := p.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(output)
+}
+
+// discover reads the provider's configuration once, retrying on the next
+// sign-in if it failed
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(p.options.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimRight(discovery.Issuer, "/") != p.options.Issuer {
+		return nil, errors.New("OpenID issuer " + discovery.Issuer + " doesn't match " + p.options.Issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksURI == "" {
+		return nil, errors.New("OpenID discovery document is incomplete")
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// key returns the signing key with a key id, reloading the key set when the
+// id is new in case the provider rotated its keys
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []oidcKey `json:"keys"`
+	}
+
+	if err := p.getJSON(discovery.JwksURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		if key, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, errors.New("No OpenID signing key " + kid)
+}
+
+func (k oidcKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		return new(big.Int).SetBytes(data), err
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("Unsupported curve " + k.Crv)
+		}
+
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, errors.New("Unsupported key type " + k.Kty)
+}
+
+// verify checks the ID token signature and claims, returning the claims
+func (p *oidcProvider) verify(idToken string, nonce string, now time.Time) (oidcClaims, error) {
+	var claims oidcClaims
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, OIDCTokenInvalid
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, OIDCTokenInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, OIDCTokenInvalid
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	// The algorithm must match the key, so a token can't pick a weaker one
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return claims, OIDCTokenInvalid
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return claims, OIDCTokenInvalid
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return claims, OIDCTokenInvalid
+		}
+	default:
+		return claims, OIDCTokenInvalid
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, OIDCTokenInvalid
+	}
+
+	audience := false
+	for _, client := range claims.Audience {
+		audience = audience || client == p.options.ClientID
+	}
+
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.options.Issuer,
+		!audience,
+		len(claims.Audience) > 1 && claims.AuthorizedFor != p.options.ClientID,
+		claims.Subject == "",
+		now.After(time.Unix(claims.Expires, 0).Add(oidcLeeway)),
+		time.Unix(claims.IssuedAt, 0).After(now.Add(oidcLeeway)),
+		claims.Nonce != nonce:
+		return claims, OIDCTokenInvalid
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, output interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, output)
+}
+
+// exchange trades an authorization code and the PKCE verifier for an ID token
+func (p *oidcProvider) exchange(code string, verifier string) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.options.RedirectURL},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.options.ClientID), url.QueryEscape(p.options.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK || result.IDToken == "" {
+		return "", errors.New("OpenID token request failed: " + result.Error)
+	}
+
+	return result.IDToken, nil
+}
+
+// externalID identifies a subject across providers
+func (p *oidcProvider) externalID(subject string) string {
+	return p.options.Issuer + "#" + subject
+}
+
+func randomString() (string, error) {
+	token, _, err := newToken()
+	return token, err
+}
+
+// OIDCAuthURL starts a sign-in, returning the provider URL and the values the
+// callback has to check
+func (s MdsService) OIDCAuthURL() (OIDCRequest, error) {
+	if s.oidc == nil {
+		return OIDCRequest{}, OIDCNotConfigured
+	}
+
+	discovery, err := s.oidc.discover()
+	if err != nil {
+		return OIDCRequest{}, err
+	}
+
+	var request OIDCRequest
+	for _, value := range []*string{&request.State, &request.Nonce, &request.Verifier} {
+		if *value, err = randomString(); err != nil {
+			return OIDCRequest{}, err
+		}
+	}
+
+	challenge := sha256.Sum256([]byte(request.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {s.oidc.options.ClientID},
+		"redirect_uri":          {s.oidc.options.RedirectURL},
+		"scope":                 {"openid email"},
+		"state":                 {request.State},
+		"nonce":                 {request.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	request.URL = discovery.AuthorizationEndpoint + separator + params.Encode()
+	return request, nil
+}
+
+// OIDCLogin finishes a sign-in with the code from the callback and returns
+// the linked user, creating one for a new verified email
+func (s MdsService) OIDCLogin(code string, verifier string, nonce string) (User, error) {
+	if s.oidc == nil {
+		return User{}, OIDCNotConfigured
+	}
+
+	idToken, err := s.oidc.exchange(code, verifier)
+	if err != nil {
+		return User{}, err
+	}
+
+	claims, err := s.oidc.verify(idToken, nonce, time.Now())
+	if err != nil {
+		return User{}, err
+	}
+
+	externalId := s.oidc.externalID(claims.Subject)
+	user, err := s.store.GetUserByExternalID(externalId)
+	if err == nil {
+		if user.VerifyToken != nil {
+			return User{}, UserNotFound
+		}
+
+		if user.SuspendedAt != nil {
+			return User{}, AccountSuspended
+		}
+
+		return user, nil
+	}
+
+	if err != RecordNotFound {
+		return User{}, err
+	}
+
+	if claims.Email == "" || !bool(claims.EmailVerified) {
+		return User{}, OIDCEmailUnverified
+	}
+
+	user, err = s.store.GetUserByEmail(claims.Email, false)
+	switch {
+	case err == RecordNotFound:
+		user = User{ID: uuid.NewString(), Email: strings.ToLower(claims.Email), CreateDate: time.Now()}
+	case err != nil:
+		return User{}, err
+	case user.ExternalID != nil:
+		return User{}, OIDCAccountLinked
+	case user.SuspendedAt != nil:
+		return User{}, AccountSuspended
+	case user.VerifyToken != nil:
+		// The provider has proven who owns the email, so a pending registration
+		// is completed without the password someone else may have chosen
+		user.VerifyToken = nil
+		user.VerifyExpires = nil
+		user.PasswordHash = ""
+		user.CreateDate = time.Now()
+	}
+
+	user.ExternalID = &externalId
+	if err := s.store.SaveUser(user); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OpenID Connect", func() {
+	var service MdsService
+	var server *httptest.Server
+	var key, signer *rsa.PrivateKey
+	var claims map[string]interface{}
+	var header map[string]interface{}
+	var challenge string
+
+	sign := func() string {
+		encode := func(value interface{}) string {
+			data, _ := json.Marshal(value)
+			return base64.RawURLEncoding.EncodeToString(data)
+		}
+
+		payload := encode(header) + "." + encode(claims)
+		digest := sha256.Sum256([]byte(payload))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest[:])
+		Expect(err).To(BeNil())
+		return payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	BeforeEach(func() {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).To(BeNil())
+		signer = key
+
+		mux := http.NewServeMux()
+		server = httptest.NewServer(mux)
+
+		mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 server.URL,
+				"authorization_endpoint": server.URL + "/authorize",
+				"token_endpoint":         server.URL + "/token",
+				"jwks_uri":               server.URL + "/keys",
+			})
+		})
+
+		mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		})
+
+		mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+			client, secret, _ := r.BasicAuth()
+			verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+
+			if client != "mds" || secret != "shh" || r.PostFormValue("code") != "code" ||
+				base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]string{"id_token": sign()})
+		})
+
+		service = newTestService(ServiceOptions{
+			OIDC: OIDCOptions{
+				Issuer:       server.URL,
+				ClientID:     "mds",
+				ClientSecret: "shh",
+				RedirectURL:  "http://localhost/api/account/oidc/callback",
+			},
+		})
+
+		header = map[string]interface{}{"alg": "RS256", "kid": "k1"}
+		claims = map[string]interface{}{
+			"iss":            server.URL,
+			"sub":            "subject-1",
+			"aud":            "mds",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"email":          "sso@test.com",
+			"email_verified": true,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// start begins a sign-in the way the browser would, returning the request
+	start := func() OIDCRequest {
+		request, err := service.OIDCAuthURL()
+		Expect(err).To(BeNil())
+
+		parsed, _ := url.Parse(request.URL)
+		Expect(parsed.Query().Get("code_challenge_method")).To(Equal("S256"))
+		Expect(parsed.Query().Get("state")).To(Equal(request.State))
+		challenge = parsed.Query().Get("code_challenge")
+		claims["nonce"] = request.Nonce
+		return request
+	}
+
+	login := func() (User, error) {
+		request := start()
+		return service.OIDCLogin("code", request.Verifier, request.Nonce)
+	}
+
+	It("should create a user for a new subject", func() {
+		user, err := login()
+		Expect(err).To(BeNil())
+		Expect(user.Email).To(Equal("sso@test.com"))
+		Expect(*user.ExternalID).To(Equal(server.URL + "#subject-1"))
+		Expect(user.PasswordHash).To(BeEmpty())
+
+		_, err = service.GetUserByLogin("sso@test.com", "", "127.0.0.1")
+		Expect(err).To(Equal(UserNotFound))
+	})
+
+	It("should link an existing user and then find them by subject", func() {
+		existing, err := service.CreateVerifiedUser("sso@test.com", "password")
+		Expect(err).To(BeNil())
+
+		user, err := login()
+		Expect(err).To(BeNil())
+		Expect(user.ID).To(Equal(existing.ID))
+
+		claims["email"] = "changed@test.com"
+		user, err = login()
+		Expect(err).To(BeNil())
+		Expect(user.ID).To(Equal(existing.ID))
+	})
+
+	It("should not link to an account linked to another subject", func() {
+		_, err := login()
+		Expect(err).To(BeNil())
+
+		claims["sub"] = "subject-2"
+		_, err = login()
+		Expect(err).To(Equal(OIDCAccountLinked))
+	})
+
+	It("should require a verified email", func() {
+		claims["email_verified"] = "false"
+		_, err := login()
+		Expect(err).To(Equal(OIDCEmailUnverified))
+	})
+
+	It("should take over a pending registration without its password", func() {
+		Expect(service.CreateUserVerification("sso@test.com", "password")).To(BeNil())
+
+		user, err := login()
+		Expect(err).To(BeNil())
+		Expect(user.VerifyToken).To(BeNil())
+		Expect(user.PasswordHash).To(BeEmpty())
+	})
+
+	It("should reject a mismatched PKCE verifier", func() {
+		request := start()
+		_, err := service.OIDCLogin("code", request.Verifier+"x", request.Nonce)
+		Expect(err).NotTo(BeNil())
+	})
+
+	Describe("ID token validation", func() {
+		rejects := func(change func()) {
+			request := start()
+			change()
+			_, err := service.OIDCLogin("code", request.Verifier, request.Nonce)
+			Expect(err).To(Equal(OIDCTokenInvalid))
+		}
+
+		It("should check the nonce", func() {
+			rejects(func() { claims["nonce"] = "other" })
+		})
+
+		It("should check the audience", func() {
+			rejects(func() { claims["aud"] = []string{"other", "mds"} })
+		})
+
+		It("should check the issuer", func() {
+			rejects(func() { claims["iss"] = "https://evil.example" })
+		})
+
+		It("should check the expiry", func() {
+			rejects(func() { claims["exp"] = time.Now().Add(-time.Hour).Unix() })
+		})
+
+		It("should refuse unsigned tokens", func() {
+			rejects(func() { header["alg"] = "none" })
+		})
+
+		It("should check the signature", func() {
+			rejects(func() { signer, _ = rsa.GenerateKey(rand.Reader, 2048) })
+		})
+	})
+
+	It("should be off without an issuer", func() {
+		service := MdsService{}
+		Expect(service.Init(ServiceOptions{Backend: BackendMemory})).To(BeNil())
+
+		_, err := service.OIDCAuthURL()
+		Expect(err).To(Equal(OIDCNotConfigured))
+	})
+})
@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are hashed with argon2id and stored in the PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=2$salt$key, which records the algorithm and
+// parameters alongside the hash. Older bcrypt hashes still verify and are
+// replaced the next time their user signs in. The stored value is base64
+// encoded, as the Elasticsearch mapping indexes it as binary.
+
+const (
+	// MinPasswordLength and MaxPasswordLength bound the length of a password
+	MinPasswordLength = 6
+	MaxPasswordLength = 50
+)
+
+// Argon2Params tune the cost of hashing, zero fields take their value from
+// DefaultArgon2Params
+type Argon2Params struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the OWASP recommendation for argon2id
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+
+// PasswordHasher hashes new passwords with argon2id and verifies any
+// supported hash
+type PasswordHasher struct {
+	params Argon2Params
+}
+
+func NewPasswordHasher(params Argon2Params) PasswordHasher {
+	if params.Memory == 0 {
+		params.Memory = DefaultArgon2Params.Memory
+	}
+
+	if params.Iterations == 0 {
+		params.Iterations = DefaultArgon2Params.Iterations
+	}
+
+	if params.Parallelism == 0 {
+		params.Parallelism = DefaultArgon2Params.Parallelism
+	}
+
+	if params.SaltLength == 0 {
+		params.SaltLength = DefaultArgon2Params.SaltLength
+	}
+
+	if params.KeyLength == 0 {
+		params.KeyLength = DefaultArgon2Params.KeyLength
+	}
+
+	return PasswordHasher{params: params}
+}
+
+// passwordHasher hashes with the configured parameters
+func (s MdsService) passwordHasher() PasswordHasher {
+	return NewPasswordHasher(s.argon2)
+}
+
+// validatePassword applies the password policy
+func validatePassword(password string, email string) error {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength || strings.TrimSpace(password) == "" {
+		return PasswordInvalid
+	}
+
+	if email != "" && strings.EqualFold(password, email) {
+		return PasswordIsEmail
+	}
+
+	return nil
+}
+
+// Hash returns the stored form of a new password hash
+func (h PasswordHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	return base64.StdEncoding.EncodeToString([]byte(encoded)), nil
+}
+
+// Verify checks a password against a stored hash, returning PasswordMismatch
+// when it doesn't match
+func (h PasswordHasher) Verify(stored string, password string) error {
+	decoded, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return err
+	}
+
+	encoded := string(decoded)
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := parseArgon2(encoded)
+		if err != nil {
+			return err
+		}
+
+		actual := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		if subtle.ConstantTimeCompare(actual, key) != 1 {
+			return PasswordMismatch
+		}
+
+		return nil
+	case strings.HasPrefix(encoded, "$2"):
+		err := bcrypt.CompareHashAndPassword(decoded, []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return PasswordMismatch
+		}
+
+		return err
+	}
+
+	return errors.New("Unknown password hash format")
+}
+
+// NeedsRehash reports whether a stored hash uses another algorithm or
+// parameters than new hashes
+func (h PasswordHasher) NeedsRehash(stored string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return true
+	}
+
+	params, _, _, err := parseArgon2(string(decoded))
+	return err != nil || params != h.params
+}
+
+// burn does the work of a verification without a hash, so unknown accounts
+// take as long to reject as wrong passwords
+func (h PasswordHasher) burn(password string) {
+	argon2.IDKey([]byte(password), make([]byte, h.params.SaltLength), h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+}
+
+func parseArgon2(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	var version int
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("Invalid argon2id hash")
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("Unsupported argon2 version")
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"encoding/base64"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("Passwords", func() {
+	var service MdsService
+	var params = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{Argon2: params})
+	})
+
+	stored := func(hash string) string {
+		decoded, err := base64.StdEncoding.DecodeString(hash)
+		Expect(err).To(BeNil())
+		return string(decoded)
+	}
+
+	Describe("Hasher", func() {
+		It("should verify what it hashes", func() {
+			hasher := NewPasswordHasher(params)
+			hash, err := hasher.Hash("password")
+			Expect(err).To(BeNil())
+			Expect(stored(hash)).To(HavePrefix("$argon2id$v=19$m=1024,t=1,p=1$"))
+
+			Expect(hasher.Verify(hash, "password")).To(BeNil())
+			Expect(hasher.Verify(hash, "Password")).To(Equal(PasswordMismatch))
+			Expect(hasher.NeedsRehash(hash)).To(BeFalse())
+		})
+
+		It("should salt every hash", func() {
+			hasher := NewPasswordHasher(params)
+			first, _ := hasher.Hash("password")
+			second, _ := hasher.Hash("password")
+			Expect(first).NotTo(Equal(second))
+		})
+
+		It("should verify bcrypt hashes and ask for a rehash", func() {
+			pass, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+			hash := base64.StdEncoding.EncodeToString(pass)
+			hasher := NewPasswordHasher(params)
+
+			Expect(hasher.Verify(hash, "password")).To(BeNil())
+			Expect(hasher.Verify(hash, "wrong")).To(Equal(PasswordMismatch))
+			Expect(hasher.NeedsRehash(hash)).To(BeTrue())
+		})
+
+		It("should ask for a rehash when the parameters change", func() {
+			hash, _ := NewPasswordHasher(params).Hash("password")
+			stronger := NewPasswordHasher(Argon2Params{Memory: 2048, Iterations: 1, Parallelism: 1})
+
+			Expect(stronger.NeedsRehash(hash)).To(BeTrue())
+			Expect(stronger.Verify(hash, "password")).To(BeNil())
+		})
+
+		It("should reject unknown hashes", func() {
+			hash := base64.StdEncoding.EncodeToString([]byte("$md5$abc"))
+			Expect(NewPasswordHasher(params).Verify(hash, "password")).NotTo(BeNil())
+		})
+
+		It("should fill in default parameters", func() {
+			Expect(NewPasswordHasher(Argon2Params{}).params).To(Equal(DefaultArgon2Params))
+		})
+	})
+
+	Describe("Policy", func() {
+		It("should check the length", func() {
+			Expect(validatePassword("short", "")).To(Equal(PasswordInvalid))
+			Expect(validatePassword(strings.Repeat("a", MaxPasswordLength+1), "")).To(Equal(PasswordInvalid))
+			Expect(validatePassword("      ", "")).To(Equal(PasswordInvalid))
+			Expect(validatePassword("password", "")).To(BeNil())
+		})
+
+		It("should not allow the email address", func() {
+			Expect(validatePassword("Me@Test.com", "me@test.com")).To(Equal(PasswordIsEmail))
+		})
+
+		It("should apply to registration and password changes", func() {
+			Expect(service.CreateUserVerification("me@test.com", "me@test.com")).To(Equal(PasswordIsEmail))
+
+			user, err := service.CreateVerifiedUser("me@test.com", "password")
+			Expect(err).To(BeNil())
+			Expect(service.UpdateUser(user.ID, "", "pass", "")).To(Equal(PasswordInvalid))
+			Expect(service.UpdateUser(user.ID, "", "me@test.com", "")).To(Equal(PasswordIsEmail))
+		})
+	})
+
+	Describe("Login", func() {
+		It("should rehash a bcrypt password", func() {
+			user, err := service.CreateVerifiedUser("me@test.com", "password")
+			Expect(err).To(BeNil())
+
+			pass, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+			user.PasswordHash = base64.StdEncoding.EncodeToString(pass)
+			Expect(service.store.SaveUser(user)).To(BeNil())
+
+			_, err = service.GetUserByLogin("me@test.com", "password", "")
+			Expect(err).To(BeNil())
+
+			actual, err := service.store.GetUserById(user.ID)
+			Expect(err).To(BeNil())
+			Expect(stored(actual.PasswordHash)).To(HavePrefix("$argon2id$"))
+
+			_, err = service.GetUserByLogin("me@test.com", "password", "")
+			Expect(err).To(BeNil())
+		})
+
+		It("should keep the hash after a failed login", func() {
+			pass, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+			user, _ := service.CreateVerifiedUser("me@test.com", "password")
+			user.PasswordHash = base64.StdEncoding.EncodeToString(pass)
+			service.store.SaveUser(user)
+
+			_, err := service.GetUserByLogin("me@test.com", "wrong", "")
+			Expect(err).To(Equal(UserNotFound))
+
+			actual, _ := service.store.GetUserById(user.ID)
+			Expect(actual.PasswordHash).To(Equal(user.PasswordHash))
+		})
+
+		It("should rehash when the parameters change", func() {
+			user, _ := service.CreateVerifiedUser("me@test.com", "password")
+
+			service.argon2 = Argon2Params{Memory: 2048, Iterations: 1, Parallelism: 1}
+			_, err := service.GetUserByLogin("me@test.com", "password", "")
+			Expect(err).To(BeNil())
+
+			actual, _ := service.store.GetUserById(user.ID)
+			Expect(stored(actual.PasswordHash)).To(HavePrefix("$argon2id$v=19$m=2048,t=1,p=1$"))
+		})
+	})
+})
@@ -0,0 +1,289 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Before an entry's items change, the items it had are kept as a revision
+// along with the session or device that changed them, so an edit made by
+// mistake on another device can be undone. Only the newest few of each entry
+// are kept, see ServiceOptions.RevisionLimit.
+
+// DefaultRevisionLimit is how many revisions of each entry are kept when the
+// settings don't say
+const DefaultRevisionLimit = 20
+
+const (
+	// ItemAdded is an item only the newer version has
+	ItemAdded = "added"
+	// ItemRemoved is an item only the older version has
+	ItemRemoved = "removed"
+	// ItemChanged is an item whose text or done state changed
+	ItemChanged = "changed"
+	// ItemMoved is an item that only changed position
+	ItemMoved = "moved"
+)
+
+// Editor is where a change to an entry was made from
+type Editor struct {
+	// SessionID is the sign-in session, empty for access tokens and jobs
+	SessionID string `json:"session_id,omitempty"`
+	// TokenID is the personal access token the change was made with
+	TokenID string `json:"token_id,omitempty"`
+	// Device is the user agent, or what made the change when there was none
+	Device string `json:"device,omitempty"`
+}
+
+// nightlyEditor makes the nightly carry over's changes
+var nightlyEditor = Editor{Device: "Nightly carry over"}
+
+// Revision is the items an entry had before it was changed
+type Revision struct {
+	ID      string       `json:"id"`
+	EntryID string       `json:"entry_id"`
+	UserId  string       `json:"user_id"`
+	Entries JournalItems `json:"entries"`
+	// Editor made the change that replaced these items
+	Editor Editor    `json:"editor"`
+	Date   time.Time `json:"date"`
+}
+
+func (r *Revision) GetID() string   { return r.ID }
+func (r *Revision) SetID(id string) { r.ID = id }
+
+// ItemChange is one item that differs between two versions of an entry
+type ItemChange struct {
+	ItemID string       `json:"item_id"`
+	Change string       `json:"change"`
+	Before *JournalItem `json:"before,omitempty"`
+	After  *JournalItem `json:"after,omitempty"`
+}
+
+// RevisionDiff lists the items that differ from one version to another, an
+// empty To being the entry as it is now
+type RevisionDiff struct {
+	From    string       `json:"from"`
+	To      string       `json:"to"`
+	Changes []ItemChange `json:"changes"`
+}
+
+// sameItems reports whether two lists have the same items in the same order
+func sameItems(a JournalItems, b JournalItems) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for index := range a {
+		if a[index].ID != b[index].ID || a[index].Text != b[index].Text || a[index].Done != b[index].Done {
+			return false
+		}
+	}
+
+	return true
+}
+
+// movedItems returns the IDs of the items in both lists that changed places,
+// those left out of the longest run of items still in the same order
+func movedItems(before JournalItems, after JournalItems) map[string]bool {
+	var a, b []string
+	for _, item := range before {
+		if after.index(item.ID) >= 0 {
+			a = append(a, item.ID)
+		}
+	}
+
+	for _, item := range after {
+		if before.index(item.ID) >= 0 {
+			b = append(b, item.ID)
+		}
+	}
+
+	// lengths[i][j] is the longest common run of a[i:] and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	moved := map[string]bool{}
+	for _, id := range a {
+		moved[id] = true
+	}
+
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if a[i] == b[j] {
+			delete(moved, a[i])
+			i++
+			j++
+		} else if lengths[i+1][j] >= lengths[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	return moved
+}
+
+// diffItems compares items by ID, listing them in the newer order followed
+// by the removed ones
+func diffItems(before JournalItems, after JournalItems) []ItemChange {
+	changes := []ItemChange{}
+	moved := movedItems(before, after)
+	for index := range after {
+		item := &after[index]
+		found := before.index(item.ID)
+		if found < 0 {
+			changes = append(changes, ItemChange{ItemID: item.ID, Change: ItemAdded, After: item})
+			continue
+		}
+
+		old := &before[found]
+		if old.Text != item.Text || old.Done != item.Done {
+			changes = append(changes, ItemChange{ItemID: item.ID, Change: ItemChanged, Before: old, After: item})
+		} else if moved[item.ID] {
+			changes = append(changes, ItemChange{ItemID: item.ID, Change: ItemMoved, Before: old, After: item})
+		}
+	}
+
+	for index := range before {
+		if after.index(before[index].ID) < 0 {
+			changes = append(changes, ItemChange{ItemID: before[index].ID, Change: ItemRemoved, Before: &before[index]})
+		}
+	}
+
+	return changes
+}
+
+// keepRevision stores previous as a revision of the entry, then drops the
+// oldest revisions past the limit
+func (s MdsService) keepRevision(entry JournalEntry, previous JournalItems, editor Editor) error {
+	err := s.store.SaveRevision(Revision{
+		ID:      uuid.NewString(),
+		EntryID: entry.ID,
+		UserId:  entry.UserId,
+		Entries: previous,
+		Editor:  editor,
+		Date:    time.Now().UTC(),
+	})
+
+	if err == nil {
+		err = s.store.PruneRevisions(entry.ID, s.revisionLimit())
+	}
+
+	return err
+}
+
+// saveRevised stores an entry that already existed with saveItems, keeping
+// the items it had before as a revision when they changed. previous must not
+// share items with entry.Entries.
+func (s MdsService) saveRevised(entry JournalEntry, previous JournalItems, editor Editor) error {
+	if !sameItems(previous, entry.Entries) {
+		if err := s.keepRevision(entry, previous, editor); err != nil {
+			return err
+		}
+	}
+
+	return s.saveItems(entry)
+}
+
+func (s MdsService) revisionLimit() int {
+	if s.keepRevisions <= 0 {
+		return DefaultRevisionLimit
+	}
+
+	return s.keepRevisions
+}
+
+// userRevision loads a revision of one of the user's entries
+func (s MdsService) userRevision(entry JournalEntry, id string) (Revision, error) {
+	revision, err := s.store.GetRevision(id)
+	if err == RecordNotFound || (err == nil && revision.EntryID != entry.ID) {
+		return Revision{}, RevisionNotFound
+	}
+
+	return revision, err
+}
+
+// GetRevisions lists the earlier versions of an entry, newest first
+func (s MdsService) GetRevisions(userId string, entryId string) ([]Revision, error) {
+	entry, err := s.userEntry(entryId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.store.GetRevisions(entry.ID, s.revisionLimit())
+}
+
+// DiffRevisions compares two revisions of an entry item by item, or a
+// revision with the entry as it is now when to is empty
+func (s MdsService) DiffRevisions(userId string, entryId string, from string, to string) (RevisionDiff, error) {
+	diff := RevisionDiff{From: from, To: to}
+	entry, err := s.userEntry(entryId, userId)
+	if err != nil {
+		return diff, err
+	}
+
+	before, err := s.userRevision(entry, from)
+	if err != nil {
+		return diff, err
+	}
+
+	after := entry.Entries
+	if to != "" {
+		revision, err := s.userRevision(entry, to)
+		if err != nil {
+			return diff, err
+		}
+
+		after = revision.Entries
+	}
+
+	diff.Changes = diffItems(before.Entries, after)
+	return diff, nil
+}
+
+// RestoreRevision puts an entry's items back the way a revision has them.
+// The items it replaces are kept as a revision, so a restore can be undone.
+func (s MdsService) RestoreRevision(userId string, entryId string, revisionId string, editor Editor) (JournalEntry, error) {
+	limits, err := s.GetJournalLimits(userId)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	entry, err := s.userEntry(entryId, userId)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	revision, err := s.userRevision(entry, revisionId)
+	if err == nil {
+		err = limits.checkCount(len(revision.Entries))
+	}
+
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	previous := entry.Entries
+	entry.Entries = append(JournalItems{}, revision.Entries...)
+	if err := s.saveRevised(entry, previous, editor); err != nil {
+		return JournalEntry{}, err
+	}
+
+	entry.Tags = extractTags(entry.Entries.Texts())
+	return entry, nil
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Revisions", func() {
+	var service MdsService
+	var user User
+	var entry JournalEntry
+	phone := Editor{SessionID: "phone", Device: "Phone"}
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{RevisionLimit: 3})
+
+		var err error
+		user, err = service.CreateVerifiedUser("revisions@test.com", "password")
+		Expect(err).To(BeNil())
+
+		entry, err = service.CreateJournalEntry(user.ID, []string{"first", "second"}, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC))
+		Expect(err).To(BeNil())
+	})
+
+	revisions := func() []Revision {
+		found, err := service.GetRevisions(user.ID, entry.ID)
+		Expect(err).To(BeNil())
+		return found
+	}
+
+	It("should keep the items an edit replaced", func() {
+		Expect(service.UpdateJournalEntry(entry.ID, user.ID, []string{"first", "changed"}, phone)).To(BeNil())
+
+		found := revisions()
+		Expect(found).To(HaveLen(1))
+		Expect(found[0].Entries.Texts()).To(Equal([]string{"first", "second"}))
+		Expect(found[0].Entries[1].ID).To(Equal(entry.Entries[1].ID))
+		Expect(found[0].Editor).To(Equal(phone))
+		Expect(found[0].Date).NotTo(BeZero())
+	})
+
+	It("should not keep a revision when nothing changed", func() {
+		Expect(service.UpdateJournalEntry(entry.ID, user.ID, []string{"first", "second"}, phone)).To(BeNil())
+		Expect(revisions()).To(BeEmpty())
+	})
+
+	It("should only keep the newest revisions", func() {
+		service.AddJournalItem(entry.ID, user.ID, "third", phone)
+		service.ToggleJournalItem(entry.ID, user.ID, entry.Entries[0].ID, phone)
+		service.EditJournalItem(entry.ID, user.ID, entry.Entries[1].ID, "edited", phone)
+		service.RemoveJournalItem(entry.ID, user.ID, entry.Entries[0].ID, phone)
+
+		found := revisions()
+		Expect(found).To(HaveLen(3))
+		Expect(found[0].Entries.Texts()).To(Equal([]string{"first", "edited", "third"}))
+		Expect(found[2].Entries.Texts()).To(Equal([]string{"first", "second", "third"}))
+	})
+
+	It("should compare versions item by item", func() {
+		third, _ := service.AddJournalItem(entry.ID, user.ID, "third", phone)
+		service.ReorderJournalItems(entry.ID, user.ID, []string{entry.Entries[1].ID, entry.Entries[0].ID, third.ID}, phone)
+		Expect(service.UpdateJournalEntry(entry.ID, user.ID, []string{"second", "first", "fourth"}, phone)).To(BeNil())
+		service.ToggleJournalItem(entry.ID, user.ID, entry.Entries[1].ID, phone)
+
+		oldest := revisions()[len(revisions())-1]
+		diff, err := service.DiffRevisions(user.ID, entry.ID, oldest.ID, "")
+		Expect(err).To(BeNil())
+
+		changes := map[string]string{}
+		for _, change := range diff.Changes {
+			changes[change.ItemID] = change.Change
+		}
+
+		Expect(changes).To(HaveKeyWithValue(entry.Entries[0].ID, ItemMoved))
+		Expect(changes).To(HaveKeyWithValue(entry.Entries[1].ID, ItemChanged))
+		Expect(changes).To(HaveKeyWithValue(third.ID, ItemRemoved))
+		Expect(changes).To(HaveLen(4))
+		Expect(diff.Changes[2].Change).To(Equal(ItemAdded))
+		Expect(diff.Changes[2].After.Text).To(Equal("fourth"))
+
+		_, err = service.DiffRevisions(user.ID, entry.ID, "missing", "")
+		Expect(err).To(Equal(RevisionNotFound))
+	})
+
+	It("should restore a revision", func() {
+		Expect(service.UpdateJournalEntry(entry.ID, user.ID, []string{"wiped #out"}, phone)).To(BeNil())
+		revision := revisions()[0]
+
+		restored, err := service.RestoreRevision(user.ID, entry.ID, revision.ID, Editor{Device: "Laptop"})
+		Expect(err).To(BeNil())
+		Expect(restored.Entries.Texts()).To(Equal([]string{"first", "second"}))
+		Expect(restored.Tags).To(BeEmpty())
+
+		stored, _ := service.GetJournalEntryByDate(user.ID, entry.Date)
+		Expect(stored.Entries[0].ID).To(Equal(entry.Entries[0].ID))
+
+		found := revisions()
+		Expect(found).To(HaveLen(2))
+		Expect(found[0].Entries.Texts()).To(Equal([]string{"wiped #out"}))
+		Expect(found[0].Editor.Device).To(Equal("Laptop"))
+	})
+
+	It("should only show the user's own revisions", func() {
+		other, _ := service.CreateVerifiedUser("other@test.com", "password")
+		otherEntry, _ := service.CreateJournalEntry(other.ID, []string{"theirs"}, entry.Date)
+		service.UpdateJournalEntry(otherEntry.ID, other.ID, []string{"changed"}, phone)
+		theirs, _ := service.GetRevisions(other.ID, otherEntry.ID)
+
+		_, err := service.GetRevisions(other.ID, entry.ID)
+		Expect(err).To(Equal(EntryNotFound))
+
+		_, err = service.RestoreRevision(user.ID, entry.ID, theirs[0].ID, phone)
+		Expect(err).To(Equal(RevisionNotFound))
+	})
+
+	It("should remove revisions when the entry is purged", func() {
+		service.UpdateJournalEntry(entry.ID, user.ID, []string{"changed"}, phone)
+		revision := revisions()[0]
+
+		Expect(service.DeleteJournalEntry(entry.ID, user.ID)).To(BeNil())
+		_, err := service.GetRevisions(user.ID, entry.ID)
+		Expect(err).To(Equal(EntryNotFound))
+
+		service.PurgeTrash(time.Now().Add(TrashRetention + time.Hour))
+		_, err = service.store.GetRevision(revision.ID)
+		Expect(err).To(Equal(RecordNotFound))
+	})
+
+	Describe("Controller", func() {
+		var router *gin.Engine
+
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			controller := Controller{}
+			controller.SetOptions(service, false)
+
+			router = gin.New()
+			router.Use(sessions.Sessions("my_session", cookie.NewStore([]byte("secret"))))
+			router.Use(func(c *gin.Context) {
+				c.Set("userId", user.ID)
+				c.Set("session", Session{ID: "desktop"})
+			})
+			router.PUT("/api/journal/:id", controller.UpdateEntry)
+			router.GET("/api/revisions/:entry", controller.GetRevisions)
+			router.GET("/api/revisions/:entry/diff", controller.DiffRevisions)
+			router.POST("/api/revisions/:entry/:revision/restore", controller.RestoreRevision)
+		})
+
+		request := func(method string, path string, body string) (int, Response) {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", "Desktop browser")
+			router.ServeHTTP(recorder, req)
+
+			var response Response
+			json.Unmarshal(recorder.Body.Bytes(), &response)
+			return recorder.Code, response
+		}
+
+		It("should record where an edit came from", func() {
+			code, _ := request("PUT", "/api/journal/"+entry.ID, `{"entries":["changed"]}`)
+			Expect(code).To(Equal(200))
+
+			Expect(revisions()[0].Editor).To(Equal(Editor{SessionID: "desktop", Device: "Desktop browser"}))
+
+			code, response := request("GET", "/api/revisions/"+entry.ID, "")
+			Expect(code).To(Equal(200))
+			Expect(response.Result).To(HaveLen(1))
+		})
+
+		It("should diff and restore revisions", func() {
+			service.UpdateJournalEntry(entry.ID, user.ID, []string{"changed"}, phone)
+			revision := revisions()[0]
+
+			code, response := request("GET", "/api/revisions/"+entry.ID+"/diff?from="+revision.ID, "")
+			Expect(code).To(Equal(200))
+			Expect(response.Result).To(HaveKeyWithValue("changes", HaveLen(3)))
+
+			code, _ = request("GET", "/api/revisions/"+entry.ID+"/diff", "")
+			Expect(code).To(Equal(http.StatusBadRequest))
+
+			code, response = request("POST", "/api/revisions/"+entry.ID+"/"+revision.ID+"/restore", "")
+			Expect(code).To(Equal(200))
+			Expect(response.Result).To(HaveKeyWithValue("id", entry.ID))
+
+			code, response = request("POST", "/api/revisions/"+entry.ID+"/missing/restore", "")
+			Expect(code).To(Equal(http.StatusNotFound))
+			Expect(response.Error).To(Equal(RevisionNotFound.Error()))
+		})
+	})
+})
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The helpers below approximate the query_string parsing and english
+// analyzer used by the Elasticsearch mapping closely enough for the
+// Service contract on the other backends.
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "if": true, "in": true, "into": true, "is": true,
+	"it": true, "no": true, "not": true, "of": true, "on": true, "or": true, "such": true,
+	"that": true, "the": true, "their": true, "then": true, "there": true, "these": true,
+	"they": true, "this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// queryTerms splits a query string into lower case terms, dropping operators and stop words
+func queryTerms(query string) []string {
+	var terms []string
+	for _, field := range strings.Fields(query) {
+		if field == "AND" || field == "OR" || field == "NOT" || field == "&&" || field == "||" {
+			continue
+		}
+
+		term := strings.ToLower(strings.Trim(field, "\"()+-!"))
+		if term == "" || stopWords[term] {
+			continue
+		}
+
+		terms = append(terms, term)
+	}
+
+	return terms
+}
+
+func stem(word string) string {
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-3] + "y"
+	case len(word) > 5 && strings.HasSuffix(word, "ing"):
+		word = word[:len(word)-3]
+	case len(word) > 4 && strings.HasSuffix(word, "ed"):
+		word = word[:len(word)-2]
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss"):
+		word = word[:len(word)-1]
+	}
+
+	return word
+}
+
+func matchTerm(term string, word string) bool {
+	word = strings.ToLower(word)
+	if strings.HasSuffix(term, "*") {
+		return strings.HasPrefix(word, strings.TrimSuffix(term, "*"))
+	}
+
+	return word == term || stem(word) == stem(term)
+}
+
+func matchDate(date time.Time, terms []string) bool {
+	for _, term := range terms {
+		if term == date.Format("2006-01-02") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// highlightItems wraps matching words in strong tags and returns only the
+// items that matched, like an Elasticsearch highlight on an array field.
+func highlightItems(items JournalItems, terms []string) (JournalItems, bool) {
+	var retval JournalItems
+	for _, item := range items {
+		if highlighted, ok := highlight(item.Text, terms); ok {
+			item.Text = highlighted
+			retval = append(retval, item)
+		}
+	}
+
+	return retval, len(retval) > 0
+}
+
+func highlight(text string, terms []string) (string, bool) {
+	var b strings.Builder
+	matched := false
+	runes := []rune(text)
+
+	for i := 0; i < len(runes); {
+		if !unicode.IsLetter(runes[i]) && !unicode.IsDigit(runes[i]) {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j])) {
+			j++
+		}
+
+		word := string(runes[i:j])
+		hit := false
+		for _, term := range terms {
+			if matchTerm(term, word) {
+				hit = true
+				break
+			}
+		}
+
+		if hit {
+			matched = true
+			b.WriteString("<strong>" + word + "</strong>")
+		} else {
+			b.WriteString(word)
+		}
+
+		i = j
+	}
+
+	return b.String(), matched
+}
@@ -1,9 +1,8 @@
 package lib
 
 import (
-	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -11,44 +10,44 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/kennygrant/sanitize"
-	"github.com/olivere/elastic"
 	"github.com/sendgrid/rest"
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// esIndex the main ES index, default to mds
-var esIndex = "mds"
-
-const (
-	// userType ES index for user data
-	userType = "user"
-	// journalType ES index for journal entries
-	journalType = "journal"
-)
-
-func userIndex() string {
-	return esIndex + "_" + userType
-}
-
-func journalIndex() string {
-	return esIndex + "_" + journalType
-}
-
-type IdDocument interface {
-	GetID() string
-	SetID(id string)
-}
-
 type User struct {
-	ID            string    `json:"id,omitempty"`
-	Email         string    `json:"email"`
-	PasswordHash  string    `json:"password_hash"`
-	CreateDate    time.Time `json:"create_date"`
-	LastLoginDate time.Time `json:"last_login_date"`
-	VerifyToken   *string   `json:"verify_token"`
-	ResetToken    *string   `json:"reset_token"`
+	ID            string     `json:"id,omitempty"`
+	Email         string     `json:"email"`
+	PasswordHash  string     `json:"password_hash"`
+	CreateDate    time.Time  `json:"create_date"`
+	LastLoginDate time.Time  `json:"last_login_date"`
+	VerifyToken   *string    `json:"verify_token"`
+	VerifyExpires *time.Time `json:"verify_expires"`
+	ResetToken    *string    `json:"reset_token"`
+	ResetExpires  *time.Time `json:"reset_expires"`
+	TOTPSecret    *string    `json:"totp_secret"`
+	TOTPEnabled   bool       `json:"totp_enabled"`
+	TOTPLastStep  int64      `json:"totp_last_step"`
+	RecoveryCodes []string   `json:"recovery_codes"`
+	// ExternalID links the user to an OpenID Connect subject, see externalID
+	ExternalID *string `json:"external_id"`
+	// PendingEmail is an address waiting for EmailToken to be confirmed
+	PendingEmail *string    `json:"pending_email"`
+	EmailToken   *string    `json:"email_token"`
+	EmailExpires *time.Time `json:"email_expires"`
+	// DeleteAfter is set while a requested account deletion can be cancelled
+	DeleteAfter *time.Time `json:"delete_after"`
+	// Role is RoleAdmin for administrators and empty for everyone else
+	Role        string     `json:"role"`
+	SuspendedAt *time.Time `json:"suspended_at"`
+	// Plan names the JournalLimits the user gets instead of the defaults
+	Plan string `json:"plan"`
+	// TimeZone is the IANA name dates are resolved in, UTC when empty
+	TimeZone string `json:"time_zone"`
+	// CarryOver is the nightly carry over mode, off when empty, and
+	// CarryOverAfter when it next runs
+	CarryOver      string     `json:"carry_over"`
+	CarryOverAfter *time.Time `json:"carry_over_after"`
 }
 
 func (u *User) GetID() string   { return u.ID }
@@ -60,6 +59,7 @@ type UserVerification struct {
 	Token        string    `json:"verify_token"`
 	PasswordHash string    `json:"password_hash"`
 	CreateDate   time.Time `json:"create_date"`
+	Expires      time.Time `json:"verify_expires"`
 }
 
 func (u *UserVerification) GetID() string   { return u.ID }
@@ -69,17 +69,31 @@ type PasswordReset struct {
 	ID         string    `json:"-"`
 	Token      string    `json:"reset_token"`
 	CreateDate time.Time `json:"create_date"`
+	Expires    time.Time `json:"reset_expires"`
 }
 
 func (u *PasswordReset) GetID() string   { return u.ID }
 func (u *PasswordReset) SetID(id string) { u.ID = id }
 
+type EmailChange struct {
+	ID      string    `json:"-"`
+	Email   string    `json:"pending_email"`
+	Token   string    `json:"email_token"`
+	Expires time.Time `json:"email_expires"`
+}
+
+func (u *EmailChange) GetID() string   { return u.ID }
+func (u *EmailChange) SetID(id string) { u.ID = id }
+
 type JournalEntry struct {
-	UserId     string    `json:"user_id"`
-	Entries    []string  `json:"entries"`
-	Date       time.Time `json:"date"`
-	CreateDate time.Time `json:"create_date"`
-	ID         string    `json:"id,omitempty"`
+	UserId     string       `json:"user_id"`
+	Entries    JournalItems `json:"entries"`
+	Tags       []string     `json:"tags"` // the hashtags in Entries, see extractTags
+	Date       time.Time    `json:"date"`
+	CreateDate time.Time    `json:"create_date"`
+	ID         string       `json:"id,omitempty"`
+	// DeletedAt is when the entry was moved to the trash, see TrashRetention
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 func (u *JournalEntry) GetID() string   { return u.ID }
@@ -89,6 +103,7 @@ type JournalQuery struct {
 	Start  time.Time
 	End    time.Time
 	Query  string
+	Tags   []string // entries must have every one of them
 	Limit  int
 	Offset int
 	SortBy string
@@ -97,8 +112,8 @@ type JournalQuery struct {
 type Service interface {
 	GetUserById(id string) (User, error)
 	GetUserByEmail(email string, verified bool) (User, error)
-	GetUserByLogin(email string, password string) (User, error)
-	UpdateUser(id string, email string, password string) error
+	GetUserByLogin(email string, password string, ip string) (User, error)
+	UpdateUser(id string, email string, password string, keepSession string) error
 	GetUserVerification(token string) (string, UserVerification, error)
 	CreateUserVerification(email string, password string) error
 	CreateUser(verificationToken string) (string, error)
@@ -106,12 +121,61 @@ type Service interface {
 	CreateAndSendResetPassword(email string) error
 	ResetPassword(token string, password string) error
 	CreateJournalEntry(userId string, entries []string, date time.Time) (JournalEntry, error)
-	UpdateJournalEntry(id string, userId string, entries []string) error
+	UpdateJournalEntry(id string, userId string, entries []string, editor Editor) error
+	AddJournalItem(entryId string, userId string, text string, editor Editor) (JournalItem, error)
+	EditJournalItem(entryId string, userId string, itemId string, text string, editor Editor) (JournalItem, error)
+	ToggleJournalItem(entryId string, userId string, itemId string, editor Editor) (JournalItem, error)
+	ReorderJournalItems(entryId string, userId string, order []string, editor Editor) (JournalItems, error)
+	RemoveJournalItem(entryId string, userId string, itemId string, editor Editor) error
+	CarryOver(userId string, date time.Time, mode string, editor Editor) (CarryOverResult, error)
+	SetCarryOver(userId string, mode string) error
+	GetRevisions(userId string, entryId string) ([]Revision, error)
+	DiffRevisions(userId string, entryId string, from string, to string) (RevisionDiff, error)
+	RestoreRevision(userId string, entryId string, revisionId string, editor Editor) (JournalEntry, error)
 	DeleteJournalEntry(id string, userId string) error
+	GetTrash(userId string) ([]JournalEntry, error)
+	RestoreJournalEntry(userId string, id string) (JournalEntry, error)
 	GetJournalEntryByDate(userId string, date time.Time) (JournalEntry, error)
 	SearchJournal(userId string, jq JournalQuery) ([]JournalEntry, int64, error)
 	SearchJournalDates(userId string, jq JournalQuery) ([]string, error)
 	GetStreak(userId string, date time.Time, limit int) (int, error)
+	ExportJournal(userId string, format string, w io.Writer) error
+	ImportJournal(userId string, r io.Reader, options ImportOptions) (ImportReport, error)
+	EnrollTwoFactor(userId string) (TwoFactorEnrollment, error)
+	ConfirmTwoFactor(userId string, code string) ([]string, error)
+	VerifyTwoFactor(userId string, code string) error
+	DisableTwoFactor(userId string, password string) error
+	CreateAccessToken(userId string, name string, scopes []string, expires *time.Time) (AccessToken, string, error)
+	GetAccessTokens(userId string) ([]AccessToken, error)
+	RevokeAccessToken(userId string, id string) error
+	AuthenticateAccessToken(secret string) (AccessToken, error)
+	OIDCAuthURL() (OIDCRequest, error)
+	OIDCLogin(code string, verifier string, nonce string) (User, error)
+	CreateSession(userId string, ip string, userAgent string, persist bool) (Session, string, error)
+	AuthenticateSession(secret string) (Session, error)
+	GetSessions(userId string, currentId string) ([]Session, error)
+	RevokeSession(userId string, id string) error
+	RevokeSessions(userId string, except string) error
+	RequestEmailChange(userId string, password string, email string) error
+	ConfirmEmailChange(token string) (string, error)
+	DeleteAccount(userId string, password string, signedIn time.Time) (*time.Time, error)
+	CancelAccountDeletion(userId string) error
+	RecordAuditEvent(event AuditEvent, err error) error
+	GetAuditEvents(userId string, limit int) ([]AuditEvent, error)
+	IsAdmin(userId string) (bool, error)
+	SearchUsers(query UserQuery) ([]AdminUser, int64, error)
+	GetAdminUser(userId string) (AdminUser, error)
+	ResendVerification(userId string) error
+	ForcePasswordReset(userId string) error
+	SuspendUser(userId string) error
+	UnsuspendUser(userId string) error
+	GetUserStats() (UserStats, error)
+	GetJournalLimits(userId string) (JournalLimits, error)
+	GetTags(userId string) ([]TagCount, error)
+	RenameTag(userId string, tag string, name string, editor Editor) (int, error)
+	MergeTags(userId string, tags []string, into string, editor Editor) (int, error)
+	GetLocation(userId string) (*time.Location, error)
+	SetTimeZone(userId string, zone string) error
 }
 
 type MailService interface {
@@ -119,184 +183,171 @@ type MailService interface {
 }
 
 type MdsService struct {
-	es         *elastic.Client
-	MailClient MailService
-}
-
-type IndexSettings struct {
-	Mapper   map[string]interface{} `json:"mapper"`
-	Mappings map[string]interface{} `json:"mappings"`
+	store         Store
+	throttle      AttemptStore
+	MailClient    MailService
+	resetTTL      time.Duration
+	verifyTTL     time.Duration
+	lockoutAfter  int
+	lockoutFor    time.Duration
+	oidc          *oidcProvider
+	siteURL       string
+	deleteGrace   time.Duration
+	argon2        Argon2Params
+	limits        JournalLimits
+	plans         map[string]JournalLimits
+	keepRevisions int
 }
 
 type ServiceOptions struct {
+	// Backend selects the Store, BackendElastic when empty
+	Backend          string
 	ElasticUrl       string
+	SqlitePath       string
 	SendGridUsername string
 	SendGridPassword string
 	MainIndex        string
+	// ResetTokenTTL and VerifyTokenTTL default to DefaultResetTokenTTL and DefaultVerifyTokenTTL
+	ResetTokenTTL  time.Duration
+	VerifyTokenTTL time.Duration
+	// AttemptBackend selects where failed logins are counted, BackendMemory or
+	// BackendElastic. When empty the storage backend is used if it can count them.
+	AttemptBackend string
+	// LockoutThreshold and LockoutDuration default to DefaultLockoutThreshold and DefaultLockoutDuration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// OIDC enables single sign-on when its Issuer is set
+	OIDC OIDCOptions
+	// SiteURL is where links in emails point, DefaultSiteURL when empty
+	SiteURL string
+	// DeletionGracePeriod is how long a user can cancel deleting their
+	// account, it is deleted right away when zero
+	DeletionGracePeriod time.Duration
+	// Argon2 sets the cost of new password hashes, see DefaultArgon2Params
+	Argon2 Argon2Params
+	// JournalLimits are the defaults, any left at zero use DefaultJournalLimits
+	JournalLimits JournalLimits
+	// Plans are the limits users on each named plan get
+	Plans map[string]JournalLimits
+	// RevisionLimit is how many earlier versions of each entry are kept,
+	// DefaultRevisionLimit when zero
+	RevisionLimit int
 }
 
 func (s *MdsService) Init(options ServiceOptions) error {
-	conn, err := elastic.NewClient(
-		elastic.SetURL(options.ElasticUrl),
-		elastic.SetSniff(false),
-	)
+	var err error
 
-	if err != nil {
-		return err
+	switch options.Backend {
+	case "", BackendElastic:
+		if options.MainIndex != "" {
+			esIndex = options.MainIndex
+		}
+		s.store, err = newElasticStore(options.ElasticUrl)
+	case BackendMemory:
+		s.store = newMemoryStore()
+	case BackendSqlite:
+		s.store, err = newSqliteStore(options.SqlitePath)
+	default:
+		err = errors.New("Unknown storage backend " + options.Backend)
 	}
 
-	if options.MainIndex != "" {
-		esIndex = options.MainIndex
+	if err == nil {
+		s.throttle, err = newAttemptStore(options, s.store)
 	}
 
-	err = s.createIndexes(conn)
+	s.resetTTL = options.ResetTokenTTL
+	s.verifyTTL = options.VerifyTokenTTL
+	s.lockoutAfter = options.LockoutThreshold
+	s.lockoutFor = options.LockoutDuration
+	s.oidc = newOIDCProvider(options.OIDC)
+	s.siteURL = options.SiteURL
+	s.deleteGrace = options.DeletionGracePeriod
+	s.argon2 = options.Argon2
+	s.limits = options.JournalLimits.withDefaults(DefaultJournalLimits)
+	s.plans = options.Plans
+	s.keepRevisions = options.RevisionLimit
 
-	if err == nil {
-		s.es = conn
-		if options.SendGridUsername != "" {
-			s.MailClient = sendgrid.NewSendClient(os.Getenv("SENDGRID_API_KEY"))
-		}
+	if err == nil && options.SendGridUsername != "" {
+		s.MailClient = sendgrid.NewSendClient(os.Getenv("SENDGRID_API_KEY"))
 	}
 
 	return err
 }
 
-func (s *MdsService) createIndex(c *elastic.Client, index string, json string) error {
-	ctx := context.Background()
-	indexExists, err := c.IndexExists(index).Do(ctx)
-
-	if err != nil {
-		log.Println("Error retriving " + index + " index: " + err.Error())
-		return err
-	}
+//User Functions
 
-	if !indexExists {
-		log.Println("Creating index " + index)
-		resp, err := c.CreateIndex(index).BodyString(json).Do(ctx)
+// GetUserByEmail retrieves a user by their email address
+func (s MdsService) GetUserByEmail(email string, verified bool) (User, error) {
+	user, err := s.store.GetUserByEmail(email, verified)
 
-		if err != nil {
-			log.Println("Error creating " + index + " index: " + err.Error())
-			return err
-		} else {
-			log.Println(resp.Acknowledged)
-		}
+	if err == RecordNotFound {
+		return User{}, UserNotFound
 	}
 
-	return nil
+	return user, err
 }
 
-func (s *MdsService) createIndexes(c *elastic.Client) error {
-	log.Println("Preparing Indexes")
-	err := s.createIndex(c, userIndex(), IndexUserJSON)
-	if err != nil {
-		return err
-	}
-
-	err = s.createIndex(c, journalIndex(), IndexJournalJSON)
-	if err != nil {
-		return err
+// GetUserByLogin retrieves a user account by their email and password hash.
+// Failed attempts are counted for the email and the client ip, and while
+// either has to wait a ThrottleError is returned without checking the password.
+func (s MdsService) GetUserByLogin(email string, password string, ip string) (User, error) {
+	// No account has an address that isn't valid, and it shouldn't become a
+	// throttle key
+	email = strings.TrimSpace(email)
+	if !validEmail(email) {
+		return User{}, UserNotFound
 	}
 
-	return err
-}
-
-func getSingleResult(result *elastic.SearchResult, output interface{}) (string, error) {
-	if result.Hits.TotalHits > 0 {
-
-		bytes, err := result.Hits.Hits[0].Source.MarshalJSON()
-		if err != nil {
-			panic(err)
+	if s.throttle != nil {
+		if err := s.checkThrottle(loginKeys(email, ip)); err != nil {
+			return User{}, err
 		}
-
-		err = json.Unmarshal(bytes, output)
-		return result.Hits.Hits[0].Id, err
 	}
 
-	return "", RecordNotFound
-}
-
-func initID(doc IdDocument, id string, err error) {
+	var found *User
+	user, err := s.GetUserByEmail(email, true)
 	if err == nil {
-		doc.SetID(id)
+		found = &user
+	} else if err != UserNotFound {
+		return User{}, err
 	}
-}
-
-func getUserFromResult(result *elastic.SearchResult) (User, error) {
-	var user User
-	id, err := getSingleResult(result, &user)
-	initID(&user, id, err)
-	return user, err
-}
-
-func getVerificationFromResult(result *elastic.SearchResult) (UserVerification, error) {
-	var verification UserVerification
-	id, err := getSingleResult(result, &verification)
-	initID(&verification, id, err)
-	return verification, err
-}
-
-func getResetFromResult(result *elastic.SearchResult) (PasswordReset, error) {
-	var reset PasswordReset
-	id, err := getSingleResult(result, &reset)
-	initID(&reset, id, err)
-	return reset, err
-}
-
-func getEntryFromResult(result *elastic.SearchResult) (JournalEntry, error) {
-	var entry JournalEntry
-	id, err := getSingleResult(result, &entry)
-	initID(&entry, id, err)
-	return entry, err
-}
 
-//User Functions
+	err = s.comparePassword(found, password)
 
-// GetUserByEmail retrieves a user by their email address
-func (s MdsService) GetUserByEmail(email string, verified bool) (User, error) {
-	var retVal User
-	ctx := context.Background()
-
-	query := elastic.NewBoolQuery().
-		Must(elastic.NewTermQuery("email", strings.ToLower(email)))
-
-	if verified {
-		query = query.MustNot(elastic.NewExistsQuery("verify_token"))
-	}
-
-	result, err := s.es.Search(userIndex()).Type(userType).Query(query).Do(ctx)
-
-	if err == nil {
-		retVal, err = getUserFromResult(result)
-	}
+	if err == UserNotFound || err == PasswordMismatch {
+		if s.throttle != nil {
+			s.loginFailed(email, ip, found)
+		}
 
-	if err == RecordNotFound {
-		return retVal, UserNotFound
+		return User{}, UserNotFound
 	}
 
-	return retVal, nil
-}
-
-// GetUserByLogin retrieves a user account by their email and password hash
-func (s MdsService) GetUserByLogin(email string, password string) (User, error) {
-	ctx := context.Background()
-	user, err := s.GetUserByEmail(email, true)
-
-	var hash []byte
-	if err == nil {
-		hash, err = base64.StdEncoding.DecodeString(user.PasswordHash)
+	if err == nil && user.SuspendedAt != nil {
+		return User{}, AccountSuspended
 	}
 
-	if err == nil {
-		err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err == nil && s.throttle != nil {
+		s.throttle.ClearLoginAttempts(accountKey(email))
+		if ip != "" {
+			s.throttle.ForgiveLoginFailures(ipKey(ip), loginForgiven)
+		}
 	}
 
-	if err == RecordNotFound || err == bcrypt.ErrMismatchedHashAndPassword {
-		return User{}, UserNotFound
+	if err == nil && user.ResetToken != nil {
+		user.ResetToken = nil
+		user.ResetExpires = nil
+		s.store.SetResetToken(user.ID, nil, nil)
 	}
 
-	if user.ResetToken != nil {
-		user.ResetToken = nil
-		s.es.Update().Index(userIndex()).Type(userType).Refresh("true").Doc(user).Do(ctx)
+	// Hashes from bcrypt or older argon2 parameters are replaced while the
+	// password is at hand
+	if err == nil && s.passwordHasher().NeedsRehash(user.PasswordHash) {
+		if hash, hashErr := s.passwordHasher().Hash(password); hashErr == nil {
+			user.PasswordHash = hash
+			if saveErr := s.store.SaveUser(user); saveErr != nil {
+				log.Println("Error rehashing password:", saveErr)
+			}
+		}
 	}
 
 	return user, err
@@ -304,31 +355,19 @@ func (s MdsService) GetUserByLogin(email string, password string) (User, error)
 
 //GetUserById retrieves a user by their id
 func (s MdsService) GetUserById(id string) (User, error) {
-	var retval User
-
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().
-		MustNot(elastic.NewExistsQuery("verify_token")).
-		Must(elastic.NewIdsQuery(userType).Ids(id))
-
-	result, err := s.es.Search().Index(userIndex()).Type(userType).Query(query).Do(ctx)
+	user, err := s.store.GetUserById(id)
 
-	if err != nil {
-		return retval, err
-	}
-
-	retval, err = getUserFromResult(result)
-
-	if err != nil {
-		return retval, UserNotFound
+	if err == RecordNotFound || (err == nil && user.VerifyToken != nil) {
+		return User{}, UserNotFound
 	}
 
-	return retval, err
+	return user, err
 }
 
-func (s MdsService) UpdateUser(id string, email string, password string) error {
+// UpdateUser changes the email or password. A new password signs out every
+// session but keepSession, the one making the change.
+func (s MdsService) UpdateUser(id string, email string, password string, keepSession string) error {
 	user, err := s.GetUserById(id)
-	ctx := context.Background()
 
 	if err != nil {
 		return UserNotFound
@@ -338,13 +377,22 @@ func (s MdsService) UpdateUser(id string, email string, password string) error {
 		user.Email = strings.ToLower(email)
 	}
 
-	if len(password) >= 6 {
-		pass, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if password != "" {
+		if err := validatePassword(password, user.Email); err != nil {
+			return err
+		}
+
+		hash, err := s.passwordHasher().Hash(password)
 		if err == nil {
-			user.PasswordHash = base64.StdEncoding.EncodeToString(pass)
+			user.PasswordHash = hash
 			user.ResetToken = nil
+			user.ResetExpires = nil
 
-			_, err = s.es.Update().Index(userIndex()).Type(userType).Id(id).Doc(user).Refresh("true").Do(ctx)
+			err = s.store.SaveUser(user)
+		}
+
+		if err == nil {
+			err = s.store.DeleteSessions(id, keepSession)
 		}
 
 		return err
@@ -354,85 +402,101 @@ func (s MdsService) UpdateUser(id string, email string, password string) error {
 }
 
 func (s MdsService) GetUserVerification(token string) (string, UserVerification, error) {
-	var retVal UserVerification
-	ctx := context.Background()
+	verify, err := s.store.GetUserVerification(hashToken(token))
 
-	search := elastic.NewTermQuery("verify_token", token)
-	result, err := s.es.Search(userIndex()).Type(userType).Query(search).Do(ctx)
+	if err == RecordNotFound {
+		log.Println("Error GetUserVerification: " + err.Error())
+		return "", verify, VerificationNotFound
+	}
 
-	if err == nil {
-		retVal, err = getVerificationFromResult(result)
+	if err == nil && tokenExpired(verify.Expires) {
+		return "", UserVerification{}, VerificationExpired
 	}
 
-	if err == RecordNotFound {
-		log.Println("Error GetUserVerification: " + err.Error())
-		return "", retVal, VerificationNotFound
+	return verify.ID, verify, err
+}
+
+func (s MdsService) sendVerification(email string, token string) error {
+	message := mail.NewV3Mail()
+	message.SetFrom(mail.NewEmail("MyDailyStuff", "no-reply@mydailystuff.com"))
+	message.SetTemplateID("d-e782572e444d460e8d24b3f07005bcdf")
+	personalizations := mail.NewPersonalization()
+	personalizations.AddTos(mail.NewEmail(email, email))
+	personalizations.DynamicTemplateData["token"] = token
+	message.AddPersonalizations(personalizations)
+
+	if s.MailClient != nil {
+		_, err := s.MailClient.Send(message)
+		return err
 	}
 
-	return result.Hits.Hits[0].Id, retVal, err
+	return nil
 }
 
 func (s MdsService) CreateUserVerification(email string, password string) error {
+	if err := validatePassword(password, email); err != nil {
+		return err
+	}
+
 	user, err := s.GetUserByEmail(email, false)
-	ctx := context.Background()
+	if err != nil && err != UserNotFound {
+		return err
+	}
 
 	if err == UserNotFound {
+		if err := s.emailPending(email, ""); err != nil {
+			return err
+		}
+
 		//Generate token
 		id := uuid.NewString()
-		token := uuid.NewString()
+		token, hash, err := newToken()
 
-		pass, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+		var pass string
+		if err == nil {
+			pass, err = s.passwordHasher().Hash(password)
+		}
 
 		if err == nil {
 			verify := UserVerification{
 				Email:        email,
 				CreateDate:   time.Now(),
-				PasswordHash: base64.StdEncoding.EncodeToString(pass),
-				Token:        token,
+				Expires:      time.Now().Add(s.verifyTokenTTL()),
+				PasswordHash: pass,
+				Token:        hash,
 				ID:           id}
 
-			_, err = s.es.Index().Index(userIndex()).Type(userType).Id(id).BodyJson(verify).Refresh("true").Do(ctx)
+			err = s.store.SaveUserVerification(verify)
 		}
 
 		if err != nil {
 			panic(err)
 		}
 
-		message := mail.NewV3Mail()
-		message.SetFrom(mail.NewEmail("MyDailyStuff", "no-reply@mydailystuff.com"))
-		message.SetTemplateID("d-e782572e444d460e8d24b3f07005bcdf")
-		personalizations := mail.NewPersonalization()
-		personalizations.AddTos(mail.NewEmail(email, email))
-		personalizations.DynamicTemplateData["token"] = token
-		message.AddPersonalizations(personalizations)
-
-		if s.MailClient != nil {
-			_, err = s.MailClient.Send(message)
-		}
-
-		return err
+		return s.sendVerification(email, token)
 	} else {
 		if user.VerifyToken == nil {
 			return EmailInUse
 		}
 
-		// Resend the user verification and update password
-		pass, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+		// Resend the user verification with a new token, only the old hash is stored
+		token, hash, err := newToken()
+
+		var pass string
 		if err == nil {
-			user.PasswordHash = base64.StdEncoding.EncodeToString(pass)
-			_, err = s.es.Update().Index(userIndex()).Type(userType).Id(user.ID).Doc(user).Refresh("true").Do(ctx)
+			pass, err = s.passwordHasher().Hash(password)
+		}
 
-			message := mail.NewV3Mail()
-			message.SetFrom(mail.NewEmail("MyDailyStuff", "no-reply@mydailystuff.com"))
-			message.SetTemplateID("d-e782572e444d460e8d24b3f07005bcdf")
-			personalizations := mail.NewPersonalization()
-			personalizations.AddTos(mail.NewEmail(email, email))
-			personalizations.DynamicTemplateData["token"] = user.VerifyToken
-			message.AddPersonalizations(personalizations)
+		if err == nil {
+			expires := time.Now().Add(s.verifyTokenTTL())
+			user.PasswordHash = pass
+			user.VerifyToken = &hash
+			user.VerifyExpires = &expires
+			err = s.store.SaveUser(user)
+		}
 
-			if s.MailClient != nil {
-				_, err = s.MailClient.Send(message)
-			}
+		if err == nil {
+			err = s.sendVerification(email, token)
 		}
 
 		return err
@@ -440,12 +504,27 @@ func (s MdsService) CreateUserVerification(email string, password string) error
 }
 
 func (s MdsService) CreateUser(verificationToken string) (string, error) {
-	ctx := context.Background()
 	userID, verify, err := s.GetUserVerification(verificationToken)
 
+	// A suspended registration can't be verified, which would clear the suspension
+	if err == nil {
+		if pending, _ := s.store.GetUserById(userID); pending.SuspendedAt != nil {
+			err = AccountSuspended
+		}
+	}
+
+	if err == nil {
+		// Only one request can clear the token, a second one finds nothing
+		err = s.store.ConsumeVerifyToken(userID, verify.Token)
+	}
+
+	if err == RecordNotFound {
+		err = VerificationNotFound
+	}
+
 	if err != nil {
 		log.Println(err.Error())
-		return "", VerificationNotFound
+		return "", err
 	}
 
 	user := User{
@@ -456,7 +535,7 @@ func (s MdsService) CreateUser(verificationToken string) (string, error) {
 		VerifyToken:  nil,
 	}
 
-	_, err = s.es.Update().Index(userIndex()).Type(userType).Doc(user).Id(verify.ID).Do(ctx)
+	err = s.store.SaveUser(user)
 
 	if err != nil {
 		log.Println("Error", err)
@@ -467,30 +546,30 @@ func (s MdsService) CreateUser(verificationToken string) (string, error) {
 }
 
 func (s MdsService) GetResetPassword(token string) (PasswordReset, error) {
-	var retVal PasswordReset
-	ctx := context.Background()
+	reset, err := s.store.GetResetPassword(hashToken(token))
 
-	search := elastic.NewTermQuery("reset_token", token)
-	result, err := s.es.Search(userIndex()).Type(userType).Query(search).Do(ctx)
-
-	if err == nil {
-		retVal, err = getResetFromResult(result)
+	if err == RecordNotFound {
+		return reset, ResetNotFound
 	}
 
-	if err == RecordNotFound {
-		return retVal, ResetNotFound
+	if err == nil && tokenExpired(reset.Expires) {
+		return PasswordReset{}, ResetExpired
 	}
 
-	return retVal, err
+	return reset, err
 }
 
 func (s MdsService) CreateAndSendResetPassword(email string) error {
-	ctx := context.Background()
 	user, err := s.GetUserByEmail(email, true)
+
+	var token, hash string
 	if err == nil {
-		id := uuid.New()
+		token, hash, err = newToken()
+	}
 
-		_, err = s.es.Update().Index(userIndex()).Type(userType).Id(user.ID).Doc(map[string]interface{}{"reset_token": id}).Do(ctx)
+	if err == nil {
+		expires := time.Now().Add(s.resetTokenTTL())
+		err = s.store.SetResetToken(user.ID, &hash, &expires)
 
 		if err == nil {
 			log.Println("Sending reset password to " + user.ID)
@@ -500,7 +579,7 @@ func (s MdsService) CreateAndSendResetPassword(email string) error {
 			message.SetTemplateID("d-1019375cd8da4ae08345bc600e03e241")
 			personalizations := mail.NewPersonalization()
 			personalizations.AddTos(mail.NewEmail(email, email))
-			personalizations.DynamicTemplateData["id"] = id
+			personalizations.DynamicTemplateData["id"] = token
 			message.AddPersonalizations(personalizations)
 
 			if s.MailClient != nil {
@@ -515,13 +594,21 @@ func (s MdsService) CreateAndSendResetPassword(email string) error {
 func (s MdsService) ResetPassword(token string, password string) error {
 	reset, err := s.GetResetPassword(token)
 
-	if len(password) < 6 || len(password) > 50 {
-		err = PasswordInvalid
+	if err == nil {
+		err = validatePassword(password, "")
+	}
+
+	if err == nil {
+		// Only one request can clear the token, a second one finds nothing
+		err = s.store.ConsumeResetToken(reset.ID, reset.Token)
+		if err == RecordNotFound {
+			err = ResetNotFound
+		}
 	}
 
 	if err == nil {
 		log.Println("Resetting password for " + reset.ID)
-		err = s.UpdateUser(reset.ID, "", password)
+		err = s.UpdateUser(reset.ID, "", password, "")
 	}
 
 	return err
@@ -529,251 +616,173 @@ func (s MdsService) ResetPassword(token string, password string) error {
 
 //Journal Functions
 
-func (s MdsService) CreateJournalEntry(userId string, entries []string, date time.Time) (JournalEntry, error) {
-	var entry JournalEntry
-	ctx := context.Background()
+// cleanItem checks the length of an item and sanitizes it
+func cleanItem(item string, limits JournalLimits) (string, error) {
+	if len(item) > limits.MaxItemLength {
+		return "", LimitError{Err: JournalEntryInvalid, Limit: limits.MaxItemLength}
+	}
 
-	var err error = nil
+	item = strings.TrimSpace(sanitize.HTML(item))
+	if len(item) <= 0 {
+		return "", JournalEntryEmpty
+	}
 
-	if len(entries) > 7 {
-		err = TooManyEntries
+	return item, nil
+}
+
+// cleanEntries checks the item limits and sanitizes each item in place
+func cleanEntries(entries []string, limits JournalLimits) error {
+	if err := limits.checkCount(len(entries)); err != nil {
+		return err
 	}
 
-	if err == nil {
-		for index, entry := range entries {
-			if len(entry) > 500 {
-				err = JournalEntryInvalid
-				break
-			} else {
-				entries[index] = strings.TrimSpace(sanitize.HTML(entry))
-				if len(entries[index]) <= 0 {
-					err = JournalEntryEmpty
-					break
-				}
-			}
+	for index, entry := range entries {
+		item, err := cleanItem(entry, limits)
+		if err != nil {
+			return err
 		}
+
+		entries[index] = item
+	}
+
+	return nil
+}
+
+func (s MdsService) CreateJournalEntry(userId string, entries []string, date time.Time) (JournalEntry, error) {
+	var entry JournalEntry
+	user, err := s.GetUserById(userId)
+	day := calendarDay(date, locationOf(user))
+
+	if err == nil {
+		err = cleanEntries(entries, s.limitsFor(user))
 	}
 
 	if err == nil {
-		_, jerr := s.GetJournalEntryByDate(userId, date)
+		_, jerr := s.store.GetJournalEntryByDate(userId, day)
 
-		if jerr != NoJournalWithDate {
+		if jerr != RecordNotFound {
 			err = EntryAlreadyExists
 		}
 	}
 
 	if err == nil {
-		entryDate := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
-
 		id := uuid.NewString()
-		entry = JournalEntry{ID: id, UserId: userId, Date: entryDate, CreateDate: time.Now().UTC(), Entries: entries}
+		created := time.Now().UTC()
+		entry = JournalEntry{ID: id, UserId: userId, Date: day, CreateDate: created, Entries: newItems(entries, created), Tags: extractTags(entries)}
 
-		_, err = s.es.Index().Index(journalIndex()).Type(journalType).Id(id).Refresh("true").BodyJson(entry).Do(ctx)
+		err = s.store.SaveJournalEntry(entry)
 	}
 
 	return entry, err
 }
 
-func (s MdsService) UpdateJournalEntry(id string, userId string, entries []string) error {
-	ctx := context.Background()
+// UpdateJournalEntry replaces the items of an entry. Items whose text is
+// unchanged keep their ID and whether they are done.
+func (s MdsService) UpdateJournalEntry(id string, userId string, entries []string, editor Editor) error {
 	if userId == "" {
 		return UserUnauthorized
 	}
 
-	var err error = nil
-
-	if len(entries) > 7 {
-		err = TooManyEntries
-	}
+	limits, err := s.GetJournalLimits(userId)
 
-	for index, entry := range entries {
-		if len(entry) > 500 {
-			err = JournalEntryInvalid
-			break
-		} else {
-			entries[index] = strings.TrimSpace(sanitize.HTML(entry))
-			if len(entries[index]) <= 0 {
-				err = JournalEntryEmpty
-				break
-			}
-		}
-	}
-
-	var entry JournalEntry
 	if err == nil {
-		// err = json.Unmarshal(*result.Source, &retval)
-		result, err := s.es.Get().Index(journalIndex()).Type(journalType).Id(id).Do(ctx)
-		if err == nil && result.Found {
-			err = json.Unmarshal(*result.Source, &entry)
-		}
+		err = cleanEntries(entries, limits)
 	}
 
-	if err == nil && entry.UserId == userId {
-		entry.Entries = entries
-		_, err = s.es.Index().Index(journalIndex()).Type(journalType).Id(id).Refresh("true").BodyJson(entry).Do(ctx)
+	if err != nil {
+		return err
 	}
 
-	if err == nil && entry.UserId != userId {
-		return EntryNotFound
+	entry, err := s.userEntry(id, userId)
+
+	if err == nil {
+		previous := entry.Entries
+		entry.Entries = reconcileItems(previous, entries, time.Now().UTC())
+		err = s.saveRevised(entry, previous, editor)
 	}
 
 	return err
 }
 
+// DeleteJournalEntry moves an entry to the trash, it can be restored with
+// RestoreJournalEntry until PurgeTrash removes it
 func (s MdsService) DeleteJournalEntry(id string, userId string) error {
-	ctx := context.Background()
 	if userId == "" {
 		return UserUnauthorized
 	}
 
-	var entry JournalEntry
-	result, err := s.es.Get().Index(journalIndex()).Type(journalType).Id(id).Do(ctx)
-	if err == nil && result.Found {
-		err = json.Unmarshal(*result.Source, &entry)
-	}
+	entry, err := s.store.GetJournalEntry(id)
 
-	if err != nil || userId != entry.UserId {
+	if err != nil || userId != entry.UserId || entry.DeletedAt != nil {
 		return EntryNotFound
 	}
 
-	_, err = s.es.Delete().Index(journalIndex()).Type(journalType).Id(id).Refresh("true").Do(ctx)
-	return err
+	deleted := time.Now().UTC()
+	entry.DeletedAt = &deleted
+	return s.store.SaveJournalEntry(entry)
 }
 
 func (s MdsService) GetJournalEntryByDate(userId string, date time.Time) (JournalEntry, error) {
-	var retVal JournalEntry
-	ctx := context.Background()
-
 	if userId == "" {
-		return retVal, UserUnauthorized
+		return JournalEntry{}, UserUnauthorized
 	}
 
-	createDate := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
-
-	query := elastic.NewBoolQuery().
-		Must(elastic.NewTermQuery("user_id", userId)).
-		Filter(elastic.NewTermQuery("date", createDate))
-
-	result, err := s.es.Search(journalIndex()).Type(journalType).Query(query).Do(ctx)
-
-	if err == nil {
-		if result.Hits.TotalHits == 0 {
-			return retVal, NoJournalWithDate
-		}
-
-		retVal, err = getEntryFromResult(result)
+	loc, err := s.GetLocation(userId)
+	if err == UserNotFound {
+		return JournalEntry{}, NoJournalWithDate
+	} else if err != nil {
+		return JournalEntry{}, err
 	}
 
-	if err != nil {
-		_, ok := err.(*elastic.Error)
-		if !ok {
-			err = NoJournalWithDate
-		}
+	entry, err := s.store.GetJournalEntryByDate(userId, calendarDay(date, loc))
 
+	if err == RecordNotFound {
+		return entry, NoJournalWithDate
 	}
 
-	return retVal, err
+	return entry, err
 }
 
 //Search journal entries
 func (s MdsService) SearchJournal(userId string, jq JournalQuery) ([]JournalEntry, int64, error) {
-	ctx := context.Background()
 	if userId == "" {
 		return nil, 0, UserUnauthorized
 	}
 
-	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("user_id", userId))
-	if jq.Query != "" {
-		query = query.Filter(elastic.NewQueryStringQuery(jq.Query).Field("entries").Field("date").Lenient(true))
-	}
-
-	start := time.Date(jq.Start.Year(), jq.Start.Month(), jq.Start.Day(), 0, 0, 0, 0, time.UTC)
-	end := time.Date(jq.End.Year(), jq.End.Month(), jq.End.Day(), 0, 0, 0, 0, time.UTC)
-
-	if !jq.Start.IsZero() && !jq.End.IsZero() {
-		query = query.Filter(elastic.NewRangeQuery("date").Gte(start).Lte(end))
-	} else if !jq.Start.IsZero() {
-		query = query.Filter(elastic.NewRangeQuery("date").Gte(start))
-	} else if !jq.End.IsZero() {
-		query = query.Filter(elastic.NewRangeQuery("date").Lte(end))
-	}
-
-	highlight := elastic.NewHighlight().Field("entries").PreTags("<strong>").PostTags("</strong>")
-
-	search := s.es.Search(journalIndex()).Type(journalType).Query(query).Highlight(highlight).Sort("date", false)
-
-	if jq.Limit > 0 {
-		search.Size(jq.Limit)
-	}
-
-	if jq.Offset > 0 {
-		search.From(jq.Offset)
-	}
-
-	result, err := search.Do(ctx)
-
-	if err == nil {
-		size := len(result.Hits.Hits)
-		retval := make([]JournalEntry, size)
-
-		//TODO: Maybe only take the fields we need
-		for index, hit := range result.Hits.Hits {
-			bytes, err := hit.Source.MarshalJSON()
-			if err != nil {
-				panic(err)
-			}
-
-			var entry JournalEntry
-
-			err = json.Unmarshal(bytes, &entry)
-			if err != nil {
-				panic(err)
-			}
-			entry.ID = hit.Id
-
-			if hit.Highlight != nil && hit.Highlight["entries"] != nil {
-				entry.Entries = hit.Highlight["entries"]
-			}
-
-			retval[index] = entry
-		}
-
-		return retval, result.TotalHits(), nil
+	jq, err := s.journalQueryIn(userId, jq)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return nil, 0, err
+	return s.store.SearchJournal(userId, jq)
 }
 
+// GetStreak counts the days in a row with an entry before the day date falls
+// on in the user's time zone, looking back at most limit days
 func (s MdsService) GetStreak(userId string, date time.Time, limit int) (int, error) {
-	ctx := context.Background()
-	end := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC).Add(-time.Hour * 24)
-	start := end.Add(-time.Hour * 24 * time.Duration(limit-1))
+	loc, err := s.GetLocation(userId)
+	if err != nil {
+		return 0, err
+	}
 
-	query := elastic.NewBoolQuery().Filter(
-		elastic.NewTermQuery("user_id", userId),
-		elastic.NewRangeQuery("date").Gte(start).Lte(end),
-	)
+	end := calendarDay(date, loc).Add(-time.Hour * 24)
+	start := end.Add(-time.Hour * 24 * time.Duration(limit-1))
 
-	result, err := s.es.Search(journalIndex()).Type(journalType).Query(query).Sort("date", false).Do(ctx)
+	entries, err := s.store.GetJournalEntries(userId, start, end)
 
 	var retval int = 0
 
 	if err == nil {
 		current := end
 
-		for _, hit := range result.Hits.Hits {
-			var entry JournalEntry
-			err := json.Unmarshal(*hit.Source, &entry)
-
-			if err == nil {
-				//Calculate the streak by finding the last ten entry dates and figuring out if there
-				//are any gaps
-				if current.Sub(entry.Date).Hours() == 0 {
-					retval++
-					current = entry.Date.Add(-time.Hour * 24)
-				} else {
-					break
-				}
+		for _, entry := range entries {
+			//Calculate the streak by finding the last ten entry dates and figuring out if there
+			//are any gaps
+			if current.Sub(entry.Date).Hours() == 0 {
+				retval++
+				current = entry.Date.Add(-time.Hour * 24)
+			} else {
+				break
 			}
 		}
 	}
@@ -783,45 +792,20 @@ func (s MdsService) GetStreak(userId string, date time.Time, limit int) (int, er
 
 //Find dates with journal entries
 func (s MdsService) SearchJournalDates(userId string, jq JournalQuery) ([]string, error) {
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("user_id", userId))
-
-	if jq.Query != "" {
-		query = query.Must(elastic.NewMultiMatchQuery(jq.Query, "entries", "date").Lenient(true))
-	}
-
-	start := time.Date(jq.Start.Year(), jq.Start.Month(), jq.Start.Day(), 0, 0, 0, 0, time.UTC)
-	end := time.Date(jq.End.Year(), jq.End.Month(), jq.End.Day(), 0, 0, 0, 0, time.UTC)
-
-	if !jq.Start.IsZero() && !jq.End.IsZero() {
-		query.Filter(elastic.NewRangeQuery("date").Gte(start).Lte(end))
-	} else if !jq.Start.IsZero() {
-		query.Filter(elastic.NewRangeQuery("date").Gte(start))
-	} else if !jq.End.IsZero() {
-		query.Filter(elastic.NewRangeQuery("date").Lte(end))
+	jq, err := s.journalQueryIn(userId, jq)
+	if err != nil {
+		return nil, err
 	}
 
-	result, err := s.es.Search(journalIndex()).Type(journalType).Query(query).Size(185).Do(ctx)
+	dates, err := s.store.SearchJournalDates(userId, jq)
 
 	if err != nil {
 		return nil, err
 	}
 
-	size := len(result.Hits.Hits)
-	retval := make([]string, size)
-
-	for index, hit := range result.Hits.Hits {
-		if err != nil {
-			panic(err)
-		}
-
-		var entry JournalEntry
-		err := json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return nil, err
-		}
-
-		retval[index] = entry.Date.Format(time.RFC3339)
+	retval := make([]string, len(dates))
+	for index, date := range dates {
+		retval[index] = date.Format(time.RFC3339)
 	}
 
 	return retval, nil
@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Sign-in sessions are recorded in the store so a user can see where they
+// are signed in and revoke a session, such as a stolen cookie. The session
+// cookie only carries the secret, which like access tokens is stored hashed.
+
+const (
+	// sessionTTL is how long a persistent session lasts, matching its cookie
+	sessionTTL = 30 * 24 * time.Hour
+	// sessionIdleTimeout ends browser sessions that haven't been used for a while
+	sessionIdleTimeout = 24 * time.Hour
+	// maxSessions is how many sessions one user can have, the least recently
+	// seen is signed out to make room
+	maxSessions = 100
+	// sessionTouchInterval limits how often last seen is written for a busy session
+	sessionTouchInterval = time.Minute
+)
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserId     string    `json:"user_id"`
+	Hash       string    `json:"session_hash,omitempty"`
+	CreateDate time.Time `json:"create_date"`
+	LastSeen   time.Time `json:"last_seen"`
+	Expires    time.Time `json:"expires"`
+	Persist    bool      `json:"persist"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	// Current marks the session making the request in GetSessions
+	Current bool `json:"current"`
+}
+
+func (s *Session) GetID() string   { return s.ID }
+func (s *Session) SetID(id string) { s.ID = id }
+
+// expiry is when a session seen at seen ends
+func (s Session) expiry(seen time.Time) time.Time {
+	if s.Persist {
+		return s.CreateDate.Add(sessionTTL)
+	}
+
+	return seen.Add(sessionIdleTimeout)
+}
+
+// CreateSession records a sign-in and returns the secret for the cookie
+func (s MdsService) CreateSession(userId string, ip string, userAgent string, persist bool) (Session, string, error) {
+	if len(userAgent) > 500 {
+		userAgent = userAgent[:500]
+	}
+
+	existing, err := s.store.GetSessions(userId)
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	// Sessions are listed most recently seen first, clear out the expired and
+	// the oldest beyond the limit
+	now := time.Now()
+	for i, session := range existing {
+		if i >= maxSessions-1 || now.After(session.Expires) {
+			s.store.DeleteSession(userId, session.ID)
+		}
+	}
+
+	secret, hash, err := newToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	session := Session{
+		ID:         uuid.NewString(),
+		UserId:     userId,
+		Hash:       hash,
+		CreateDate: now,
+		LastSeen:   now,
+		Persist:    persist,
+		IP:         ip,
+		UserAgent:  userAgent,
+	}
+	session.Expires = session.expiry(now)
+
+	if err := s.store.SaveSession(session); err != nil {
+		return Session{}, "", err
+	}
+
+	session.Hash = ""
+	return session, secret, nil
+}
+
+// AuthenticateSession finds the session for a cookie secret and records
+// that it was seen
+func (s MdsService) AuthenticateSession(secret string) (Session, error) {
+	if secret == "" {
+		return Session{}, SessionInvalid
+	}
+
+	session, err := s.store.GetSession(hashToken(secret))
+	if err == RecordNotFound {
+		return Session{}, SessionInvalid
+	}
+
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	if now.After(session.Expires) {
+		s.store.DeleteSession(session.UserId, session.ID)
+		return Session{}, SessionInvalid
+	}
+
+	if _, err := s.GetUserById(session.UserId); err != nil {
+		return Session{}, SessionInvalid
+	}
+
+	if now.Sub(session.LastSeen) > sessionTouchInterval {
+		session.LastSeen = now
+		session.Expires = session.expiry(now)
+		s.store.TouchSession(session.ID, session.LastSeen, session.Expires)
+	}
+
+	session.Hash = ""
+	return session, nil
+}
+
+// GetSessions lists a user's active sessions, marking the one with currentId
+func (s MdsService) GetSessions(userId string, currentId string) ([]Session, error) {
+	sessions, err := s.store.GetSessions(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	retval := make([]Session, 0, len(sessions))
+	for _, session := range sessions {
+		if now.After(session.Expires) {
+			continue
+		}
+
+		session.Hash = ""
+		session.Current = session.ID == currentId
+		retval = append(retval, session)
+	}
+
+	return retval, nil
+}
+
+func (s MdsService) RevokeSession(userId string, id string) error {
+	err := s.store.DeleteSession(userId, id)
+	if err == RecordNotFound {
+		return SessionNotFound
+	}
+
+	return err
+}
+
+// RevokeSessions signs the user out everywhere, except the session with id
+// except when it is set
+func (s MdsService) RevokeSessions(userId string, except string) error {
+	return s.store.DeleteSessions(userId, except)
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	csrf "github.com/utrack/gin-csrf"
+)
+
+var _ = Describe("Sessions", func() {
+	var service MdsService
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		var err error
+		user, err = service.CreateVerifiedUser("sessions@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	It("should record the device and only store a hash of the secret", func() {
+		session, secret, err := service.CreateSession(user.ID, "10.0.0.1", "Firefox", true)
+		Expect(err).To(BeNil())
+		Expect(session.Hash).To(BeEmpty())
+
+		stored, err := service.store.GetSession(hashToken(secret))
+		Expect(err).To(BeNil())
+		Expect(stored.ID).To(Equal(session.ID))
+		Expect(stored.IP).To(Equal("10.0.0.1"))
+		Expect(stored.UserAgent).To(Equal("Firefox"))
+		Expect(stored.Expires).To(BeTemporally("~", stored.CreateDate.Add(sessionTTL), time.Second))
+	})
+
+	It("should list sessions and mark the current one", func() {
+		first, _, _ := service.CreateSession(user.ID, "10.0.0.1", "Firefox", false)
+		second, _, _ := service.CreateSession(user.ID, "10.0.0.2", "Safari", false)
+
+		list, err := service.GetSessions(user.ID, second.ID)
+		Expect(err).To(BeNil())
+		Expect(list).To(HaveLen(2))
+
+		for _, session := range list {
+			Expect(session.Hash).To(BeEmpty())
+			Expect(session.Current).To(Equal(session.ID == second.ID))
+		}
+
+		Expect([]string{list[0].ID, list[1].ID}).To(ConsistOf(first.ID, second.ID))
+	})
+
+	It("should end idle and expired sessions", func() {
+		session, secret, _ := service.CreateSession(user.ID, "10.0.0.1", "Firefox", false)
+
+		stored, _ := service.store.GetSession(hashToken(secret))
+		stored.Expires = time.Now().Add(-time.Minute)
+		Expect(service.store.SaveSession(stored)).To(BeNil())
+
+		_, err := service.AuthenticateSession(secret)
+		Expect(err).To(Equal(SessionInvalid))
+
+		list, _ := service.GetSessions(user.ID, session.ID)
+		Expect(list).To(BeEmpty())
+	})
+
+	It("should only revoke the owner's sessions", func() {
+		session, secret, _ := service.CreateSession(user.ID, "10.0.0.1", "Firefox", false)
+		other, _ := service.CreateVerifiedUser("other@test.com", "password")
+
+		Expect(service.RevokeSession(other.ID, session.ID)).To(Equal(SessionNotFound))
+		Expect(service.RevokeSession(user.ID, session.ID)).To(BeNil())
+
+		_, err := service.AuthenticateSession(secret)
+		Expect(err).To(Equal(SessionInvalid))
+	})
+
+	It("should sign out other sessions when the password changes", func() {
+		current, currentSecret, _ := service.CreateSession(user.ID, "10.0.0.1", "Firefox", false)
+		_, otherSecret, _ := service.CreateSession(user.ID, "10.0.0.2", "Safari", false)
+
+		Expect(service.UpdateUser(user.ID, "", "newpassword", current.ID)).To(BeNil())
+
+		_, err := service.AuthenticateSession(currentSecret)
+		Expect(err).To(BeNil())
+		_, err = service.AuthenticateSession(otherSecret)
+		Expect(err).To(Equal(SessionInvalid))
+	})
+
+	It("should sign out everywhere after a password reset", func() {
+		_, secret, _ := service.CreateSession(user.ID, "10.0.0.1", "Firefox", true)
+		token, hash, _ := newToken()
+		expires := time.Now().Add(time.Hour)
+		Expect(service.store.SetResetToken(user.ID, &hash, &expires)).To(BeNil())
+
+		Expect(service.ResetPassword(token, "newpassword")).To(BeNil())
+
+		_, err := service.AuthenticateSession(secret)
+		Expect(err).To(Equal(SessionInvalid))
+	})
+
+	Describe("Middleware", func() {
+		var router *gin.Engine
+
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			controller := Controller{}
+			controller.SetOptions(service, false)
+
+			router = gin.New()
+			router.Use(sessions.Sessions("my_session", cookie.NewStore([]byte("secret"))))
+			router.Use(csrf.Middleware(csrf.Options{Secret: "secret"}))
+			router.GET("/login", func(c *gin.Context) {
+				Expect(controller.startSession(c, user.ID, false)).To(BeNil())
+			})
+			router.GET("/account", controller.SessionAuth, func(c *gin.Context) {
+				c.String(200, currentSessionId(c))
+			})
+		})
+
+		request := func(path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", path, nil)
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		It("should accept a session until it is revoked", func() {
+			cookies := request("/login", nil).Result().Cookies()
+
+			recorder := request("/account", cookies)
+			Expect(recorder.Body.String()).NotTo(BeEmpty())
+
+			Expect(service.RevokeSessions(user.ID, "")).To(BeNil())
+			Expect(request("/account", cookies).Body.String()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,1242 @@
+//go:build sqlite_fts5
+
+package lib
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SqliteSchema creates the tables used by the SQLite backend. Journal items
+// are also written to an FTS5 table, one row per item, so a search can
+// highlight and return only the items that matched like Elasticsearch does.
+const SqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	password_hash TEXT NOT NULL,
+	create_date TIMESTAMP NOT NULL,
+	last_login_date TIMESTAMP NOT NULL,
+	verify_token TEXT,
+	reset_token TEXT
+);
+CREATE INDEX IF NOT EXISTS users_email ON users (email);
+CREATE INDEX IF NOT EXISTS users_verify_token ON users (verify_token);
+CREATE INDEX IF NOT EXISTS users_reset_token ON users (reset_token);
+
+CREATE TABLE IF NOT EXISTS journal (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	date TIMESTAMP NOT NULL,
+	create_date TIMESTAMP NOT NULL,
+	entries TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS journal_user_date ON journal (user_id, date);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS journal_items USING fts5(
+	journal_id UNINDEXED,
+	position UNINDEXED,
+	item,
+	tokenize = 'porter unicode61'
+);
+`
+
+// sqliteMigrations bring a database up to date, PRAGMA user_version records
+// how many have been applied. Append new migrations, never edit old ones.
+var sqliteMigrations = []string{
+	SqliteSchema,
+	`ALTER TABLE users ADD COLUMN verify_expires TIMESTAMP;
+	ALTER TABLE users ADD COLUMN reset_expires TIMESTAMP;`,
+	`ALTER TABLE users ADD COLUMN totp_secret TEXT;
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN recovery_codes TEXT;`,
+	`CREATE TABLE access_tokens (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		create_date TIMESTAMP NOT NULL,
+		last_used TIMESTAMP,
+		expires TIMESTAMP
+	);
+	CREATE INDEX access_tokens_user ON access_tokens (user_id, create_date);`,
+	`ALTER TABLE users ADD COLUMN external_id TEXT;
+	CREATE UNIQUE INDEX users_external_id ON users (external_id);`,
+	`CREATE TABLE sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		session_hash TEXT NOT NULL UNIQUE,
+		create_date TIMESTAMP NOT NULL,
+		last_seen TIMESTAMP NOT NULL,
+		expires TIMESTAMP NOT NULL,
+		persist INTEGER NOT NULL DEFAULT 0,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL
+	);
+	CREATE INDEX sessions_user ON sessions (user_id, last_seen);`,
+	`ALTER TABLE users ADD COLUMN pending_email TEXT;
+	ALTER TABLE users ADD COLUMN email_token TEXT;
+	ALTER TABLE users ADD COLUMN email_expires TIMESTAMP;`,
+	`ALTER TABLE users ADD COLUMN delete_after TIMESTAMP;
+	CREATE INDEX users_delete_after ON users (delete_after);
+	CREATE TABLE tombstones (
+		id TEXT PRIMARY KEY,
+		email_hash TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		create_date TIMESTAMP NOT NULL,
+		delete_date TIMESTAMP NOT NULL
+	);`,
+	`CREATE TABLE audit_events (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		action TEXT NOT NULL,
+		result TEXT NOT NULL,
+		detail TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		date TIMESTAMP NOT NULL
+	);
+	CREATE INDEX audit_events_user ON audit_events (user_id, date);
+	CREATE INDEX audit_events_date ON audit_events (date);`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN suspended_at TIMESTAMP;
+	ALTER TABLE audit_events ADD COLUMN actor_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX audit_events_actor ON audit_events (actor_id, date);`,
+	`ALTER TABLE users ADD COLUMN plan TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE journal ADD COLUMN tags TEXT;
+	CREATE TABLE journal_tags (
+		journal_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		tag TEXT NOT NULL
+	);
+	CREATE INDEX journal_tags_user ON journal_tags (user_id, tag);
+	CREATE INDEX journal_tags_journal ON journal_tags (journal_id);`,
+	`ALTER TABLE users ADD COLUMN time_zone TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE users ADD COLUMN carry_over TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN carry_over_after TIMESTAMP;
+	CREATE INDEX users_carry_over_after ON users (carry_over_after);`,
+	`CREATE TABLE revisions (
+		id TEXT PRIMARY KEY,
+		entry_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		entries TEXT NOT NULL,
+		session_id TEXT NOT NULL,
+		token_id TEXT NOT NULL,
+		device TEXT NOT NULL,
+		date TIMESTAMP NOT NULL
+	);
+	CREATE INDEX revisions_entry ON revisions (entry_id, date);
+	CREATE INDEX revisions_user ON revisions (user_id);`,
+	`ALTER TABLE journal ADD COLUMN deleted_at TIMESTAMP;
+	CREATE INDEX journal_deleted_at ON journal (deleted_at);`,
+	// Times used to be stored in whatever zone they were in, see sqliteDB.
+	// The ones queries compare are rewritten in UTC.
+	`UPDATE users SET delete_after = strftime('%Y-%m-%d %H:%M:%f+00:00', delete_after)
+		WHERE strftime('%Y-%m-%d %H:%M:%f', delete_after) IS NOT NULL;
+	UPDATE users SET carry_over_after = strftime('%Y-%m-%d %H:%M:%f+00:00', carry_over_after)
+		WHERE strftime('%Y-%m-%d %H:%M:%f', carry_over_after) IS NOT NULL;
+	UPDATE journal SET deleted_at = strftime('%Y-%m-%d %H:%M:%f+00:00', deleted_at)
+		WHERE strftime('%Y-%m-%d %H:%M:%f', deleted_at) IS NOT NULL;
+	UPDATE audit_events SET date = strftime('%Y-%m-%d %H:%M:%f+00:00', date)
+		WHERE strftime('%Y-%m-%d %H:%M:%f', date) IS NOT NULL;`,
+}
+
+func migrateSqlite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sqliteMigrations[version])
+		if err == nil {
+			_, err = tx.Exec("PRAGMA user_version = " + strconv.Itoa(version+1))
+		}
+
+		if err == nil {
+			err = tx.Commit()
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sqliteDB binds every time in UTC. go-sqlite3 writes a time as text with
+// its zone offset, and SQLite compares and sorts that text as it is, so times
+// from different zones would be out of order.
+type sqliteDB struct {
+	*sql.DB
+}
+
+// sqliteTx binds every time in UTC like sqliteDB
+type sqliteTx struct {
+	*sql.Tx
+}
+
+// utcArgs converts the times among query arguments to UTC
+func utcArgs(args []interface{}) []interface{} {
+	retval := make([]interface{}, len(args))
+	for index, arg := range args {
+		switch value := arg.(type) {
+		case time.Time:
+			arg = value.UTC()
+		case *time.Time:
+			if value != nil {
+				utc := value.UTC()
+				arg = &utc
+			}
+		}
+
+		retval[index] = arg
+	}
+
+	return retval
+}
+
+func (db sqliteDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(query, utcArgs(args)...)
+}
+
+func (db sqliteDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(query, utcArgs(args)...)
+}
+
+func (db sqliteDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(query, utcArgs(args)...)
+}
+
+func (db sqliteDB) Begin() (sqliteTx, error) {
+	tx, err := db.DB.Begin()
+	return sqliteTx{tx}, err
+}
+
+func (tx sqliteTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(query, utcArgs(args)...)
+}
+
+type sqliteStore struct {
+	db sqliteDB
+}
+
+func newSqliteStore(path string) (Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, a single connection also keeps :memory: databases intact
+	db.SetMaxOpenConns(1)
+
+	err = migrateSqlite(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: sqliteDB{db}}, nil
+}
+
+const userColumns = "id, email, password_hash, create_date, last_login_date, verify_token, verify_expires, reset_token, reset_expires, " +
+	"totp_secret, totp_enabled, totp_last_step, recovery_codes, external_id, pending_email, email_token, email_expires, delete_after, role, suspended_at, plan, time_zone, carry_over, carry_over_after"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var recoveryCodes sql.NullString
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreateDate, &user.LastLoginDate,
+		&user.VerifyToken, &user.VerifyExpires, &user.ResetToken, &user.ResetExpires,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep, &recoveryCodes, &user.ExternalID,
+		&user.PendingEmail, &user.EmailToken, &user.EmailExpires, &user.DeleteAfter, &user.Role, &user.SuspendedAt, &user.Plan, &user.TimeZone,
+		&user.CarryOver, &user.CarryOverAfter)
+
+	if err == sql.ErrNoRows {
+		return User{}, RecordNotFound
+	}
+
+	if err == nil && recoveryCodes.Valid {
+		err = json.Unmarshal([]byte(recoveryCodes.String), &user.RecoveryCodes)
+	}
+
+	return user, err
+}
+
+const journalColumns = "id, user_id, date, create_date, entries, tags, deleted_at"
+
+func scanEntry(row rowScanner) (JournalEntry, error) {
+	var entry JournalEntry
+	var entries string
+	var tags *string
+	err := row.Scan(&entry.ID, &entry.UserId, &entry.Date, &entry.CreateDate, &entries, &tags, &entry.DeletedAt)
+
+	if err == sql.ErrNoRows {
+		return JournalEntry{}, RecordNotFound
+	}
+
+	// Rows written before items had IDs hold strings, see JournalItems
+	if err == nil {
+		err = json.Unmarshal([]byte(entries), &entry.Entries)
+		entry.Entries.fillCreated(entry.CreateDate)
+	}
+
+	// Entries saved before tags were stored have none until they are retagged
+	if err == nil && tags != nil {
+		err = json.Unmarshal([]byte(*tags), &entry.Tags)
+	}
+
+	entry.Date = entry.Date.UTC()
+	return entry, err
+}
+
+func (s *sqliteStore) queryEntries(query string, args ...interface{}) ([]JournalEntry, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []JournalEntry{}
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, entry)
+	}
+
+	return retval, rows.Err()
+}
+
+//User Functions
+
+func (s *sqliteStore) GetUserById(id string) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func (s *sqliteStore) GetUserByEmail(email string, verified bool) (User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE email = ?"
+	if verified {
+		query += " AND verify_token IS NULL"
+	}
+
+	return scanUser(s.db.QueryRow(query+" LIMIT 1", strings.ToLower(email)))
+}
+
+func (s *sqliteStore) GetUserByExternalID(externalId string) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE external_id = ?", externalId))
+}
+
+func (s *sqliteStore) SaveUser(user User) error {
+	var recoveryCodes *string
+	if user.RecoveryCodes != nil {
+		codes, err := json.Marshal(user.RecoveryCodes)
+		if err != nil {
+			return err
+		}
+
+		value := string(codes)
+		recoveryCodes = &value
+	}
+
+	_, err := s.db.Exec("INSERT OR REPLACE INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		user.ID, user.Email, user.PasswordHash, user.CreateDate, user.LastLoginDate,
+		user.VerifyToken, user.VerifyExpires, user.ResetToken, user.ResetExpires,
+		user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep, recoveryCodes, user.ExternalID,
+		user.PendingEmail, user.EmailToken, user.EmailExpires, user.DeleteAfter, user.Role, user.SuspendedAt, user.Plan, user.TimeZone,
+		user.CarryOver, user.CarryOverAfter)
+	return err
+}
+
+func (s *sqliteStore) DeleteUser(id string) error {
+	result, err := s.db.Exec("DELETE FROM users WHERE id = ?", id)
+	return affectedOrNotFound(result, err)
+}
+
+func (s *sqliteStore) GetUsersToDelete(date time.Time) ([]User, error) {
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users WHERE delete_after <= ? LIMIT ?", date, purgeBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, user)
+	}
+
+	return retval, rows.Err()
+}
+
+func (s *sqliteStore) GetUsersToCarryOver(date time.Time) ([]User, error) {
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users WHERE carry_over_after <= ? LIMIT ?", date, purgeBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, user)
+	}
+
+	return retval, rows.Err()
+}
+
+func (s *sqliteStore) SetCarryOverAfter(userId string, after *time.Time) error {
+	return affectedOrNotFound(s.db.Exec("UPDATE users SET carry_over_after = ? WHERE id = ?", after, userId))
+}
+
+func (s *sqliteStore) SetSuspendedAt(userId string, at *time.Time) error {
+	return affectedOrNotFound(s.db.Exec("UPDATE users SET suspended_at = ? WHERE id = ?", at, userId))
+}
+
+func (s *sqliteStore) SetPasswordHash(userId string, hash string) error {
+	return affectedOrNotFound(s.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, userId))
+}
+
+func (s *sqliteStore) SaveTombstone(tombstone Tombstone) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO tombstones (id, email_hash, reason, create_date, delete_date) VALUES (?, ?, ?, ?, ?)",
+		tombstone.ID, tombstone.EmailHash, tombstone.Reason, tombstone.CreateDate, tombstone.DeleteDate)
+	return err
+}
+
+func (s *sqliteStore) GetUserVerification(token string) (UserVerification, error) {
+	user, err := scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE verify_token = ?", token))
+
+	if err != nil {
+		return UserVerification{}, err
+	}
+
+	return UserVerification{
+		ID:           user.ID,
+		Email:        user.Email,
+		Token:        token,
+		PasswordHash: user.PasswordHash,
+		CreateDate:   user.CreateDate,
+		Expires:      timeOf(user.VerifyExpires),
+	}, nil
+}
+
+func (s *sqliteStore) SaveUserVerification(verify UserVerification) error {
+	token := verify.Token
+	expires := verify.Expires
+	return s.SaveUser(User{
+		ID:            verify.ID,
+		Email:         verify.Email,
+		PasswordHash:  verify.PasswordHash,
+		CreateDate:    verify.CreateDate,
+		VerifyToken:   &token,
+		VerifyExpires: &expires,
+	})
+}
+
+func (s *sqliteStore) ConsumeVerifyToken(userId string, token string) error {
+	result, err := s.db.Exec("UPDATE users SET verify_token = NULL, verify_expires = NULL WHERE id = ? AND verify_token = ?", userId, token)
+	return affectedOrNotFound(result, err)
+}
+
+func (s *sqliteStore) RenewVerifyToken(userId string, token string, expires time.Time) error {
+	return affectedOrNotFound(s.db.Exec("UPDATE users SET verify_token = ?, verify_expires = ? WHERE id = ? AND verify_token IS NOT NULL", token, expires, userId))
+}
+
+func (s *sqliteStore) GetResetPassword(token string) (PasswordReset, error) {
+	var reset PasswordReset
+	var expires *time.Time
+	err := s.db.QueryRow("SELECT id, reset_token, reset_expires FROM users WHERE reset_token = ?", token).Scan(&reset.ID, &reset.Token, &expires)
+
+	if err == sql.ErrNoRows {
+		return PasswordReset{}, RecordNotFound
+	}
+
+	reset.Expires = timeOf(expires)
+	return reset, err
+}
+
+func (s *sqliteStore) SetResetToken(userId string, token *string, expires *time.Time) error {
+	result, err := s.db.Exec("UPDATE users SET reset_token = ?, reset_expires = ? WHERE id = ?", token, expires, userId)
+	return affectedOrNotFound(result, err)
+}
+
+func (s *sqliteStore) ConsumeResetToken(userId string, token string) error {
+	result, err := s.db.Exec("UPDATE users SET reset_token = NULL, reset_expires = NULL WHERE id = ? AND reset_token = ?", userId, token)
+	return affectedOrNotFound(result, err)
+}
+
+func (s *sqliteStore) GetEmailChange(token string) (EmailChange, error) {
+	var change EmailChange
+	var email *string
+	var expires *time.Time
+	err := s.db.QueryRow("SELECT id, pending_email, email_token, email_expires FROM users WHERE email_token = ?", token).
+		Scan(&change.ID, &email, &change.Token, &expires)
+
+	if err == sql.ErrNoRows {
+		return EmailChange{}, RecordNotFound
+	}
+
+	change.Email = stringOf(email)
+	change.Expires = timeOf(expires)
+	return change, err
+}
+
+func (s *sqliteStore) GetPendingEmailChange(email string, now time.Time) (EmailChange, error) {
+	var change EmailChange
+	var expires *time.Time
+	err := s.db.QueryRow("SELECT id, email_token, email_expires FROM users WHERE pending_email = ? AND email_token IS NOT NULL AND email_expires > ? LIMIT 1", email, now).
+		Scan(&change.ID, &change.Token, &expires)
+
+	if err == sql.ErrNoRows {
+		return EmailChange{}, RecordNotFound
+	}
+
+	change.Email = email
+	change.Expires = timeOf(expires)
+	return change, err
+}
+
+func (s *sqliteStore) SetEmailChange(userId string, email *string, token *string, expires *time.Time) error {
+	result, err := s.db.Exec("UPDATE users SET pending_email = ?, email_token = ?, email_expires = ? WHERE id = ?", email, token, expires, userId)
+	return affectedOrNotFound(result, err)
+}
+
+func (s *sqliteStore) ConsumeEmailToken(userId string, token string) error {
+	result, err := s.db.Exec("UPDATE users SET email_token = NULL, email_expires = NULL WHERE id = ? AND email_token = ?", userId, token)
+	return affectedOrNotFound(result, err)
+}
+
+func (s *sqliteStore) AdvanceTOTPStep(userId string, step int64) error {
+	result, err := s.db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userId, step)
+	return affectedOrNotFound(result, err)
+}
+
+// UseRecoveryCode only writes the codes back if they are still the ones read,
+// so two requests can't both remove the same code
+func (s *sqliteStore) UseRecoveryCode(userId string, hash string) error {
+	var stored sql.NullString
+	err := s.db.QueryRow("SELECT recovery_codes FROM users WHERE id = ?", userId).Scan(&stored)
+	if err == sql.ErrNoRows || (err == nil && !stored.Valid) {
+		return RecordNotFound
+	}
+
+	var hashes []string
+	if err == nil {
+		err = json.Unmarshal([]byte(stored.String), &hashes)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	codes := []string{}
+	for _, code := range hashes {
+		if code != hash {
+			codes = append(codes, code)
+		}
+	}
+
+	if len(codes) == len(hashes) {
+		return RecordNotFound
+	}
+
+	remaining, err := json.Marshal(codes)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec("UPDATE users SET recovery_codes = ? WHERE id = ? AND recovery_codes = ?", string(remaining), userId, stored.String)
+	return affectedOrNotFound(result, err)
+}
+
+func affectedOrNotFound(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		return RecordNotFound
+	}
+
+	return err
+}
+
+//Journal Functions
+
+func (s *sqliteStore) GetJournalEntry(id string) (JournalEntry, error) {
+	return scanEntry(s.db.QueryRow("SELECT "+journalColumns+" FROM journal WHERE id = ?", id))
+}
+
+func (s *sqliteStore) GetJournalEntryByDate(userId string, date time.Time) (JournalEntry, error) {
+	return scanEntry(s.db.QueryRow("SELECT "+journalColumns+" FROM journal WHERE user_id = ? AND date = ? AND deleted_at IS NULL LIMIT 1", userId, dayOf(date)))
+}
+
+func (s *sqliteStore) SaveJournalEntry(entry JournalEntry) error {
+	return s.SaveJournalEntries([]JournalEntry{entry})
+}
+
+func (s *sqliteStore) SaveJournalEntries(entries []JournalEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, entry := range entries {
+		if err = saveEntry(tx, entry); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func saveEntry(tx sqliteTx, entry JournalEntry) error {
+	entries, err := json.Marshal(entry.Entries)
+	if err != nil {
+		return err
+	}
+
+	tags, err := json.Marshal(entry.Tags)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO journal ("+journalColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entry.ID, entry.UserId, dayOf(entry.Date), entry.CreateDate, string(entries), string(tags), entry.DeletedAt)
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM journal_items WHERE journal_id = ?", entry.ID)
+	}
+
+	// Entries in the trash are kept out of the search and tag tables
+	searchable := entry.DeletedAt == nil
+	for position, item := range entry.Entries {
+		if err != nil || !searchable {
+			break
+		}
+
+		_, err = tx.Exec("INSERT INTO journal_items (journal_id, position, item) VALUES (?, ?, ?)", entry.ID, position, item.Text)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM journal_tags WHERE journal_id = ?", entry.ID)
+	}
+
+	for _, tag := range entry.Tags {
+		if err != nil || !searchable {
+			break
+		}
+
+		_, err = tx.Exec("INSERT INTO journal_tags (journal_id, user_id, tag) VALUES (?, ?, ?)", entry.ID, entry.UserId, tag)
+	}
+
+	return err
+}
+
+func (s *sqliteStore) DeleteJournalEntry(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM journal WHERE id = ?", id)
+	err = affectedOrNotFound(result, err)
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM journal_items WHERE journal_id = ?", id)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM journal_tags WHERE journal_id = ?", id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) GetJournalEntries(userId string, start time.Time, end time.Time) ([]JournalEntry, error) {
+	return s.queryEntries("SELECT "+journalColumns+" FROM journal WHERE user_id = ? AND date >= ? AND date <= ? AND deleted_at IS NULL ORDER BY date DESC",
+		userId, dayOf(start), dayOf(end))
+}
+
+// ftsMatch converts query terms into an FTS5 expression that matches any of
+// them, the same as the default OR operator of an Elasticsearch query string.
+// Terms that look like dates are returned separately to match the date column.
+func ftsMatch(terms []string) (string, []time.Time) {
+	var match []string
+	var dates []time.Time
+
+	for _, term := range terms {
+		if date, err := time.Parse("2006-01-02", term); err == nil {
+			dates = append(dates, date)
+			continue
+		}
+
+		prefix := strings.HasSuffix(term, "*")
+		term = `"` + strings.ReplaceAll(strings.TrimRight(term, "*"), `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+
+		match = append(match, term)
+	}
+
+	return strings.Join(match, " OR "), dates
+}
+
+// journalFilter builds the WHERE clause shared by the journal searches
+func journalFilter(userId string, jq JournalQuery, match string, dates []time.Time) (string, []interface{}) {
+	where := "user_id = ? AND deleted_at IS NULL"
+	args := []interface{}{userId}
+
+	if !jq.Start.IsZero() {
+		where += " AND date >= ?"
+		args = append(args, dayOf(jq.Start))
+	}
+
+	if !jq.End.IsZero() {
+		where += " AND date <= ?"
+		args = append(args, dayOf(jq.End))
+	}
+
+	for _, tag := range jq.Tags {
+		where += " AND id IN (SELECT journal_id FROM journal_tags WHERE user_id = ? AND tag = ?)"
+		args = append(args, userId, tag)
+	}
+
+	if jq.Query != "" {
+		var or []string
+		if match != "" {
+			or = append(or, "id IN (SELECT journal_id FROM journal_items WHERE journal_items MATCH ?)")
+			args = append(args, match)
+		}
+
+		for _, date := range dates {
+			or = append(or, "date = ?")
+			args = append(args, date)
+		}
+
+		if len(or) == 0 {
+			or = append(or, "0")
+		}
+
+		where += " AND (" + strings.Join(or, " OR ") + ")"
+	}
+
+	return where, args
+}
+
+func (s *sqliteStore) highlightEntry(entry *JournalEntry, match string) error {
+	rows, err := s.db.Query("SELECT position, highlight(journal_items, 2, '<strong>', '</strong>') FROM journal_items "+
+		"WHERE journal_items MATCH ? AND journal_id = ? ORDER BY position", match, entry.ID)
+
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var highlighted JournalItems
+	for rows.Next() {
+		var position int
+		var text string
+		if err := rows.Scan(&position, &text); err != nil {
+			return err
+		}
+
+		if position < len(entry.Entries) {
+			item := entry.Entries[position]
+			item.Text = text
+			highlighted = append(highlighted, item)
+		}
+	}
+
+	if len(highlighted) > 0 {
+		entry.Entries = highlighted
+	}
+
+	return rows.Err()
+}
+
+func (s *sqliteStore) SearchJournal(userId string, jq JournalQuery) ([]JournalEntry, int64, error) {
+	match, dates := ftsMatch(queryTerms(jq.Query))
+	where, args := journalFilter(userId, jq, match, dates)
+
+	var total int64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM journal WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit := jq.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	entries, err := s.queryEntries("SELECT "+journalColumns+" FROM journal WHERE "+where+" ORDER BY date DESC LIMIT ? OFFSET ?",
+		append(args, limit, jq.Offset)...)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if jq.Query != "" && match != "" {
+		for index := range entries {
+			if err := s.highlightEntry(&entries[index], match); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	return entries, total, nil
+}
+
+func (s *sqliteStore) SearchJournalDates(userId string, jq JournalQuery) ([]time.Time, error) {
+	match, dates := ftsMatch(queryTerms(jq.Query))
+	where, args := journalFilter(userId, jq, match, dates)
+
+	rows, err := s.db.Query("SELECT date FROM journal WHERE "+where+" ORDER BY date DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []time.Time{}
+	for rows.Next() {
+		var date time.Time
+		if err := rows.Scan(&date); err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, date.UTC())
+	}
+
+	return retval, rows.Err()
+}
+
+func (s *sqliteStore) EachJournalEntry(userId string, fn func(JournalEntry) error) error {
+	var after time.Time
+
+	for {
+		// Read a page at a time so fn can write while no rows are open
+		entries, err := s.queryEntries("SELECT "+journalColumns+" FROM journal WHERE user_id = ? AND date > ? AND deleted_at IS NULL ORDER BY date LIMIT ?",
+			userId, after, journalPageSize)
+
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+
+			after = entry.Date
+		}
+
+		if len(entries) < journalPageSize {
+			return nil
+		}
+	}
+}
+
+func (s *sqliteStore) GetJournalTags(userId string) ([]TagCount, error) {
+	rows, err := s.db.Query("SELECT tag, COUNT(*) FROM journal_tags WHERE user_id = ? GROUP BY tag", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Tag, &tag.Count); err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, tag)
+	}
+
+	return retval, rows.Err()
+}
+
+func (s *sqliteStore) GetTrash(userId string, since time.Time) ([]JournalEntry, error) {
+	return s.queryEntries("SELECT "+journalColumns+" FROM journal WHERE user_id = ? AND deleted_at > ? ORDER BY deleted_at DESC LIMIT ?",
+		userId, since, maxTrash)
+}
+
+func (s *sqliteStore) GetEntriesToPurge(date time.Time) ([]JournalEntry, error) {
+	return s.queryEntries("SELECT "+journalColumns+" FROM journal WHERE deleted_at < ? LIMIT ?", date, purgeBatchSize)
+}
+
+func (s *sqliteStore) DeleteJournalEntries(userId string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM journal_items WHERE journal_id IN (SELECT id FROM journal WHERE user_id = ?)", userId)
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM journal_tags WHERE user_id = ?", userId)
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM journal WHERE user_id = ?", userId)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//Revision Functions
+
+const revisionColumns = "id, entry_id, user_id, entries, session_id, token_id, device, date"
+
+func scanRevision(row rowScanner) (Revision, error) {
+	var revision Revision
+	var entries string
+	err := row.Scan(&revision.ID, &revision.EntryID, &revision.UserId, &entries,
+		&revision.Editor.SessionID, &revision.Editor.TokenID, &revision.Editor.Device, &revision.Date)
+
+	if err == sql.ErrNoRows {
+		return Revision{}, RecordNotFound
+	}
+
+	if err == nil {
+		err = json.Unmarshal([]byte(entries), &revision.Entries)
+	}
+
+	return revision, err
+}
+
+func (s *sqliteStore) SaveRevision(revision Revision) error {
+	entries, err := json.Marshal(revision.Entries)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT INTO revisions ("+revisionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		revision.ID, revision.EntryID, revision.UserId, string(entries),
+		revision.Editor.SessionID, revision.Editor.TokenID, revision.Editor.Device, revision.Date)
+	return err
+}
+
+func (s *sqliteStore) GetRevision(id string) (Revision, error) {
+	return scanRevision(s.db.QueryRow("SELECT "+revisionColumns+" FROM revisions WHERE id = ?", id))
+}
+
+func (s *sqliteStore) GetRevisions(entryId string, limit int) ([]Revision, error) {
+	rows, err := s.db.Query("SELECT "+revisionColumns+" FROM revisions WHERE entry_id = ? ORDER BY date DESC LIMIT ?", entryId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []Revision{}
+	for rows.Next() {
+		revision, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, revision)
+	}
+
+	return retval, rows.Err()
+}
+
+func (s *sqliteStore) PruneRevisions(entryId string, keep int) error {
+	_, err := s.db.Exec("DELETE FROM revisions WHERE entry_id = ? AND id NOT IN "+
+		"(SELECT id FROM revisions WHERE entry_id = ? ORDER BY date DESC LIMIT ?)", entryId, entryId, keep)
+	return err
+}
+
+func (s *sqliteStore) DeleteRevisions(userId string) error {
+	_, err := s.db.Exec("DELETE FROM revisions WHERE user_id = ?", userId)
+	return err
+}
+
+//Access Token Functions
+
+const tokenColumns = "id, user_id, name, token_hash, scopes, create_date, last_used, expires"
+
+func scanToken(row rowScanner) (AccessToken, error) {
+	var token AccessToken
+	var scopes string
+	err := row.Scan(&token.ID, &token.UserId, &token.Name, &token.Hash, &scopes, &token.CreateDate, &token.LastUsed, &token.Expires)
+
+	if err == sql.ErrNoRows {
+		return AccessToken{}, RecordNotFound
+	}
+
+	if err == nil {
+		err = json.Unmarshal([]byte(scopes), &token.Scopes)
+	}
+
+	return token, err
+}
+
+func (s *sqliteStore) GetAccessToken(hash string) (AccessToken, error) {
+	return scanToken(s.db.QueryRow("SELECT "+tokenColumns+" FROM access_tokens WHERE token_hash = ?", hash))
+}
+
+func (s *sqliteStore) GetAccessTokens(userId string) ([]AccessToken, error) {
+	rows, err := s.db.Query("SELECT "+tokenColumns+" FROM access_tokens WHERE user_id = ? ORDER BY create_date DESC", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []AccessToken{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, token)
+	}
+
+	return retval, rows.Err()
+}
+
+func (s *sqliteStore) SaveAccessToken(token AccessToken) error {
+	scopes, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT OR REPLACE INTO access_tokens ("+tokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		token.ID, token.UserId, token.Name, token.Hash, string(scopes), token.CreateDate, token.LastUsed, token.Expires)
+	return err
+}
+
+func (s *sqliteStore) DeleteAccessToken(userId string, id string) error {
+	return affectedOrNotFound(s.db.Exec("DELETE FROM access_tokens WHERE id = ? AND user_id = ?", id, userId))
+}
+
+func (s *sqliteStore) TouchAccessToken(id string, used time.Time) error {
+	return affectedOrNotFound(s.db.Exec("UPDATE access_tokens SET last_used = ? WHERE id = ?", used, id))
+}
+
+//Session Functions
+
+const sessionColumns = "id, user_id, session_hash, create_date, last_seen, expires, persist, ip, user_agent"
+
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+	err := row.Scan(&session.ID, &session.UserId, &session.Hash, &session.CreateDate, &session.LastSeen,
+		&session.Expires, &session.Persist, &session.IP, &session.UserAgent)
+
+	if err == sql.ErrNoRows {
+		return Session{}, RecordNotFound
+	}
+
+	return session, err
+}
+
+func (s *sqliteStore) GetSession(hash string) (Session, error) {
+	return scanSession(s.db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE session_hash = ?", hash))
+}
+
+func (s *sqliteStore) GetSessions(userId string) ([]Session, error) {
+	rows, err := s.db.Query("SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? ORDER BY last_seen DESC", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, session)
+	}
+
+	return retval, rows.Err()
+}
+
+func (s *sqliteStore) SaveSession(session Session) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO sessions ("+sessionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		session.ID, session.UserId, session.Hash, session.CreateDate, session.LastSeen, session.Expires,
+		session.Persist, session.IP, session.UserAgent)
+	return err
+}
+
+func (s *sqliteStore) DeleteSession(userId string, id string) error {
+	return affectedOrNotFound(s.db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userId))
+}
+
+func (s *sqliteStore) DeleteSessions(userId string, except string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userId, except)
+	return err
+}
+
+func (s *sqliteStore) TouchSession(id string, seen time.Time, expires time.Time) error {
+	return affectedOrNotFound(s.db.Exec("UPDATE sessions SET last_seen = ?, expires = ? WHERE id = ?", seen, expires, id))
+}
+
+//Admin Functions
+
+func (s *sqliteStore) SearchUsers(query UserQuery) ([]User, int64, error) {
+	where := []string{"email LIKE ? ESCAPE '\\'"}
+	args := []interface{}{"%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query.Email) + "%"}
+
+	if query.Role != "" {
+		where = append(where, "role = ?")
+		args = append(args, query.Role)
+	}
+
+	switch query.Status {
+	case UserStatusVerified:
+		where = append(where, "verify_token IS NULL")
+	case UserStatusPending:
+		where = append(where, "verify_token IS NOT NULL")
+	case UserStatusSuspended:
+		where = append(where, "suspended_at IS NOT NULL")
+	}
+
+	filter := " FROM users WHERE " + strings.Join(where, " AND ")
+
+	var total int64
+	if err := s.db.QueryRow("SELECT COUNT(*)"+filter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query("SELECT "+userColumns+filter+" ORDER BY create_date DESC LIMIT ? OFFSET ?", append(args, query.Limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	retval := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		retval = append(retval, user)
+	}
+
+	return retval, total, rows.Err()
+}
+
+func (s *sqliteStore) GetUserStats() (UserStats, error) {
+	var stats UserStats
+	err := s.db.QueryRow(`SELECT COUNT(*),
+		COUNT(verify_token),
+		COUNT(suspended_at),
+		COALESCE(SUM(role = ?), 0),
+		COALESCE(SUM(totp_enabled), 0),
+		COUNT(delete_after)
+		FROM users`, RoleAdmin).Scan(&stats.Users, &stats.Pending, &stats.Suspended, &stats.Admins, &stats.TwoFactor, &stats.PendingDeletion)
+
+	if err == nil {
+		err = s.db.QueryRow("SELECT COUNT(*) FROM journal WHERE deleted_at IS NULL").Scan(&stats.JournalEntries)
+	}
+
+	stats.Verified = stats.Users - stats.Pending
+	return stats, err
+}
+
+//Audit Functions
+
+const auditColumns = "id, user_id, actor_id, email, action, result, detail, ip, user_agent, date"
+
+func (s *sqliteStore) SaveAuditEvent(event AuditEvent) error {
+	_, err := s.db.Exec("INSERT INTO audit_events ("+auditColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		event.ID, event.UserId, event.ActorId, event.Email, event.Action, event.Result, event.Detail, event.IP, event.UserAgent, event.Date)
+	return err
+}
+
+func (s *sqliteStore) GetAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	var where []string
+	var args []interface{}
+
+	for _, term := range []struct {
+		column string
+		value  string
+	}{{"user_id", query.UserId}, {"actor_id", query.ActorId}, {"email", query.Email}, {"action", query.Action}, {"result", query.Result}, {"ip", query.IP}} {
+		if term.value != "" {
+			where = append(where, term.column+" = ?")
+			args = append(args, term.value)
+		}
+	}
+
+	if !query.Since.IsZero() {
+		where = append(where, "date >= ?")
+		args = append(args, query.Since)
+	}
+
+	if !query.Until.IsZero() {
+		where = append(where, "date <= ?")
+		args = append(args, query.Until)
+	}
+
+	statement := "SELECT " + auditColumns + " FROM audit_events"
+	if len(where) > 0 {
+		statement += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	rows, err := s.db.Query(statement+" ORDER BY date DESC LIMIT ?", append(args, query.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		err := rows.Scan(&event.ID, &event.UserId, &event.ActorId, &event.Email, &event.Action, &event.Result, &event.Detail,
+			&event.IP, &event.UserAgent, &event.Date)
+		if err != nil {
+			return nil, err
+		}
+
+		retval = append(retval, event)
+	}
+
+	return retval, rows.Err()
+}
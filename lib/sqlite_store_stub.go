@@ -0,0 +1,13 @@
+//go:build !sqlite_fts5
+
+package lib
+
+import (
+	"errors"
+)
+
+// newSqliteStore is replaced when building with -tags sqlite_fts5, which
+// compiles SQLite with the FTS5 extension
+func newSqliteStore(path string) (Store, error) {
+	return nil, errors.New("SQLite backend requires building with -tags sqlite_fts5")
+}
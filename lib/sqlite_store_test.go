@@ -0,0 +1,69 @@
+//go:build sqlite_fts5
+
+package lib
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SQLite store", func() {
+	var store Store
+	var user User
+
+	BeforeEach(func() {
+		var err error
+		store, err = newSqliteStore(":memory:")
+		Expect(err).To(BeNil())
+
+		user = User{ID: "zoned", Email: "zoned@test.com", TimeZone: "Asia/Tokyo", CarryOver: CarryOverCopy}
+	})
+
+	zone := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		Expect(err).To(BeNil())
+		return loc
+	}
+
+	It("should compare times stored in another zone", func() {
+		midnight := time.Date(2021, 3, 2, 0, 0, 0, 0, zone("Asia/Tokyo"))
+		user.CarryOverAfter = &midnight
+		user.DeleteAfter = &midnight
+		Expect(store.SaveUser(user)).To(BeNil())
+
+		// Half an hour past midnight in Tokyo is still the day before in New York
+		now := midnight.Add(30 * time.Minute).In(zone("America/New_York"))
+
+		users, err := store.GetUsersToCarryOver(now)
+		Expect(err).To(BeNil())
+		Expect(users).To(HaveLen(1))
+		Expect(users[0].CarryOverAfter.Equal(midnight)).To(BeTrue())
+
+		users, err = store.GetUsersToDelete(now)
+		Expect(err).To(BeNil())
+		Expect(users).To(HaveLen(1))
+
+		users, err = store.GetUsersToCarryOver(midnight.Add(-30 * time.Minute).In(zone("America/New_York")))
+		Expect(err).To(BeNil())
+		Expect(users).To(BeEmpty())
+	})
+
+	It("should run the nightly carry over at midnight in the user's zone", func() {
+		service := MdsService{}
+		Expect(service.Init(ServiceOptions{Backend: BackendSqlite, SqlitePath: ":memory:"})).To(BeNil())
+
+		created, err := service.CreateVerifiedUser("zoned@test.com", "password")
+		Expect(err).To(BeNil())
+		Expect(service.SetTimeZone(created.ID, "Asia/Tokyo")).To(BeNil())
+		Expect(service.SetCarryOver(created.ID, CarryOverCopy)).To(BeNil())
+
+		stored, _ := service.GetUserById(created.ID)
+		now := stored.CarryOverAfter.Add(time.Minute).In(zone("America/Los_Angeles"))
+
+		count, err := service.RunNightlyCarryOver(now)
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(1))
+	})
+})
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"time"
+)
+
+// Store is the persistence layer beneath MdsService. A store only reads and
+// writes records; validation, password hashing and mail are handled by the
+// service. Lookups that find nothing return RecordNotFound. Reset and
+// verification tokens reach the store already hashed. Journal lookups by date,
+// searches and tags leave out entries in the trash, GetJournalEntry doesn't.
+type Store interface {
+	// GetUserById retrieves a user or pending verification by id
+	GetUserById(id string) (User, error)
+	// GetUserByEmail retrieves a user by email, only verified users if verified is set
+	GetUserByEmail(email string, verified bool) (User, error)
+	// GetUserByExternalID retrieves the user linked to a sign-in provider's subject
+	GetUserByExternalID(externalId string) (User, error)
+	SaveUser(user User) error
+	DeleteUser(id string) error
+	// GetUsersToDelete returns up to purgeBatchSize users whose deletion grace
+	// period ended before date
+	GetUsersToDelete(date time.Time) ([]User, error)
+	// GetUsersToCarryOver returns up to purgeBatchSize users whose nightly
+	// carry over is due at date
+	GetUsersToCarryOver(date time.Time) ([]User, error)
+	// SetCarryOverAfter only changes when a user's nightly carry over next runs
+	SetCarryOverAfter(userId string, after *time.Time) error
+	// SetSuspendedAt only changes when a user was suspended, nil lifts it
+	SetSuspendedAt(userId string, at *time.Time) error
+	// SetPasswordHash only changes a user's password, "" removes it
+	SetPasswordHash(userId string, hash string) error
+	// SaveTombstone records that an account was deleted
+	SaveTombstone(tombstone Tombstone) error
+
+	GetUserVerification(token string) (UserVerification, error)
+	SaveUserVerification(verify UserVerification) error
+	// ConsumeVerifyToken clears the verification token only if it is still set,
+	// returning RecordNotFound when another request used it first
+	ConsumeVerifyToken(userId string, token string) error
+	// RenewVerifyToken replaces the verification token only while the
+	// registration is pending, returning RecordNotFound once it was verified
+	RenewVerifyToken(userId string, token string, expires time.Time) error
+
+	GetResetPassword(token string) (PasswordReset, error)
+	SetResetToken(userId string, token *string, expires *time.Time) error
+	// ConsumeResetToken clears the reset token only if it is still set,
+	// returning RecordNotFound when another request used it first
+	ConsumeResetToken(userId string, token string) error
+	GetEmailChange(token string) (EmailChange, error)
+	// GetPendingEmailChange finds a change to email that hasn't expired at now
+	GetPendingEmailChange(email string, now time.Time) (EmailChange, error)
+	// SetEmailChange records the address waiting for confirmation, nil clears it
+	SetEmailChange(userId string, email *string, token *string, expires *time.Time) error
+	// ConsumeEmailToken clears the email token only if it is still set,
+	// returning RecordNotFound when another request already consumed it
+	ConsumeEmailToken(userId string, token string) error
+	// AdvanceTOTPStep records the last two-factor step used, only if step is
+	// later than it, returning RecordNotFound when another request got there first
+	AdvanceTOTPStep(userId string, step int64) error
+	// UseRecoveryCode removes a recovery code hash only if it is still there,
+	// returning RecordNotFound when another request already used it
+	UseRecoveryCode(userId string, hash string) error
+
+	GetJournalEntry(id string) (JournalEntry, error)
+	GetJournalEntryByDate(userId string, date time.Time) (JournalEntry, error)
+	SaveJournalEntry(entry JournalEntry) error
+	// SaveJournalEntries writes many entries at once, refreshing only at the end
+	SaveJournalEntries(entries []JournalEntry) error
+	DeleteJournalEntry(id string) error
+	// GetJournalEntries returns a user's entries between start and end inclusive, newest first
+	GetJournalEntries(userId string, start time.Time, end time.Time) ([]JournalEntry, error)
+	// SearchJournal runs a full text query, highlighting matched entries, newest first
+	SearchJournal(userId string, jq JournalQuery) ([]JournalEntry, int64, error)
+	SearchJournalDates(userId string, jq JournalQuery) ([]time.Time, error)
+	// EachJournalEntry calls fn with every entry of a user, oldest first, reading a page at a time
+	EachJournalEntry(userId string, fn func(JournalEntry) error) error
+	// GetJournalTags counts the entries of a user having each tag
+	GetJournalTags(userId string) ([]TagCount, error)
+	// DeleteJournalEntries removes every entry of a user, including the trash
+	DeleteJournalEntries(userId string) error
+	// GetTrash returns a user's entries deleted after since, most recently deleted first
+	GetTrash(userId string, since time.Time) ([]JournalEntry, error)
+	// GetEntriesToPurge returns up to purgeBatchSize entries deleted before date
+	GetEntriesToPurge(date time.Time) ([]JournalEntry, error)
+
+	SaveRevision(revision Revision) error
+	GetRevision(id string) (Revision, error)
+	// GetRevisions returns up to limit revisions of an entry, newest first
+	GetRevisions(entryId string, limit int) ([]Revision, error)
+	// PruneRevisions removes all but the newest keep revisions of an entry
+	PruneRevisions(entryId string, keep int) error
+	// DeleteRevisions removes every revision of a user's entries
+	DeleteRevisions(userId string) error
+
+	// GetAccessToken finds a personal access token by the hash of its secret
+	GetAccessToken(hash string) (AccessToken, error)
+	// GetAccessTokens returns a user's access tokens, newest first
+	GetAccessTokens(userId string) ([]AccessToken, error)
+	SaveAccessToken(token AccessToken) error
+	// DeleteAccessToken returns RecordNotFound unless the token belongs to the user
+	DeleteAccessToken(userId string, id string) error
+	TouchAccessToken(id string, used time.Time) error
+
+	// GetSession finds a sign-in session by the hash of its secret
+	GetSession(hash string) (Session, error)
+	// GetSessions returns a user's sessions, most recently seen first
+	GetSessions(userId string) ([]Session, error)
+	SaveSession(session Session) error
+	// DeleteSession returns RecordNotFound unless the session belongs to the user
+	DeleteSession(userId string, id string) error
+	// DeleteSessions removes every session of a user but the one with id except
+	DeleteSessions(userId string, except string) error
+	TouchSession(id string, seen time.Time, expires time.Time) error
+
+	// SearchUsers returns a page of matching users, newest first, and how many match
+	SearchUsers(query UserQuery) ([]User, int64, error)
+	GetUserStats() (UserStats, error)
+
+	// SaveAuditEvent appends to the security audit log
+	SaveAuditEvent(event AuditEvent) error
+	// GetAuditEvents returns up to query.Limit matching events, newest first
+	GetAuditEvents(query AuditQuery) ([]AuditEvent, error)
+}
+
+// journalPageSize is how many entries EachJournalEntry reads per request
+const journalPageSize = 100
+
+// maxTrash is the most deleted entries GetTrash returns
+const maxTrash = 1000
+
+const (
+	// BackendElastic stores data in Elasticsearch, the default
+	BackendElastic = "elasticsearch"
+	// BackendMemory keeps everything in process, for development and tests
+	BackendMemory = "memory"
+	// BackendSqlite stores data in an embedded SQLite database file
+	BackendSqlite = "sqlite"
+)
+
+// defaultSearchLimit matches the Elasticsearch default page size
+const defaultSearchLimit = 10
+
+func dayOf(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// timeOf returns the zero time for an unset optional date
+func timeOf(date *time.Time) time.Time {
+	if date == nil {
+		return time.Time{}
+	}
+
+	return *date
+}
+
+// stringOf returns the empty string for an unset optional string
+func stringOf(value *string) string {
+	if value == nil {
+		return ""
+	}
+
+	return *value
+}
@@ -0,0 +1,248 @@
+package lib
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Hashtags such as #work or #gym written in a day's items are stored in the
+// entry's Tags, lower case and without the #, whenever the entry is saved.
+// Renaming or merging tags rewrites the hashtags in the items themselves so
+// the text and the tags never disagree.
+
+// maxTagLength is the longest hashtag that becomes a tag
+const maxTagLength = 50
+
+// hashtagPattern finds a # that doesn't follow a word, another # or an HTML
+// entity, then the tag: words joined by single dashes
+var hashtagPattern = regexp.MustCompile(`(^|[^\p{L}\p{N}_&#/])#([\p{L}\p{N}_]+(?:-[\p{L}\p{N}_]+)*)`)
+
+// TagCount is how many of a user's entries have a tag
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+// normalizeTag lower cases a tag and drops a leading #, returning "" when it
+// isn't something extractTags would find
+func normalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+	if !validTag(tag) || hashtagPattern.FindString("#"+tag) != "#"+tag {
+		return ""
+	}
+
+	return tag
+}
+
+// normalizeTags normalizes every tag, returning TagInvalid if one isn't a tag
+func normalizeTags(tags []string) ([]string, error) {
+	var retval []string
+	for _, tag := range tags {
+		if tag = normalizeTag(tag); tag == "" {
+			return nil, TagInvalid
+		}
+
+		retval = append(retval, tag)
+	}
+
+	return retval, nil
+}
+
+// validTag requires a letter, so #1 in "item #1" isn't a tag
+func validTag(tag string) bool {
+	return len(tag) <= maxTagLength && strings.IndexFunc(tag, unicode.IsLetter) >= 0
+}
+
+// eachHashtag calls fn with the start and end of every hashtag in text,
+// including the #, and the tag it holds
+func eachHashtag(text string, fn func(start int, end int, tag string)) {
+	for _, match := range hashtagPattern.FindAllStringSubmatchIndex(text, -1) {
+		tag := strings.ToLower(text[match[4]:match[5]])
+		if validTag(tag) {
+			fn(match[4]-1, match[5], tag)
+		}
+	}
+}
+
+// extractTags returns the distinct tags in a day's items, sorted
+func extractTags(items []string) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+
+	for _, item := range items {
+		eachHashtag(item, func(start int, end int, tag string) {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		})
+	}
+
+	sort.Strings(tags)
+	return tags
+}
+
+// replaceTags rewrites the hashtags found in renames, returning whether any changed
+func replaceTags(items JournalItems, renames map[string]string) bool {
+	changed := false
+
+	for index := range items {
+		item := items[index].Text
+		var b strings.Builder
+		last := 0
+
+		eachHashtag(item, func(start int, end int, tag string) {
+			if name, ok := renames[tag]; ok {
+				b.WriteString(item[last:start] + "#" + name)
+				last = end
+				changed = true
+			}
+		})
+
+		if last > 0 {
+			b.WriteString(item[last:])
+			items[index].Text = b.String()
+		}
+	}
+
+	return changed
+}
+
+// GetTags lists the tags a user has written with how many entries have each,
+// most used first
+func (s MdsService) GetTags(userId string) ([]TagCount, error) {
+	if userId == "" {
+		return nil, UserUnauthorized
+	}
+
+	tags, err := s.store.GetJournalTags(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+
+		return tags[i].Tag < tags[j].Tag
+	})
+
+	return tags, nil
+}
+
+// RenameTag changes a tag in every entry that has it and returns how many
+// were rewritten. Use MergeTags when the new name is already in use.
+func (s MdsService) RenameTag(userId string, tag string, name string, editor Editor) (int, error) {
+	tag = normalizeTag(tag)
+	name = normalizeTag(name)
+	if tag == "" || name == "" {
+		return 0, TagInvalid
+	}
+
+	if tag == name {
+		return 0, nil
+	}
+
+	// Look for the name itself, the tag counts are capped at maxTags
+	_, total, err := s.store.SearchJournal(userId, JournalQuery{Tags: []string{name}, Limit: 1})
+	if err != nil {
+		return 0, err
+	}
+
+	if total > 0 {
+		return 0, TagExists
+	}
+
+	return s.rewriteTags(userId, map[string]string{tag: name}, editor)
+}
+
+// MergeTags renames each of the tags to into, so entries that had any of
+// them have into instead, and returns how many entries were rewritten
+func (s MdsService) MergeTags(userId string, tags []string, into string, editor Editor) (int, error) {
+	into = normalizeTag(into)
+	tags, err := normalizeTags(tags)
+	if into == "" || len(tags) == 0 || err != nil {
+		return 0, TagInvalid
+	}
+
+	renames := map[string]string{}
+	for _, tag := range tags {
+		if tag != into {
+			renames[tag] = into
+		}
+	}
+
+	return s.rewriteTags(userId, renames, editor)
+}
+
+// rewriteTags replaces hashtags in a user's entries, keeping the items each
+// had as a revision. Every entry is checked against the limits before any is
+// saved, so a rename that makes an item too long changes nothing.
+func (s MdsService) rewriteTags(userId string, renames map[string]string, editor Editor) (int, error) {
+	limits, err := s.GetJournalLimits(userId)
+	if err != nil || len(renames) == 0 {
+		return 0, err
+	}
+
+	var changed []JournalEntry
+	var previous []JournalItems
+	err = s.store.EachJournalEntry(userId, func(entry JournalEntry) error {
+		before := append(JournalItems{}, entry.Entries...)
+		if !replaceTags(entry.Entries, renames) {
+			return nil
+		}
+
+		for _, item := range entry.Entries {
+			if len(item.Text) > limits.MaxItemLength {
+				return LimitError{Err: JournalEntryInvalid, Limit: limits.MaxItemLength}
+			}
+		}
+
+		entry.Tags = extractTags(entry.Entries.Texts())
+		changed = append(changed, entry)
+		previous = append(previous, before)
+		return nil
+	})
+
+	for index := 0; err == nil && index < len(changed); index++ {
+		err = s.keepRevision(changed[index], previous[index], editor)
+	}
+
+	if err == nil {
+		err = s.saveEntries(changed)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(changed), nil
+}
+
+// RetagJournal extracts the tags of every entry of a user again, for entries
+// written before tags were stored, and returns how many changed
+func (s MdsService) RetagJournal(userId string) (int, error) {
+	var changed []JournalEntry
+	err := s.store.EachJournalEntry(userId, func(entry JournalEntry) error {
+		tags := extractTags(entry.Entries.Texts())
+		if entry.Tags == nil || strings.Join(tags, " ") != strings.Join(entry.Tags, " ") {
+			entry.Tags = tags
+			changed = append(changed, entry)
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		err = s.saveEntries(changed)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(changed), nil
+}
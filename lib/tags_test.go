@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tags", func() {
+	var service MdsService
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		var err error
+		user, err = service.CreateVerifiedUser("tags@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	day := func(date string) time.Time {
+		parsed, _ := time.Parse("2006-01-02", date)
+		return parsed
+	}
+
+	write := func(date string, items ...string) JournalEntry {
+		entry, err := service.CreateJournalEntry(user.ID, items, day(date))
+		Expect(err).To(BeNil())
+		return entry
+	}
+
+	entryOn := func(date string) JournalEntry {
+		entry, err := service.GetJournalEntryByDate(user.ID, day(date))
+		Expect(err).To(BeNil())
+		return entry
+	}
+
+	Describe("Extracting", func() {
+		It("should find hashtags", func() {
+			Expect(extractTags([]string{"#Gym then #work", "more #work, #late-night!", "#work#not"})).
+				To(Equal([]string{"gym", "late-night", "work"}))
+		})
+
+		It("should skip what isn't a hashtag", func() {
+			Expect(extractTags([]string{"item #1", "mail@host#x", "a&#39;b", "see /page#top", "trailing #"})).To(BeEmpty())
+			Expect(extractTags([]string{"#" + strings.Repeat("a", maxTagLength+1)})).To(BeEmpty())
+		})
+
+		It("should normalize tags", func() {
+			Expect(normalizeTag(" #Work ")).To(Equal("work"))
+			Expect(normalizeTag("two words")).To(BeEmpty())
+			Expect(normalizeTag("123")).To(BeEmpty())
+		})
+	})
+
+	It("should store tags on create and update", func() {
+		entry := write("2021-03-01", "Lifted at the #gym")
+		Expect(entry.Tags).To(Equal([]string{"gym"}))
+		Expect(entryOn("2021-03-01").Tags).To(Equal([]string{"gym"}))
+
+		Expect(service.UpdateJournalEntry(entry.ID, user.ID, []string{"#Work all day"}, Editor{})).To(BeNil())
+		Expect(entryOn("2021-03-01").Tags).To(Equal([]string{"work"}))
+	})
+
+	It("should filter searches by tag", func() {
+		write("2021-03-01", "#gym", "#work")
+		write("2021-03-02", "#work")
+		write("2021-03-03", "nothing")
+
+		entries, total, err := service.SearchJournal(user.ID, JournalQuery{Tags: []string{"#Work"}})
+		Expect(err).To(BeNil())
+		Expect(total).To(BeEquivalentTo(2))
+		Expect(entries[0].Date).To(Equal(day("2021-03-02")))
+
+		entries, _, _ = service.SearchJournal(user.ID, JournalQuery{Tags: []string{"work", "gym"}})
+		Expect(entries).To(HaveLen(1))
+
+		dates, err := service.SearchJournalDates(user.ID, JournalQuery{Tags: []string{"gym"}})
+		Expect(err).To(BeNil())
+		Expect(dates).To(HaveLen(1))
+
+		_, _, err = service.SearchJournal(user.ID, JournalQuery{Tags: []string{"not a tag"}})
+		Expect(err).To(Equal(TagInvalid))
+	})
+
+	It("should count tags", func() {
+		write("2021-03-01", "#gym", "#work")
+		write("2021-03-02", "#work #work")
+
+		tags, err := service.GetTags(user.ID)
+		Expect(err).To(BeNil())
+		Expect(tags).To(Equal([]TagCount{{Tag: "work", Count: 2}, {Tag: "gym", Count: 1}}))
+
+		other, _ := service.CreateVerifiedUser("other@test.com", "password")
+		tags, _ = service.GetTags(other.ID)
+		Expect(tags).To(BeEmpty())
+	})
+
+	It("should rename a tag in the items", func() {
+		write("2021-03-01", "#Job then #job-search", "more #job")
+		write("2021-03-02", "nothing")
+
+		count, err := service.RenameTag(user.ID, "job", "#work", Editor{})
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(1))
+
+		entry := entryOn("2021-03-01")
+		Expect(entry.Entries.Texts()).To(Equal([]string{"#work then #job-search", "more #work"}))
+		Expect(entry.Tags).To(Equal([]string{"job-search", "work"}))
+
+		_, err = service.RenameTag(user.ID, "job-search", "work", Editor{})
+		Expect(err).To(Equal(TagExists))
+
+		_, err = service.RenameTag(user.ID, "job", "two words", Editor{})
+		Expect(err).To(Equal(TagInvalid))
+	})
+
+	It("should not rename onto a tag left out of the tag counts", func() {
+		write("2021-03-01", "#job")
+		write("2021-03-02", "#work")
+
+		// Elasticsearch only counts the most used maxTags tags
+		service.store = uncountedTags{service.store}
+
+		_, err := service.RenameTag(user.ID, "job", "work", Editor{})
+		Expect(err).To(Equal(TagExists))
+		Expect(entryOn("2021-03-01").Tags).To(Equal([]string{"job"}))
+	})
+
+	It("should merge tags", func() {
+		write("2021-03-01", "#run and #jog")
+		write("2021-03-02", "#running")
+
+		count, err := service.MergeTags(user.ID, []string{"jog", "running"}, "run", Editor{})
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(2))
+
+		Expect(entryOn("2021-03-01").Entries.Texts()).To(Equal([]string{"#run and #run"}))
+		tags, _ := service.GetTags(user.ID)
+		Expect(tags).To(Equal([]TagCount{{Tag: "run", Count: 2}}))
+	})
+
+	It("should keep the text a rename or merge replaced as a revision", func() {
+		entry := write("2021-03-01", "#Work and #jog")
+		laptop := Editor{Device: "Laptop"}
+
+		_, err := service.RenameTag(user.ID, "work", "job", laptop)
+		Expect(err).To(BeNil())
+		_, err = service.MergeTags(user.ID, []string{"jog"}, "job", laptop)
+		Expect(err).To(BeNil())
+		Expect(entryOn("2021-03-01").Entries.Texts()).To(Equal([]string{"#job and #job"}))
+
+		revisions, err := service.GetRevisions(user.ID, entry.ID)
+		Expect(err).To(BeNil())
+		Expect(revisions).To(HaveLen(2))
+		Expect(revisions[0].Entries.Texts()).To(Equal([]string{"#job and #jog"}))
+		Expect(revisions[1].Entries.Texts()).To(Equal([]string{"#Work and #jog"}))
+		Expect(revisions[1].Editor).To(Equal(laptop))
+	})
+
+	It("should not rename past the item length", func() {
+		write("2021-03-01", "#a"+strings.Repeat("b", 497))
+
+		_, err := service.RenameTag(user.ID, "a"+strings.Repeat("b", 497), "a"+strings.Repeat("c", 499), Editor{})
+		Expect(err).To(Equal(TagInvalid))
+
+		write("2021-03-02", strings.Repeat("x", 497)+" #a")
+		_, err = service.RenameTag(user.ID, "a", "abc", Editor{})
+		Expect(err).To(MatchError("Journal entries must be 500 characters or less"))
+		Expect(entryOn("2021-03-02").Tags).To(Equal([]string{"a"}))
+	})
+
+	It("should retag entries written before tags", func() {
+		entry := write("2021-03-01", "#gym")
+		entry.Tags = nil
+		Expect(service.store.SaveJournalEntry(entry)).To(BeNil())
+
+		count, err := service.RetagJournal(user.ID)
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(1))
+		Expect(entryOn("2021-03-01").Tags).To(Equal([]string{"gym"}))
+
+		count, _ = service.RetagJournal(user.ID)
+		Expect(count).To(Equal(0))
+	})
+})
+
+// uncountedTags leaves every tag out of the counts, like a user with more
+// tags than Elasticsearch counts
+type uncountedTags struct {
+	Store
+}
+
+func (s uncountedTags) GetJournalTags(userId string) ([]TagCount, error) {
+	return nil, nil
+}
@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Failed logins are counted per account and per client IP. After a few free
+// attempts each failure doubles the wait before the next one, and an account
+// that keeps failing is locked for a while. Accounts are counted by the email
+// typed in, whether or not it exists, so the answers look the same for both.
+
+const (
+	// DefaultLockoutThreshold is how many failures in a row lock an account
+	DefaultLockoutThreshold = 10
+	// DefaultLockoutDuration is how long a locked account stays locked
+	DefaultLockoutDuration = 15 * time.Minute
+
+	accountFreeAttempts = 3
+	// Many people can share an address behind NAT, so an IP gets more room
+	ipFreeAttempts = 20
+	loginBaseDelay = time.Second
+	loginMaxDelay  = 5 * time.Minute
+	// loginWindow is how long failures are remembered after the last one
+	loginWindow = time.Hour
+	// loginForgiven is how many of an IP's failures a login from it takes
+	// off. Clearing them all would let anyone with an account reset the IP
+	// between guesses, keeping them all would leave everyone else behind a
+	// shared address waiting.
+	loginForgiven = 5
+)
+
+// LoginAttempts counts the recent failed logins for an account or IP
+type LoginAttempts struct {
+	Key         string    `json:"-"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// AttemptStore keeps the failure counters. The memory and Elasticsearch
+// stores implement it; other backends fall back to an in-memory store.
+// Lookups that find nothing return RecordNotFound.
+type AttemptStore interface {
+	GetLoginAttempts(key string) (LoginAttempts, error)
+	// AddLoginFailure counts a failure at now, starting again from one when
+	// the last failure was before since, and returns the new count
+	AddLoginFailure(key string, now time.Time, since time.Time) (LoginAttempts, error)
+	LockLogin(key string, until time.Time) error
+	// ForgiveLoginFailures takes count failures off a key, never below zero
+	ForgiveLoginFailures(key string, count int) error
+	ClearLoginAttempts(key string) error
+}
+
+// newAttemptStore opens the AttemptStore for options.AttemptBackend, sharing
+// the storage backend's connection where it can
+func newAttemptStore(options ServiceOptions, store Store) (AttemptStore, error) {
+	switch options.AttemptBackend {
+	case "":
+		if attempts, ok := store.(AttemptStore); ok {
+			return attempts, nil
+		}
+
+		return newMemoryStore(), nil
+	case BackendMemory:
+		if attempts, ok := store.(*memoryStore); ok {
+			return attempts, nil
+		}
+
+		return newMemoryStore(), nil
+	case BackendElastic:
+		if attempts, ok := store.(*elasticStore); ok {
+			return attempts, nil
+		}
+
+		return newElasticStore(options.ElasticUrl)
+	default:
+		return nil, errors.New("Unknown login attempt backend " + options.AttemptBackend)
+	}
+}
+
+// ThrottleError is returned instead of checking the password while a key has to wait
+type ThrottleError struct {
+	RetryAt time.Time
+}
+
+func (e ThrottleError) Error() string { return TooManyAttempts.Error() }
+func (e ThrottleError) Unwrap() error { return TooManyAttempts }
+
+// RetryAfter is how long the client should wait, rounded up to a second
+func (e ThrottleError) RetryAfter() time.Duration {
+	return time.Until(e.RetryAt).Truncate(time.Second) + time.Second
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginDelay is the wait after failures, doubling for each one past free
+func loginDelay(failures int, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+
+	delay := loginBaseDelay
+	for i := free; i < failures && delay < loginMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+
+	return delay
+}
+
+// retryAt is the first moment another attempt is allowed
+func (a LoginAttempts) retryAt(free int) time.Time {
+	retry := a.LastFailure.Add(loginDelay(a.Failures, free))
+	if a.LockedUntil.After(retry) {
+		return a.LockedUntil
+	}
+
+	return retry
+}
+
+func (s MdsService) lockoutThreshold() int {
+	if s.lockoutAfter > 0 {
+		return s.lockoutAfter
+	}
+
+	return DefaultLockoutThreshold
+}
+
+func (s MdsService) lockoutDuration() time.Duration {
+	if s.lockoutFor > 0 {
+		return s.lockoutFor
+	}
+
+	return DefaultLockoutDuration
+}
+
+// loginKeys are the counters a password attempt is checked against, with
+// the free attempts each one gets
+func loginKeys(email string, ip string) map[string]int {
+	keys := map[string]int{accountKey(email): accountFreeAttempts}
+	if ip != "" {
+		keys[ipKey(ip)] = ipFreeAttempts
+	}
+
+	return keys
+}
+
+// checkThrottle returns a ThrottleError when any of the keys has to wait
+func (s MdsService) checkThrottle(keys map[string]int) error {
+	now := time.Now()
+	var wait time.Time
+	for key, free := range keys {
+		attempts, err := s.throttle.GetLoginAttempts(key)
+		if err == RecordNotFound {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if retry := attempts.retryAt(free); retry.After(now) && retry.After(wait) {
+			wait = retry
+		}
+	}
+
+	if !wait.IsZero() {
+		return ThrottleError{RetryAt: wait}
+	}
+
+	return nil
+}
+
+// loginFailed counts a failed password for the IP and the account
+func (s MdsService) loginFailed(email string, ip string, user *User) {
+	if ip != "" {
+		now := time.Now()
+		if _, err := s.throttle.AddLoginFailure(ipKey(ip), now, now.Add(-loginWindow)); err != nil {
+			log.Println("Error counting login failure: " + err.Error())
+		}
+	}
+
+	s.countFailure(accountKey(email), user)
+}
+
+// countFailure counts a failure for a key, locking it and mailing the user
+// when it reaches the threshold. Failures are remembered longer than a lock
+// lasts, so every failure past the threshold after a lock runs out locks again.
+func (s MdsService) countFailure(key string, user *User) {
+	now := time.Now()
+	attempts, err := s.throttle.AddLoginFailure(key, now, now.Add(-loginWindow))
+	if err != nil {
+		log.Println("Error counting login failure: " + err.Error())
+		return
+	}
+
+	// Only a failure that finds the key unlocked locks it, so one notice goes
+	// out for each lock
+	if attempts.Failures < s.lockoutThreshold() || attempts.LockedUntil.After(now) {
+		return
+	}
+
+	until := now.Add(s.lockoutDuration())
+	if err := s.throttle.LockLogin(key, until); err != nil {
+		log.Println("Error locking login: " + err.Error())
+		return
+	}
+
+	if user != nil {
+		log.Println("Locked login for " + user.ID)
+		if err := s.sendLockoutNotice(user.Email, until); err != nil {
+			log.Println("Error sending lockout notice: " + err.Error())
+		}
+	}
+}
+
+func (s MdsService) sendLockoutNotice(email string, until time.Time) error {
+	return s.sendEmail(email, "Your MyDailyStuff account has been locked",
+		"There were too many failed attempts to sign in to your account, so sign in is disabled until "+
+			until.UTC().Format("Jan 2, 2006 15:04 MST")+".\n\n"+
+			"If this wasn't you, consider resetting your password once the lock expires.")
+}
+
+// comparePassword checks a password against the user's hash, doing the same
+// work when there is no user
+func (s MdsService) comparePassword(user *User, password string) error {
+	if user == nil {
+		s.passwordHasher().burn(password)
+		return UserNotFound
+	}
+
+	// Accounts created through single sign-on have no password until they reset one
+	if user.PasswordHash == "" {
+		return PasswordMismatch
+	}
+
+	return s.passwordHasher().Verify(user.PasswordHash, password)
+}
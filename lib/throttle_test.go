@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/sendgrid/rest"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	"github.com/stretchr/testify/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Login throttling", func() {
+	var service MdsService
+	var client *MockSendGridClient
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{LockoutThreshold: 3})
+
+		client = new(MockSendGridClient)
+		client.On("Send", mock.AnythingOfType("*mail.SGMailV3")).Return(&rest.Response{}, nil)
+		service.MailClient = client
+
+		_, err := service.CreateVerifiedUser("throttle@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	failLogins := func(email string, count int) {
+		for i := 0; i < count; i++ {
+			_, err := service.GetUserByLogin(email, "wrong", "10.0.0.1")
+			Expect(err).To(Equal(UserNotFound))
+		}
+	}
+
+	It("should back off after the free attempts", func() {
+		Expect(loginDelay(accountFreeAttempts-1, accountFreeAttempts)).To(Equal(time.Duration(0)))
+		Expect(loginDelay(accountFreeAttempts, accountFreeAttempts)).To(Equal(loginBaseDelay))
+		Expect(loginDelay(accountFreeAttempts+2, accountFreeAttempts)).To(Equal(4 * loginBaseDelay))
+		Expect(loginDelay(100, accountFreeAttempts)).To(Equal(loginMaxDelay))
+	})
+
+	It("should lock the account and send one notice", func() {
+		failLogins("throttle@test.com", 3)
+
+		_, err := service.GetUserByLogin("throttle@test.com", "password", "10.0.0.2")
+		Expect(errors.Is(err, TooManyAttempts)).To(BeTrue())
+
+		var throttled ThrottleError
+		Expect(errors.As(err, &throttled)).To(BeTrue())
+		Expect(throttled.RetryAfter()).To(BeNumerically(">", DefaultLockoutDuration-time.Minute))
+
+		client.AssertNumberOfCalls(GinkgoT(), "Send", 1)
+		notice := client.Calls[0].Arguments[0].(*mail.SGMailV3)
+		Expect(notice.Personalizations[0].To[0].Address).To(Equal("throttle@test.com"))
+	})
+
+	It("should lock again when failures go on after the lock runs out", func() {
+		failLogins("throttle@test.com", 3)
+		client.AssertNumberOfCalls(GinkgoT(), "Send", 1)
+
+		// Run the lock and the backoff out while the failures are still remembered
+		Expect(service.throttle.LockLogin(accountKey("throttle@test.com"), time.Now().Add(-time.Second))).To(BeNil())
+		_, err := service.throttle.AddLoginFailure(accountKey("throttle@test.com"), time.Now().Add(-loginMaxDelay), time.Now().Add(-loginWindow))
+		Expect(err).To(BeNil())
+
+		failLogins("throttle@test.com", 1)
+
+		_, err = service.GetUserByLogin("throttle@test.com", "password", "10.0.0.2")
+		var throttled ThrottleError
+		Expect(errors.As(err, &throttled)).To(BeTrue())
+		Expect(throttled.RetryAfter()).To(BeNumerically(">", DefaultLockoutDuration-time.Minute))
+		client.AssertNumberOfCalls(GinkgoT(), "Send", 2)
+	})
+
+	It("should answer the same for an account that doesn't exist", func() {
+		failLogins("nobody@test.com", 3)
+
+		_, err := service.GetUserByLogin("nobody@test.com", "password", "10.0.0.2")
+		Expect(errors.Is(err, TooManyAttempts)).To(BeTrue())
+		client.AssertNotCalled(GinkgoT(), "Send", mock.Anything)
+	})
+
+	It("should clear the account's failures after a login", func() {
+		failLogins("throttle@test.com", 2)
+
+		_, err := service.GetUserByLogin("throttle@test.com", "password", "10.0.0.1")
+		Expect(err).To(BeNil())
+
+		_, err = service.throttle.GetLoginAttempts(accountKey("throttle@test.com"))
+		Expect(err).To(Equal(RecordNotFound))
+	})
+
+	It("should not count an address that isn't valid", func() {
+		_, err := service.GetUserByLogin("nobody?x=1", "wrong", "10.0.0.1")
+		Expect(err).To(Equal(UserNotFound))
+
+		_, err = service.throttle.GetLoginAttempts(accountKey("nobody?x=1"))
+		Expect(err).To(Equal(RecordNotFound))
+
+		_, err = service.GetUserByLogin(" throttle@test.com ", "password", "10.0.0.1")
+		Expect(err).To(BeNil())
+	})
+
+	It("should throttle an IP across accounts", func() {
+		for i := 0; i < ipFreeAttempts; i++ {
+			service.throttle.AddLoginFailure(ipKey("10.0.0.9"), time.Now(), time.Now().Add(-loginWindow))
+		}
+
+		_, err := service.GetUserByLogin("throttle@test.com", "password", "10.0.0.9")
+		Expect(errors.Is(err, TooManyAttempts)).To(BeTrue())
+
+		_, err = service.GetUserByLogin("throttle@test.com", "password", "10.0.0.1")
+		Expect(err).To(BeNil())
+	})
+
+	It("should take some of the IP's failures off after a login", func() {
+		for i := 0; i < ipFreeAttempts-1; i++ {
+			_, err := service.GetUserByLogin(strconv.Itoa(i)+"@test.com", "wrong", "10.0.0.9")
+			Expect(err).To(Equal(UserNotFound))
+		}
+
+		_, err := service.GetUserByLogin("throttle@test.com", "password", "10.0.0.9")
+		Expect(err).To(BeNil())
+
+		attempts, err := service.throttle.GetLoginAttempts(ipKey("10.0.0.9"))
+		Expect(err).To(BeNil())
+		Expect(attempts.Failures).To(Equal(ipFreeAttempts - 1 - loginForgiven))
+	})
+
+	It("should forget failures outside the window", func() {
+		old := time.Now().Add(-2 * loginWindow)
+		service.throttle.AddLoginFailure(ipKey("10.0.0.9"), old, old.Add(-loginWindow))
+
+		attempts, err := service.throttle.AddLoginFailure(ipKey("10.0.0.9"), time.Now(), time.Now().Add(-loginWindow))
+		Expect(err).To(BeNil())
+		Expect(attempts.Failures).To(Equal(1))
+	})
+})
@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// Entries are stored by calendar date, as midnight UTC of the day. Which day
+// a moment falls on depends on where the user is, so each user can set an
+// IANA time zone that "today", streaks and dates from the client are
+// resolved in. Users without one are on UTC.
+
+// locations caches loaded time zones by name
+var locations sync.Map
+
+// loadLocation loads an IANA time zone, "" is UTC. Local is refused because
+// it is wherever the server runs.
+func loadLocation(zone string) (*time.Location, error) {
+	if zone == "Local" {
+		return nil, TimeZoneInvalid
+	}
+
+	if loc, ok := locations.Load(zone); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, TimeZoneInvalid
+	}
+
+	locations.Store(zone, loc)
+	return loc, nil
+}
+
+// locationOf returns the user's time zone, UTC when unset or no longer known
+func locationOf(user User) *time.Location {
+	loc, err := loadLocation(user.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+
+	return loc
+}
+
+// calendarDay returns the stored date of the day an instant falls on in loc
+func calendarDay(date time.Time, loc *time.Location) time.Time {
+	return dayOf(date.In(loc))
+}
+
+// GetLocation returns the time zone the user's dates are resolved in
+func (s MdsService) GetLocation(userId string) (*time.Location, error) {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return locationOf(user), nil
+}
+
+// SetTimeZone changes the user's time zone, "" goes back to UTC. Entries
+// already written keep their dates, the nightly carry over moves to the new
+// midnight.
+func (s MdsService) SetTimeZone(userId string, zone string) error {
+	loc, err := loadLocation(zone)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	user.TimeZone = zone
+	if user.CarryOverAfter != nil {
+		next := nextMidnight(time.Now(), loc)
+		user.CarryOverAfter = &next
+	}
+
+	return s.store.SaveUser(user)
+}
+
+// journalQueryIn resolves the dates of a query in the user's time zone and
+// normalizes its tags
+func (s MdsService) journalQueryIn(userId string, jq JournalQuery) (JournalQuery, error) {
+	loc, err := s.GetLocation(userId)
+	if err != nil {
+		return jq, err
+	}
+
+	if !jq.Start.IsZero() {
+		jq.Start = calendarDay(jq.Start, loc)
+	}
+
+	if !jq.End.IsZero() {
+		jq.End = calendarDay(jq.End, loc)
+	}
+
+	jq.Tags, err = normalizeTags(jq.Tags)
+	return jq, err
+}
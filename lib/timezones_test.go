@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Time zones", func() {
+	var service MdsService
+	var user User
+	var tokyo, losAngeles *time.Location
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		var err error
+		user, err = service.CreateVerifiedUser("zone@test.com", "password")
+		Expect(err).To(BeNil())
+
+		tokyo, _ = time.LoadLocation("Asia/Tokyo")
+		losAngeles, _ = time.LoadLocation("America/Los_Angeles")
+	})
+
+	day := func(date string) time.Time {
+		parsed, _ := time.Parse("2006-01-02", date)
+		return parsed
+	}
+
+	It("should only accept IANA zones", func() {
+		Expect(service.SetTimeZone(user.ID, "Mars/Olympus")).To(Equal(TimeZoneInvalid))
+		Expect(service.SetTimeZone(user.ID, "Local")).To(Equal(TimeZoneInvalid))
+		Expect(service.SetTimeZone(user.ID, "Asia/Tokyo")).To(BeNil())
+
+		loc, err := service.GetLocation(user.ID)
+		Expect(err).To(BeNil())
+		Expect(loc.String()).To(Equal("Asia/Tokyo"))
+
+		Expect(service.SetTimeZone(user.ID, "")).To(BeNil())
+		loc, _ = service.GetLocation(user.ID)
+		Expect(loc).To(Equal(time.UTC))
+	})
+
+	It("should file a late evening entry on that day", func() {
+		Expect(service.SetTimeZone(user.ID, "America/Los_Angeles")).To(BeNil())
+		evening := time.Date(2021, 3, 1, 23, 30, 0, 0, losAngeles)
+
+		entry, err := service.CreateJournalEntry(user.ID, []string{"late"}, evening)
+		Expect(err).To(BeNil())
+		Expect(entry.Date).To(Equal(day("2021-03-01")))
+
+		found, err := service.GetJournalEntryByDate(user.ID, evening.UTC())
+		Expect(err).To(BeNil())
+		Expect(found.ID).To(Equal(entry.ID))
+
+		_, err = service.CreateJournalEntry(user.ID, []string{"again"}, evening.Add(-time.Hour))
+		Expect(err).To(Equal(EntryAlreadyExists))
+	})
+
+	It("should end streaks on the user's day", func() {
+		Expect(service.SetTimeZone(user.ID, "Asia/Tokyo")).To(BeNil())
+		for _, date := range []string{"2021-03-01", "2021-03-02"} {
+			_, err := service.CreateJournalEntry(user.ID, []string{"item"}, day(date).In(tokyo).Add(12*time.Hour))
+			Expect(err).To(BeNil())
+		}
+
+		// Already March 3rd in Tokyo, still March 2nd in UTC
+		instant := time.Date(2021, 3, 2, 16, 0, 0, 0, time.UTC)
+		streak, err := service.GetStreak(user.ID, instant, 10)
+		Expect(err).To(BeNil())
+		Expect(streak).To(Equal(2))
+
+		Expect(service.SetTimeZone(user.ID, "")).To(BeNil())
+		streak, _ = service.GetStreak(user.ID, instant, 10)
+		Expect(streak).To(Equal(1))
+	})
+
+	It("should resolve search ranges in the zone", func() {
+		Expect(service.SetTimeZone(user.ID, "Asia/Tokyo")).To(BeNil())
+		service.CreateJournalEntry(user.ID, []string{"item"}, time.Date(2021, 3, 2, 8, 0, 0, 0, tokyo))
+
+		start := time.Date(2021, 3, 2, 0, 0, 0, 0, tokyo)
+		dates, err := service.SearchJournalDates(user.ID, JournalQuery{Start: start, End: start})
+		Expect(err).To(BeNil())
+		Expect(dates).To(Equal([]string{"2021-03-02T00:00:00Z"}))
+	})
+
+	Describe("Controller", func() {
+		var router *gin.Engine
+
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			controller := Controller{}
+			controller.SetOptions(service, false)
+
+			router = gin.New()
+			router.Use(sessions.Sessions("my_session", cookie.NewStore([]byte("secret"))))
+			router.Use(func(c *gin.Context) {
+				c.Set("userId", user.ID)
+			})
+			router.GET("/api/journal/:date", controller.GetEntryByDate)
+		})
+
+		get := func(date string) (int, Response) {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/journal/"+date, nil)
+			router.ServeHTTP(recorder, req)
+
+			var response Response
+			json.Unmarshal(recorder.Body.Bytes(), &response)
+			return recorder.Code, response
+		}
+
+		It("should parse dates in the user's zone", func() {
+			Expect(service.SetTimeZone(user.ID, "America/Los_Angeles")).To(BeNil())
+			service.CreateJournalEntry(user.ID, []string{"late"}, time.Date(2021, 3, 1, 23, 30, 0, 0, losAngeles))
+
+			code, response := get("2021-03-01")
+			Expect(code).To(Equal(200))
+			Expect(response.Result).NotTo(BeNil())
+
+			code, response = get("2021-03-02")
+			Expect(code).To(Equal(200))
+			Expect(response.Result).To(BeNil())
+		})
+
+		It("should reject dates it can't read", func() {
+			code, response := get("someday")
+			Expect(code).To(Equal(http.StatusBadRequest))
+			Expect(response.Error).To(Equal(DateInvalid.Error()))
+
+			code, _ = get("today")
+			Expect(code).To(Equal(200))
+		})
+	})
+})
@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// Reset and verification tokens are emailed to the user and only a SHA-256
+// hash is stored, so a leaked database can't be used to take over accounts.
+
+const (
+	// DefaultResetTokenTTL is how long a password reset link works
+	DefaultResetTokenTTL = time.Hour
+	// DefaultVerifyTokenTTL is how long an account verification link works
+	DefaultVerifyTokenTTL = 72 * time.Hour
+)
+
+// newToken returns a random token for an email link and the hash to store
+func newToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenExpired treats tokens without an expiry, issued before they had one, as expired
+func tokenExpired(expires time.Time) bool {
+	return expires.IsZero() || time.Now().After(expires)
+}
+
+func (s MdsService) resetTokenTTL() time.Duration {
+	if s.resetTTL > 0 {
+		return s.resetTTL
+	}
+
+	return DefaultResetTokenTTL
+}
+
+func (s MdsService) verifyTokenTTL() time.Duration {
+	if s.verifyTTL > 0 {
+		return s.verifyTTL
+	}
+
+	return DefaultVerifyTokenTTL
+}
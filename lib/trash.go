@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"time"
+)
+
+// Deleting an entry moves it to the trash instead of removing it. Trashed
+// entries are left out of every lookup, search and streak, but the user can
+// restore them for TrashRetention, after which PurgeTrash removes them along
+// with their revisions.
+
+// TrashRetention is how long a deleted entry can be restored
+const TrashRetention = 30 * 24 * time.Hour
+
+// GetTrash lists the user's deleted entries that can still be restored, most
+// recently deleted first
+func (s MdsService) GetTrash(userId string) ([]JournalEntry, error) {
+	if userId == "" {
+		return nil, UserUnauthorized
+	}
+
+	return s.store.GetTrash(userId, time.Now().UTC().Add(-TrashRetention))
+}
+
+// RestoreJournalEntry takes an entry out of the trash. When another entry has
+// been written for its date since, EntryRestoreConflict is returned and the
+// entry stays in the trash.
+func (s MdsService) RestoreJournalEntry(userId string, id string) (JournalEntry, error) {
+	if userId == "" {
+		return JournalEntry{}, UserUnauthorized
+	}
+
+	entry, err := s.store.GetJournalEntry(id)
+	if err == RecordNotFound || (err == nil && (entry.UserId != userId || entry.DeletedAt == nil)) {
+		return JournalEntry{}, EntryNotFound
+	}
+
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	if entry.DeletedAt.Before(time.Now().Add(-TrashRetention)) {
+		return JournalEntry{}, EntryNotFound
+	}
+
+	_, err = s.store.GetJournalEntryByDate(userId, entry.Date)
+	if err == nil {
+		return JournalEntry{}, EntryRestoreConflict
+	} else if err != RecordNotFound {
+		return JournalEntry{}, err
+	}
+
+	entry.DeletedAt = nil
+	return entry, s.store.SaveJournalEntry(entry)
+}
+
+// PurgeTrash removes the entries that were deleted more than TrashRetention
+// before now and returns how many were removed
+func (s MdsService) PurgeTrash(now time.Time) (int, error) {
+	count := 0
+	for {
+		entries, err := s.store.GetEntriesToPurge(now.UTC().Add(-TrashRetention))
+		if err != nil || len(entries) == 0 {
+			return count, err
+		}
+
+		for _, entry := range entries {
+			err := s.store.DeleteJournalEntry(entry.ID)
+			if err == nil || err == RecordNotFound {
+				err = s.store.PruneRevisions(entry.ID, 0)
+			}
+
+			if err != nil {
+				return count, err
+			}
+
+			count++
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Trash", func() {
+	var service MdsService
+	var user User
+	var entry JournalEntry
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		var err error
+		user, err = service.CreateVerifiedUser("trash@test.com", "password")
+		Expect(err).To(BeNil())
+
+		entry, err = service.CreateJournalEntry(user.ID, []string{"thrown #away"}, yesterday)
+		Expect(err).To(BeNil())
+		Expect(service.DeleteJournalEntry(entry.ID, user.ID)).To(BeNil())
+	})
+
+	// deletedAgo moves the entry's deletion back in time
+	deletedAgo := func(ago time.Duration) {
+		trashed, err := service.store.GetJournalEntry(entry.ID)
+		Expect(err).To(BeNil())
+
+		deleted := time.Now().UTC().Add(-ago)
+		trashed.DeletedAt = &deleted
+		Expect(service.store.SaveJournalEntry(trashed)).To(BeNil())
+	}
+
+	It("should leave trashed entries out of lookups, searches and streaks", func() {
+		_, err := service.GetJournalEntryByDate(user.ID, yesterday)
+		Expect(err).To(Equal(NoJournalWithDate))
+
+		entries, total, err := service.SearchJournal(user.ID, JournalQuery{Query: "thrown"})
+		Expect(err).To(BeNil())
+		Expect(entries).To(BeEmpty())
+		Expect(total).To(BeZero())
+
+		dates, err := service.SearchJournalDates(user.ID, JournalQuery{Start: yesterday, End: today})
+		Expect(err).To(BeNil())
+		Expect(dates).To(BeEmpty())
+
+		Expect(service.GetStreak(user.ID, today, 10)).To(Equal(0))
+		Expect(service.GetTags(user.ID)).To(BeEmpty())
+
+		_, err = service.AddJournalItem(entry.ID, user.ID, "more", Editor{})
+		Expect(err).To(Equal(EntryNotFound))
+		Expect(service.DeleteJournalEntry(entry.ID, user.ID)).To(Equal(EntryNotFound))
+	})
+
+	It("should list the user's trash", func() {
+		other, _ := service.CreateVerifiedUser("other@test.com", "password")
+		otherEntry, _ := service.CreateJournalEntry(other.ID, []string{"theirs"}, yesterday)
+		service.DeleteJournalEntry(otherEntry.ID, other.ID)
+
+		trash, err := service.GetTrash(user.ID)
+		Expect(err).To(BeNil())
+		Expect(trash).To(HaveLen(1))
+		Expect(trash[0].ID).To(Equal(entry.ID))
+		Expect(trash[0].Entries.Texts()).To(Equal([]string{"thrown #away"}))
+		Expect(trash[0].DeletedAt).NotTo(BeNil())
+
+		deletedAgo(TrashRetention + time.Hour)
+		Expect(service.GetTrash(user.ID)).To(BeEmpty())
+	})
+
+	It("should restore an entry", func() {
+		restored, err := service.RestoreJournalEntry(user.ID, entry.ID)
+		Expect(err).To(BeNil())
+		Expect(restored.DeletedAt).To(BeNil())
+
+		found, err := service.GetJournalEntryByDate(user.ID, yesterday)
+		Expect(err).To(BeNil())
+		Expect(found.ID).To(Equal(entry.ID))
+		Expect(service.GetTags(user.ID)).To(HaveLen(1))
+		Expect(service.GetTrash(user.ID)).To(BeEmpty())
+
+		_, err = service.RestoreJournalEntry(user.ID, entry.ID)
+		Expect(err).To(Equal(EntryNotFound))
+	})
+
+	It("should not restore over a newer entry for the date", func() {
+		_, err := service.CreateJournalEntry(user.ID, []string{"written again"}, yesterday)
+		Expect(err).To(BeNil())
+
+		_, err = service.RestoreJournalEntry(user.ID, entry.ID)
+		Expect(err).To(Equal(EntryRestoreConflict))
+		Expect(service.GetTrash(user.ID)).To(HaveLen(1))
+	})
+
+	It("should only restore the user's own entries from the last 30 days", func() {
+		other, _ := service.CreateVerifiedUser("other@test.com", "password")
+		_, err := service.RestoreJournalEntry(other.ID, entry.ID)
+		Expect(err).To(Equal(EntryNotFound))
+
+		deletedAgo(TrashRetention + time.Hour)
+		_, err = service.RestoreJournalEntry(user.ID, entry.ID)
+		Expect(err).To(Equal(EntryNotFound))
+	})
+
+	It("should purge entries after 30 days", func() {
+		kept, _ := service.CreateJournalEntry(user.ID, []string{"recent"}, today)
+		service.DeleteJournalEntry(kept.ID, user.ID)
+		deletedAgo(TrashRetention + time.Hour)
+
+		count, err := service.PurgeTrash(time.Now())
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(1))
+
+		_, err = service.store.GetJournalEntry(entry.ID)
+		Expect(err).To(Equal(RecordNotFound))
+		Expect(service.GetTrash(user.ID)).To(HaveLen(1))
+	})
+
+	Describe("Controller", func() {
+		var router *gin.Engine
+
+		BeforeEach(func() {
+			gin.SetMode(gin.TestMode)
+			controller := Controller{}
+			controller.SetOptions(service, false)
+
+			router = gin.New()
+			router.Use(func(c *gin.Context) {
+				c.Set("userId", user.ID)
+			})
+			router.GET("/api/trash", controller.GetTrash)
+			router.POST("/api/trash/:id/restore", controller.RestoreEntry)
+		})
+
+		request := func(method string, path string) (int, Response) {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, nil)
+			router.ServeHTTP(recorder, req)
+
+			var response Response
+			json.Unmarshal(recorder.Body.Bytes(), &response)
+			return recorder.Code, response
+		}
+
+		It("should list and restore entries", func() {
+			code, response := request("GET", "/api/trash")
+			Expect(code).To(Equal(200))
+			Expect(response.Result).To(HaveLen(1))
+
+			code, response = request("POST", "/api/trash/missing/restore")
+			Expect(code).To(Equal(http.StatusNotFound))
+			Expect(response.Error).To(Equal(EntryNotFound.Error()))
+
+			code, response = request("POST", "/api/trash/"+entry.ID+"/restore")
+			Expect(code).To(Equal(200))
+			Expect(response.Result).To(HaveKeyWithValue("id", entry.ID))
+		})
+
+		It("should report a conflict with a newer entry", func() {
+			service.CreateJournalEntry(user.ID, []string{"written again"}, yesterday)
+
+			code, response := request("POST", "/api/trash/"+entry.ID+"/restore")
+			Expect(code).To(Equal(http.StatusConflict))
+			Expect(response.Error).To(Equal(EntryRestoreConflict.Error()))
+		})
+	})
+})
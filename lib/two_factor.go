@@ -0,0 +1,286 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Two-factor authentication uses RFC 6238 time-based codes: six digits from
+// an HMAC-SHA1 of the 30 second step, which every authenticator app supports.
+// A code is accepted one step either side of now to allow for clock drift,
+// and never twice. Recovery codes are stored hashed like reset tokens.
+
+const (
+	totpIssuer = "MyDailyStuff"
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+	// recoveryCodeCount is how many one-time recovery codes a user gets
+	recoveryCodeCount = 10
+	// twoFactorTimeout is how long a login waits for the code after the password
+	twoFactorTimeout = 5 * time.Minute
+)
+
+// TwoFactorEnrollment is what an authenticator app needs to generate codes,
+// the URI is usually shown as a QR code
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpModulus keeps the last totpDigits digits of a code
+var totpModulus = pow10(totpDigits)
+
+func pow10(n int) uint32 {
+	retval := uint32(1)
+	for i := 0; i < n; i++ {
+		retval *= 10
+	}
+
+	return retval
+}
+
+func newTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// totpCode is the code for a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus), nil
+}
+
+// matchTOTP returns the step a code belongs to, only accepting steps after
+// lastStep so a code can't be replayed
+func matchTOTP(secret string, code string, lastStep int64, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		expected, err := totpCode(secret, step)
+		if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpURI is the otpauth provisioning URI understood by authenticator apps
+func totpURI(secret string, email string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// newRecoveryCodes returns codes to show the user once, and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		buf := make([]byte, 6)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeCode drops the spaces people type when copying a code
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.Join(strings.Fields(code), ""))
+}
+
+func twoFactorKey(userId string) string {
+	return "2fa:" + userId
+}
+
+// EnrollTwoFactor starts setting up two-factor authentication. It isn't
+// required at login until ConfirmTwoFactor proves the app has the secret.
+func (s MdsService) EnrollTwoFactor(userId string) (TwoFactorEnrollment, error) {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+
+	if user.TOTPEnabled {
+		return TwoFactorEnrollment{}, TwoFactorEnabled
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+
+	user.TOTPSecret = &secret
+	if err := s.store.SaveUser(user); err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+
+	return TwoFactorEnrollment{Secret: secret, URI: totpURI(secret, user.Email)}, nil
+}
+
+// ConfirmTwoFactor turns on two-factor authentication with a code from the
+// enrolled app and returns the recovery codes, which can't be shown again
+func (s MdsService) ConfirmTwoFactor(userId string, code string) ([]string, error) {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.TOTPEnabled {
+		return nil, TwoFactorEnabled
+	}
+
+	if user.TOTPSecret == nil {
+		return nil, TwoFactorNotEnrolled
+	}
+
+	step, ok := matchTOTP(*user.TOTPSecret, normalizeCode(code), 0, time.Now())
+	if !ok {
+		return nil, TwoFactorCodeInvalid
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+
+	return codes, s.store.SaveUser(user)
+}
+
+// VerifyTwoFactor checks the second login step, a code from the app or an
+// unused recovery code. Failures are throttled like passwords.
+func (s MdsService) VerifyTwoFactor(userId string, code string) error {
+	key := twoFactorKey(userId)
+	if s.throttle != nil {
+		if err := s.checkThrottle(map[string]int{key: accountFreeAttempts}); err != nil {
+			return err
+		}
+	}
+
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	if !user.TOTPEnabled || user.TOTPSecret == nil {
+		return TwoFactorNotEnrolled
+	}
+
+	// The step or recovery code is only spent if no other login spent it
+	// since the user was read
+	code = normalizeCode(code)
+	if step, ok := matchTOTP(*user.TOTPSecret, code, user.TOTPLastStep, time.Now()); ok {
+		err = s.store.AdvanceTOTPStep(user.ID, step)
+	} else if index := recoveryCodeIndex(user.RecoveryCodes, code); index >= 0 {
+		err = s.store.UseRecoveryCode(user.ID, user.RecoveryCodes[index])
+	} else {
+		if s.throttle != nil {
+			s.countFailure(key, &user)
+		}
+
+		return TwoFactorCodeInvalid
+	}
+
+	if err == RecordNotFound {
+		return TwoFactorCodeInvalid
+	}
+
+	if err == nil && s.throttle != nil {
+		s.throttle.ClearLoginAttempts(key)
+	}
+
+	return err
+}
+
+// recoveryCodeIndex finds a code among the stored hashes, the dash is optional
+func recoveryCodeIndex(hashes []string, code string) int {
+	code = strings.ReplaceAll(code, "-", "")
+	if len(code) != 10 {
+		return -1
+	}
+
+	hash := hashToken(code[:5] + "-" + code[5:])
+	for index, stored := range hashes {
+		if hmac.Equal([]byte(stored), []byte(hash)) {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// DisableTwoFactor turns two-factor authentication off after the user
+// re-enters their password
+func (s MdsService) DisableTwoFactor(userId string, password string) error {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.comparePassword(&user, password); err != nil {
+		return PasswordIncorrect
+	}
+
+	return s.clearTwoFactor(user)
+}
+
+func (s MdsService) clearTwoFactor(user User) error {
+	user.TOTPSecret = nil
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+
+	return s.store.SaveUser(user)
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Two-factor authentication", func() {
+	var service MdsService
+	var user User
+
+	BeforeEach(func() {
+		service = newTestService(ServiceOptions{})
+
+		var err error
+		user, err = service.CreateVerifiedUser("totp@test.com", "password")
+		Expect(err).To(BeNil())
+	})
+
+	currentCode := func(secret string) string {
+		code, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+		Expect(err).To(BeNil())
+		return code
+	}
+
+	enable := func() (string, []string) {
+		enrollment, err := service.EnrollTwoFactor(user.ID)
+		Expect(err).To(BeNil())
+
+		codes, err := service.ConfirmTwoFactor(user.ID, currentCode(enrollment.Secret))
+		Expect(err).To(BeNil())
+		return enrollment.Secret, codes
+	}
+
+	It("should match the RFC 6238 test vectors", func() {
+		secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+		Expect(totpCode(secret, 59/totpPeriod)).To(Equal("287082"))
+		Expect(totpCode(secret, 1111111109/totpPeriod)).To(Equal("081804"))
+		Expect(totpCode(secret, 2000000000/totpPeriod)).To(Equal("279037"))
+	})
+
+	It("should return a provisioning URI", func() {
+		enrollment, err := service.EnrollTwoFactor(user.ID)
+		Expect(err).To(BeNil())
+		Expect(enrollment.URI).To(HavePrefix("otpauth://totp/MyDailyStuff:totp@test.com?"))
+		Expect(enrollment.URI).To(ContainSubstring("secret=" + enrollment.Secret))
+	})
+
+	It("should only enable with a valid code", func() {
+		_, err := service.EnrollTwoFactor(user.ID)
+		Expect(err).To(BeNil())
+
+		_, err = service.ConfirmTwoFactor(user.ID, "000000")
+		Expect(err).To(Equal(TwoFactorCodeInvalid))
+
+		stored, _ := service.GetUserById(user.ID)
+		Expect(stored.TOTPEnabled).To(BeFalse())
+	})
+
+	It("should accept a code once", func() {
+		secret, codes := enable()
+		Expect(codes).To(HaveLen(recoveryCodeCount))
+
+		step := time.Now().Unix()/totpPeriod + 1
+		next, _ := totpCode(secret, step)
+		Expect(service.VerifyTwoFactor(user.ID, next[:3]+" "+next[3:])).To(BeNil())
+		Expect(service.VerifyTwoFactor(user.ID, next)).To(Equal(TwoFactorCodeInvalid))
+	})
+
+	It("should accept each recovery code once", func() {
+		_, codes := enable()
+
+		Expect(service.VerifyTwoFactor(user.ID, strings.ToUpper(codes[3]))).To(BeNil())
+		Expect(service.VerifyTwoFactor(user.ID, codes[3])).To(Equal(TwoFactorCodeInvalid))
+
+		stored, _ := service.GetUserById(user.ID)
+		Expect(stored.RecoveryCodes).To(HaveLen(recoveryCodeCount - 1))
+		Expect(stored.RecoveryCodes).NotTo(ContainElement(codes[4]))
+	})
+
+	It("should let only one of several logins at once spend a code", func() {
+		secret, codes := enable()
+		next, _ := totpCode(secret, time.Now().Unix()/totpPeriod+1)
+
+		for _, code := range []string{next, codes[0]} {
+			// Logins that read the user after the winner count as failures and
+			// can be throttled
+			service.throttle.ClearLoginAttempts(twoFactorKey(user.ID))
+
+			results := make(chan error, 5)
+			for i := 0; i < cap(results); i++ {
+				go func(code string) {
+					defer GinkgoRecover()
+					results <- service.VerifyTwoFactor(user.ID, code)
+				}(code)
+			}
+
+			accepted := 0
+			for i := 0; i < cap(results); i++ {
+				if err := <-results; err == nil {
+					accepted++
+				} else {
+					Expect(err).To(Or(Equal(TwoFactorCodeInvalid), MatchError(TooManyAttempts)))
+				}
+			}
+
+			Expect(accepted).To(Equal(1))
+		}
+
+		Expect(service.store.AdvanceTOTPStep(user.ID, 1)).To(Equal(RecordNotFound))
+		Expect(service.store.UseRecoveryCode(user.ID, hashToken(codes[0]))).To(Equal(RecordNotFound))
+	})
+
+	It("should throttle wrong codes", func() {
+		enable()
+
+		for i := 0; i < accountFreeAttempts; i++ {
+			Expect(service.VerifyTwoFactor(user.ID, "000000")).To(Equal(TwoFactorCodeInvalid))
+		}
+
+		Expect(service.VerifyTwoFactor(user.ID, "000000")).To(MatchError(TooManyAttempts))
+	})
+
+	It("should disable only with the password", func() {
+		enable()
+
+		Expect(service.DisableTwoFactor(user.ID, "wrong")).To(Equal(PasswordIncorrect))
+		Expect(service.DisableTwoFactor(user.ID, "password")).To(BeNil())
+
+		stored, _ := service.GetUserById(user.ID)
+		Expect(stored.TOTPEnabled).To(BeFalse())
+		Expect(stored.TOTPSecret).To(BeNil())
+		Expect(stored.RecoveryCodes).To(BeEmpty())
+	})
+
+	It("should let an operator turn it off", func() {
+		enable()
+
+		Expect(service.ResetTwoFactor("totp@test.com")).To(BeNil())
+		stored, _ := service.GetUserById(user.ID)
+		Expect(stored.TOTPEnabled).To(BeFalse())
+	})
+})
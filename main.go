@@ -6,6 +6,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
+	// Embedded so user time zones resolve on hosts without zoneinfo
+	_ "time/tzdata"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
@@ -17,18 +21,63 @@ import (
 )
 
 var (
-	DEFAULT_ES_URL         *string = flag.String("esurl", "http://localhost:9200", "Elasticsearch Server Url")
-	DEFAULT_SESSION_SECRET *string = flag.String("sessionSecret", "secret123", "Session Secret Key")
-	DEFAULT_SG_USERNAME    *string = flag.String("sg_name", "", "Sendgrid Username")
-	DEFAULT_SG_PASSWORD    *string = flag.String("sg_pw", "", "Sendgrid Password")
+	DEFAULT_BACKEND         *string = flag.String("backend", lib.BackendElastic, "Storage backend (elasticsearch, memory, sqlite)")
+	DEFAULT_ES_URL          *string = flag.String("esurl", "http://localhost:9200", "Elasticsearch Server Url")
+	DEFAULT_SQLITE_PATH     *string = flag.String("sqlitePath", "mds.db", "SQLite Database File")
+	DEFAULT_SESSION_SECRET  *string = flag.String("sessionSecret", "secret123", "Session Secret Key")
+	DEFAULT_SG_USERNAME     *string = flag.String("sg_name", "", "Sendgrid Username")
+	DEFAULT_SG_PASSWORD     *string = flag.String("sg_pw", "", "Sendgrid Password")
+	DEFAULT_RESET_TTL       *string = flag.String("resetTokenTTL", lib.DefaultResetTokenTTL.String(), "How long password reset links work")
+	DEFAULT_VERIFY_TTL      *string = flag.String("verifyTokenTTL", lib.DefaultVerifyTokenTTL.String(), "How long account verification links work")
+	DEFAULT_ATTEMPTS        *string = flag.String("attemptBackend", "", "Where failed logins are counted (elasticsearch, memory), the storage backend when empty")
+	DEFAULT_LOCKOUT_AFTER   *int    = flag.Int("lockoutThreshold", lib.DefaultLockoutThreshold, "Failed logins that lock an account")
+	DEFAULT_LOCKOUT_FOR     *string = flag.String("lockoutDuration", lib.DefaultLockoutDuration.String(), "How long a locked account stays locked")
+	DEFAULT_OIDC_ISSUER     *string = flag.String("oidcIssuer", "", "OpenID Connect issuer URL, enables single sign-on")
+	DEFAULT_OIDC_CLIENT     *string = flag.String("oidcClientId", "", "OpenID Connect client ID")
+	DEFAULT_OIDC_SECRET     *string = flag.String("oidcClientSecret", "", "OpenID Connect client secret")
+	DEFAULT_OIDC_REDIRECT   *string = flag.String("oidcRedirectUrl", "", "Absolute URL of /api/account/oidc/callback")
+	DEFAULT_SITE_URL        *string = flag.String("siteUrl", lib.DefaultSiteURL, "Public URL used for links in emails")
+	DEFAULT_DELETE_GRACE    *string = flag.String("deletionGracePeriod", "0s", "How long users can cancel deleting their account, immediate when 0")
+	DEFAULT_ARGON2_MEMORY   *int    = flag.Int("argon2Memory", int(lib.DefaultArgon2Params.Memory), "Memory in KiB used to hash a password")
+	DEFAULT_ARGON2_TIME     *int    = flag.Int("argon2Iterations", int(lib.DefaultArgon2Params.Iterations), "Passes over memory when hashing a password")
+	DEFAULT_ARGON2_THREADS  *int    = flag.Int("argon2Parallelism", int(lib.DefaultArgon2Params.Parallelism), "Threads used to hash a password")
+	DEFAULT_MAX_ITEMS       *int    = flag.Int("maxItems", lib.DefaultJournalLimits.MaxItems, "Journal items allowed per day")
+	DEFAULT_MAX_ITEM_LENGTH *int    = flag.Int("maxItemLength", lib.DefaultJournalLimits.MaxItemLength, "Characters allowed per journal item")
+	DEFAULT_PLANS           *string = flag.String("plans", "", "Plans with their own limits, as name=items/length separated by commas")
+	DEFAULT_REVISIONS       *int    = flag.Int("revisionLimit", lib.DefaultRevisionLimit, "Earlier versions kept of each journal entry")
 
+	backend    string
 	esurl      string
+	sqlitePath string
 	sgUsername string
 	sgPassword string
 	secret     string
+	resetTTL   time.Duration
+	verifyTTL  time.Duration
+	attempts   string
+	lockAfter  int
+	lockFor    time.Duration
+	oidc       lib.OIDCOptions
+	siteURL    string
+	deleteIn   time.Duration
+	argon2     lib.Argon2Params
+	limits     lib.JournalLimits
+	plans      map[string]lib.JournalLimits
+	revisions  int
 )
 
 func LoginRequired(c *gin.Context) {
+	// Set by TokenAuth on routes that take personal access tokens
+	if c.GetString("userId") != "" {
+		c.Next()
+		return
+	}
+
+	if lib.BearerToken(c) != "" {
+		c.AbortWithStatusJSON(403, lib.ErrorResponse("Access tokens can't be used for this request"))
+		return
+	}
+
 	session := sessions.Default(c)
 	c.Header("X-Csrf-Token", csrf.GetToken(c))
 
@@ -48,12 +97,23 @@ func DefaultPage(c *gin.Context) {
 	}
 }
 
-func main() {
+// loadConfig reads each setting from its environment variable, falling back to the flag default
+func loadConfig() {
+	backend = os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = *DEFAULT_BACKEND
+	}
+
 	esurl = os.Getenv("ESURL")
 	if esurl == "" {
 		esurl = *DEFAULT_ES_URL
 	}
 
+	sqlitePath = os.Getenv("SQLITE_PATH")
+	if sqlitePath == "" {
+		sqlitePath = *DEFAULT_SQLITE_PATH
+	}
+
 	sgUsername = os.Getenv("SENDGRID_USERNAME")
 	if sgUsername == "" {
 		sgUsername = *DEFAULT_SG_USERNAME
@@ -69,16 +129,173 @@ func main() {
 		secret = *DEFAULT_SESSION_SECRET
 	}
 
+	resetTTL = durationSetting("RESET_TOKEN_TTL", *DEFAULT_RESET_TTL)
+	verifyTTL = durationSetting("VERIFY_TOKEN_TTL", *DEFAULT_VERIFY_TTL)
+
+	attempts = os.Getenv("LOGIN_ATTEMPT_BACKEND")
+	if attempts == "" {
+		attempts = *DEFAULT_ATTEMPTS
+	}
+
+	lockAfter = intSetting("LOCKOUT_THRESHOLD", *DEFAULT_LOCKOUT_AFTER)
+
+	lockFor = durationSetting("LOCKOUT_DURATION", *DEFAULT_LOCKOUT_FOR)
+
+	oidc = lib.OIDCOptions{
+		Issuer:       stringSetting("OIDC_ISSUER", *DEFAULT_OIDC_ISSUER),
+		ClientID:     stringSetting("OIDC_CLIENT_ID", *DEFAULT_OIDC_CLIENT),
+		ClientSecret: stringSetting("OIDC_CLIENT_SECRET", *DEFAULT_OIDC_SECRET),
+		RedirectURL:  stringSetting("OIDC_REDIRECT_URL", *DEFAULT_OIDC_REDIRECT),
+	}
+
+	siteURL = stringSetting("SITE_URL", *DEFAULT_SITE_URL)
+	deleteIn = durationSetting("DELETION_GRACE_PERIOD", *DEFAULT_DELETE_GRACE)
+
+	argon2 = lib.Argon2Params{
+		Memory:      uint32(intSetting("ARGON2_MEMORY", *DEFAULT_ARGON2_MEMORY)),
+		Iterations:  uint32(intSetting("ARGON2_ITERATIONS", *DEFAULT_ARGON2_TIME)),
+		Parallelism: uint8(intSetting("ARGON2_PARALLELISM", *DEFAULT_ARGON2_THREADS)),
+	}
+
+	limits = lib.JournalLimits{
+		MaxItems:      intSetting("MAX_ITEMS", *DEFAULT_MAX_ITEMS),
+		MaxItemLength: intSetting("MAX_ITEM_LENGTH", *DEFAULT_MAX_ITEM_LENGTH),
+	}
+
+	revisions = intSetting("REVISION_LIMIT", *DEFAULT_REVISIONS)
+
+	var err error
+	plans, err = lib.ParsePlans(stringSetting("PLANS", *DEFAULT_PLANS))
+	if err != nil {
+		log.Fatal("Invalid PLANS: " + err.Error())
+	}
+}
+
+// stringSetting reads a setting from the environment or the flag default
+func stringSetting(env string, fallback string) string {
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// intSetting parses a number from the environment or uses the flag default
+func intSetting(env string, fallback int) int {
+	value := os.Getenv(env)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		log.Fatal("Invalid " + env + ": " + value)
+	}
+
+	return number
+}
+
+// durationSetting parses a duration such as "30m" from the environment or the flag default
+func durationSetting(env string, fallback string) time.Duration {
+	value := os.Getenv(env)
+	if value == "" {
+		value = fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatal("Invalid " + env + ": " + err.Error())
+	}
+
+	return duration
+}
+
+func serviceOptions() lib.ServiceOptions {
+	return lib.ServiceOptions{
+		Backend:             backend,
+		ElasticUrl:          esurl,
+		SqlitePath:          sqlitePath,
+		SendGridUsername:    sgUsername,
+		SendGridPassword:    sgPassword,
+		ResetTokenTTL:       resetTTL,
+		VerifyTokenTTL:      verifyTTL,
+		AttemptBackend:      attempts,
+		LockoutThreshold:    lockAfter,
+		LockoutDuration:     lockFor,
+		OIDC:                oidc,
+		SiteURL:             siteURL,
+		DeletionGracePeriod: deleteIn,
+		Argon2:              argon2,
+		JournalLimits:       limits,
+		Plans:               plans,
+		RevisionLimit:       revisions}
+}
+
+// purgeDeletedAccounts deletes accounts whose deletion grace period ended, every hour
+func purgeDeletedAccounts(mds lib.MdsService) {
+	ticker := time.NewTicker(time.Hour)
+	for {
+		count, err := mds.PurgeDeletedAccounts()
+		if err != nil {
+			log.Println("Error purging deleted accounts:", err)
+		} else if count > 0 {
+			log.Printf("Purged %d deleted accounts", count)
+		}
+
+		<-ticker.C
+	}
+}
+
+// purgeTrash removes journal entries deleted longer than lib.TrashRetention ago, every hour
+func purgeTrash(mds lib.MdsService) {
+	ticker := time.NewTicker(time.Hour)
+	for {
+		count, err := mds.PurgeTrash(time.Now())
+		if err != nil {
+			log.Println("Error purging deleted journal entries:", err)
+		} else if count > 0 {
+			log.Printf("Purged %d deleted journal entries", count)
+		}
+
+		<-ticker.C
+	}
+}
+
+// carryOverItems runs the nightly carry over of users whose midnight has passed, every hour
+func carryOverItems(mds lib.MdsService) {
+	ticker := time.NewTicker(time.Hour)
+	for {
+		count, err := mds.RunNightlyCarryOver(time.Now())
+		if err != nil {
+			log.Println("Error carrying over items:", err)
+		} else if count > 0 {
+			log.Printf("Carried over items for %d users", count)
+		}
+
+		<-ticker.C
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	loadConfig()
+
+	if isCommand(flag.Arg(0)) {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	mds := lib.MdsService{}
-	err := mds.Init(lib.ServiceOptions{
-		ElasticUrl:       esurl,
-		SendGridUsername: sgUsername,
-		SendGridPassword: sgPassword})
+	err := mds.Init(serviceOptions())
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	go purgeDeletedAccounts(mds)
+	go purgeTrash(mds)
+	go carryOverItems(mds)
+
 	store := cookie.NewStore([]byte(secret))
 
 	router := gin.Default()
@@ -98,13 +315,23 @@ func main() {
 	}
 
 	router.Use(sessions.Sessions("my_session", store))
-	router.Use(csrf.Middleware(csrf.Options{
+	csrfMiddleware := csrf.Middleware(csrf.Options{
 		Secret: secret,
 		ErrorFunc: func(c *gin.Context) {
 			c.String(400, "CSRF token mismatch")
 			c.Abort()
 		},
-	}))
+	})
+
+	// A page on another site can't set the Authorization header, so requests
+	// with an access token skip the CSRF check
+	router.Use(func(c *gin.Context) {
+		if lib.BearerToken(c) != "" {
+			c.Next()
+		} else {
+			csrfMiddleware(c)
+		}
+	})
 
 	c := lib.Controller{}
 	c.SetOptions(mds, secret != *DEFAULT_SESSION_SECRET)
@@ -113,12 +340,16 @@ func main() {
 
 	//Login
 	public.POST("/account/login", c.Login)
-	public.POST("/account/logout", LoginRequired, c.Logout)
+	public.POST("/account/login/verify", c.VerifyLogin)  //Second step with a two-factor code
+	public.GET("/account/oidc/login", c.OIDCLogin)       //Redirect to the single sign-on provider
+	public.GET("/account/oidc/callback", c.OIDCCallback) //Provider redirects back here
+	public.POST("/account/logout", c.SessionAuth, LoginRequired, c.Logout)
 	public.POST("/account/register", c.Register)                         //Submit registration
 	public.POST("/account/forgot/:email", c.CreateForgotPasswordRequest) //Send reset password link
 	public.GET("/account/reset/:token", c.GetResetPasswordRequest)       //Check if reset link is valid
 	public.POST("/account/reset/", c.ResetPassword)
 	public.GET("/account/verify/:token", c.VerifyAccount)
+	public.GET("/account/email/:token", c.ConfirmEmail) //Link sent to a new email address
 	// public.OPTIONS("/csrf", func(c *gin.Context) {
 	// 	session := sessions.Default(c)
 	// 	if session.Get("userId") != nil {
@@ -130,19 +361,74 @@ func main() {
 	// })
 
 	privateAPI := router.Group("/api")
-	privateAPI.Use(LoginRequired)
-	privateAPI.GET("/account", c.Profile)       //Get user account information
-	privateAPI.PUT("/account", c.UpdateProfile) //Modify user account
+	privateAPI.Use(c.SessionAuth, LoginRequired)
+	privateAPI.GET("/account", c.Profile)                        //Get user account information
+	privateAPI.PUT("/account", c.UpdateProfile)                  //Modify user account
+	privateAPI.POST("/account/email", c.ChangeEmail)             //Send a confirmation link to a new address
+	privateAPI.PUT("/account/timezone", c.SetTimeZone)           //IANA zone that dates and streaks are resolved in
+	privateAPI.PUT("/account/carryover", c.SetCarryOver)         //Nightly carry over of unfinished items: copy, move or ""
+	privateAPI.DELETE("/account", c.DeleteAccount)               //Delete with the password or a recent sign-in, or schedule it with a grace period
+	privateAPI.POST("/account/restore", c.CancelAccountDeletion) //Cancel a scheduled deletion
+
+	privateAPI.POST("/account/2fa", c.EnrollTwoFactor)          //Start two-factor setup
+	privateAPI.POST("/account/2fa/confirm", c.ConfirmTwoFactor) //Enable with a code, returns recovery codes
+	privateAPI.DELETE("/account/2fa", c.DisableTwoFactor)       //Disable with the password
+
+	privateAPI.GET("/account/tokens", c.GetAccessTokens)          //List personal access tokens
+	privateAPI.POST("/account/tokens", c.CreateAccessToken)       //Create a token, the secret is only returned here
+	privateAPI.DELETE("/account/tokens/:id", c.RevokeAccessToken) //Revoke a token
+
+	privateAPI.GET("/account/sessions", c.GetSessions)          //List where the user is signed in
+	privateAPI.DELETE("/account/sessions", c.RevokeSessions)    //Sign out everywhere, ?others=true keeps this one
+	privateAPI.DELETE("/account/sessions/:id", c.RevokeSession) //Sign out one session
+
+	privateAPI.GET("/account/activity", c.GetActivity) //Recent sign-ins and account changes
+
+	admin := router.Group("/api/admin")
+	admin.Use(c.SessionAuth, LoginRequired, c.RequireAdmin)
+	admin.GET("/users", c.AdminSearchUsers) //?email=&status=verified|pending|suspended&role=&limit=&offset=
+	admin.GET("/users/:id", c.AdminGetUser)
+	admin.POST("/users/:id/verification", c.AdminResendVerification) //Email a pending registration a new link
+	admin.POST("/users/:id/reset", c.AdminForcePasswordReset)        //Remove the password and email a reset link
+	admin.POST("/users/:id/suspend", c.AdminSuspendUser)             //Sign out everywhere and block sign-in
+	admin.DELETE("/users/:id/suspend", c.AdminUnsuspendUser)
+	admin.GET("/stats", c.AdminStats) //Counts of users by status and journal entries
+
+	//Routes that also accept a personal access token with the scope
+	tokenAPI := router.Group("/api")
+	tokenAPI.Use(c.TokenAuth, c.SessionAuth, LoginRequired)
+	read := lib.RequireScope(lib.ScopeJournalRead)
+	write := lib.RequireScope(lib.ScopeJournalWrite)
+	search := lib.RequireScope(lib.ScopeSearch)
+
+	tokenAPI.GET("/account/streak/:date", read, c.GetStreak)
+	tokenAPI.GET("/account/export", read, c.ExportJournal)   //Download the journal as json, csv or zip
+	tokenAPI.POST("/account/import", write, c.ImportJournal) //Upload a json, csv or Day One export
+
+	tokenAPI.GET("/journal/:date", read, c.GetEntryByDate) //Get a journal entry
+	tokenAPI.DELETE("/journal/:id", write, c.DeleteEntry)  //Move an entry to the trash
+	tokenAPI.POST("/journal", write, c.CreateEntry)
+	tokenAPI.PUT("/journal/:id", write, c.UpdateEntry)
+	tokenAPI.POST("/journal/carryover", write, c.CarryOver)                //Bring unfinished items of the last entry to a day
+	tokenAPI.POST("/journal/:id/items", write, c.AddItem)                  //Add an item to the end of the day
+	tokenAPI.PATCH("/journal/:id/items", write, c.ReorderItems)            //Order the day's items by their IDs
+	tokenAPI.PATCH("/journal/:id/items/:item", write, c.EditItem)          //Change an item's text
+	tokenAPI.PATCH("/journal/:id/items/:item/toggle", write, c.ToggleItem) //Mark an item done or not done
+	tokenAPI.DELETE("/journal/:id/items/:item", write, c.RemoveItem)       //Remove one item
+
+	tokenAPI.GET("/revisions/:entry", read, c.GetRevisions)                        //Earlier versions of an entry, newest first
+	tokenAPI.GET("/revisions/:entry/diff", read, c.DiffRevisions)                  //?from=&to= item by item, to is the entry now when empty
+	tokenAPI.POST("/revisions/:entry/:revision/restore", write, c.RestoreRevision) //Put the entry back the way a revision has it
 
-	privateAPI.GET("/account/streak/:date", c.GetStreak)
+	tokenAPI.GET("/trash", read, c.GetTrash)                   //Deleted entries that can be restored for 30 days
+	tokenAPI.POST("/trash/:id/restore", write, c.RestoreEntry) //Conflicts when the date has a new entry
 
-	privateAPI.GET("/journal/:date", c.GetEntryByDate) //Get a journal entry
-	privateAPI.DELETE("/journal/:id", c.DeleteEntry)
-	privateAPI.POST("/journal", c.CreateEntry)
-	privateAPI.PUT("/journal/:id", c.UpdateEntry)
+	tokenAPI.GET("/search/date", search, c.SearchJournalDates) //Find dates that have entries in month
+	tokenAPI.POST("/search", search, c.SearchJournal)          //Full text search, tags narrows to entries with every tag
 
-	privateAPI.GET("/search/date", c.SearchJournalDates) //Find dates that have entries in month
-	privateAPI.POST("/search", c.SearchJournal)
+	tokenAPI.GET("/tags", read, c.GetTags)           //Tags with how many entries have each
+	tokenAPI.PUT("/tags/:tag", write, c.RenameTag)   //Rename a tag in every entry
+	tokenAPI.POST("/tags/merge", write, c.MergeTags) //Replace several tags with one
 
 	private := router.Group("/")
 	private.Use(c.RequireLogin)